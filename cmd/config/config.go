@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/zs-dima/auth-service/pkg/tool"
 )
@@ -15,9 +16,118 @@ type Config struct {
 	HttpAddress       string
 	HttpApiKey        string
 	OpenTelemetry     bool
-	JwtSecretKey      string
-	DB                *DbConfig
-	Log               *LogConfig
+	// DevMode allows senders writing sign in links and codes to the log, never set it in production
+	DevMode      bool
+	JwtSecretKey string
+	AppUrl       string
+	DB           *DbConfig
+	Email        *EmailConfig
+	Mail         *MailConfig
+	Sms          *SmsConfig
+	SignUp       *SignUpConfig
+	Log          *LogConfig
+	RateLimit    *RateLimitConfig
+	// Oidc is nil unless the service acts as an OpenID Connect provider
+	Oidc *OidcConfig
+	// Federation is nil unless users sign in by external identity providers
+	Federation *FederationConfig
+	// Ldap directories checking passwords of their email domains
+	Ldap []*LdapConfig
+	// Device authorization grant of TVs and CLIs
+	Device *DeviceConfig
+	// ImpersonationTtl is the lifetime of access tokens issued by Impersonate
+	ImpersonationTtl time.Duration
+	// ServiceAccountTokenTtl is the lifetime of access tokens issued by SignInServiceAccount
+	ServiceAccountTokenTtl time.Duration
+	// StepUpMaxAge is the maximum time since sign in to call sensitive methods
+	StepUpMaxAge time.Duration
+	// ExtAuthzAddress is the internal gRPC address of the Envoy external authorization service, empty unless it is served
+	ExtAuthzAddress string
+	// ForwardAuth is nil unless the forward auth endpoint of reverse proxies is served
+	ForwardAuth *ForwardAuthConfig
+	// Centrifugo is nil unless the service issues Centrifugo tokens or publishes events
+	Centrifugo *CentrifugoConfig
+}
+
+type CentrifugoConfig struct {
+	// TokenSecretKey is the `token_hmac_secret_key` of Centrifugo verifying connection and subscription tokens, tokens are not issued when empty
+	TokenSecretKey string
+	TokenTtl       time.Duration
+	// ApiUrl is the Centrifugo server HTTP API, events are not published when empty
+	ApiUrl string
+	ApiKey string
+	// UserEventsChannel receives user lifecycle events
+	UserEventsChannel string
+}
+
+type ForwardAuthConfig struct {
+	// Address is the internal HTTP address of the endpoint, reachable by the reverse proxy only
+	Address string
+	// Cookie is the name of the session cookie holding the access token, checked when the Authorization header is missing
+	Cookie string
+}
+
+type DeviceConfig struct {
+	CodeTtl time.Duration
+	// PollInterval is the minimum time between polls of the device
+	PollInterval time.Duration
+}
+
+type OidcConfig struct {
+	Issuer string
+	// SigningKey is the PEM encoded RSA private key signing ID and access tokens
+	SigningKey      string
+	AccessTokenTtl  time.Duration
+	ServiceTokenTtl time.Duration
+	// ExchangedTokenTtl is the lifetime of delegated tokens issued by the token exchange
+	ExchangedTokenTtl time.Duration
+}
+
+type FederationConfig struct {
+	// BaseUrl is the public base URL of the HTTP gateway, the callback endpoint is registered at identity providers
+	BaseUrl   string
+	Providers []*FederationProviderConfig
+	// SamlKey and SamlCertificate are PEM encoded, SAML connections are served when they are set
+	SamlKey         string
+	SamlCertificate string
+}
+
+type FederationProviderConfig struct {
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	// RoleClaim is the ID token claim with the user groups or roles, e.g. `groups`
+	RoleClaim string
+	// RoleMapping maps claim values to user roles
+	RoleMapping map[string]string
+	// Provisioning creates users on the first sign in
+	Provisioning bool
+	// TrustEmail treats provider emails as verified, for providers without the `email_verified` claim
+	TrustEmail bool
+}
+
+type LdapConfig struct {
+	Name         string
+	Url          string
+	StartTls     bool
+	BindDn       string
+	BindPassword string
+	BaseDn       string
+	UserFilter   string
+	// EmailAttribute, NameAttribute and GroupAttribute default to `mail`, `cn` and `memberOf`
+	EmailAttribute string
+	NameAttribute  string
+	GroupAttribute string
+	// RoleMapping maps group DNs to user roles
+	RoleMapping  map[string]string
+	Domains      []string
+	SyncInterval time.Duration
+	// SyncMaxDeletes is the maximum number of users deleted by one sync
+	SyncMaxDeletes int
+	SyncDryRun     bool
 }
 
 type LogConfig struct {
@@ -31,6 +141,68 @@ type DbConfig struct {
 	Password string
 }
 
+type EmailConfig struct {
+	VerificationTtl      time.Duration
+	RequireVerified      bool
+	ChangeTtl            time.Duration
+	ChangeRevokeSessions bool
+	InvitationTtl        time.Duration
+	PasswordResetTtl     time.Duration
+	MagicLinkTtl         time.Duration
+	OtpTtl               time.Duration
+	OtpMaxAttempts       int
+}
+
+type MailConfig struct {
+	// Sender is `smtp` or `log` to write emails to the log in development mode
+	Sender        string
+	DefaultLocale string
+	// OutboxRetention is how long sent and failed emails are kept in the outbox
+	OutboxRetention time.Duration
+	Smtp            *SmtpConfig
+}
+
+type SmsConfig struct {
+	// Sender is empty when SMS is disabled, `log` to write messages to the log or `file` to append them to FilePath in development mode
+	Sender   string
+	FilePath string
+}
+
+type SmtpConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// Tls is one of `starttls`, `tls` or `none`
+	Tls string
+}
+
+type SignUpConfig struct {
+	// Policy is one of `disabled`, `open`, `domains` or `invitation`, `domains` requires verified emails
+	Policy         string
+	AllowedDomains []string
+}
+
+type RateLimitConfig struct {
+	Disabled      bool
+	Default       *RateLimitRule
+	SignIn        *RateLimitRule
+	ResetPassword *RateLimitRule
+	Bulk          *RateLimitRule
+	// ExtAuthz limits checks of each proxy on the internal ext_authz and forward auth addresses, proxies check requests of all clients
+	ExtAuthz *RateLimitRule
+	// TrustedProxies is the number of proxies in front of the HTTP gateway appending to `x-forwarded-for`,
+	// forwarded IPs of direct gRPC clients are never trusted
+	TrustedProxies int
+}
+
+// RateLimitRule is a token bucket refilled with Rate tokens per second up to Burst tokens.
+type RateLimitRule struct {
+	Rate  float64
+	Burst int
+}
+
 func NewConfig() (*Config, error) {
 
 	grpcAddress := os.Getenv("GRPC_ADDRESS")
@@ -53,6 +225,77 @@ func NewConfig() (*Config, error) {
 	}
 
 	_, opentelemetry := os.LookupEnv("opentelemetry")
+	_, devMode := os.LookupEnv("DEV_MODE")
+	// The check takes tokens of any caller, it is served on an internal address reachable by the proxy only
+	var extAuthzAddress string
+	if _, ok := os.LookupEnv("EXT_AUTHZ"); ok {
+		extAuthzAddress = os.Getenv("EXT_AUTHZ_ADDRESS")
+		if extAuthzAddress == "" {
+			return nil, fmt.Errorf("missing environment variable: EXT_AUTHZ_ADDRESS")
+		}
+	}
+
+	var forwardAuth *ForwardAuthConfig
+	if _, ok := os.LookupEnv("FORWARD_AUTH"); ok {
+		forwardAuth = &ForwardAuthConfig{
+			Address: os.Getenv("FORWARD_AUTH_ADDRESS"),
+			Cookie:  os.Getenv("FORWARD_AUTH_COOKIE"),
+		}
+		if forwardAuth.Address == "" {
+			return nil, fmt.Errorf("missing environment variable: FORWARD_AUTH_ADDRESS")
+		}
+	}
+
+	// APP_URL is required by the features redirecting to the client application below,
+	// without it RPCs sending links by email are rejected
+	appUrl := os.Getenv("APP_URL")
+
+	emailVerificationTtl, err := tool.GetDurationValue("EMAIL_VERIFICATION_TTL", 48*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	_, requireVerifiedEmail := os.LookupEnv("REQUIRE_VERIFIED_EMAIL")
+
+	emailChangeTtl, err := tool.GetDurationValue("EMAIL_CHANGE_TTL", 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	_, emailChangeRevokeSessions := os.LookupEnv("EMAIL_CHANGE_REVOKE_SESSIONS")
+
+	invitationTtl, err := tool.GetDurationValue("INVITATION_TTL", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	passwordResetTtl, err := tool.GetDurationValue("PASSWORD_RESET_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	magicLinkTtl, err := tool.GetDurationValue("MAGIC_LINK_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	otpTtl, err := tool.GetDurationValue("OTP_TTL", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	otpMaxAttempts, err := tool.GetIntValue("OTP_MAX_ATTEMPTS", 5)
+	if err != nil {
+		return nil, err
+	}
+
+	mail, err := newMailConfig(devMode)
+	if err != nil {
+		return nil, err
+	}
+
+	sms, err := newSmsConfig(devMode)
+	if err != nil {
+		return nil, err
+	}
 
 	dbUri := tool.GetFileValue("DB_URI")
 	if dbUri == "" {
@@ -64,18 +307,94 @@ func NewConfig() (*Config, error) {
 		return nil, fmt.Errorf("missing environment variable: DB_PASSWORD")
 	}
 
+	signUp, err := newSignUpConfig(requireVerifiedEmail)
+	if err != nil {
+		return nil, err
+	}
+
 	logLevel := strings.ToUpper(os.Getenv("LOG_LEVEL"))
 	_, human := os.LookupEnv("HUMAN_LOGGING")
 	logFile := os.Getenv("LOG_FILE")
 
+	rateLimit, err := newRateLimitConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	oidc, err := newOidcConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	federation, err := newFederationConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if appUrl == "" {
+		switch {
+		case requireVerifiedEmail:
+			return nil, fmt.Errorf("missing environment variable: APP_URL, required by REQUIRE_VERIFIED_EMAIL")
+		case signUp.Policy != "disabled":
+			return nil, fmt.Errorf("missing environment variable: APP_URL, required by SIGN_UP_POLICY")
+		case oidc != nil:
+			return nil, fmt.Errorf("missing environment variable: APP_URL, required by the OpenID Connect provider")
+		case federation != nil:
+			return nil, fmt.Errorf("missing environment variable: APP_URL, required by federated sign in")
+		}
+	}
+
+	ldap, err := newLdapConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	centrifugo, err := newCentrifugoConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	impersonationTtl, err := tool.GetDurationValue("IMPERSONATION_TTL", 15*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceAccountTokenTtl, err := tool.GetDurationValue("SERVICE_ACCOUNT_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	stepUpMaxAge, err := tool.GetDurationValue("STEP_UP_MAX_AGE", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceCodeTtl, err := tool.GetDurationValue("DEVICE_CODE_TTL", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	devicePollInterval, err := tool.GetDurationValue("DEVICE_POLL_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
-		GrpcAddress:       grpcAddress,
-		GrpcApiKey:        grpcApiKey,
-		GrpcApiReflection: grpcApiReflection,
-		HttpAddress:       httpAddress,
-		HttpApiKey:        httpApiKey,
-		JwtSecretKey:      jwtSecretKey,
-		OpenTelemetry:     opentelemetry,
+		GrpcAddress:            grpcAddress,
+		GrpcApiKey:             grpcApiKey,
+		GrpcApiReflection:      grpcApiReflection,
+		HttpAddress:            httpAddress,
+		HttpApiKey:             httpApiKey,
+		JwtSecretKey:           jwtSecretKey,
+		ImpersonationTtl:       impersonationTtl,
+		ServiceAccountTokenTtl: serviceAccountTokenTtl,
+		StepUpMaxAge:           stepUpMaxAge,
+		ExtAuthzAddress:        extAuthzAddress,
+		ForwardAuth:            forwardAuth,
+		Centrifugo:             centrifugo,
+		AppUrl:                 appUrl,
+		OpenTelemetry:          opentelemetry,
+		DevMode:                devMode,
 		Log: &LogConfig{
 			Level: logLevel,
 			File:  logFile,
@@ -85,5 +404,448 @@ func NewConfig() (*Config, error) {
 			Uri:      dbUri,
 			Password: dbPassword,
 		},
+		Email: &EmailConfig{
+			VerificationTtl:      emailVerificationTtl,
+			RequireVerified:      requireVerifiedEmail,
+			ChangeTtl:            emailChangeTtl,
+			ChangeRevokeSessions: emailChangeRevokeSessions,
+			InvitationTtl:        invitationTtl,
+			PasswordResetTtl:     passwordResetTtl,
+			MagicLinkTtl:         magicLinkTtl,
+			OtpTtl:               otpTtl,
+			OtpMaxAttempts:       otpMaxAttempts,
+		},
+		Mail:       mail,
+		Sms:        sms,
+		SignUp:     signUp,
+		RateLimit:  rateLimit,
+		Oidc:       oidc,
+		Federation: federation,
+		Ldap:       ldap,
+		Device: &DeviceConfig{
+			CodeTtl:      deviceCodeTtl,
+			PollInterval: devicePollInterval,
+		},
 	}, nil
 }
+
+func newMailConfig(devMode bool) (*MailConfig, error) {
+	sender := strings.ToLower(os.Getenv("MAILER"))
+	if sender == "" {
+		sender = "smtp"
+	}
+
+	defaultLocale := strings.ToLower(os.Getenv("MAIL_DEFAULT_LOCALE"))
+	if defaultLocale == "" {
+		defaultLocale = "en"
+	}
+
+	outboxRetention, err := tool.GetDurationValue("MAIL_OUTBOX_RETENTION", 7*24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &MailConfig{
+		Sender:          sender,
+		DefaultLocale:   defaultLocale,
+		OutboxRetention: outboxRetention,
+	}
+
+	switch sender {
+	case "log":
+		// Emails carry password reset and sign in links, the log would leak them
+		if !devMode {
+			return nil, fmt.Errorf("invalid environment variable MAILER: log is allowed in DEV_MODE only")
+		}
+		return config, nil
+	case "smtp":
+	default:
+		return nil, fmt.Errorf("invalid environment variable MAILER: %s", sender)
+	}
+
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return nil, fmt.Errorf("missing environment variable: SMTP_HOST")
+	}
+	port, err := tool.GetIntValue("SMTP_PORT", 587)
+	if err != nil {
+		return nil, err
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		return nil, fmt.Errorf("missing environment variable: SMTP_FROM")
+	}
+	tls := strings.ToLower(os.Getenv("SMTP_TLS"))
+	if tls == "" {
+		tls = "starttls"
+	}
+	if tls != "starttls" && tls != "tls" && tls != "none" {
+		return nil, fmt.Errorf("invalid environment variable SMTP_TLS: %s", tls)
+	}
+
+	config.Smtp = &SmtpConfig{
+		Host:     host,
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: strings.TrimSpace(tool.GetFileValue("SMTP_PASSWORD")),
+		From:     from,
+		Tls:      tls,
+	}
+	return config, nil
+}
+
+func newSmsConfig(devMode bool) (*SmsConfig, error) {
+	sender := strings.ToLower(os.Getenv("SMS_SENDER"))
+
+	config := &SmsConfig{
+		Sender: sender,
+	}
+
+	// Messages carry sign in codes, the log and the file would leak them
+	if sender != "" && !devMode {
+		return nil, fmt.Errorf("invalid environment variable SMS_SENDER: %s is allowed in DEV_MODE only", sender)
+	}
+
+	switch sender {
+	case "", "log":
+	case "file":
+		config.FilePath = os.Getenv("SMS_FILE_PATH")
+		if config.FilePath == "" {
+			return nil, fmt.Errorf("missing environment variable: SMS_FILE_PATH")
+		}
+	default:
+		return nil, fmt.Errorf("invalid environment variable SMS_SENDER: %s", sender)
+	}
+
+	return config, nil
+}
+
+func newOidcConfig() (*OidcConfig, error) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	signingKey := tool.GetFileValue("OIDC_SIGNING_KEY")
+	if strings.TrimSpace(signingKey) == "" {
+		return nil, fmt.Errorf("missing environment variable: OIDC_SIGNING_KEY")
+	}
+
+	accessTokenTtl, err := tool.GetDurationValue("OIDC_ACCESS_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	serviceTokenTtl, err := tool.GetDurationValue("OIDC_SERVICE_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	exchangedTokenTtl, err := tool.GetDurationValue("OIDC_EXCHANGED_TOKEN_TTL", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OidcConfig{
+		Issuer:            issuer,
+		SigningKey:        signingKey,
+		AccessTokenTtl:    accessTokenTtl,
+		ServiceTokenTtl:   serviceTokenTtl,
+		ExchangedTokenTtl: exchangedTokenTtl,
+	}, nil
+}
+
+func newCentrifugoConfig() (*CentrifugoConfig, error) {
+	tokenSecretKey := tool.GetFileValue("CENTRIFUGO_TOKEN_HMAC_SECRET_KEY")
+	apiUrl := os.Getenv("CENTRIFUGO_API_URL")
+	if tokenSecretKey == "" && apiUrl == "" {
+		return nil, nil
+	}
+
+	apiKey := tool.GetFileValue("CENTRIFUGO_API_KEY")
+	if apiUrl != "" && apiKey == "" {
+		return nil, fmt.Errorf("missing environment variable: CENTRIFUGO_API_KEY")
+	}
+
+	userEventsChannel, ok := os.LookupEnv("CENTRIFUGO_USER_EVENTS_CHANNEL")
+	if !ok {
+		userEventsChannel = "admin:users"
+	}
+
+	tokenTtl, err := tool.GetDurationValue("CENTRIFUGO_TOKEN_TTL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CentrifugoConfig{
+		TokenSecretKey:    tokenSecretKey,
+		TokenTtl:          tokenTtl,
+		ApiUrl:            apiUrl,
+		ApiKey:            apiKey,
+		UserEventsChannel: userEventsChannel,
+	}, nil
+}
+
+func newFederationConfig() (*FederationConfig, error) {
+	names := strings.TrimSpace(os.Getenv("FEDERATION_PROVIDERS"))
+	samlKey := strings.TrimSpace(tool.GetFileValue("SAML_SP_KEY"))
+	if names == "" && samlKey == "" {
+		return nil, nil
+	}
+
+	baseUrl := os.Getenv("FEDERATION_BASE_URL")
+	if baseUrl == "" {
+		return nil, fmt.Errorf("missing environment variable: FEDERATION_BASE_URL")
+	}
+
+	samlCertificate := strings.TrimSpace(tool.GetFileValue("SAML_SP_CERTIFICATE"))
+	if samlKey != "" && samlCertificate == "" {
+		return nil, fmt.Errorf("missing environment variable: SAML_SP_CERTIFICATE")
+	}
+
+	config := &FederationConfig{
+		BaseUrl:         baseUrl,
+		SamlKey:         samlKey,
+		SamlCertificate: samlCertificate,
+	}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		provider, err := newFederationProviderConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		config.Providers = append(config.Providers, provider)
+	}
+
+	return config, nil
+}
+
+// newFederationProviderConfig reads `FEDERATION_<NAME>_*` variables of the provider.
+func newFederationProviderConfig(name string) (*FederationProviderConfig, error) {
+	prefix := "FEDERATION_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+
+	issuer := os.Getenv(prefix + "ISSUER")
+	if issuer == "" {
+		return nil, fmt.Errorf("missing environment variable: %sISSUER", prefix)
+	}
+	clientId := os.Getenv(prefix + "CLIENT_ID")
+	if clientId == "" {
+		return nil, fmt.Errorf("missing environment variable: %sCLIENT_ID", prefix)
+	}
+
+	displayName := os.Getenv(prefix + "DISPLAY_NAME")
+	if displayName == "" {
+		displayName = name
+	}
+
+	scopes := strings.Fields(strings.ReplaceAll(os.Getenv(prefix+"SCOPES"), ",", " "))
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+
+	roleMapping, err := newRoleMapping(prefix+"ROLE_MAPPING", ",")
+	if err != nil {
+		return nil, err
+	}
+
+	_, provisioning := os.LookupEnv(prefix + "PROVISIONING")
+	_, trustEmail := os.LookupEnv(prefix + "TRUST_EMAIL")
+
+	return &FederationProviderConfig{
+		Name:         name,
+		DisplayName:  displayName,
+		Issuer:       issuer,
+		ClientId:     clientId,
+		ClientSecret: strings.TrimSpace(tool.GetFileValue(prefix + "CLIENT_SECRET")),
+		Scopes:       scopes,
+		RoleClaim:    os.Getenv(prefix + "ROLE_CLAIM"),
+		RoleMapping:  roleMapping,
+		Provisioning: provisioning,
+		TrustEmail:   trustEmail,
+	}, nil
+}
+
+func newLdapConfig() ([]*LdapConfig, error) {
+	var directories []*LdapConfig
+	for _, name := range strings.Split(os.Getenv("LDAP_DIRECTORIES"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		directory, err := newLdapDirectoryConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		directories = append(directories, directory)
+	}
+	return directories, nil
+}
+
+// newLdapDirectoryConfig reads `LDAP_<NAME>_*` variables of the directory.
+func newLdapDirectoryConfig(name string) (*LdapConfig, error) {
+	prefix := "LDAP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+
+	url := os.Getenv(prefix + "URL")
+	if url == "" {
+		return nil, fmt.Errorf("missing environment variable: %sURL", prefix)
+	}
+	baseDn := os.Getenv(prefix + "BASE_DN")
+	if baseDn == "" {
+		return nil, fmt.Errorf("missing environment variable: %sBASE_DN", prefix)
+	}
+
+	var domains []string
+	for _, domain := range strings.Split(os.Getenv(prefix+"DOMAINS"), ",") {
+		if domain = strings.ToLower(strings.TrimSpace(domain)); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, fmt.Errorf("missing environment variable: %sDOMAINS", prefix)
+	}
+
+	// Group DNs contain commas, so pairs are separated by semicolons
+	roleMapping, err := newRoleMapping(prefix+"ROLE_MAPPING", ";")
+	if err != nil {
+		return nil, err
+	}
+
+	syncInterval, err := tool.GetDurationValue(prefix+"SYNC_INTERVAL", time.Hour)
+	if err != nil {
+		return nil, err
+	}
+
+	syncMaxDeletes, err := tool.GetIntValue(prefix+"SYNC_MAX_DELETES", 10)
+	if err != nil {
+		return nil, err
+	}
+
+	_, startTls := os.LookupEnv(prefix + "START_TLS")
+	_, syncDryRun := os.LookupEnv(prefix + "SYNC_DRY_RUN")
+
+	return &LdapConfig{
+		Name:           name,
+		Url:            url,
+		StartTls:       startTls,
+		BindDn:         os.Getenv(prefix + "BIND_DN"),
+		BindPassword:   strings.TrimSpace(tool.GetFileValue(prefix + "BIND_PASSWORD")),
+		BaseDn:         baseDn,
+		UserFilter:     os.Getenv(prefix + "USER_FILTER"),
+		EmailAttribute: os.Getenv(prefix + "EMAIL_ATTRIBUTE"),
+		NameAttribute:  os.Getenv(prefix + "NAME_ATTRIBUTE"),
+		GroupAttribute: os.Getenv(prefix + "GROUP_ATTRIBUTE"),
+		RoleMapping:    roleMapping,
+		Domains:        domains,
+		SyncInterval:   syncInterval,
+		SyncMaxDeletes: syncMaxDeletes,
+		SyncDryRun:     syncDryRun,
+	}, nil
+}
+
+// newRoleMapping reads `value:role` pairs, e.g. `admins:administrator,staff:user`.
+func newRoleMapping(key string, separator string) (map[string]string, error) {
+	roleMapping := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv(key), separator) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid environment variable %s: %s", key, pair)
+		}
+		role := strings.ToLower(strings.TrimSpace(pair[i+1:]))
+		if role != "administrator" && role != "user" {
+			return nil, fmt.Errorf("invalid environment variable %s: %s", key, pair)
+		}
+		roleMapping[strings.TrimSpace(pair[:i])] = role
+	}
+	return roleMapping, nil
+}
+
+func newSignUpConfig(requireVerifiedEmail bool) (*SignUpConfig, error) {
+	policy := strings.ToLower(strings.TrimSpace(os.Getenv("SIGN_UP_POLICY")))
+	if policy == "" {
+		policy = "disabled"
+	}
+
+	var allowedDomains []string
+	for _, domain := range strings.Split(os.Getenv("SIGN_UP_ALLOWED_DOMAINS"), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			allowedDomains = append(allowedDomains, domain)
+		}
+	}
+
+	switch policy {
+	case "disabled", "open", "invitation":
+	case "domains":
+		if len(allowedDomains) == 0 {
+			return nil, fmt.Errorf("missing environment variable: SIGN_UP_ALLOWED_DOMAINS")
+		}
+		// Only the verified email proves the user owns an address of the allowed domain
+		if !requireVerifiedEmail {
+			return nil, fmt.Errorf("missing environment variable: REQUIRE_VERIFIED_EMAIL, required by SIGN_UP_POLICY=domains")
+		}
+	default:
+		return nil, fmt.Errorf("invalid environment variable SIGN_UP_POLICY: %s", policy)
+	}
+
+	return &SignUpConfig{
+		Policy:         policy,
+		AllowedDomains: allowedDomains,
+	}, nil
+}
+
+func newRateLimitConfig() (*RateLimitConfig, error) {
+	_, disabled := os.LookupEnv("RATE_LIMIT_DISABLED")
+	trustedProxies, err := tool.GetIntValue("RATE_LIMIT_TRUSTED_PROXIES", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultRule, err := newRateLimitRule("RATE_LIMIT", 10, 20)
+	if err != nil {
+		return nil, err
+	}
+	signIn, err := newRateLimitRule("RATE_LIMIT_SIGN_IN", 0.1, 5)
+	if err != nil {
+		return nil, err
+	}
+	resetPassword, err := newRateLimitRule("RATE_LIMIT_RESET_PASSWORD", 1.0/60, 3)
+	if err != nil {
+		return nil, err
+	}
+	bulk, err := newRateLimitRule("RATE_LIMIT_BULK", 1, 5)
+	if err != nil {
+		return nil, err
+	}
+	extAuthz, err := newRateLimitRule("RATE_LIMIT_EXT_AUTHZ", 1000, 2000)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RateLimitConfig{
+		Disabled:       disabled,
+		TrustedProxies: trustedProxies,
+		Default:        defaultRule,
+		SignIn:         signIn,
+		ResetPassword:  resetPassword,
+		Bulk:           bulk,
+		ExtAuthz:       extAuthz,
+	}, nil
+}
+
+// newRateLimitRule reads `<PREFIX>_RATE` (tokens per second) and `<PREFIX>_BURST` variables.
+func newRateLimitRule(prefix string, rate float64, burst int) (*RateLimitRule, error) {
+	rate, err := tool.GetFloatValue(prefix+"_RATE", rate)
+	if err != nil {
+		return nil, err
+	}
+	burst, err = tool.GetIntValue(prefix+"_BURST", burst)
+	if err != nil {
+		return nil, err
+	}
+	return &RateLimitRule{Rate: rate, Burst: burst}, nil
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestNewSignUpConfig(t *testing.T) {
+	tests := []struct {
+		name                 string
+		policy               string
+		allowedDomains       string
+		requireVerifiedEmail bool
+		want                 string
+		ok                   bool
+	}{
+		{"disabled by default", "", "", false, "disabled", true},
+		{"open", " Open ", "", false, "open", true},
+		{"invitation", "invitation", "", false, "invitation", true},
+		{"domains", "domains", "example.com, partner.org", true, "domains", true},
+		{"domains without domains", "domains", " , ", true, "", false},
+		// The domain of an unverified email proves nothing
+		{"domains without verified email", "domains", "example.com", false, "", false},
+		{"unknown policy", "everyone", "", false, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("SIGN_UP_POLICY", test.policy)
+			t.Setenv("SIGN_UP_ALLOWED_DOMAINS", test.allowedDomains)
+
+			config, err := newSignUpConfig(test.requireVerifiedEmail)
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if test.ok && config.Policy != test.want {
+				t.Fatalf("got policy %q, want %q", config.Policy, test.want)
+			}
+		})
+	}
+}
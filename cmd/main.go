@@ -21,6 +21,7 @@ import (
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	grpc_runtime "github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
 
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
@@ -29,12 +30,24 @@ import (
 	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+
 	config "github.com/zs-dima/auth-service/cmd/config"
 	logger "github.com/zs-dima/auth-service/cmd/log"
+	ext_authz "github.com/zs-dima/auth-service/internal/api/extauthz"
 	jwt_interceptor "github.com/zs-dima/auth-service/internal/api/interceptor"
 	api "github.com/zs-dima/auth-service/internal/api/service"
+	authn "github.com/zs-dima/auth-service/internal/authn"
 	build "github.com/zs-dima/auth-service/internal/build"
+	centrifugo "github.com/zs-dima/auth-service/internal/centrifugo"
+	federation "github.com/zs-dima/auth-service/internal/federation"
+	mailer "github.com/zs-dima/auth-service/internal/mailer"
+	oidc "github.com/zs-dima/auth-service/internal/oidc"
+	outbox "github.com/zs-dima/auth-service/internal/outbox"
+	sms "github.com/zs-dima/auth-service/internal/sms"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
 
+	auth_db "github.com/zs-dima/auth-service/internal/gen/db"
 	pb "github.com/zs-dima/auth-service/internal/gen/proto"
 )
 
@@ -67,30 +80,343 @@ func main() {
 	}
 	defer dbPool.Close()
 
+	var centrifugoTokens *centrifugo.Tokens
+	if config.Centrifugo != nil && config.Centrifugo.TokenSecretKey != "" {
+		centrifugoTokens = centrifugo.NewTokens(config.Centrifugo.TokenSecretKey, config.Centrifugo.TokenTtl)
+	}
+
+	var oidcProvider *oidc.Provider
+	var oidcSigningKey *jwt_tool.SigningKey
+	if config.Oidc != nil {
+		oidcSigningKey, err = jwt_tool.ParseSigningKey([]byte(config.Oidc.SigningKey))
+		if err != nil {
+			log.Fatal().Msgf("failed to load OIDC signing key: %v", err)
+		}
+		oidcProvider = oidc.NewProvider(
+			&oidc.ProviderOptions{
+				Issuer:            config.Oidc.Issuer,
+				SigningKey:        oidcSigningKey,
+				LoginUrl:          strings.TrimRight(config.AppUrl, "/") + "/authorize",
+				AccessTokenTtl:    config.Oidc.AccessTokenTtl,
+				ServiceTokenTtl:   config.Oidc.ServiceTokenTtl,
+				ExchangedTokenTtl: config.Oidc.ExchangedTokenTtl,
+			},
+			auth_db.New(dbPool),
+			log,
+		)
+	}
+
+	var federationLogin *federation.Federation
+	if config.Federation != nil {
+		providers := []*federation.ProviderOptions{}
+		for _, provider := range config.Federation.Providers {
+			roleMapping := map[string]auth_db.UserRole{}
+			for value, role := range provider.RoleMapping {
+				roleMapping[value] = auth_db.UserRole(role)
+			}
+			providers = append(providers, &federation.ProviderOptions{
+				Name:         provider.Name,
+				DisplayName:  provider.DisplayName,
+				Issuer:       provider.Issuer,
+				ClientId:     provider.ClientId,
+				ClientSecret: provider.ClientSecret,
+				Scopes:       provider.Scopes,
+				RoleClaim:    provider.RoleClaim,
+				RoleMapping:  roleMapping,
+				Provisioning: provider.Provisioning,
+				TrustEmail:   provider.TrustEmail,
+			})
+		}
+		var samlOptions *federation.SamlOptions
+		if config.Federation.SamlKey != "" {
+			samlOptions, err = federation.NewSamlOptions([]byte(config.Federation.SamlKey), []byte(config.Federation.SamlCertificate))
+			if err != nil {
+				log.Fatal().Msgf("failed to load SAML key pair: %v", err)
+			}
+		}
+		federationLogin = federation.NewFederation(
+			&federation.FederationOptions{
+				BaseUrl:   config.Federation.BaseUrl,
+				AppUrl:    config.AppUrl,
+				Providers: providers,
+				Saml:      samlOptions,
+			},
+			auth_db.New(dbPool),
+			log,
+		)
+	}
+
+	authenticator := authn.NewDomainAuthenticator(authn.NewPostgresAuthenticator(auth_db.New(dbPool)))
+	var directories []*authn.LdapAuthenticator
+	for _, directory := range config.Ldap {
+		roleMapping := map[string]auth_db.UserRole{}
+		for group, role := range directory.RoleMapping {
+			roleMapping[group] = auth_db.UserRole(role)
+		}
+		ldapAuthenticator := authn.NewLdapAuthenticator(
+			&authn.LdapOptions{
+				Name:           directory.Name,
+				Url:            directory.Url,
+				StartTls:       directory.StartTls,
+				BindDn:         directory.BindDn,
+				BindPassword:   directory.BindPassword,
+				BaseDn:         directory.BaseDn,
+				UserFilter:     directory.UserFilter,
+				EmailAttribute: directory.EmailAttribute,
+				NameAttribute:  directory.NameAttribute,
+				GroupAttribute: directory.GroupAttribute,
+				RoleMapping:    roleMapping,
+				Domains:        directory.Domains,
+				SyncInterval:   directory.SyncInterval,
+				SyncMaxDeletes: directory.SyncMaxDeletes,
+				SyncDryRun:     directory.SyncDryRun,
+			},
+			auth_db.New(dbPool),
+			log,
+		)
+		authenticator.Add(ldapAuthenticator, directory.Domains...)
+		directories = append(directories, ldapAuthenticator)
+	}
+
 	jwtOptions := &jwt_interceptor.JwtInterceptorOptions{
 		SecretKey: config.JwtSecretKey,
 		AllowedMethods: []string{
+			"/auth.AuthService/SignUp",
 			"/auth.AuthService/SignIn",
+			"/auth.AuthService/ResetPassword",
+			"/auth.AuthService/ConfirmPasswordReset",
+			"/auth.AuthService/RequestMagicLink",
+			"/auth.AuthService/ConsumeMagicLink",
+			"/auth.AuthService/RequestEmailOtp",
+			"/auth.AuthService/SignInWithEmailOtp",
+			"/auth.AuthService/RequestSmsOtp",
+			"/auth.AuthService/SignInWithSmsOtp",
+			"/auth.AuthService/VerifySmsMfa",
+			"/auth.AuthService/LoadFederationProviders",
+			"/auth.AuthService/SignInWithFederation",
+			"/auth.AuthService/FindSamlConnection",
+			"/auth.AuthService/RequestDeviceCode",
+			"/auth.AuthService/SignInWithDeviceCode",
+			"/auth.AuthService/SignInServiceAccount",
+			"/auth.AuthService/VerifyEmail",
+			"/auth.AuthService/SendEmailVerification",
+			"/auth.AuthService/ConfirmEmailChange",
+			"/auth.AuthService/AcceptInvitation",
+			// Envoy calls without a token of its own, the checked token is in the request
+			"/envoy.service.auth.v3.Authorization/Check",
+		},
+		ImpersonationDeniedMethods: []string{
+			"/auth.AuthService/SignOut",
+			"/auth.AuthService/RefreshTokens",
+			"/auth.AuthService/UpdateUser",
+			"/auth.AuthService/SetPassword",
+			"/auth.AuthService/SetPhone",
+			"/auth.AuthService/VerifyPhone",
+			"/auth.AuthService/SetSmsMfa",
+			"/auth.AuthService/AuthorizeOAuthClient",
+			"/auth.AuthService/ApproveDeviceCode",
+			"/auth.AuthService/Impersonate",
+			"/auth.AuthService/Reauthenticate",
+			"/auth.AuthService/CreatePersonalAccessToken",
+			"/auth.AuthService/RevokePersonalAccessToken",
+			// Tokens outliving the impersonation token
+			"/auth.AuthService/ExchangeToken",
+			"/auth.AuthService/GetCentrifugoConnectionToken",
+			"/auth.AuthService/GetCentrifugoSubscriptionToken",
+		},
+		// Service accounts never manage sessions, tokens or other service accounts
+		ServiceAccountDeniedMethods: []string{
+			"/auth.AuthService/SignOut",
+			"/auth.AuthService/RefreshTokens",
+			"/auth.AuthService/SetPassword",
+			"/auth.AuthService/SetPhone",
+			"/auth.AuthService/VerifyPhone",
+			"/auth.AuthService/SetSmsMfa",
+			"/auth.AuthService/AuthorizeOAuthClient",
+			"/auth.AuthService/ApproveDeviceCode",
+			"/auth.AuthService/Impersonate",
+			"/auth.AuthService/Reauthenticate",
+			"/auth.AuthService/CreatePersonalAccessToken",
+			"/auth.AuthService/LoadPersonalAccessTokens",
+			"/auth.AuthService/RevokePersonalAccessToken",
+			"/auth.AuthService/CreateServiceAccount",
+			"/auth.AuthService/DeleteServiceAccount",
+			"/auth.AuthService/AddServiceAccountKey",
+			"/auth.AuthService/RevokeServiceAccountKey",
 		},
+		// Sensitive methods require a recent sign in, the client calls Reauthenticate otherwise
+		MaxAuthAge: map[string]time.Duration{
+			"/auth.AuthService/SetPassword":               config.StepUpMaxAge,
+			"/auth.AuthService/UpdateUser":                config.StepUpMaxAge,
+			"/auth.AuthService/SetPhone":                  config.StepUpMaxAge,
+			"/auth.AuthService/SetSmsMfa":                 config.StepUpMaxAge,
+			"/auth.AuthService/CreatePersonalAccessToken": config.StepUpMaxAge,
+			"/auth.AuthService/AddServiceAccountKey":      config.StepUpMaxAge,
+		},
+		// Personal access tokens of users, `Bearer pat_...`
+		PersonalAccessTokens: authn.NewPersonalAccessTokens(auth_db.New(dbPool)),
+		PersonalAccessTokenMethods: map[string]string{
+			"/auth.AuthService/LoadUsersInfo":  authn.ScopeUsersRead,
+			"/auth.AuthService/LoadUserAvatar": authn.ScopeUsersRead,
+			"/auth.AuthService/LoadUsers":      authn.ScopeUsersRead,
+			"/auth.AuthService/CreateUser":     authn.ScopeUsersWrite,
+			"/auth.AuthService/SaveUserPhoto":  authn.ScopeUsersWrite,
+		},
+		// Service tokens of OAuth clients, issued by the client credentials grant
+		ClientSigningKey: oidcSigningKey,
+		ClientMethods: map[string]string{
+			"/auth.AuthService/LoadUsersInfo":  "users:read",
+			"/auth.AuthService/LoadUserAvatar": "users:read",
+			"/auth.AuthService/LoadUsers":      "users:read",
+			"/auth.AuthService/ExchangeToken":  oidc.ScopeTokenExchange,
+		},
+	}
+	if config.Oidc != nil {
+		jwtOptions.ClientIssuer = strings.TrimRight(config.Oidc.Issuer, "/")
 	}
 
+	// Methods checking credentials, codes and links get the strict sign in limits
+	rateLimits := map[string]jwt_interceptor.RateLimit{
+		"/auth.AuthService/SignIn":                rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/SignUp":                rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/ResetPassword":         rateLimit(config.RateLimit.ResetPassword),
+		"/auth.AuthService/ConfirmPasswordReset":  rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/SendEmailVerification": rateLimit(config.RateLimit.ResetPassword),
+		"/auth.AuthService/VerifyEmail":           rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/ConfirmEmailChange":    rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/AcceptInvitation":      rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/RequestMagicLink":      rateLimit(config.RateLimit.ResetPassword),
+		"/auth.AuthService/ConsumeMagicLink":      rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/RequestEmailOtp":       rateLimit(config.RateLimit.ResetPassword),
+		"/auth.AuthService/SignInWithEmailOtp":    rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/RequestSmsOtp":         rateLimit(config.RateLimit.ResetPassword),
+		"/auth.AuthService/SignInWithSmsOtp":      rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/VerifySmsMfa":          rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/Reauthenticate":        rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/SignInWithFederation":  rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/SignInServiceAccount":  rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/FindSamlConnection":    rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/RequestDeviceCode":     rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/LoadDeviceCode":        rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/ApproveDeviceCode":     rateLimit(config.RateLimit.SignIn),
+		"/auth.AuthService/SetPhone":              rateLimit(config.RateLimit.ResetPassword),
+		"/auth.AuthService/LoadUserAvatar":        rateLimit(config.RateLimit.Bulk),
+		"/auth.AuthService/LoadUsersInfo":         rateLimit(config.RateLimit.Bulk),
+		"/auth.AuthService/LoadUsers":             rateLimit(config.RateLimit.Bulk),
+	}
+	// The HTTP gateway proves its requests by a random key, only their `x-forwarded-for` is trusted
+	gatewayKey := uuid.NewString()
+	ipRateLimiter := jwt_interceptor.NewRateLimiter(&jwt_interceptor.RateLimiterOptions{
+		Default:        rateLimit(config.RateLimit.Default),
+		Methods:        rateLimits,
+		GatewayKey:     gatewayKey,
+		TrustedProxies: config.RateLimit.TrustedProxies,
+	})
+	principalRateLimiter := jwt_interceptor.NewRateLimiter(&jwt_interceptor.RateLimiterOptions{
+		Default:      rateLimit(config.RateLimit.Default),
+		Methods:      rateLimits,
+		PerPrincipal: true,
+	})
+
+	// Background workers are stopped on shutdown
+	workersCtx, stopWorkers := context.WithCancel(ctx)
+	defer stopWorkers()
+	go ipRateLimiter.Run(workersCtx)
+	go principalRateLimiter.Run(workersCtx)
+	for _, directory := range directories {
+		go directory.Run(workersCtx)
+	}
+
+	mailTemplates, err := mailer.NewTemplates(config.Mail.DefaultLocale)
+	if err != nil {
+		log.Fatal().Msgf("failed to load email templates: %v", err)
+	}
+	var mailSender mailer.Mailer
+	switch config.Mail.Sender {
+	case "log":
+		log.Warn().Msg("Emails are written to the log, DEV_MODE must not be used in production")
+		mailSender = mailer.NewLogMailer(log)
+	case "smtp":
+		mailSender = mailer.NewSmtpMailer(&mailer.SmtpOptions{
+			Host:     config.Mail.Smtp.Host,
+			Port:     config.Mail.Smtp.Port,
+			Username: config.Mail.Smtp.Username,
+			Password: config.Mail.Smtp.Password,
+			From:     config.Mail.Smtp.From,
+			Tls:      mailer.SmtpTls(config.Mail.Smtp.Tls),
+		})
+	}
+	// SMS flows are disabled without a sender
+	var smsSender sms.SmsSender
+	switch config.Sms.Sender {
+	case "log":
+		log.Warn().Msg("SMS messages are written to the log, DEV_MODE must not be used in production")
+		smsSender = sms.NewLogSender(log)
+	case "file":
+		log.Warn().Msgf("SMS messages are written to %s, DEV_MODE must not be used in production", config.Sms.FilePath)
+		smsSender = sms.NewFileSender(config.Sms.FilePath)
+	}
+
+	mailOutbox := mailer.NewOutboxMailer(
+		auth_db.New(dbPool),
+		mailSender,
+		&outbox.Options{Retention: config.Mail.OutboxRetention},
+		log,
+	)
+	go mailOutbox.Run(workersCtx)
+
+	var eventOutbox *centrifugo.Outbox
+	userEventsChannel := ""
+	if config.Centrifugo != nil && config.Centrifugo.ApiUrl != "" {
+		eventOutbox = centrifugo.NewOutbox(
+			auth_db.New(dbPool),
+			centrifugo.NewClient(config.Centrifugo.ApiUrl, config.Centrifugo.ApiKey),
+			&outbox.Options{},
+			log,
+		)
+		go eventOutbox.Run(workersCtx)
+		userEventsChannel = config.Centrifugo.UserEventsChannel
+	}
+
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		grpc_logging.StreamServerInterceptor(logger.InterceptorLogger(*log)),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		grpc_logging.UnaryServerInterceptor(logger.InterceptorLogger(*log)),
+	}
+	// Rate limiter by IP goes before the JWT interceptor to limit requests with invalid tokens as well,
+	// rate limiter by principal goes after it to key buckets by the authenticated user
+	if !config.RateLimit.Disabled {
+		streamInterceptors = append(streamInterceptors,
+			ipRateLimiter.StreamServerInterceptor(),
+			jwt_interceptor.StreamServerInterceptor(jwtOptions),
+			principalRateLimiter.StreamServerInterceptor(),
+		)
+		unaryInterceptors = append(unaryInterceptors,
+			ipRateLimiter.UnaryServerInterceptor(),
+			jwt_interceptor.UnaryServerInterceptor(jwtOptions),
+			principalRateLimiter.UnaryServerInterceptor(),
+		)
+	} else {
+		streamInterceptors = append(streamInterceptors, jwt_interceptor.StreamServerInterceptor(jwtOptions))
+		unaryInterceptors = append(unaryInterceptors, jwt_interceptor.UnaryServerInterceptor(jwtOptions))
+	}
+	streamInterceptors = append(streamInterceptors,
+		grpc_recovery.StreamServerInterceptor(),
+		grpc_prometheus.StreamServerInterceptor,
+	)
+	unaryInterceptors = append(unaryInterceptors,
+		grpc_recovery.UnaryServerInterceptor(),
+		grpc_prometheus.UnaryServerInterceptor,
+	)
+
 	// Set up gRPC server options
 	var grpcOpts = []grpc.ServerOption{
 		// Limit message size to 32 MB, gRPC effective for smaller messages compared to HTTP
 		grpc.MaxRecvMsgSize(32 * 1024 * 1024),
 		grpc.MaxSendMsgSize(32 * 1024 * 1024),
-		grpc.ChainStreamInterceptor(
-			grpc_logging.StreamServerInterceptor(logger.InterceptorLogger(*log)),
-			jwt_interceptor.StreamServerInterceptor(jwtOptions),
-			grpc_recovery.StreamServerInterceptor(),
-			grpc_prometheus.StreamServerInterceptor,
-		),
-		grpc.ChainUnaryInterceptor(
-			grpc_logging.UnaryServerInterceptor(logger.InterceptorLogger(*log)),
-			jwt_interceptor.UnaryServerInterceptor(jwtOptions),
-			grpc_recovery.UnaryServerInterceptor(),
-			grpc_prometheus.UnaryServerInterceptor,
-		),
+		grpc.ChainStreamInterceptor(streamInterceptors...),
+		grpc.ChainUnaryInterceptor(unaryInterceptors...),
 	}
 
 	// Listen on the specified [host]:port
@@ -112,7 +438,35 @@ func main() {
 	// Register gRPC service servers
 	api.RegisterAuthServiceServer(
 		grpcServer,
-		&api.AuthServiceServerConfig{JwtSecretKey: config.JwtSecretKey},
+		&api.AuthServiceServerConfig{
+			JwtSecretKey:               config.JwtSecretKey,
+			Authenticator:              authenticator,
+			AppUrl:                     config.AppUrl,
+			EmailVerificationTtl:       config.Email.VerificationTtl,
+			RequireVerifiedEmail:       config.Email.RequireVerified,
+			EmailChangeTtl:             config.Email.ChangeTtl,
+			EmailChangeRevokesSessions: config.Email.ChangeRevokeSessions,
+			InvitationTtl:              config.Email.InvitationTtl,
+			SignUpPolicy:               api.SignUpPolicy(config.SignUp.Policy),
+			SignUpAllowedDomains:       config.SignUp.AllowedDomains,
+			Mailer:                     mailOutbox,
+			MailTemplates:              mailTemplates,
+			PasswordResetTtl:           config.Email.PasswordResetTtl,
+			MagicLinkTtl:               config.Email.MagicLinkTtl,
+			OtpTtl:                     config.Email.OtpTtl,
+			OtpMaxAttempts:             config.Email.OtpMaxAttempts,
+			SmsSender:                  smsSender,
+			OidcProvider:               oidcProvider,
+			Federation:                 federationLogin,
+			DeviceCodeTtl:              config.Device.CodeTtl,
+			DevicePollInterval:         config.Device.PollInterval,
+			ImpersonationTtl:           config.ImpersonationTtl,
+			ServiceAccounts:            authn.NewServiceAccounts(auth_db.New(dbPool)),
+			ServiceAccountTokenTtl:     config.ServiceAccountTokenTtl,
+			CentrifugoTokens:           centrifugoTokens,
+			EventOutbox:                eventOutbox,
+			UserEventsChannel:          userEventsChannel,
+		},
 		dbPool,
 		log,
 		false,
@@ -138,18 +492,72 @@ func main() {
 		Str("address", config.GrpcAddress).
 		Msg("serving GRPC API")
 
+	// Proxies check requests of all clients, their checks are limited per proxy address
+	proxyRateLimiter := jwt_interceptor.NewRateLimiter(&jwt_interceptor.RateLimiterOptions{
+		Default: rateLimit(config.RateLimit.ExtAuthz),
+	})
+	go proxyRateLimiter.Run(workersCtx)
+
+	// Envoy external authorization of upstreams behind Envoy, served on the internal address of the proxy only
+	var extAuthzServer *grpc.Server
+	if config.ExtAuthzAddress != "" {
+		extAuthzInterceptors := []grpc.UnaryServerInterceptor{
+			grpc_logging.UnaryServerInterceptor(logger.InterceptorLogger(*log)),
+		}
+		if !config.RateLimit.Disabled {
+			extAuthzInterceptors = append(extAuthzInterceptors, proxyRateLimiter.UnaryServerInterceptor())
+		}
+		extAuthzInterceptors = append(extAuthzInterceptors,
+			grpc_recovery.UnaryServerInterceptor(),
+			grpc_prometheus.UnaryServerInterceptor,
+		)
+		extAuthzOpts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(extAuthzInterceptors...)}
+		if config.GrpcApiKey != "" {
+			extAuthzOpts = append(extAuthzOpts, api.GRPCKeyAuth(config.GrpcApiKey))
+		}
+
+		extAuthzConn, err := net.Listen("tcp", config.ExtAuthzAddress)
+		if err != nil {
+			log.Fatal().Msgf("cannot listen to address %s", config.ExtAuthzAddress)
+		}
+		extAuthzServer = grpc.NewServer(extAuthzOpts...)
+		authv3.RegisterAuthorizationServer(extAuthzServer, ext_authz.NewAuthorizationServer(jwtOptions, log))
+
+		go func() {
+			if err := extAuthzServer.Serve(extAuthzConn); err != nil {
+				log.Fatal().Msgf("serve ext_authz: %v", err)
+			}
+		}()
+
+		log.Info().
+			Str("address", config.ExtAuthzAddress).
+			Msg("serving Envoy ext_authz")
+	}
+
 	// Start HTTP server (and proxy calls to gRPC server endpoint)
 	gwmux := grpc_runtime.NewServeMux()
 
 	// Register Web API services to the gateway
-	opts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(jwt_interceptor.GatewayUnaryClientInterceptor(gatewayKey)),
+		grpc.WithStreamInterceptor(jwt_interceptor.GatewayStreamClientInterceptor(gatewayKey)),
+	}
 	pb.RegisterAuthServiceHandlerFromEndpoint(ctx, gwmux, config.GrpcAddress, opts)
 	if err != nil {
 		log.Fatal().Msgf("failed to register Web API service: %v", err)
 	}
+	httpMux := http.NewServeMux()
+	httpMux.Handle("/", gwmux)
+	if oidcProvider != nil {
+		oidcProvider.Register(httpMux)
+	}
+	if federationLogin != nil {
+		federationLogin.Register(httpMux)
+	}
 	gwServer := &http.Server{
 		Addr:    config.HttpAddress,
-		Handler: gwmux,
+		Handler: httpMux,
 	}
 
 	log.Info().
@@ -162,6 +570,32 @@ func main() {
 		}
 	}()
 
+	// Forward auth of reverse proxies, served on the internal address of the proxy only
+	var forwardAuthServer *http.Server
+	if config.ForwardAuth != nil {
+		forwardAuthMux := http.NewServeMux()
+		ext_authz.NewForwardAuth(jwtOptions, config.ForwardAuth.Cookie, log).Register(forwardAuthMux)
+
+		var forwardAuthHandler http.Handler = forwardAuthMux
+		if !config.RateLimit.Disabled {
+			forwardAuthHandler = proxyRateLimiter.HttpHandler(ext_authz.VerifyPath, forwardAuthMux)
+		}
+		forwardAuthServer = &http.Server{
+			Addr:    config.ForwardAuth.Address,
+			Handler: forwardAuthHandler,
+		}
+
+		log.Info().
+			Str("address", config.ForwardAuth.Address).
+			Msg("serving forward auth")
+
+		go func() {
+			if err := forwardAuthServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Fatal().Msgf("failed to serve forward auth: %v", err)
+			}
+		}()
+	}
+
 	// Graceful shutdown
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
@@ -173,9 +607,21 @@ func main() {
 	defer cancel()
 
 	grpcServer.GracefulStop()
+	if extAuthzServer != nil {
+		extAuthzServer.GracefulStop()
+	}
 	if err := gwServer.Shutdown(ctx); err != nil {
 		log.Fatal().Msgf("failed to stop HTTP server: %v", err)
 	}
+	if forwardAuthServer != nil {
+		if err := forwardAuthServer.Shutdown(ctx); err != nil {
+			log.Fatal().Msgf("failed to stop forward auth server: %v", err)
+		}
+	}
 
 	log.Info().Msg("gRPC server stopped")
 }
+
+func rateLimit(rule *config.RateLimitRule) jwt_interceptor.RateLimit {
+	return jwt_interceptor.RateLimit{Rate: rule.Rate, Burst: rule.Burst}
+}
@@ -0,0 +1,7 @@
+-- Upgrades databases created before email verification, run it once before starting the upgraded service.
+-- Users existing before the upgrade are treated as verified, so REQUIRE_VERIFIED_EMAIL does not lock them out.
+alter table public."user" add column if not exists email_verified_at timestamp;
+
+update public."user"
+   set email_verified_at = now()
+ where email_verified_at is null;
@@ -4,14 +4,73 @@ SELECT * FROM "user"
    AND deleted_at IS NULL OR deleted_at > NOW()
  LIMIT 1;
 
+-- name: GetActiveUserById :one
+SELECT * FROM "user"
+ WHERE id = $1
+   AND (deleted_at IS NULL OR deleted_at > NOW())
+ LIMIT 1;
+
+-- name: GetActiveUserByPhone :one
+SELECT * FROM "user"
+ WHERE phone = $1
+   AND phone_verified_at IS NOT NULL
+   AND (deleted_at IS NULL OR deleted_at > NOW())
+ LIMIT 1;
+
+-- name: IsPhoneTaken :one
+SELECT EXISTS (
+  SELECT 1 FROM "user"
+   WHERE phone = $1
+     AND id <> $2
+);
+
+-- name: UpdateUserPhone :execrows
+UPDATE "user"
+   SET phone = $2,
+       phone_verified_at = NOW()
+ WHERE id = $1;
+
+-- name: SetUserSmsMfa :execrows
+UPDATE "user"
+   SET sms_mfa_enabled = $2
+ WHERE id = $1
+   AND (NOT $2 OR phone_verified_at IS NOT NULL);
+
+-- name: IsEmailTaken :one
+SELECT EXISTS (
+  SELECT 1 FROM "user"
+   WHERE email = $1
+);
+
+-- name: GetUser :one
+SELECT * FROM "user"
+ WHERE id = $1
+ LIMIT 1;
+
 -- name: LoadUsers :many
 SELECT id,
        role,
        name,
        email,
        blurhash,
-       deleted_at IS NOT NULL AND deleted_at < NOW() AS deleted
+       email_verified_at IS NOT NULL AS email_verified,
+       phone,
+       sms_mfa_enabled,
+       deleted_at IS NOT NULL AND deleted_at < NOW() AS deleted,
+       false AS service_account
   FROM "user"
+ UNION ALL
+SELECT id,
+       role,
+       name,
+       ''::varchar AS email,
+       NULL::varchar AS blurhash,
+       false AS email_verified,
+       NULL::varchar AS phone,
+       false AS sms_mfa_enabled,
+       deleted_at IS NOT NULL AS deleted,
+       true AS service_account
+  FROM service_account
  ORDER BY name;
 
 -- name: CreateUser :one
@@ -32,10 +91,35 @@ RETURNING id;
 UPDATE "user"
    SET role = $2,
        name = $3,
-      email = $4,
  deleted_at = CASE WHEN sqlc.arg('Deleted')::bool THEN NOW() ELSE NULL END
  WHERE id = $1;
 
+-- name: UpdateUserEmail :execrows
+UPDATE "user"
+   SET email = $2,
+       email_verified_at = NOW()
+ WHERE id = $1;
+
+-- name: UpdateUserRole :exec
+UPDATE "user"
+   SET role = $2
+ WHERE id = $1;
+
+-- name: LoadActiveIdentityUsers :many
+SELECT * FROM "user" u
+ WHERE (u.deleted_at IS NULL OR u.deleted_at > NOW())
+   AND EXISTS (
+     SELECT 1 FROM user_identity i
+      WHERE i.user_id = u.id
+        AND i.issuer = $1
+   );
+
+-- name: SyncDirectoryUser :exec
+UPDATE "user"
+   SET name = $2,
+       role = $3
+ WHERE id = $1;
+
 -- name: UpdateUserBlurhash :exec
 UPDATE "user"
    SET blurhash = $2
@@ -46,6 +130,29 @@ UPDATE "user"
    SET password = $2
  WHERE email = $1;
 
+-- name: VerifyUserEmail :execrows
+UPDATE "user"
+   SET email_verified_at = NOW()
+ WHERE id = $1
+   AND email = $2;
+
+-- name: CompleteInvitedUser :exec
+UPDATE "user"
+   SET name = $2,
+       password = $3,
+       email_verified_at = NOW()
+ WHERE id = $1;
+
+-- name: DeletePendingUser :exec
+DELETE FROM "user"
+ WHERE id = $1
+   AND password = '';
+
+-- name: UpdateUserPasswordById :exec
+UPDATE "user"
+   SET password = $2
+ WHERE id = $1;
+
 -- name: DeleteUser :exec
 UPDATE "user"
    SET deleted_at = NOW()
@@ -96,3 +203,579 @@ SELECT refresh_token
  WHERE user_id = $1 
    AND deleted_at is null;
 
+
+-- name: CreateUserToken :exec
+INSERT INTO user_token (
+  token_hash,
+  user_id,
+  purpose,
+  email,
+  expires_at
+)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: ConsumeUserToken :one
+UPDATE user_token
+   SET used_at = NOW()
+ WHERE token_hash = $1
+   AND purpose = $2
+   AND used_at IS NULL
+   AND expires_at > NOW()
+RETURNING user_id, email;
+
+-- name: GetUserToken :one
+SELECT user_id, email FROM user_token
+ WHERE token_hash = $1
+   AND purpose = $2
+   AND used_at IS NULL
+   AND expires_at > NOW()
+ LIMIT 1;
+
+-- name: RevokeUserTokens :exec
+DELETE FROM user_token
+ WHERE user_id = $1
+   AND purpose = $2
+   AND used_at IS NULL;
+
+
+-- name: CreateUserOtp :exec
+INSERT INTO user_otp (
+  user_id,
+  purpose,
+  recipient,
+  code_hash,
+  expires_at
+)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: RevokeUserOtps :exec
+DELETE FROM user_otp
+ WHERE user_id = $1
+   AND purpose = $2
+   AND used_at IS NULL;
+
+-- name: UseUserOtpAttempt :one
+-- Attempt is counted before the code is checked, so parallel guesses could not exceed the limit
+UPDATE user_otp
+   SET attempts = attempts + 1
+ WHERE id = (
+   SELECT id
+     FROM user_otp
+    WHERE user_otp.user_id = $1
+      AND user_otp.purpose = $2
+      AND used_at IS NULL
+      AND expires_at > NOW()
+    ORDER BY created_at DESC
+    LIMIT 1
+ )
+   AND attempts < sqlc.arg('MaxAttempts')
+RETURNING id, recipient, code_hash;
+
+-- name: ConsumeUserOtp :execrows
+UPDATE user_otp
+   SET used_at = NOW()
+ WHERE id = $1
+   AND used_at IS NULL;
+
+
+-- name: CreateInvitation :exec
+INSERT INTO user_invitation (
+  id,
+  user_id,
+  email,
+  role,
+  token_hash,
+  invited_by,
+  expires_at
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7);
+
+-- name: GetInvitation :one
+SELECT * FROM user_invitation
+ WHERE id = $1
+ LIMIT 1;
+
+-- name: LoadInvitations :many
+SELECT * FROM user_invitation
+ ORDER BY created_at DESC;
+
+-- name: RenewInvitation :execrows
+UPDATE user_invitation
+   SET token_hash = $2,
+       expires_at = $3
+ WHERE id = $1
+   AND accepted_at IS NULL
+   AND cancelled_at IS NULL;
+
+-- name: CancelInvitation :one
+UPDATE user_invitation
+   SET cancelled_at = NOW()
+ WHERE id = $1
+   AND accepted_at IS NULL
+   AND cancelled_at IS NULL
+RETURNING user_id;
+
+-- name: AcceptInvitation :one
+UPDATE user_invitation
+   SET accepted_at = NOW()
+ WHERE token_hash = $1
+   AND accepted_at IS NULL
+   AND cancelled_at IS NULL
+   AND expires_at > NOW()
+RETURNING user_id, email;
+
+
+-- name: EnqueueMail :exec
+INSERT INTO mail_outbox (
+  recipient,
+  subject,
+  text_body,
+  html_body
+)
+VALUES ($1, $2, $3, $4);
+
+-- name: ClaimMailOutbox :many
+UPDATE mail_outbox
+   SET locked_until = NOW() + sqlc.arg('Lease')::interval
+ WHERE id IN (
+   SELECT id
+     FROM mail_outbox
+    WHERE sent_at IS NULL
+      AND failed_at IS NULL
+      AND next_attempt_at <= NOW()
+      AND (locked_until IS NULL OR locked_until < NOW())
+    ORDER BY next_attempt_at
+    LIMIT sqlc.arg('BatchSize')
+      FOR UPDATE SKIP LOCKED
+ )
+RETURNING *;
+
+-- name: MarkMailSent :exec
+UPDATE mail_outbox
+   SET sent_at = NOW(),
+       attempts = attempts + 1,
+       locked_until = NULL,
+       last_error = NULL,
+       text_body = '',
+       html_body = ''
+ WHERE id = $1;
+
+-- name: MarkMailAttemptFailed :exec
+UPDATE mail_outbox
+   SET attempts = attempts + 1,
+       locked_until = NULL,
+       last_error = $2,
+       next_attempt_at = $3,
+       failed_at = CASE WHEN sqlc.arg('Failed')::bool THEN NOW() ELSE NULL END,
+       text_body = CASE WHEN sqlc.arg('Failed')::bool THEN '' ELSE text_body END,
+       html_body = CASE WHEN sqlc.arg('Failed')::bool THEN '' ELSE html_body END
+ WHERE id = $1;
+
+-- name: PurgeMailOutbox :execrows
+DELETE FROM mail_outbox
+ WHERE sent_at < NOW() - sqlc.arg('Retention')::interval
+    OR failed_at < NOW() - sqlc.arg('Retention')::interval;
+
+-- name: EnqueueEvent :exec
+INSERT INTO event_outbox (
+  channel,
+  data,
+  disconnect_user
+)
+VALUES ($1, $2, $3);
+
+-- name: ClaimEventOutbox :many
+UPDATE event_outbox
+   SET locked_until = NOW() + sqlc.arg('Lease')::interval
+ WHERE id IN (
+   SELECT id
+     FROM event_outbox
+    WHERE published_at IS NULL
+      AND failed_at IS NULL
+      AND next_attempt_at <= NOW()
+      AND (locked_until IS NULL OR locked_until < NOW())
+    ORDER BY created_at
+    LIMIT sqlc.arg('BatchSize')
+      FOR UPDATE SKIP LOCKED
+ )
+RETURNING *;
+
+-- name: MarkEventPublished :exec
+UPDATE event_outbox
+   SET published_at = NOW(),
+       attempts = attempts + 1,
+       locked_until = NULL,
+       last_error = NULL
+ WHERE id = $1;
+
+-- name: MarkEventChannelPublished :exec
+UPDATE event_outbox
+   SET channel_published_at = NOW()
+ WHERE id = $1;
+
+-- name: MarkEventAttemptFailed :exec
+UPDATE event_outbox
+   SET attempts = attempts + 1,
+       locked_until = NULL,
+       last_error = $2,
+       next_attempt_at = $3,
+       failed_at = CASE WHEN sqlc.arg('Failed')::bool THEN NOW() ELSE NULL END
+ WHERE id = $1;
+
+-- name: PurgeEventOutbox :execrows
+DELETE FROM event_outbox
+ WHERE published_at < NOW() - sqlc.arg('Retention')::interval
+    OR failed_at < NOW() - sqlc.arg('Retention')::interval;
+
+
+-- name: GetOAuthClient :one
+SELECT * FROM oauth_client
+ WHERE id = $1
+   AND disabled_at IS NULL
+ LIMIT 1;
+
+-- name: CreateOAuthAuthorizationCode :exec
+INSERT INTO oauth_authorization_code (
+  code_hash,
+  client_id,
+  user_id,
+  redirect_uri,
+  scope,
+  nonce,
+  code_challenge,
+  expires_at
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+
+-- name: ConsumeOAuthAuthorizationCode :one
+UPDATE oauth_authorization_code
+   SET used_at = NOW()
+ WHERE code_hash = $1
+   AND used_at IS NULL
+   AND expires_at > NOW()
+RETURNING *;
+
+-- name: LoadOAuthClients :many
+SELECT * FROM oauth_client
+ ORDER BY created_at;
+
+-- name: CreateOAuthClient :exec
+INSERT INTO oauth_client (
+  id,
+  name,
+  secret_hash,
+  redirect_uris,
+  scopes,
+  grant_types,
+  audience,
+  exchange_audiences
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8);
+
+-- name: UpdateOAuthClient :execrows
+UPDATE oauth_client
+   SET name = $2,
+       redirect_uris = $3,
+       scopes = $4,
+       grant_types = $5,
+       audience = $6,
+       exchange_audiences = $7
+ WHERE id = $1;
+
+-- name: UpdateOAuthClientSecret :execrows
+UPDATE oauth_client
+   SET secret_hash = $2
+ WHERE id = $1
+   AND secret_hash IS NOT NULL;
+
+-- name: DisableOAuthClient :execrows
+UPDATE oauth_client
+   SET disabled_at = NOW()
+ WHERE id = $1
+   AND disabled_at IS NULL;
+
+
+-- name: CreateFederatedLogin :exec
+INSERT INTO federated_login (
+  state_hash,
+  provider,
+  nonce,
+  code_verifier,
+  expires_at
+)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: ConsumeFederatedLogin :one
+UPDATE federated_login
+   SET used_at = NOW()
+ WHERE state_hash = $1
+   AND used_at IS NULL
+   AND expires_at > NOW()
+RETURNING provider, nonce, code_verifier;
+
+-- name: GetUserIdentity :one
+SELECT * FROM user_identity
+ WHERE issuer = $1
+   AND subject = $2
+ LIMIT 1;
+
+-- name: CreateUserIdentity :exec
+INSERT INTO user_identity (
+  user_id,
+  provider,
+  issuer,
+  subject,
+  email,
+  last_sign_in_at
+)
+VALUES ($1, $2, $3, $4, $5, NOW());
+
+-- name: UpdateUserIdentitySignIn :exec
+UPDATE user_identity
+   SET email = $2,
+       last_sign_in_at = NOW()
+ WHERE id = $1;
+
+
+-- name: GetSamlConnection :one
+SELECT * FROM saml_connection
+ WHERE id = $1
+   AND disabled_at IS NULL
+ LIMIT 1;
+
+-- name: FindSamlConnectionByDomain :one
+SELECT * FROM saml_connection
+ WHERE lower(sqlc.arg('Domain')) = ANY(domains)
+   AND disabled_at IS NULL
+ LIMIT 1;
+
+-- name: LoadSamlConnections :many
+SELECT * FROM saml_connection
+ ORDER BY name;
+
+-- name: SaveSamlConnection :exec
+INSERT INTO saml_connection (
+  id,
+  name,
+  idp_metadata,
+  domains,
+  email_attribute,
+  name_attribute,
+  role_attribute,
+  role_mapping,
+  provisioning
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+ON CONFLICT (id) DO UPDATE
+   SET name = EXCLUDED.name,
+       idp_metadata = EXCLUDED.idp_metadata,
+       domains = EXCLUDED.domains,
+       email_attribute = EXCLUDED.email_attribute,
+       name_attribute = EXCLUDED.name_attribute,
+       role_attribute = EXCLUDED.role_attribute,
+       role_mapping = EXCLUDED.role_mapping,
+       provisioning = EXCLUDED.provisioning,
+       disabled_at = NULL;
+
+-- name: DisableSamlConnection :execrows
+UPDATE saml_connection
+   SET disabled_at = NOW()
+ WHERE id = $1
+   AND disabled_at IS NULL;
+
+-- name: CreateSamlRequest :exec
+INSERT INTO saml_request (
+  relay_state_hash,
+  connection_id,
+  request_id,
+  expires_at
+)
+VALUES ($1, $2, $3, $4);
+
+-- name: ConsumeSamlRequest :one
+UPDATE saml_request
+   SET used_at = NOW()
+ WHERE relay_state_hash = $1
+   AND connection_id = $2
+   AND used_at IS NULL
+   AND expires_at > NOW()
+RETURNING request_id;
+
+-- name: CreateDeviceAuthorization :exec
+INSERT INTO device_authorization (
+  device_code_hash,
+  user_code_hash,
+  device_id,
+  installation_id,
+  device_name,
+  expires_at
+)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: GetPendingDeviceAuthorization :one
+SELECT * FROM device_authorization
+ WHERE user_code_hash = $1
+   AND status = 'pending'
+   AND expires_at > NOW()
+ LIMIT 1;
+
+-- name: CompleteDeviceAuthorization :execrows
+UPDATE device_authorization
+   SET status = $2,
+       user_id = $3
+ WHERE user_code_hash = $1
+   AND status = 'pending'
+   AND expires_at > NOW();
+
+-- name: PollDeviceAuthorization :one
+-- SlowDown is set for devices polling faster than the interval since the previous poll
+UPDATE device_authorization AS d
+   SET last_polled_at = NOW()
+  FROM (
+    SELECT device_code_hash, last_polled_at
+      FROM device_authorization
+     WHERE device_code_hash = sqlc.arg('DeviceCodeHash')
+       FOR UPDATE
+  ) AS previous
+ WHERE d.device_code_hash = previous.device_code_hash
+   AND d.used_at IS NULL
+RETURNING d.status,
+          d.user_id,
+          d.device_id,
+          d.installation_id,
+          (d.expires_at <= NOW())::boolean AS expired,
+          COALESCE(previous.last_polled_at > NOW() - make_interval(secs => sqlc.arg('IntervalSeconds')::float8), false)::boolean AS slow_down;
+
+-- name: ConsumeDeviceAuthorization :execrows
+UPDATE device_authorization
+   SET used_at = NOW()
+ WHERE device_code_hash = $1
+   AND status = 'approved'
+   AND used_at IS NULL
+   AND expires_at > NOW();
+
+-- name: CreateAuditLog :exec
+INSERT INTO audit_log (
+  id,
+  action,
+  actor_id,
+  actor_email,
+  subject_id,
+  subject_email,
+  details
+)
+VALUES ($1, $2, $3, $4, $5, $6, $7);
+
+-- name: CreatePersonalAccessToken :exec
+INSERT INTO personal_access_token (
+  id,
+  user_id,
+  name,
+  token_hash,
+  scopes,
+  expires_at
+)
+VALUES ($1, $2, $3, $4, $5, $6);
+
+-- name: LoadPersonalAccessTokens :many
+SELECT * FROM personal_access_token
+ WHERE user_id = $1
+ ORDER BY created_at DESC;
+
+-- name: RevokePersonalAccessToken :execrows
+UPDATE personal_access_token
+   SET revoked_at = NOW()
+ WHERE id = $1
+   AND user_id = $2
+   AND revoked_at IS NULL;
+
+-- name: UsePersonalAccessToken :one
+-- Last use time is written once a minute, scripts calling often do not update the row on every request
+WITH token AS (
+  SELECT id, user_id, scopes, last_used_at
+    FROM personal_access_token
+   WHERE token_hash = $1
+     AND revoked_at IS NULL
+     AND (expires_at IS NULL OR expires_at > NOW())
+), touched AS (
+  UPDATE personal_access_token p
+     SET last_used_at = NOW()
+    FROM token
+   WHERE p.id = token.id
+     AND (token.last_used_at IS NULL OR token.last_used_at < NOW() - interval '1 minute')
+)
+SELECT id, user_id, scopes
+  FROM token;
+
+
+-- name: CreateServiceAccount :exec
+INSERT INTO service_account (
+  id,
+  role,
+  name,
+  description
+)
+VALUES ($1, $2, $3, $4);
+
+-- name: GetActiveServiceAccount :one
+SELECT * FROM service_account
+ WHERE id = $1
+   AND deleted_at IS NULL
+ LIMIT 1;
+
+-- name: LoadServiceAccounts :many
+SELECT * FROM service_account
+ ORDER BY name;
+
+-- name: DeleteServiceAccount :execrows
+UPDATE service_account
+   SET deleted_at = NOW()
+ WHERE id = $1
+   AND deleted_at IS NULL;
+
+-- name: CreateServiceAccountKey :exec
+INSERT INTO service_account_key (
+  id,
+  service_account_id,
+  type,
+  public_key,
+  secret_hash
+)
+VALUES ($1, $2, $3, $4, $5);
+
+-- name: LoadServiceAccountKeys :many
+SELECT * FROM service_account_key
+ WHERE service_account_id = $1
+ ORDER BY created_at DESC;
+
+-- name: LoadActiveServiceAccountKeys :many
+SELECT * FROM service_account_key
+ WHERE service_account_id = $1
+   AND type = $2
+   AND revoked_at IS NULL;
+
+-- name: UseServiceAccountKey :exec
+UPDATE service_account_key
+   SET last_used_at = NOW()
+ WHERE id = $1;
+
+-- name: RevokeServiceAccountKey :execrows
+UPDATE service_account_key
+   SET revoked_at = NOW()
+ WHERE id = $1
+   AND service_account_id = $2
+   AND revoked_at IS NULL;
+
+-- name: DeleteExpiredServiceAccountAssertions :exec
+DELETE FROM service_account_assertion
+ WHERE service_account_id = $1
+   AND expires_at < NOW();
+
+-- name: CreateServiceAccountAssertion :execrows
+INSERT INTO service_account_assertion (
+  service_account_id,
+  jti,
+  expires_at
+)
+VALUES ($1, $2, $3)
+ON CONFLICT DO NOTHING;
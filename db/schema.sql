@@ -13,6 +13,13 @@ create table if not exists public."user"
             unique,
     password        varchar(512)         not null,
     blurhash        varchar(37),
+    email_verified_at timestamp,
+    -- Phone in E.164 format, set once verified by a code
+    phone           varchar(16)
+        constraint phone
+            unique,
+    phone_verified_at timestamp,
+    sms_mfa_enabled boolean default false not null,
     deleted_at      timestamp
 );
 create index user_email_idx on public."user"(email);
@@ -37,3 +44,320 @@ create table if not exists public.user_photo
     avatar     bytea,
     photo      bytea
 );
+
+
+create type public.user_token_purpose as enum ('email_verification', 'email_change', 'password_reset', 'magic_link', 'mfa', 'federated_sign_in');
+alter type public.user_token_purpose owner to admin;
+
+-- Single-use tokens sent by email, only SHA-256 hashes are stored
+create table if not exists public.user_token
+(
+    token_hash      varchar(64)          not null primary key,
+    user_id         uuid                 not null
+        constraint user_token_user_id_fk
+            references public."user",
+    purpose         user_token_purpose   not null,
+    email           varchar(256)         not null,
+    expires_at      timestamp            not null,
+    used_at         timestamp,
+    created_at      timestamp default now() not null
+);
+create index user_token_user_id_idx on public.user_token(user_id, purpose);
+
+
+-- One-time codes for sign in on devices where links are awkward, codes are bcrypt hashed
+create type public.user_otp_purpose as enum ('email_sign_in', 'phone_verification', 'sms_sign_in', 'sms_mfa');
+alter type public.user_otp_purpose owner to admin;
+
+create table if not exists public.user_otp
+(
+    id              uuid default uuid_generate_v4() primary key,
+    user_id         uuid                 not null
+        constraint user_otp_user_id_fk
+            references public."user"
+            on delete cascade,
+    purpose         user_otp_purpose     not null,
+    recipient       varchar(256)         not null,
+    code_hash       varchar(60)          not null,
+    attempts        integer   default 0  not null,
+    expires_at      timestamp            not null,
+    used_at         timestamp,
+    created_at      timestamp default now() not null
+);
+create index user_otp_user_id_idx on public.user_otp(user_id, purpose);
+
+
+-- Invited users are created pending with an empty password until the invitation is accepted
+create table if not exists public.user_invitation
+(
+    id              uuid default uuid_generate_v4() primary key,
+    user_id         uuid
+        constraint user_invitation_user_id_fk
+            references public."user"
+            on delete set null,
+    email           varchar(256)  not null,
+    role            user_role     not null,
+    token_hash      varchar(64)   not null
+        constraint user_invitation_token_hash
+            unique,
+    invited_by      uuid
+        constraint user_invitation_invited_by_fk
+            references public."user",
+    expires_at      timestamp     not null,
+    accepted_at     timestamp,
+    cancelled_at    timestamp,
+    created_at      timestamp default now() not null
+);
+create index user_invitation_email_idx on public.user_invitation(email);
+
+
+-- Emails are queued in the same database and delivered by a background worker with retries
+create table if not exists public.mail_outbox
+(
+    id              uuid default uuid_generate_v4() primary key,
+    recipient       varchar(256)  not null,
+    subject         varchar(998)  not null,
+    text_body       text          not null,
+    html_body       text          not null,
+    attempts        integer   default 0     not null,
+    next_attempt_at timestamp default now() not null,
+    locked_until    timestamp,
+    last_error      text,
+    sent_at         timestamp,
+    failed_at       timestamp,
+    created_at      timestamp default now() not null
+);
+create index mail_outbox_next_attempt_at_idx on public.mail_outbox(next_attempt_at)
+    where sent_at is null and failed_at is null;
+
+-- Events published to Centrifugo channels, queued in the transaction of the change
+create table if not exists public.event_outbox
+(
+    id              uuid default uuid_generate_v4() primary key,
+    channel         varchar(256)  not null,
+    data            jsonb         not null,
+    -- Connections of the user are disconnected once the event is published
+    disconnect_user varchar(64),
+    -- Retries of a failed disconnect do not publish the event again
+    channel_published_at timestamp,
+    attempts        integer   default 0     not null,
+    next_attempt_at timestamp default now() not null,
+    locked_until    timestamp,
+    last_error      text,
+    published_at    timestamp,
+    failed_at       timestamp,
+    created_at      timestamp default now() not null
+);
+create index event_outbox_next_attempt_at_idx on public.event_outbox(next_attempt_at)
+    where published_at is null and failed_at is null;
+
+
+-- Relying parties of the OpenID Connect provider and backend services using the client credentials grant,
+-- public clients have no secret and rely on PKCE
+create table if not exists public.oauth_client
+(
+    id              varchar(64)   not null primary key,
+    name            varchar(256)  not null,
+    secret_hash     varchar(512),
+    redirect_uris   text[]        not null,
+    scopes          text[]        not null,
+    grant_types     text[]        default '{authorization_code}' not null,
+    -- Audience of service tokens, `auth-service` tokens are accepted by this service
+    audience        varchar(256)  default 'auth-service' not null,
+    disabled_at     timestamp,
+    created_at      timestamp default now() not null,
+    -- Audiences the client may exchange user tokens for, none by default
+    exchange_audiences text[]     default '{}' not null
+);
+
+create table if not exists public.oauth_authorization_code
+(
+    code_hash       varchar(64)   not null primary key,
+    client_id       varchar(64)   not null
+        constraint oauth_authorization_code_client_id_fk
+            references public.oauth_client
+            on delete cascade,
+    user_id         uuid          not null
+        constraint oauth_authorization_code_user_id_fk
+            references public."user"
+            on delete cascade,
+    redirect_uri    text          not null,
+    scope           text          not null,
+    nonce           varchar(512),
+    code_challenge  varchar(128)  not null,
+    expires_at      timestamp     not null,
+    used_at         timestamp,
+    created_at      timestamp default now() not null
+);
+
+
+-- External identities of users signed in by federated OpenID Connect identity providers
+create table if not exists public.user_identity
+(
+    id              uuid default uuid_generate_v4() primary key,
+    user_id         uuid          not null
+        constraint user_identity_user_id_fk
+            references public."user"
+            on delete cascade,
+    provider        varchar(64)   not null,
+    issuer          varchar(512)  not null,
+    subject         varchar(256)  not null,
+    email           varchar(256),
+    last_sign_in_at timestamp,
+    created_at      timestamp default now() not null,
+    constraint user_identity_issuer_subject
+        unique (issuer, subject)
+);
+create index user_identity_user_id_idx on public.user_identity(user_id);
+
+-- Pending federated sign in requests, the state is sent to the identity provider and only its hash is stored
+create table if not exists public.federated_login
+(
+    state_hash      varchar(64)   not null primary key,
+    provider        varchar(64)   not null,
+    nonce           varchar(64)   not null,
+    code_verifier   varchar(128)  not null,
+    expires_at      timestamp     not null,
+    used_at         timestamp,
+    created_at      timestamp default now() not null
+);
+
+
+-- SAML identity providers of organizations, users of the organization domains sign in by the identity provider
+create table if not exists public.saml_connection
+(
+    id              varchar(64)   not null primary key,
+    name            varchar(256)  not null,
+    -- EntityDescriptor XML of the identity provider
+    idp_metadata    text          not null,
+    domains         text[]        not null,
+    -- NameID is used when the email attribute is not set
+    email_attribute varchar(256),
+    name_attribute  varchar(256),
+    role_attribute  varchar(256),
+    -- Role attribute values mapped to user roles, e.g. {"admins": "administrator"}
+    role_mapping    jsonb     default '{}'  not null,
+    provisioning    boolean   default false not null,
+    disabled_at     timestamp,
+    created_at      timestamp default now() not null
+);
+
+-- Pending SAML authentication requests, the relay state is sent to the identity provider and only its hash is stored
+create table if not exists public.saml_request
+(
+    relay_state_hash varchar(64)  not null primary key,
+    connection_id   varchar(64)   not null
+        constraint saml_request_connection_id_fk
+            references public.saml_connection
+            on delete cascade,
+    request_id      varchar(64)   not null,
+    expires_at      timestamp     not null,
+    used_at         timestamp,
+    created_at      timestamp default now() not null
+);
+
+create type public.device_authorization_status as enum ('pending', 'approved', 'denied');
+
+-- Device authorization grant requests of TVs and CLIs, RFC 8628, only hashes of the codes are stored
+create table if not exists public.device_authorization
+(
+    device_code_hash varchar(64)  not null primary key,
+    user_code_hash  varchar(64)   not null
+        constraint device_authorization_user_code_hash
+            unique,
+    device_id       uuid          not null,
+    installation_id uuid          not null,
+    -- Shown to the user approving the request
+    device_name     varchar(256)  not null,
+    status          public.device_authorization_status default 'pending' not null,
+    user_id         uuid
+        constraint device_authorization_user_id_fk
+            references public."user"
+            on delete cascade,
+    last_polled_at  timestamp,
+    expires_at      timestamp     not null,
+    used_at         timestamp,
+    created_at      timestamp default now() not null
+);
+
+-- Security relevant actions, e.g. impersonation, actor and subject emails are kept when users are deleted
+create table if not exists public.audit_log
+(
+    id              uuid          not null primary key,
+    action          varchar(64)   not null,
+    actor_id        uuid,
+    actor_email     varchar(256),
+    subject_id      uuid,
+    subject_email   varchar(256),
+    details         jsonb     default '{}'  not null,
+    created_at      timestamp default now() not null
+);
+create index audit_log_created_at_idx on public.audit_log(created_at);
+create index audit_log_subject_id_idx on public.audit_log(subject_id);
+
+-- Long-lived tokens of users for scripts, not tied to a device session, only hashes are stored
+create table if not exists public.personal_access_token
+(
+    id              uuid          not null primary key,
+    user_id         uuid          not null
+        constraint personal_access_token_user_id_fk
+            references public."user"
+            on delete cascade,
+    name            varchar(256)  not null,
+    token_hash      varchar(64)   not null
+        constraint personal_access_token_token_hash
+            unique,
+    scopes          text[]        not null,
+    -- Tokens without expiration are valid until revoked
+    expires_at      timestamp,
+    last_used_at    timestamp,
+    revoked_at      timestamp,
+    created_at      timestamp default now() not null
+);
+create index personal_access_token_user_id_idx on public.personal_access_token(user_id);
+
+-- Non-human principals of other services, they have a role but no email or password
+create table if not exists public.service_account
+(
+    id              uuid          not null primary key,
+    role            user_role     not null,
+    name            varchar(256)  not null,
+    description     varchar(1024),
+    deleted_at      timestamp,
+    created_at      timestamp default now() not null
+);
+
+create type public.service_account_key_type as enum ('public_key', 'secret');
+alter type public.service_account_key_type owner to admin;
+
+-- Credentials of service accounts, PEM public keys verifying signed assertions or bcrypt hashes of client secrets
+create table if not exists public.service_account_key
+(
+    id                  uuid                      not null primary key,
+    service_account_id  uuid                      not null
+        constraint service_account_key_service_account_id_fk
+            references public.service_account
+            on delete cascade,
+    type                service_account_key_type  not null,
+    public_key          text,
+    secret_hash         varchar(512),
+    last_used_at        timestamp,
+    revoked_at          timestamp,
+    created_at          timestamp default now() not null,
+    constraint service_account_key_credential
+        check ((type = 'public_key' and public_key is not null) or (type = 'secret' and secret_hash is not null))
+);
+create index service_account_key_service_account_id_idx on public.service_account_key(service_account_id);
+
+-- Ids of accepted assertions, kept until the assertion expires so it is never replayed
+create table if not exists public.service_account_assertion
+(
+    service_account_id  uuid          not null
+        constraint service_account_assertion_service_account_id_fk
+            references public.service_account
+            on delete cascade,
+    jti                 varchar(256)  not null,
+    expires_at          timestamp     not null,
+    primary key (service_account_id, jti)
+);
+create index service_account_assertion_expires_at_idx on public.service_account_assertion(expires_at);
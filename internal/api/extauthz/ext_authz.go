@@ -0,0 +1,234 @@
+package ext_authz
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/rs/zerolog"
+	jwt_interceptor "github.com/zs-dima/auth-service/internal/api/interceptor"
+	tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Headers injected into requests passed to upstreams, the same headers sent by the client are removed.
+const (
+	HeaderUserId         = "x-user-id"
+	HeaderUserRole       = "x-user-role"
+	HeaderUserEmail      = "x-user-email"
+	HeaderClientId       = "x-client-id"
+	HeaderScopes         = "x-scopes"
+	HeaderImpersonatorId = "x-impersonator-id"
+	// HeaderPrincipal is `user`, `service_account` or `client`
+	HeaderPrincipal = "x-principal"
+)
+
+var identityHeaders = []string{
+	HeaderUserId,
+	HeaderUserRole,
+	HeaderUserEmail,
+	HeaderClientId,
+	HeaderScopes,
+	HeaderImpersonatorId,
+	HeaderPrincipal,
+}
+
+// Context extensions of Envoy routes, set by `check_settings` of the ext_authz per route config.
+const (
+	// ExtensionRole is the comma separated list of roles allowed by the route.
+	ExtensionRole = "role"
+	// ExtensionMaxAuthAge is the maximum time since the user signed in, e.g. `10m`.
+	ExtensionMaxAuthAge = "max_auth_age"
+)
+
+// AuthorizationServer implements the Envoy external authorization service `envoy.service.auth.v3.Authorization`,
+// it validates user tokens, personal access tokens and service tokens for all upstreams behind Envoy.
+type AuthorizationServer struct {
+	authv3.UnimplementedAuthorizationServer
+
+	options *jwt_interceptor.JwtInterceptorOptions
+	log     *zerolog.Logger
+}
+
+func NewAuthorizationServer(options *jwt_interceptor.JwtInterceptorOptions, log *zerolog.Logger) *AuthorizationServer {
+	return &AuthorizationServer{
+		options: options,
+		log:     log,
+	}
+}
+
+// Check allows the request with identity headers of the caller, or denies it with 401 or 403.
+func (s *AuthorizationServer) Check(ctx context.Context, request *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	httpRequest := request.GetAttributes().GetRequest().GetHttp()
+	extensions := request.GetAttributes().GetContextExtensions()
+	target := httpRequest.GetMethod() + " " + httpRequest.GetHost() + httpRequest.GetPath()
+
+	// Envoy sends header names in lower case
+	tokenStr, _ := jwt_interceptor.BearerToken(httpRequest.GetHeaders()["authorization"])
+
+	authInfo, denial, err := verify(ctx, s.options, tokenStr, extensions[ExtensionRole], extensions[ExtensionMaxAuthAge])
+	if err != nil {
+		return nil, fmt.Errorf("invalid route context extensions: %w", err)
+	}
+	if denial != nil {
+		s.log.Info().Msgf("Denied %s, %s", target, denial.message)
+		return denied(denial), nil
+	}
+
+	s.log.Debug().Msgf("Allowed %s to %s", target, authInfo.Principal())
+
+	return allowed(authInfo), nil
+}
+
+// denial is the reason the request is not allowed.
+type denial struct {
+	code       codes.Code
+	httpStatus int
+	// challenge is the `WWW-Authenticate` header of 401 responses
+	challenge string
+	message   string
+}
+
+// verify authenticates the token and checks the roles and the maximum sign in age required by the route, both are optional.
+// The error is returned for invalid route settings only.
+func verify(ctx context.Context, options *jwt_interceptor.JwtInterceptorOptions, tokenStr string, roles string, maxAuthAge string) (*tool.JwtAuthInfo, *denial, error) {
+	if tokenStr == "" {
+		return nil, &denial{codes.Unauthenticated, http.StatusUnauthorized, `Bearer`, "missing bearer token"}, nil
+	}
+
+	authInfo, err := jwt_interceptor.Authenticate(ctx, options, tokenStr)
+	if err != nil {
+		return nil, &denial{codes.Unauthenticated, http.StatusUnauthorized, `Bearer error="invalid_token"`, "invalid token"}, nil
+	}
+	principal := authInfo.Principal()
+
+	if roles != "" && !hasRole(authInfo, roles) {
+		return nil, &denial{codes.PermissionDenied, http.StatusForbidden, "", fmt.Sprintf("role %s is required, %s", roles, principal)}, nil
+	}
+
+	if maxAuthAge != "" {
+		maxAge, err := time.ParseDuration(maxAuthAge)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s %s: %w", ExtensionMaxAuthAge, maxAuthAge, err)
+		}
+		// Same as the step-up policy of the service, personal access tokens, service accounts and clients can not re-authenticate
+		if !jwt_interceptor.IsUserSession(authInfo) {
+			return nil, &denial{codes.PermissionDenied, http.StatusForbidden, "", fmt.Sprintf("recent sign in of a user session is required, %s", principal)}, nil
+		}
+		if time.Since(authInfo.AuthTime) > maxAge {
+			return nil, &denial{
+				codes.Unauthenticated,
+				http.StatusUnauthorized,
+				fmt.Sprintf(`Bearer error="insufficient_user_authentication", max_age=%d`, int(maxAge.Seconds())),
+				fmt.Sprintf("re-authentication required, %s", principal),
+			}, nil
+		}
+	}
+
+	return authInfo, nil, nil
+}
+
+func hasRole(authInfo *tool.JwtAuthInfo, roles string) bool {
+	if authInfo.UserInfo == nil {
+		return false
+	}
+	for _, role := range strings.Split(roles, ",") {
+		if strings.TrimSpace(role) == string(authInfo.UserInfo.Role) {
+			return true
+		}
+	}
+	return false
+}
+
+// identity returns the identity headers of the caller, headers not applicable to the caller are missing.
+func identity(authInfo *tool.JwtAuthInfo) map[string]string {
+	values := map[string]string{}
+	switch {
+	case authInfo.ClientInfo != nil:
+		values[HeaderPrincipal] = tool.PrincipalClient
+		values[HeaderClientId] = authInfo.ClientInfo.Id
+		values[HeaderScopes] = strings.Join(authInfo.ClientInfo.Scopes, " ")
+	case authInfo.UserInfo != nil && authInfo.UserInfo.ServiceAccount:
+		values[HeaderPrincipal] = tool.PrincipalServiceAccount
+	default:
+		values[HeaderPrincipal] = "user"
+	}
+	if authInfo.UserInfo != nil {
+		values[HeaderUserId] = authInfo.UserInfo.Id.String()
+		values[HeaderUserRole] = string(authInfo.UserInfo.Role)
+		if authInfo.UserInfo.Email != "" {
+			values[HeaderUserEmail] = authInfo.UserInfo.Email
+		}
+	}
+	if authInfo.PatInfo != nil {
+		values[HeaderScopes] = strings.Join(authInfo.PatInfo.Scopes, " ")
+	}
+	if authInfo.Impersonator != nil {
+		values[HeaderImpersonatorId] = authInfo.Impersonator.Id.String()
+	}
+	return values
+}
+
+func allowed(authInfo *tool.JwtAuthInfo) *authv3.CheckResponse {
+	values := identity(authInfo)
+
+	headers := []*corev3.HeaderValueOption{}
+	headersToRemove := []string{}
+	for _, name := range identityHeaders {
+		value, ok := values[name]
+		if !ok {
+			// Headers sent by the client never reach upstreams
+			headersToRemove = append(headersToRemove, name)
+			continue
+		}
+		headers = append(headers, header(name, value))
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{
+			OkResponse: &authv3.OkHttpResponse{
+				Headers:         headers,
+				HeadersToRemove: headersToRemove,
+			},
+		},
+	}
+}
+
+func denied(denial *denial) *authv3.CheckResponse {
+	headers := []*corev3.HeaderValueOption{header("content-type", "application/json")}
+	if denial.challenge != "" {
+		headers = append(headers, header("www-authenticate", denial.challenge))
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(denial.code), Message: denial.message},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(denial.httpStatus)},
+				Headers: headers,
+				Body:    denialBody(denial),
+			},
+		},
+	}
+}
+
+// denialBody does not name the caller, the message is logged only.
+func denialBody(denial *denial) string {
+	return fmt.Sprintf(`{"code":%d,"message":%q}`, denial.httpStatus, http.StatusText(denial.httpStatus))
+}
+
+// header overwrites the header of the same name.
+func header(name string, value string) *corev3.HeaderValueOption {
+	return &corev3.HeaderValueOption{
+		Header: &corev3.HeaderValue{Key: name, Value: value},
+		Append: wrapperspb.Bool(false),
+	}
+}
@@ -0,0 +1,250 @@
+package ext_authz
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	jwt_interceptor "github.com/zs-dima/auth-service/internal/api/interceptor"
+	tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/grpc/codes"
+)
+
+const testSecretKey = "test-secret"
+
+func testOptions() *jwt_interceptor.JwtInterceptorOptions {
+	return &jwt_interceptor.JwtInterceptorOptions{SecretKey: testSecretKey}
+}
+
+// testToken signs a user token of the role, claims override the defaults.
+func testToken(t *testing.T, role string, claims jwt.MapClaims) string {
+	t.Helper()
+	defaults := jwt.MapClaims{
+		"iss":          tool.Issuer,
+		"aud":          tool.Audience,
+		"exp":          time.Now().Add(time.Hour).Unix(),
+		"userId":       uuid.New().String(),
+		"userEmail":    role + "@example.com",
+		"role":         role,
+		"device":       uuid.New().String(),
+		"installation": uuid.New().String(),
+		"auth_time":    time.Now().Unix(),
+	}
+	for name, value := range claims {
+		defaults[name] = value
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, defaults).SignedString([]byte(testSecretKey))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func checkRequest(authorization string, extensions map[string]string) *authv3.CheckRequest {
+	headers := map[string]string{
+		// Forged identity headers of the client
+		HeaderUserRole:       "administrator",
+		HeaderImpersonatorId: uuid.New().String(),
+	}
+	if authorization != "" {
+		headers["authorization"] = authorization
+	}
+	return &authv3.CheckRequest{
+		Attributes: &authv3.AttributeContext{
+			Request: &authv3.AttributeContext_Request{
+				Http: &authv3.AttributeContext_HttpRequest{
+					Method:  http.MethodGet,
+					Host:    "api.example.com",
+					Path:    "/orders",
+					Headers: headers,
+				},
+			},
+			ContextExtensions: extensions,
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	log := zerolog.Nop()
+	server := NewAuthorizationServer(testOptions(), &log)
+	oldSignIn := jwt.MapClaims{"auth_time": time.Now().Add(-time.Hour).Unix()}
+	impersonation := jwt.MapClaims{"act": map[string]any{"sub": uuid.New().String(), "userEmail": "admin@example.com"}}
+
+	tests := []struct {
+		name       string
+		request    *authv3.CheckRequest
+		code       codes.Code
+		httpStatus int
+		challenge  string
+		// headers set for upstreams, others of the identity headers are removed
+		headers []string
+	}{
+		{
+			name:       "missing token",
+			request:    checkRequest("", nil),
+			code:       codes.Unauthenticated,
+			httpStatus: http.StatusUnauthorized,
+			challenge:  `Bearer`,
+		},
+		{
+			name:       "invalid token",
+			request:    checkRequest("Bearer abc", nil),
+			code:       codes.Unauthenticated,
+			httpStatus: http.StatusUnauthorized,
+			challenge:  `Bearer error="invalid_token"`,
+		},
+		{
+			name:    "user",
+			request: checkRequest("Bearer "+testToken(t, "user", nil), nil),
+			code:    codes.OK,
+			headers: []string{HeaderPrincipal, HeaderUserId, HeaderUserRole, HeaderUserEmail},
+		},
+		{
+			name:    "impersonation",
+			request: checkRequest("Bearer "+testToken(t, "user", impersonation), nil),
+			code:    codes.OK,
+			headers: []string{HeaderPrincipal, HeaderUserId, HeaderUserRole, HeaderUserEmail, HeaderImpersonatorId},
+		},
+		{
+			name:    "role of the route",
+			request: checkRequest("Bearer "+testToken(t, "user", nil), map[string]string{ExtensionRole: "administrator, user"}),
+			code:    codes.OK,
+			headers: []string{HeaderPrincipal, HeaderUserId, HeaderUserRole, HeaderUserEmail},
+		},
+		{
+			name:       "other role",
+			request:    checkRequest("Bearer "+testToken(t, "user", nil), map[string]string{ExtensionRole: "administrator"}),
+			code:       codes.PermissionDenied,
+			httpStatus: http.StatusForbidden,
+		},
+		{
+			name:    "recent sign in",
+			request: checkRequest("Bearer "+testToken(t, "user", nil), map[string]string{ExtensionMaxAuthAge: "10m"}),
+			code:    codes.OK,
+			headers: []string{HeaderPrincipal, HeaderUserId, HeaderUserRole, HeaderUserEmail},
+		},
+		{
+			name:       "old sign in",
+			request:    checkRequest("Bearer "+testToken(t, "user", oldSignIn), map[string]string{ExtensionMaxAuthAge: "10m"}),
+			code:       codes.Unauthenticated,
+			httpStatus: http.StatusUnauthorized,
+			challenge:  `Bearer error="insufficient_user_authentication", max_age=600`,
+		},
+		{
+			name:       "service account on recent sign in route",
+			request:    checkRequest("Bearer "+testToken(t, "user", jwt.MapClaims{"principal": tool.PrincipalServiceAccount}), map[string]string{ExtensionMaxAuthAge: "10m"}),
+			code:       codes.PermissionDenied,
+			httpStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response, err := server.Check(context.Background(), test.request)
+			if err != nil {
+				t.Fatalf("failed to check: %v", err)
+			}
+
+			if code := codes.Code(response.Status.Code); code != test.code {
+				t.Fatalf("got %s, want %s: %s", code, test.code, response.Status.Message)
+			}
+
+			if test.code != codes.OK {
+				deniedResponse := response.GetDeniedResponse()
+				if int(deniedResponse.GetStatus().GetCode()) != test.httpStatus {
+					t.Fatalf("got status %d, want %d", deniedResponse.GetStatus().GetCode(), test.httpStatus)
+				}
+				challenge := ""
+				for _, header := range deniedResponse.Headers {
+					if header.Header.Key == "www-authenticate" {
+						challenge = header.Header.Value
+					}
+				}
+				if challenge != test.challenge {
+					t.Fatalf("got challenge %q, want %q", challenge, test.challenge)
+				}
+				return
+			}
+
+			okResponse := response.GetOkResponse()
+			set := map[string]string{}
+			for _, header := range okResponse.Headers {
+				set[header.Header.Key] = header.Header.Value
+			}
+			for _, name := range test.headers {
+				if set[name] == "" {
+					t.Errorf("header %s is not set", name)
+				}
+			}
+			if len(set) != len(test.headers) {
+				t.Errorf("got headers %v, want %v", set, test.headers)
+			}
+			// Every identity header not set is removed, so forged headers never reach upstreams
+			if len(okResponse.HeadersToRemove)+len(set) != len(identityHeaders) {
+				t.Errorf("got headers to remove %v, want the rest of %v", okResponse.HeadersToRemove, identityHeaders)
+			}
+			if set[HeaderUserRole] != "user" {
+				t.Errorf("got role %q, want user", set[HeaderUserRole])
+			}
+		})
+	}
+}
+
+func TestCheckInvalidRoute(t *testing.T) {
+	log := zerolog.Nop()
+	server := NewAuthorizationServer(testOptions(), &log)
+
+	request := checkRequest("Bearer "+testToken(t, "user", nil), map[string]string{ExtensionMaxAuthAge: "ten minutes"})
+	if _, err := server.Check(context.Background(), request); err == nil {
+		t.Fatal("invalid max_auth_age of the route is accepted")
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	userId := uuid.New()
+
+	tests := []struct {
+		name     string
+		authInfo *tool.JwtAuthInfo
+		want     map[string]string
+	}{
+		{
+			"client",
+			&tool.JwtAuthInfo{ClientInfo: &tool.JwtClientInfo{Id: "billing", Scopes: []string{"users:read", "users:write"}}},
+			map[string]string{HeaderPrincipal: tool.PrincipalClient, HeaderClientId: "billing", HeaderScopes: "users:read users:write"},
+		},
+		{
+			"service account",
+			&tool.JwtAuthInfo{UserInfo: &tool.JwtUserInfo{Id: &userId, Role: "user", ServiceAccount: true}},
+			map[string]string{HeaderPrincipal: tool.PrincipalServiceAccount, HeaderUserId: userId.String(), HeaderUserRole: "user"},
+		},
+		{
+			"personal access token",
+			&tool.JwtAuthInfo{
+				UserInfo: &tool.JwtUserInfo{Id: &userId, Role: "user", Email: "user@example.com"},
+				PatInfo:  &tool.JwtPatInfo{Id: uuid.New(), Scopes: []string{"users:read"}},
+			},
+			map[string]string{HeaderPrincipal: "user", HeaderUserId: userId.String(), HeaderUserRole: "user", HeaderUserEmail: "user@example.com", HeaderScopes: "users:read"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			headers := identity(test.authInfo)
+
+			if len(headers) != len(test.want) {
+				t.Fatalf("got %v, want %v", headers, test.want)
+			}
+			for name, value := range test.want {
+				if headers[name] != value {
+					t.Errorf("got %s %q, want %q", name, headers[name], value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package ext_authz
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog"
+	jwt_interceptor "github.com/zs-dima/auth-service/internal/api/interceptor"
+)
+
+// VerifyPath is the forward auth endpoint of Traefik `forwardAuth` and nginx `auth_request`.
+const VerifyPath = "/auth/verify"
+
+// Query parameters of the verify endpoint, the same as context extensions of Envoy routes.
+const (
+	// QueryRole is the comma separated list of roles allowed by the route.
+	QueryRole = ExtensionRole
+	// QueryMaxAuthAge is the maximum time since the user signed in, e.g. `10m`.
+	QueryMaxAuthAge = ExtensionMaxAuthAge
+)
+
+// ForwardAuth verifies requests forwarded by reverse proxies over plain HTTP,
+// it responds 200 with identity headers of the caller, 401 or 403.
+type ForwardAuth struct {
+	options *jwt_interceptor.JwtInterceptorOptions
+	// cookie is the name of the session cookie holding the access token of browsers
+	cookie string
+	log    *zerolog.Logger
+}
+
+func NewForwardAuth(options *jwt_interceptor.JwtInterceptorOptions, cookie string, log *zerolog.Logger) *ForwardAuth {
+	return &ForwardAuth{
+		options: options,
+		cookie:  cookie,
+		log:     log,
+	}
+}
+
+func (f *ForwardAuth) Register(mux *http.ServeMux) {
+	mux.HandleFunc(VerifyPath, f.handleVerify)
+}
+
+// handleVerify accepts any method, proxies forward the method of the original request.
+func (f *ForwardAuth) handleVerify(w http.ResponseWriter, r *http.Request) {
+	target := originalRequest(r)
+
+	authInfo, denial, err := verify(r.Context(), f.options, f.token(r), r.URL.Query().Get(QueryRole), r.URL.Query().Get(QueryMaxAuthAge))
+	if err != nil {
+		f.log.Error().Msgf("Failed to verify %s: %v", target, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if denial != nil {
+		f.log.Info().Msgf("Denied %s, %s", target, denial.message)
+		if denial.challenge != "" {
+			w.Header().Set("WWW-Authenticate", denial.challenge)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(denial.httpStatus)
+		_, _ = w.Write([]byte(denialBody(denial)))
+		return
+	}
+
+	for name, value := range identity(authInfo) {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	f.log.Debug().Msgf("Allowed %s to %s", target, authInfo.Principal())
+}
+
+// token takes the Bearer token of the Authorization header, otherwise the session cookie.
+func (f *ForwardAuth) token(r *http.Request) string {
+	if tokenStr, ok := jwt_interceptor.BearerToken(r.Header.Get("Authorization")); ok {
+		return tokenStr
+	}
+	if f.cookie == "" {
+		return ""
+	}
+	cookie, err := r.Cookie(f.cookie)
+	if err != nil {
+		return ""
+	}
+	return cookie.Value
+}
+
+// originalRequest describes the proxied request by headers of Traefik and of the nginx configuration in docs/forward-auth.md.
+func originalRequest(r *http.Request) string {
+	method := r.Header.Get("X-Forwarded-Method")
+	if method == "" {
+		method = r.Method
+	}
+	return method + " " + r.Header.Get("X-Forwarded-Host") + r.Header.Get("X-Forwarded-Uri")
+}
@@ -0,0 +1,86 @@
+package ext_authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/rs/zerolog"
+)
+
+func TestHandleVerify(t *testing.T) {
+	log := zerolog.Nop()
+	forwardAuth := NewForwardAuth(testOptions(), "session", &log)
+	withoutCookie := NewForwardAuth(testOptions(), "", &log)
+	token := testToken(t, "user", nil)
+	oldSignIn := testToken(t, "user", jwt.MapClaims{"auth_time": time.Now().Add(-time.Hour).Unix()})
+
+	tests := []struct {
+		name          string
+		forwardAuth   *ForwardAuth
+		query         string
+		authorization string
+		cookie        string
+		status        int
+		challenge     string
+	}{
+		{name: "bearer token", forwardAuth: forwardAuth, authorization: "Bearer " + token, status: http.StatusOK},
+		{name: "session cookie", forwardAuth: forwardAuth, cookie: token, status: http.StatusOK},
+		{name: "bearer token before cookie", forwardAuth: forwardAuth, authorization: "Bearer " + token, cookie: "abc", status: http.StatusOK},
+		{name: "cookie not configured", forwardAuth: withoutCookie, cookie: token, status: http.StatusUnauthorized, challenge: `Bearer`},
+		{name: "missing token", forwardAuth: forwardAuth, status: http.StatusUnauthorized, challenge: `Bearer`},
+		{name: "invalid token", forwardAuth: forwardAuth, authorization: "Bearer abc", status: http.StatusUnauthorized, challenge: `Bearer error="invalid_token"`},
+		{name: "role of the route", forwardAuth: forwardAuth, query: "?role=administrator,user", authorization: "Bearer " + token, status: http.StatusOK},
+		{name: "other role", forwardAuth: forwardAuth, query: "?role=administrator", authorization: "Bearer " + token, status: http.StatusForbidden},
+		{
+			name:          "old sign in",
+			forwardAuth:   forwardAuth,
+			query:         "?max_auth_age=10m",
+			authorization: "Bearer " + oldSignIn,
+			status:        http.StatusUnauthorized,
+			challenge:     `Bearer error="insufficient_user_authentication", max_age=600`,
+		},
+		{name: "invalid max_auth_age", forwardAuth: forwardAuth, query: "?max_auth_age=ten", authorization: "Bearer " + token, status: http.StatusInternalServerError},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, VerifyPath+test.query, nil)
+			request.Header.Set("X-Forwarded-Method", http.MethodPost)
+			request.Header.Set("X-Forwarded-Uri", "/orders")
+			if test.authorization != "" {
+				request.Header.Set("Authorization", test.authorization)
+			}
+			if test.cookie != "" {
+				request.AddCookie(&http.Cookie{Name: "session", Value: test.cookie})
+			}
+			recorder := httptest.NewRecorder()
+
+			test.forwardAuth.handleVerify(recorder, request)
+
+			response := recorder.Result()
+			if response.StatusCode != test.status {
+				t.Fatalf("got status %d, want %d: %s", response.StatusCode, test.status, recorder.Body.String())
+			}
+			if challenge := response.Header.Get("WWW-Authenticate"); challenge != test.challenge {
+				t.Fatalf("got challenge %q, want %q", challenge, test.challenge)
+			}
+			if test.status == http.StatusInternalServerError {
+				return
+			}
+			if cacheControl := response.Header.Get("Cache-Control"); cacheControl != "no-store" {
+				t.Errorf("got Cache-Control %q, want no-store", cacheControl)
+			}
+
+			// Identity headers are only set for allowed requests
+			if allowed := response.Header.Get(HeaderUserId) != ""; allowed != (test.status == http.StatusOK) {
+				t.Errorf("got identity headers %v for status %d", response.Header, response.StatusCode)
+			}
+			if test.status == http.StatusOK && response.Header.Get(HeaderUserRole) != "user" {
+				t.Errorf("got role %q, want user", response.Header.Get(HeaderUserRole))
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package jwt_interceptor
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,18 +12,46 @@ import (
 	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
 
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
+// PersonalAccessTokenAuthenticator resolves personal access tokens sent as `Bearer` tokens.
+type PersonalAccessTokenAuthenticator interface {
+	IsPersonalAccessToken(token string) bool
+	Authenticate(ctx context.Context, token string) (*tool.JwtUserInfo, *tool.JwtPatInfo, error)
+}
+
+// StepUpRequiredReason is the ErrorInfo reason of methods called too long after sign in,
+// the client calls Reauthenticate and retries the call with the new access token.
+const StepUpRequiredReason = "STEP_UP_REQUIRED"
+
 type JwtInterceptorOptions struct {
 	SecretKey      string
 	AllowedMethods []string
+	// ClientSigningKey verifies RS256 service tokens issued to OAuth clients by the client credentials grant.
+	// Service tokens are rejected when it is nil.
+	ClientSigningKey *tool.SigningKey
+	ClientIssuer     string
+	// ClientMethods maps methods callable by OAuth clients to the required scope.
+	ClientMethods map[string]string
+	// ImpersonationDeniedMethods change the account or the session, they are not callable with impersonation tokens.
+	ImpersonationDeniedMethods []string
+	// PersonalAccessTokens are rejected when it is nil.
+	PersonalAccessTokens PersonalAccessTokenAuthenticator
+	// PersonalAccessTokenMethods maps methods callable with personal access tokens to the required scope.
+	PersonalAccessTokenMethods map[string]string
+	// ServiceAccountDeniedMethods need a human user, they are not callable with service account tokens.
+	ServiceAccountDeniedMethods []string
+	// MaxAuthAge maps sensitive methods to the maximum time since the user signed in.
+	// Only user sessions call them, clients, personal access tokens and service accounts can not re-authenticate.
+	MaxAuthAge map[string]time.Duration
 }
 
-func validate(ctx context.Context, secretKey string) (context.Context, error) {
+func validate(ctx context.Context, options *JwtInterceptorOptions, method string) (context.Context, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
 		return ctx, status.Errorf(codes.Unauthenticated, "missing context metadata")
@@ -32,11 +61,40 @@ func validate(ctx context.Context, secretKey string) (context.Context, error) {
 		return ctx, status.Errorf(codes.Unauthenticated, "missing JWT token")
 	}
 
-	parts := strings.Split(tokenData[0], " ")
-	if len(parts) != 2 || parts[0] != "Bearer" {
+	tokenStr, ok := BearerToken(tokenData[0])
+	if !ok {
 		return ctx, status.Errorf(codes.Unauthenticated, "malformatted JWT token, %v", tokenData)
 	}
-	tokenStr := parts[1]
+
+	authInfo, err := Authenticate(ctx, options, tokenStr)
+	if err != nil {
+		return ctx, err
+	}
+	if err := authorize(options, method, authInfo); err != nil {
+		return ctx, err
+	}
+
+	return context.WithValue(ctx, tool.UserClaimsKey, authInfo), nil
+}
+
+// BearerToken returns the token of the `Bearer <token>` authorization header.
+func BearerToken(authorization string) (string, bool) {
+	parts := strings.Split(authorization, " ")
+	if len(parts) != 2 || parts[0] != "Bearer" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// Authenticate resolves personal access tokens, RS256 service tokens of OAuth clients and HS256 user tokens
+// to the caller, methods are not checked.
+func Authenticate(ctx context.Context, options *JwtInterceptorOptions, tokenStr string) (*tool.JwtAuthInfo, error) {
+	if options.PersonalAccessTokens != nil && options.PersonalAccessTokens.IsPersonalAccessToken(tokenStr) {
+		return authenticatePersonalAccessToken(ctx, options, tokenStr)
+	}
+	if options.ClientSigningKey != nil && isClientToken(tokenStr) {
+		return authenticateClient(options, tokenStr)
+	}
 
 	claims := &jwt.MapClaims{}
 	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
@@ -45,7 +103,7 @@ func validate(ctx context.Context, secretKey string) (context.Context, error) {
 			return nil, status.Errorf(codes.Unauthenticated, "unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(secretKey), nil
+		return []byte(options.SecretKey), nil
 	})
 
 	iss, _ := (*claims)["iss"].(string)
@@ -58,15 +116,119 @@ func validate(ctx context.Context, secretKey string) (context.Context, error) {
 		iss != tool.Issuer ||
 		aud != tool.Audience ||
 		int64(exp) < time.Now().Unix() {
-		return ctx, status.Errorf(codes.Unauthenticated, "unauthenticated")
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
 	}
 
 	authInfo, err := extractAuthInfo(claims)
 	if err != nil {
-		return ctx, status.Errorf(codes.Unauthenticated, "unauthenticated")
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
 	}
+	return authInfo, nil
+}
 
-	return context.WithValue(ctx, tool.UserClaimsKey, authInfo), nil
+// authorize checks the method is allowed to the caller, by scopes of clients and personal access tokens
+// and by the deny lists and the step-up policy of users.
+func authorize(options *JwtInterceptorOptions, method string, authInfo *tool.JwtAuthInfo) error {
+	if _, ok := options.MaxAuthAge[method]; ok && !IsUserSession(authInfo) {
+		return status.Errorf(codes.PermissionDenied, "%s requires a recent sign in of a user session", method)
+	}
+
+	if authInfo.ClientInfo != nil {
+		requiredScope, ok := options.ClientMethods[method]
+		if !ok || !contains(authInfo.ClientInfo.Scopes, requiredScope) {
+			return status.Errorf(codes.PermissionDenied, "client %s is not allowed to call %s", authInfo.ClientInfo.Id, method)
+		}
+		return nil
+	}
+	if authInfo.PatInfo != nil {
+		requiredScope, ok := options.PersonalAccessTokenMethods[method]
+		if !ok || !contains(authInfo.PatInfo.Scopes, requiredScope) {
+			return status.Errorf(codes.PermissionDenied, "personal access token %s is not allowed to call %s", authInfo.PatInfo.Id, method)
+		}
+		return nil
+	}
+
+	if authInfo.Impersonator != nil && contains(options.ImpersonationDeniedMethods, method) {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed while impersonating", method)
+	}
+	if authInfo.UserInfo.ServiceAccount && contains(options.ServiceAccountDeniedMethods, method) {
+		return status.Errorf(codes.PermissionDenied, "%s is not allowed to service accounts", method)
+	}
+	if maxAge, ok := options.MaxAuthAge[method]; ok && time.Since(authInfo.AuthTime) > maxAge {
+		return stepUpRequired(method, maxAge)
+	}
+	return nil
+}
+
+// IsUserSession tells whether the caller signed in as a user, clients, personal access tokens and service accounts did not.
+func IsUserSession(authInfo *tool.JwtAuthInfo) bool {
+	return authInfo.ClientInfo == nil &&
+		authInfo.PatInfo == nil &&
+		authInfo.UserInfo != nil &&
+		!authInfo.UserInfo.ServiceAccount
+}
+
+// stepUpRequired tells the client to re-authenticate, the maximum age is in seconds.
+func stepUpRequired(method string, maxAge time.Duration) error {
+	st, err := status.
+		New(codes.Unauthenticated, "Re-authentication required").
+		WithDetails(&errdetails.ErrorInfo{
+			Reason: StepUpRequiredReason,
+			Domain: tool.Issuer,
+			Metadata: map[string]string{
+				"method":  method,
+				"max_age": strconv.Itoa(int(maxAge.Seconds())),
+			},
+		})
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "re-authentication required")
+	}
+	return st.Err()
+}
+
+// isClientToken tells apart RS256 service tokens from HS256 user tokens without verifying the signature.
+func isClientToken(tokenStr string) bool {
+	parser := jwt.Parser{}
+	token, _, err := parser.ParseUnverified(tokenStr, &jwt.MapClaims{})
+	return err == nil && token.Method.Alg() == jwt.SigningMethodRS256.Alg()
+}
+
+func authenticateClient(options *JwtInterceptorOptions, tokenStr string) (*tool.JwtAuthInfo, error) {
+	claims := jwt.MapClaims{}
+	token, err := options.ClientSigningKey.Parse(tokenStr, claims)
+
+	principal, _ := claims["principal"].(string)
+	clientId, _ := claims["client_id"].(string)
+	scope, _ := claims["scope"].(string)
+
+	if err != nil ||
+		token == nil ||
+		!token.Valid ||
+		principal != tool.PrincipalClient ||
+		clientId == "" ||
+		!claims.VerifyIssuer(options.ClientIssuer, true) ||
+		!claims.VerifyAudience(tool.Audience, true) {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+
+	return &tool.JwtAuthInfo{
+		ClientInfo: &tool.JwtClientInfo{
+			Id:     clientId,
+			Scopes: strings.Fields(scope),
+		},
+	}, nil
+}
+
+func authenticatePersonalAccessToken(ctx context.Context, options *JwtInterceptorOptions, tokenStr string) (*tool.JwtAuthInfo, error) {
+	userInfo, patInfo, err := options.PersonalAccessTokens.Authenticate(ctx, tokenStr)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "unauthenticated")
+	}
+
+	return &tool.JwtAuthInfo{
+		UserInfo: userInfo,
+		PatInfo:  patInfo,
+	}, nil
 }
 
 type wrappedStream struct {
@@ -84,7 +246,7 @@ func StreamServerInterceptor(options *JwtInterceptorOptions) grpc.StreamServerIn
 			return handler(srv, stream)
 		}
 
-		newCtx, err := validate(stream.Context(), options.SecretKey)
+		newCtx, err := validate(stream.Context(), options, info.FullMethod)
 		if err != nil {
 			return err
 		}
@@ -100,7 +262,7 @@ func UnaryServerInterceptor(options *JwtInterceptorOptions) grpc.UnaryServerInte
 			return handler(ctx, req)
 		}
 
-		newCtx, err := validate(ctx, options.SecretKey)
+		newCtx, err := validate(ctx, options, info.FullMethod)
 
 		if err != nil {
 			return nil, err
@@ -124,6 +286,10 @@ func extractAuthInfo(claims *jwt.MapClaims) (*tool.JwtAuthInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+	// Service accounts sign in without device sessions
+	if userInfo.ServiceAccount {
+		return &tool.JwtAuthInfo{UserInfo: userInfo}, nil
+	}
 
 	deviceIdStr, ok := (*claims)["device"].(string)
 	if !ok {
@@ -143,17 +309,66 @@ func extractAuthInfo(claims *jwt.MapClaims) (*tool.JwtAuthInfo, error) {
 		return nil, fmt.Errorf("failed to parse installation claim")
 	}
 
+	impersonator, err := extractImpersonator(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens issued before step-up authentication was introduced have no claims, they are treated as old sign ins
+	authTime := time.Time{}
+	if authTimeClaim, ok := (*claims)["auth_time"].(float64); ok {
+		authTime = time.Unix(int64(authTimeClaim), 0)
+	}
+	amr := []string{}
+	amrClaim, _ := (*claims)["amr"].([]interface{})
+	for _, method := range amrClaim {
+		if method, ok := method.(string); ok {
+			amr = append(amr, method)
+		}
+	}
+
 	return &tool.JwtAuthInfo{
 			UserInfo:       userInfo,
+			Impersonator:   impersonator,
 			DeviceId:       &deviceId,
 			InstallationId: &installationId,
+			AuthTime:       authTime,
+			Amr:            amr,
 		},
 		nil
 }
 
+// extractImpersonator returns the administrator of the `act` claim of impersonation tokens, nil for other tokens.
+func extractImpersonator(claims *jwt.MapClaims) (*tool.JwtUserInfo, error) {
+	act, ok := (*claims)["act"]
+	if !ok {
+		return nil, nil
+	}
+	actor, ok := act.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid act claim")
+	}
+
+	impersonatorIdStr, _ := actor["sub"].(string)
+	impersonatorId, err := uuid.Parse(impersonatorIdStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse act claim")
+	}
+	impersonatorEmail, _ := actor["userEmail"].(string)
+
+	return &tool.JwtUserInfo{
+		Id:    &impersonatorId,
+		Email: impersonatorEmail,
+	}, nil
+}
+
 func extractUserInfo(claims *jwt.MapClaims) (*tool.JwtUserInfo, error) {
+	principal, _ := (*claims)["principal"].(string)
+	serviceAccount := principal == tool.PrincipalServiceAccount
+
+	// Service accounts have no email
 	userEmail, ok := (*claims)["userEmail"].(string)
-	if !ok {
+	if !ok && !serviceAccount {
 		return nil, fmt.Errorf("no userEmail claim")
 	}
 	userIdStr, ok := (*claims)["userId"].(string)
@@ -170,9 +385,14 @@ func extractUserInfo(claims *jwt.MapClaims) (*tool.JwtUserInfo, error) {
 		return nil, fmt.Errorf("no roleId claim")
 	}
 
+	// Tokens issued before email verification was introduced have no claim
+	emailVerified, _ := (*claims)["email_verified"].(bool)
+
 	return &tool.JwtUserInfo{
-		Id:    &userId,
-		Role:  tool.JwtUserRole(role),
-		Email: userEmail,
+		Id:             &userId,
+		Role:           tool.JwtUserRole(role),
+		Email:          userEmail,
+		EmailVerified:  emailVerified,
+		ServiceAccount: serviceAccount,
 	}, nil
 }
@@ -0,0 +1,363 @@
+package jwt_interceptor
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testSecretKey    = "test-secret"
+	testStepUpMethod = "/auth.AuthService/UpdateUser"
+	testReadMethod   = "/auth.AuthService/LoadUsers"
+)
+
+type testPersonalAccessTokens struct {
+	scopes []string
+}
+
+func (p *testPersonalAccessTokens) IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, "pat_")
+}
+
+func (p *testPersonalAccessTokens) Authenticate(ctx context.Context, token string) (*tool.JwtUserInfo, *tool.JwtPatInfo, error) {
+	if token != "pat_valid" {
+		return nil, nil, fmt.Errorf("unknown token")
+	}
+	userId := uuid.New()
+	return &tool.JwtUserInfo{Id: &userId, Role: "administrator", Email: "admin@example.com"},
+		&tool.JwtPatInfo{Id: uuid.New(), Scopes: p.scopes},
+		nil
+}
+
+func testOptions() *JwtInterceptorOptions {
+	return &JwtInterceptorOptions{
+		SecretKey:            testSecretKey,
+		PersonalAccessTokens: &testPersonalAccessTokens{scopes: []string{"users:read", "users:write"}},
+		// The step-up method is mapped on purpose, the scope must not bypass the step-up policy
+		PersonalAccessTokenMethods: map[string]string{
+			testReadMethod:   "users:read",
+			testStepUpMethod: "users:write",
+		},
+		MaxAuthAge: map[string]time.Duration{
+			testStepUpMethod: 10 * time.Minute,
+		},
+	}
+}
+
+func signTestToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	claims["iss"] = tool.Issuer
+	claims["aud"] = tool.Audience
+	claims["exp"] = time.Now().Add(time.Hour).Unix()
+	claims["userId"] = uuid.New().String()
+	claims["role"] = "administrator"
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecretKey))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func userToken(t *testing.T, authTime time.Time) string {
+	return signTestToken(t, jwt.MapClaims{
+		"userEmail":    "admin@example.com",
+		"device":       uuid.New().String(),
+		"installation": uuid.New().String(),
+		"auth_time":    authTime.Unix(),
+	})
+}
+
+func serviceAccountToken(t *testing.T) string {
+	return signTestToken(t, jwt.MapClaims{
+		"principal": tool.PrincipalServiceAccount,
+	})
+}
+
+func TestValidateStepUp(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		code   codes.Code
+	}{
+		{"personal access token within scope", "pat_valid", testReadMethod, codes.OK},
+		{"personal access token calls step-up method", "pat_valid", testStepUpMethod, codes.PermissionDenied},
+		{"service account calls step-up method", serviceAccountToken(t), testStepUpMethod, codes.PermissionDenied},
+		{"recent user sign in", userToken(t, time.Now()), testStepUpMethod, codes.OK},
+		{"old user sign in", userToken(t, time.Now().Add(-time.Hour)), testStepUpMethod, codes.Unauthenticated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+test.token))
+
+			_, err := validate(ctx, testOptions(), test.method)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		authorization string
+		token         string
+		ok            bool
+	}{
+		{"Bearer abc", "abc", true},
+		{"bearer abc", "", false},
+		{"Bearer", "", false},
+		{"Basic abc", "", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		token, ok := BearerToken(test.authorization)
+		if token != test.token || ok != test.ok {
+			t.Errorf("BearerToken(%q) = %q, %v, want %q, %v", test.authorization, token, ok, test.token, test.ok)
+		}
+	}
+}
+
+func TestValidateClientToken(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signingKey := &tool.SigningKey{Id: "test", PrivateKey: privateKey}
+	options := testOptions()
+	options.ClientSigningKey = signingKey
+	options.ClientIssuer = "https://auth.example.com"
+	options.ClientMethods = map[string]string{testReadMethod: "users:read"}
+
+	clientToken := func(claims jwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := signingKey.Sign("at+jwt", claims)
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return token
+	}
+	claims := func(scope string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":       "https://auth.example.com",
+			"aud":       tool.Audience,
+			"principal": tool.PrincipalClient,
+			"client_id": "billing",
+			"scope":     scope,
+		}
+	}
+	otherIssuer := claims("users:read")
+	otherIssuer["iss"] = "https://evil.example.com"
+	otherAudience := claims("users:read")
+	otherAudience["aud"] = "orders"
+	userPrincipal := claims("users:read")
+	userPrincipal["principal"] = "user"
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		code   codes.Code
+	}{
+		{"scope of the method", clientToken(claims("users:read users:write")), testReadMethod, codes.OK},
+		{"missing scope", clientToken(claims("users:write")), testReadMethod, codes.PermissionDenied},
+		{"method not allowed to clients", clientToken(claims("users:read users:write")), testStepUpMethod, codes.PermissionDenied},
+		{"other issuer", clientToken(otherIssuer), testReadMethod, codes.Unauthenticated},
+		{"other audience", clientToken(otherAudience), testReadMethod, codes.Unauthenticated},
+		{"not a client token", clientToken(userPrincipal), testReadMethod, codes.Unauthenticated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+test.token))
+
+			_, err := validate(ctx, options, test.method)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+
+	// Service tokens are rejected unless the signing key is configured
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+clientToken(claims("users:read"))))
+	if _, err := validate(ctx, testOptions(), testReadMethod); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("got %v, want unauthenticated without the client signing key", err)
+	}
+}
+
+func TestValidateImpersonation(t *testing.T) {
+	const signOutMethod = "/auth.AuthService/SignOut"
+	const exchangeMethod = "/auth.AuthService/ExchangeToken"
+	options := testOptions()
+	options.ImpersonationDeniedMethods = []string{signOutMethod, exchangeMethod}
+
+	impersonationToken := func(act any) string {
+		return signTestToken(t, jwt.MapClaims{
+			"userEmail":    "user@example.com",
+			"device":       uuid.New().String(),
+			"installation": uuid.New().String(),
+			"auth_time":    time.Now().Unix(),
+			"act":          act,
+		})
+	}
+	administrator := map[string]any{"sub": uuid.New().String(), "userEmail": "admin@example.com"}
+
+	tests := []struct {
+		name         string
+		token        string
+		method       string
+		code         codes.Code
+		impersonated bool
+	}{
+		{"impersonation reads", impersonationToken(administrator), testReadMethod, codes.OK, true},
+		{"impersonation signs out", impersonationToken(administrator), signOutMethod, codes.PermissionDenied, true},
+		{"impersonation exchanges token", impersonationToken(administrator), exchangeMethod, codes.PermissionDenied, true},
+		{"user signs out", userToken(t, time.Now()), signOutMethod, codes.OK, false},
+		{"malformed act claim", impersonationToken("admin@example.com"), testReadMethod, codes.Unauthenticated, false},
+		{"act claim without administrator", impersonationToken(map[string]any{"sub": "admin"}), testReadMethod, codes.Unauthenticated, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+test.token))
+
+			ctx, err := validate(ctx, options, test.method)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+			if err != nil {
+				return
+			}
+			authInfo := tool.ExtractAuthInfo(ctx)
+			if (authInfo.Impersonator != nil) != test.impersonated {
+				t.Fatalf("got impersonator %v, want impersonated %v", authInfo.Impersonator, test.impersonated)
+			}
+			if test.impersonated && authInfo.Impersonator.Email != "admin@example.com" {
+				t.Fatalf("got impersonator %s, want admin@example.com", authInfo.Impersonator.Email)
+			}
+		})
+	}
+}
+
+func TestValidatePersonalAccessToken(t *testing.T) {
+	const unmappedMethod = "/auth.AuthService/SetPassword"
+	readOnly := testOptions()
+	readOnly.PersonalAccessTokens = &testPersonalAccessTokens{scopes: []string{"users:read"}}
+	withoutTokens := testOptions()
+	withoutTokens.PersonalAccessTokens = nil
+
+	tests := []struct {
+		name    string
+		options *JwtInterceptorOptions
+		token   string
+		method  string
+		code    codes.Code
+	}{
+		{"scope of the method", readOnly, "pat_valid", testReadMethod, codes.OK},
+		{"missing scope", readOnly, "pat_valid", testStepUpMethod, codes.PermissionDenied},
+		{"method not allowed to tokens", testOptions(), "pat_valid", unmappedMethod, codes.PermissionDenied},
+		{"unknown token", testOptions(), "pat_unknown", testReadMethod, codes.Unauthenticated},
+		{"tokens disabled", withoutTokens, "pat_valid", testReadMethod, codes.Unauthenticated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+test.token))
+
+			ctx, err := validate(ctx, test.options, test.method)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+			if err == nil && tool.ExtractAuthInfo(ctx).PatInfo == nil {
+				t.Fatal("personal access token is not in the context")
+			}
+		})
+	}
+}
+
+func TestValidateServiceAccount(t *testing.T) {
+	const signOutMethod = "/auth.AuthService/SignOut"
+	const createTokenMethod = "/auth.AuthService/CreatePersonalAccessToken"
+	options := testOptions()
+	options.ServiceAccountDeniedMethods = []string{signOutMethod, createTokenMethod}
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		code   codes.Code
+	}{
+		{"service account reads", serviceAccountToken(t), testReadMethod, codes.OK},
+		{"service account signs out", serviceAccountToken(t), signOutMethod, codes.PermissionDenied},
+		{"service account creates token", serviceAccountToken(t), createTokenMethod, codes.PermissionDenied},
+		{"user signs out", userToken(t, time.Now()), signOutMethod, codes.OK},
+		// Only service accounts sign in without email and device
+		{"user without device", signTestToken(t, jwt.MapClaims{"userEmail": "user@example.com"}), testReadMethod, codes.Unauthenticated},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+test.token))
+
+			_, err := validate(ctx, options, test.method)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+func TestStepUpRequired(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"old sign in", userToken(t, time.Now().Add(-11*time.Minute))},
+		// Tokens issued before step-up authentication have no auth_time
+		{"without auth time", signTestToken(t, jwt.MapClaims{
+			"userEmail":    "admin@example.com",
+			"device":       uuid.New().String(),
+			"installation": uuid.New().String(),
+		})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+test.token))
+
+			_, err := validate(ctx, testOptions(), testStepUpMethod)
+
+			st := status.Convert(err)
+			if st.Code() != codes.Unauthenticated || len(st.Details()) != 1 {
+				t.Fatalf("got %v, want unauthenticated with error info", err)
+			}
+			info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+			if !ok || info.Reason != StepUpRequiredReason || info.Domain != tool.Issuer {
+				t.Fatalf("got details %v, want %s error info", st.Details(), StepUpRequiredReason)
+			}
+			if info.Metadata["method"] != testStepUpMethod || info.Metadata["max_age"] != "600" {
+				t.Fatalf("got metadata %v, want the method and max age of 600 seconds", info.Metadata)
+			}
+		})
+	}
+}
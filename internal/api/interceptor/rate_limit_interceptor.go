@@ -0,0 +1,251 @@
+package jwt_interceptor
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+
+	"golang.org/x/time/rate"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second up to Burst tokens.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type RateLimiterOptions struct {
+	// Default limit applied to methods without a dedicated limit.
+	Default RateLimit
+	// Methods overrides the default limit per full method name, e.g. `/auth.AuthService/SignIn`.
+	Methods map[string]RateLimit
+	// PerPrincipal keys buckets by the authenticated user or OAuth client instead of the client IP.
+	// The limiter has to be chained after the JWT interceptor then, anonymous requests are left to the limiter by IP.
+	PerPrincipal bool
+	// GatewayKey is sent by the HTTP gateway in `x-gateway-key` metadata, see GatewayUnaryClientInterceptor.
+	// The client IP of gateway requests is taken from `x-forwarded-for`, it is ignored for direct gRPC clients who could forge it.
+	GatewayKey string
+	// TrustedProxies is the number of trusted proxies in front of the HTTP gateway, each of them appends the address of its client.
+	// The client IP is taken that many entries from the right, leftmost entries are set by the client and could be forged.
+	TrustedProxies int
+	// IdleTimeout after which unused buckets are evicted.
+	IdleTimeout time.Duration
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// GatewayKeyMetadata carries RateLimiterOptions.GatewayKey in requests of the HTTP gateway.
+const GatewayKeyMetadata = "x-gateway-key"
+
+// RateLimiter keeps a token bucket per method and client IP, or per method and authenticated user or OAuth client.
+// The limiter by IP goes before the JWT interceptor, so requests with invalid tokens are limited too.
+type RateLimiter struct {
+	options *RateLimiterOptions
+
+	mu      sync.Mutex
+	buckets map[string]*rateLimiterEntry
+}
+
+func NewRateLimiter(options *RateLimiterOptions) *RateLimiter {
+	if options.IdleTimeout <= 0 {
+		options.IdleTimeout = 10 * time.Minute
+	}
+	return &RateLimiter{
+		options: options,
+		buckets: make(map[string]*rateLimiterEntry),
+	}
+}
+
+// Run evicts idle buckets until the context is cancelled.
+func (l *RateLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.options.IdleTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.evict(now)
+		}
+	}
+}
+
+func (l *RateLimiter) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if !l.allow(stream.Context(), info.FullMethod) {
+			return status.Errorf(codes.ResourceExhausted, "too many requests")
+		}
+		return handler(srv, stream)
+	}
+}
+
+func (l *RateLimiter) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !l.allow(ctx, info.FullMethod) {
+			return nil, status.Errorf(codes.ResourceExhausted, "too many requests")
+		}
+		return handler(ctx, req)
+	}
+}
+
+// GatewayUnaryClientInterceptor adds the key to unary requests of the HTTP gateway to the gRPC server.
+func GatewayUnaryClientInterceptor(key string) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		return invoker(metadata.AppendToOutgoingContext(ctx, GatewayKeyMetadata, key), method, req, reply, cc, opts...)
+	}
+}
+
+// GatewayStreamClientInterceptor adds the key to streaming requests of the HTTP gateway to the gRPC server.
+func GatewayStreamClientInterceptor(key string) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		return streamer(metadata.AppendToOutgoingContext(ctx, GatewayKeyMetadata, key), desc, cc, method, opts...)
+	}
+}
+
+func (l *RateLimiter) allow(ctx context.Context, method string) bool {
+	limit, ok := l.options.Methods[method]
+	if !ok {
+		limit = l.options.Default
+	}
+
+	key := method + "|" + l.clientIp(ctx)
+	if l.options.PerPrincipal {
+		principal := principalId(ctx)
+		if principal == "" {
+			return true
+		}
+		key = method + "|" + principal
+	}
+	return l.take(key, limit)
+}
+
+// HttpHandler limits requests of the handler per client address, the name selects the limit like a method name.
+// Forwarded IPs are not trusted, the handler is called by reverse proxies directly.
+func (l *RateLimiter) HttpHandler(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := l.options.Methods[name]
+		if !ok {
+			limit = l.options.Default
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if !l.take(name+"|"+host, limit) {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (l *RateLimiter) take(key string, limit RateLimit) bool {
+	now := time.Now()
+
+	l.mu.Lock()
+	entry, ok := l.buckets[key]
+	if !ok {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		l.buckets[key] = entry
+	}
+	entry.lastSeen = now
+	l.mu.Unlock()
+
+	return entry.limiter.AllowN(now, 1)
+}
+
+func (l *RateLimiter) evict(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, entry := range l.buckets {
+		if now.Sub(entry.lastSeen) > l.options.IdleTimeout {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *RateLimiter) clientIp(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok && l.isGateway(md) {
+		if ip := forwardedIp(md.Get("x-forwarded-for"), l.options.TrustedProxies); ip != "" {
+			return ip
+		}
+	}
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// isGateway reports whether the request is sent by the HTTP gateway.
+// HTTP clients could add own values by `Grpc-Metadata-X-Gateway-Key` headers, the gateway appends the key after them.
+func (l *RateLimiter) isGateway(md metadata.MD) bool {
+	if l.options.GatewayKey == "" {
+		return false
+	}
+	for _, key := range md.Get(GatewayKeyMetadata) {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(l.options.GatewayKey)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedIp returns the `x-forwarded-for` entry appended by the outermost trusted proxy, skipping trustedProxies entries from the right.
+func forwardedIp(values []string, trustedProxies int) string {
+	var entries []string
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+
+	i := len(entries) - 1 - trustedProxies
+	if i < 0 {
+		// Shorter chain than configured, the request has not passed all proxies
+		i = 0
+	}
+	return entries[i]
+}
+
+func principalId(ctx context.Context) string {
+	authInfo, ok := ctx.Value(tool.UserClaimsKey).(*tool.JwtAuthInfo)
+	if !ok {
+		return ""
+	}
+	if authInfo.ClientInfo != nil {
+		return "client:" + authInfo.ClientInfo.Id
+	}
+	if authInfo.UserInfo == nil || authInfo.UserInfo.Id == nil {
+		return ""
+	}
+	return authInfo.UserInfo.Id.String()
+}
@@ -0,0 +1,289 @@
+package jwt_interceptor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	testLimitedMethod = "/auth.AuthService/SignIn"
+	testDefaultMethod = "/auth.AuthService/LoadUsers"
+	testGatewayKey    = "gateway-key"
+)
+
+func testRateLimiter(perPrincipal bool, trustedProxies int) *RateLimiter {
+	return NewRateLimiter(&RateLimiterOptions{
+		Default:        RateLimit{Rate: 100, Burst: 100},
+		Methods:        map[string]RateLimit{testLimitedMethod: {Rate: 0.001, Burst: 2}},
+		PerPrincipal:   perPrincipal,
+		GatewayKey:     testGatewayKey,
+		TrustedProxies: trustedProxies,
+	})
+}
+
+func peerContext(ip string, forwardedFor ...string) context.Context {
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 50000}})
+	if len(forwardedFor) > 0 {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("x-forwarded-for", forwardedFor[0]))
+	}
+	return ctx
+}
+
+// gatewayContext is a request of the HTTP gateway, gatewayKeys are the `x-gateway-key` values.
+func gatewayContext(forwardedFor string, gatewayKeys ...string) context.Context {
+	md := metadata.Pairs("x-forwarded-for", forwardedFor)
+	for _, key := range gatewayKeys {
+		md.Append(GatewayKeyMetadata, key)
+	}
+	return metadata.NewIncomingContext(peerContext("127.0.0.1"), md)
+}
+
+func userContext(ctx context.Context) context.Context {
+	userId := uuid.New()
+	return context.WithValue(ctx, tool.UserClaimsKey, &tool.JwtAuthInfo{UserInfo: &tool.JwtUserInfo{Id: &userId}})
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	firstUser := userContext(peerContext("10.0.0.1"))
+
+	tests := []struct {
+		name         string
+		perPrincipal bool
+		method       string
+		// contexts of the calls, the last call is checked
+		contexts []context.Context
+		allowed  bool
+	}{
+		{
+			name:     "within burst",
+			method:   testLimitedMethod,
+			contexts: []context.Context{peerContext("10.0.0.1"), peerContext("10.0.0.1")},
+			allowed:  true,
+		},
+		{
+			name:     "burst exceeded",
+			method:   testLimitedMethod,
+			contexts: []context.Context{peerContext("10.0.0.1"), peerContext("10.0.0.1"), peerContext("10.0.0.1")},
+			allowed:  false,
+		},
+		{
+			name:     "other client IP",
+			method:   testLimitedMethod,
+			contexts: []context.Context{peerContext("10.0.0.1"), peerContext("10.0.0.1"), peerContext("10.0.0.2")},
+			allowed:  true,
+		},
+		{
+			name:     "users of the same IP",
+			method:   testLimitedMethod,
+			contexts: []context.Context{userContext(peerContext("10.0.0.1")), userContext(peerContext("10.0.0.1")), userContext(peerContext("10.0.0.1"))},
+			allowed:  false,
+		},
+		{
+			name:         "same user of other IPs",
+			perPrincipal: true,
+			method:       testLimitedMethod,
+			contexts:     []context.Context{firstUser, userContext(peerContext("10.0.0.2")), context.WithValue(peerContext("10.0.0.3"), tool.UserClaimsKey, firstUser.Value(tool.UserClaimsKey)), firstUser},
+			allowed:      false,
+		},
+		{
+			name:         "other user of the same IP",
+			perPrincipal: true,
+			method:       testLimitedMethod,
+			contexts:     []context.Context{firstUser, firstUser, userContext(peerContext("10.0.0.1"))},
+			allowed:      true,
+		},
+		{
+			name:         "anonymous left to the limiter by IP",
+			perPrincipal: true,
+			method:       testLimitedMethod,
+			contexts:     []context.Context{peerContext("10.0.0.1"), peerContext("10.0.0.1"), peerContext("10.0.0.1")},
+			allowed:      true,
+		},
+		{
+			name:     "default limit",
+			method:   testDefaultMethod,
+			contexts: []context.Context{peerContext("10.0.0.1"), peerContext("10.0.0.1"), peerContext("10.0.0.1")},
+			allowed:  true,
+		},
+		{
+			name:     "forwarded IP of direct client ignored",
+			method:   testLimitedMethod,
+			contexts: []context.Context{peerContext("10.0.0.1", "1.1.1.1"), peerContext("10.0.0.1", "2.2.2.2"), peerContext("10.0.0.1", "3.3.3.3")},
+			allowed:  false,
+		},
+		{
+			name:     "forwarded IPs of gateway",
+			method:   testLimitedMethod,
+			contexts: []context.Context{gatewayContext("1.1.1.1", testGatewayKey), gatewayContext("1.1.1.1", testGatewayKey), gatewayContext("2.2.2.2", testGatewayKey)},
+			allowed:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := testRateLimiter(test.perPrincipal, 0)
+
+			allowed := false
+			for _, ctx := range test.contexts {
+				allowed = limiter.allow(ctx, test.method)
+			}
+
+			if allowed != test.allowed {
+				t.Fatalf("got allowed %v, want %v", allowed, test.allowed)
+			}
+		})
+	}
+}
+
+func TestRateLimiterForwardedClient(t *testing.T) {
+	limiter := testRateLimiter(false, 1)
+
+	// Clients forge the leftmost entries, the entry appended by the trusted proxy is limited
+	for i, forged := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		allowed := limiter.allow(gatewayContext(forged+", 203.0.113.7, 10.0.0.9", testGatewayKey), testLimitedMethod)
+		if want := i < 2; allowed != want {
+			t.Fatalf("call %d: got allowed %v, want %v", i+1, allowed, want)
+		}
+	}
+}
+
+func TestClientIp(t *testing.T) {
+	tests := []struct {
+		name           string
+		trustedProxies int
+		ctx            context.Context
+		ip             string
+	}{
+		{"peer address", 0, peerContext("10.0.0.1"), "10.0.0.1"},
+		{"forwarded by direct client", 0, peerContext("10.0.0.1", "203.0.113.7"), "10.0.0.1"},
+		{"forwarded with wrong gateway key", 0, gatewayContext("203.0.113.7", "guess"), "127.0.0.1"},
+		{"gateway only", 0, gatewayContext("1.1.1.1, 203.0.113.7", testGatewayKey), "203.0.113.7"},
+		{"gateway key after forged key", 0, gatewayContext("203.0.113.7", "guess", testGatewayKey), "203.0.113.7"},
+		{"one trusted proxy", 1, gatewayContext("1.1.1.1, 203.0.113.7, 10.0.0.9", testGatewayKey), "203.0.113.7"},
+		{"shorter chain than proxies", 3, gatewayContext("203.0.113.7, 10.0.0.9", testGatewayKey), "203.0.113.7"},
+		{"missing forwarded", 1, gatewayContext("", testGatewayKey), "127.0.0.1"},
+		{"no peer", 0, context.Background(), ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := testRateLimiter(false, test.trustedProxies)
+
+			if ip := limiter.clientIp(test.ctx); ip != test.ip {
+				t.Fatalf("got %q, want %q", ip, test.ip)
+			}
+		})
+	}
+}
+
+func TestForwardedIp(t *testing.T) {
+	tests := []struct {
+		values         []string
+		trustedProxies int
+		ip             string
+	}{
+		{nil, 0, ""},
+		{[]string{""}, 0, ""},
+		{[]string{"203.0.113.7"}, 0, "203.0.113.7"},
+		{[]string{"1.1.1.1, 203.0.113.7"}, 0, "203.0.113.7"},
+		{[]string{"1.1.1.1,203.0.113.7 , 10.0.0.9"}, 1, "203.0.113.7"},
+		{[]string{"1.1.1.1", "203.0.113.7", "10.0.0.9"}, 1, "203.0.113.7"},
+		{[]string{"203.0.113.7, 10.0.0.9"}, 5, "203.0.113.7"},
+	}
+
+	for _, test := range tests {
+		if ip := forwardedIp(test.values, test.trustedProxies); ip != test.ip {
+			t.Errorf("forwardedIp(%q, %d) = %q, want %q", test.values, test.trustedProxies, ip, test.ip)
+		}
+	}
+}
+
+func TestRateLimiterEvict(t *testing.T) {
+	limiter := testRateLimiter(false, 0)
+	limiter.allow(peerContext("10.0.0.1"), testLimitedMethod)
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		buckets int
+	}{
+		{"recently used bucket is kept", time.Now(), 1},
+		{"idle bucket is evicted", time.Now().Add(time.Hour), 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter.evict(test.now)
+
+			if buckets := len(limiter.buckets); buckets != test.buckets {
+				t.Fatalf("got %d buckets, want %d", buckets, test.buckets)
+			}
+		})
+	}
+}
+
+func TestGatewayUnaryClientInterceptor(t *testing.T) {
+	interceptor := GatewayUnaryClientInterceptor(testGatewayKey)
+
+	var got []string
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ := metadata.FromOutgoingContext(ctx)
+		got = md.Get(GatewayKeyMetadata)
+		return nil
+	}
+
+	// Keys forged by HTTP clients are kept, the limiter accepts any of the values
+	ctx := metadata.AppendToOutgoingContext(context.Background(), GatewayKeyMetadata, "guess")
+	if err := interceptor(ctx, testLimitedMethod, nil, nil, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 || got[1] != testGatewayKey {
+		t.Fatalf("got %q, want gateway key appended", got)
+	}
+}
+
+func TestRateLimiterHttpHandler(t *testing.T) {
+	limiter := testRateLimiter(false, 0)
+	handler := limiter.HttpHandler(testLimitedMethod, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		// forwarded is ignored, proxies call the handler directly
+		forwarded string
+		status    int
+	}{
+		{"first request", "10.0.0.1:50000", "", http.StatusOK},
+		{"other port of the same proxy", "10.0.0.1:50001", "1.1.1.1", http.StatusOK},
+		{"burst exceeded", "10.0.0.1:50002", "2.2.2.2", http.StatusTooManyRequests},
+		{"other proxy", "10.0.0.2:50000", "", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/auth/verify", nil)
+		r.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
@@ -3,16 +3,26 @@ package api
 import (
 	"context"
 	"crypto/subtle"
+	"fmt"
+	"slices"
+	"time"
 
 	"github.com/rs/zerolog"
 
 	pb "github.com/zs-dima/auth-service/internal/gen/proto"
 
+	authn "github.com/zs-dima/auth-service/internal/authn"
+	centrifugo "github.com/zs-dima/auth-service/internal/centrifugo"
+	federation "github.com/zs-dima/auth-service/internal/federation"
 	model "github.com/zs-dima/auth-service/internal/gen/db"
+	mailer "github.com/zs-dima/auth-service/internal/mailer"
+	oidc "github.com/zs-dima/auth-service/internal/oidc"
+	sms "github.com/zs-dima/auth-service/internal/sms"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
@@ -43,6 +53,56 @@ func GRPCKeyAuth(key string) grpc.ServerOption {
 // AuthServiceServerConfig for GRPC API Service.
 type AuthServiceServerConfig struct {
 	JwtSecretKey string
+	// Authenticator checks passwords on sign in, by Postgres or by the directory of the email domain.
+	Authenticator *authn.DomainAuthenticator
+	// AppUrl is the client application base URL used to build links sent by email.
+	AppUrl string
+	// EmailVerificationTtl is the lifetime of email verification links.
+	EmailVerificationTtl time.Duration
+	// RequireVerifiedEmail blocks sign-in until the user verified the email address.
+	RequireVerifiedEmail bool
+	// EmailChangeTtl is the lifetime of email change confirmation links.
+	EmailChangeTtl time.Duration
+	// EmailChangeRevokesSessions ends user sessions once the email change is confirmed.
+	EmailChangeRevokesSessions bool
+	// InvitationTtl is the lifetime of invitation links.
+	InvitationTtl time.Duration
+	// SignUpPolicy allows users to register themselves.
+	SignUpPolicy SignUpPolicy
+	// SignUpAllowedDomains restricts sign up by email domain for the `domains` policy.
+	SignUpAllowedDomains []string
+	Mailer               mailer.Mailer
+	MailTemplates        *mailer.Templates
+	// PasswordResetTtl is the lifetime of password reset links.
+	PasswordResetTtl time.Duration
+	// MagicLinkTtl is the lifetime of passwordless sign-in links.
+	MagicLinkTtl time.Duration
+	// OtpTtl is the lifetime of one-time sign in codes.
+	OtpTtl time.Duration
+	// OtpMaxAttempts is the number of wrong codes after which the code is no longer accepted.
+	OtpMaxAttempts int
+	// SmsSender is nil when SMS is disabled, phone and SMS sign in methods are rejected.
+	SmsSender sms.SmsSender
+	// OidcProvider is set when the service acts as an OpenID Connect provider.
+	OidcProvider *oidc.Provider
+	// Federation is set when users sign in by external identity providers.
+	Federation *federation.Federation
+	// DeviceCodeTtl is the lifetime of device authorization requests.
+	DeviceCodeTtl time.Duration
+	// DevicePollInterval is the minimum time between token polls of the device.
+	DevicePollInterval time.Duration
+	// ImpersonationTtl is the lifetime of access tokens issued to administrators viewing the service as a user.
+	ImpersonationTtl time.Duration
+	// ServiceAccounts authenticates non-human principals by signed assertions or client secrets.
+	ServiceAccounts *authn.ServiceAccounts
+	// ServiceAccountTokenTtl is the lifetime of access tokens issued to service accounts.
+	ServiceAccountTokenTtl time.Duration
+	// CentrifugoTokens issues Centrifugo connection and subscription tokens, nil unless the event bus is configured.
+	CentrifugoTokens *centrifugo.Tokens
+	// EventOutbox publishes events to Centrifugo, nil unless the Centrifugo API is configured.
+	EventOutbox *centrifugo.Outbox
+	// UserEventsChannel receives user lifecycle events, events are not published when empty.
+	UserEventsChannel string
 }
 
 // RegisterGRPCServerAPI registers GRPC API service in provided GRPC server.
@@ -86,4 +146,50 @@ func newAuthServiceServer(
 	}
 }
 
+// Permission is an operation granted to user roles.
+type Permission string
+
+const (
+	// PermissionImpersonate allows to view the service as another user.
+	PermissionImpersonate Permission = "users:impersonate"
+)
+
+var rolePermissions = map[model.UserRole][]Permission{
+	model.UserRoleAdministrator: {PermissionImpersonate},
+}
+
+// requirePermission returns PermissionDenied unless the caller role has the permission.
+// Impersonated users never get permissions, even when the role has them.
+func (s *AuthServiceServer) requirePermission(authInfo *jwt.JwtAuthInfo, permission Permission) error {
+	if authInfo.UserInfo == nil {
+		return s.Err.PermissionDenied(authInfo.Principal(), fmt.Errorf("user is required"))
+	}
+	if authInfo.Impersonator != nil {
+		return s.Err.PermissionDenied(authInfo.Principal(), fmt.Errorf("%s is not allowed while impersonating", permission))
+	}
+	if !slices.Contains(rolePermissions[model.UserRole(authInfo.UserInfo.Role)], permission) {
+		return s.Err.PermissionDenied(
+			authInfo.UserInfo.Email,
+			fmt.Errorf("%s role has no %s permission", authInfo.UserInfo.Role, permission),
+		)
+	}
+	return nil
+}
+
+// requireRole returns PermissionDenied unless the caller has one of the roles.
+func (s *AuthServiceServer) requireRole(authInfo *jwt.JwtAuthInfo, roles ...model.UserRole) error {
+	if authInfo.UserInfo == nil {
+		return s.Err.PermissionDenied(authInfo.Principal(), fmt.Errorf("user is required"))
+	}
+	for _, role := range roles {
+		if string(authInfo.UserInfo.Role) == string(role) {
+			return nil
+		}
+	}
+	return s.Err.PermissionDenied(
+		authInfo.UserInfo.Email,
+		fmt.Errorf("%s role is not allowed, required one of %v", authInfo.UserInfo.Role, roles),
+	)
+}
+
 // func (s *AuthServiceServer) mustEmbedUnimplementedAuthServiceServer() {}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+// AuditAction names the security relevant action recorded in the audit log.
+type AuditAction string
+
+const (
+	AuditActionImpersonate AuditAction = "impersonate"
+)
+
+// auditUser is the actor or the subject of the audit entry.
+type auditUser struct {
+	id    *uuid.UUID
+	email string
+}
+
+// audit records the action in the audit log, details are stored as JSON.
+func (s *AuthServiceServer) audit(ctx context.Context, action AuditAction, actor *auditUser, subject *auditUser, details map[string]any) error {
+	detailsJson, err := json.Marshal(details)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s audit details: %w", action, err)
+	}
+
+	params := model.CreateAuditLogParams{
+		ID:      uuid.New(),
+		Action:  string(action),
+		Details: detailsJson,
+	}
+	if actor != nil {
+		params.ActorID = nullUuid(actor.id)
+		params.ActorEmail = pgtype.Text{String: actor.email, Valid: actor.email != ""}
+	}
+	if subject != nil {
+		params.SubjectID = nullUuid(subject.id)
+		params.SubjectEmail = pgtype.Text{String: subject.email, Valid: subject.email != ""}
+	}
+
+	if err := s.DB.CreateAuditLog(ctx, params); err != nil {
+		return fmt.Errorf("failed to write %s audit log: %w", action, err)
+	}
+	return nil
+}
+
+func nullUuid(id *uuid.UUID) uuid.NullUUID {
+	if id == nil {
+		return uuid.NullUUID{}
+	}
+	return uuid.NullUUID{UUID: *id, Valid: true}
+}
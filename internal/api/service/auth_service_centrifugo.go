@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	centrifugo "github.com/zs-dima/auth-service/internal/centrifugo"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// GetCentrifugoConnectionToken issues the token of the caller to connect to Centrifugo, `sub` is the user id.
+func (s *AuthServiceServer) GetCentrifugoConnectionToken(ctx context.Context, request *emptypb.Empty) (*pb.CentrifugoToken, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Issuing Centrifugo connection token %s ...", principal)
+
+	if s.config.CentrifugoTokens == nil {
+		return nil, s.Err.FailedPrecondition("Event bus is disabled", "Centrifugo token secret is not configured")
+	}
+	if authInfo.UserInfo == nil {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("user is required"))
+	}
+
+	token, expiresAt, err := s.config.CentrifugoTokens.ConnectionToken(authInfo.UserInfo)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to issue connection token",
+			fmt.Sprintf("Failed to generate Centrifugo connection token %s", principal),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Centrifugo connection token %s issued successfully", principal)
+
+	return &pb.CentrifugoToken{
+		Token:     token,
+		ExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
+
+// GetCentrifugoSubscriptionToken issues the token of the caller to subscribe to the channel allowed by the role of the caller.
+func (s *AuthServiceServer) GetCentrifugoSubscriptionToken(ctx context.Context, request *pb.CentrifugoSubscriptionTokenRequest) (*pb.CentrifugoToken, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+	channel := strings.TrimSpace(request.Channel)
+
+	s.Log.Info().Msgf("Issuing Centrifugo subscription token of %s %s ...", channel, principal)
+
+	if s.config.CentrifugoTokens == nil {
+		return nil, s.Err.FailedPrecondition("Event bus is disabled", "Centrifugo token secret is not configured")
+	}
+	if authInfo.UserInfo == nil {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("user is required"))
+	}
+	if channel == "" {
+		return nil, s.Err.InvalidArgument("Channel is required", fmt.Sprintf("Centrifugo subscription token of %s without channel", principal))
+	}
+	if !centrifugo.CanSubscribe(authInfo.UserInfo, channel) {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("channel %s is not allowed", channel))
+	}
+
+	token, expiresAt, err := s.config.CentrifugoTokens.SubscriptionToken(authInfo.UserInfo, channel)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to issue subscription token",
+			fmt.Sprintf("Failed to generate Centrifugo subscription token of %s %s", channel, principal),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Centrifugo subscription token of %s %s issued successfully", channel, principal)
+
+	return &pb.CentrifugoToken{
+		Token:     token,
+		ExpiresAt: timestamppb.New(expiresAt),
+	}, nil
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	centrifugo "github.com/zs-dima/auth-service/internal/centrifugo"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+func TestCentrifugoSubscriptionTokenRequests(t *testing.T) {
+	tokens := centrifugo.NewTokens("secret", time.Hour)
+	clientContext := context.WithValue(context.Background(), jwt.UserClaimsKey, &jwt.JwtAuthInfo{
+		ClientInfo: &jwt.JwtClientInfo{Id: "billing"},
+	})
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		tokens  *centrifugo.Tokens
+		channel string
+		code    codes.Code
+	}{
+		{"without secret", userContext(model.UserRoleUser), nil, "eventbus:news", codes.FailedPrecondition},
+		{"by client", clientContext, tokens, "eventbus:news", codes.PermissionDenied},
+		{"without channel", userContext(model.UserRoleUser), tokens, " ", codes.InvalidArgument},
+		{"channel of other role", userContext(model.UserRoleUser), tokens, "role:administrator", codes.PermissionDenied},
+		{"admin channel", userContext(model.UserRoleUser), tokens, "admin:audit", codes.PermissionDenied},
+		{"own role", userContext(model.UserRoleUser), tokens, "role:user", codes.OK},
+		{"admin channel by administrator", userContext(model.UserRoleAdministrator), tokens, "admin:audit", codes.OK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testServer(&AuthServiceServerConfig{CentrifugoTokens: test.tokens})
+
+			_, err := s.GetCentrifugoSubscriptionToken(test.ctx, &pb.CentrifugoSubscriptionTokenRequest{Channel: test.channel})
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
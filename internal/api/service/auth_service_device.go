@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DevicePath of the client application page where users enter the user code.
+const DevicePath = "device"
+
+// RequestDeviceCode starts the device authorization grant, RFC 8628, for devices without a comfortable keyboard.
+// The user approves the request on another signed in device while the device polls SignInWithDeviceCode.
+func (s *AuthServiceServer) RequestDeviceCode(ctx context.Context, request *pb.RequestDeviceCodeRequest) (*pb.DeviceCodeReply, error) {
+	s.Log.Info().Msgf("Requesting device code ...")
+
+	if err := s.requireAppUrl("Device authorization"); err != nil {
+		return nil, err
+	}
+
+	if request.DeviceInfo.GetId() == nil || request.InstallationId == nil {
+		return nil, s.Err.InvalidArgument("Device is required", "Device code request without device info")
+	}
+
+	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
+	installationId := tool.RpcIdToId(request.InstallationId)
+
+	generator := jwt.TokenGenerator{}
+	deviceCode, expiresAt, err := generator.GenerateToken(s.config.DeviceCodeTtl)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to request device code",
+			"Failed to generate device code",
+			err,
+		)
+	}
+	userCode, _, err := generator.GenerateUserCode(s.config.DeviceCodeTtl)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to request device code",
+			"Failed to generate device user code",
+			err,
+		)
+	}
+
+	err = s.DB.CreateDeviceAuthorization(
+		ctx,
+		model.CreateDeviceAuthorizationParams{
+			DeviceCodeHash: tool.HashToken(deviceCode),
+			UserCodeHash:   tool.HashToken(jwt.NormalizeUserCode(userCode)),
+			DeviceID:       *deviceId,
+			InstallationID: *installationId,
+			DeviceName:     deviceName(request.DeviceInfo),
+			ExpiresAt:      pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to request device code",
+			fmt.Sprintf("Failed to save device %s authorization", deviceId),
+			err,
+		)
+	}
+
+	verificationUri := fmt.Sprintf("%s/%s", strings.TrimRight(s.config.AppUrl, "/"), DevicePath)
+
+	s.Log.Info().Msgf("Device code of %s requested successfully", deviceId)
+
+	return &pb.DeviceCodeReply{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: verificationUri + "?user_code=" + userCode,
+		ExpiresIn:               int32(s.config.DeviceCodeTtl.Seconds()),
+		Interval:                int32(s.config.DevicePollInterval.Seconds()),
+	}, nil
+}
+
+// LoadDeviceCode returns the device requesting the sign in, so the user checks it before the approval.
+func (s *AuthServiceServer) LoadDeviceCode(ctx context.Context, request *pb.DeviceUserCode) (*pb.DeviceCodeInfo, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Loading device code by %s ...", userEmail)
+
+	authorization, err := s.DB.GetPendingDeviceAuthorization(ctx, tool.HashToken(jwt.NormalizeUserCode(request.UserCode)))
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid code", fmt.Sprintf("Device code entered by %s is invalid or expired: %v", userEmail, err))
+	}
+
+	s.Log.Info().Msgf("Device code loaded by %s successfully", userEmail)
+
+	return &pb.DeviceCodeInfo{
+		DeviceName: authorization.DeviceName,
+		ExpiresAt:  timestamppb.New(authorization.ExpiresAt.Time),
+	}, nil
+}
+
+// ApproveDeviceCode signs the device in as the calling user, or denies the request.
+func (s *AuthServiceServer) ApproveDeviceCode(ctx context.Context, request *pb.ApproveDeviceCodeRequest) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Approving device code by %s ...", userEmail)
+
+	user, err := s.DB.GetActiveUserById(ctx, *authInfo.UserInfo.Id)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(userEmail, err)
+	}
+
+	status := model.DeviceAuthorizationStatusApproved
+	if request.Deny {
+		status = model.DeviceAuthorizationStatusDenied
+	}
+
+	rows, err := s.DB.CompleteDeviceAuthorization(
+		ctx,
+		model.CompleteDeviceAuthorizationParams{
+			UserCodeHash: tool.HashToken(jwt.NormalizeUserCode(request.UserCode)),
+			Status:       status,
+			UserID:       uuid.NullUUID{UUID: user.ID, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to approve device",
+			fmt.Sprintf("Failed to complete device authorization by %s", userEmail),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("Invalid code", fmt.Sprintf("Device code entered by %s is invalid or expired", userEmail))
+	}
+
+	s.Log.Info().Msgf("Device code %s by %s successfully", status, userEmail)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+// SignInWithDeviceCode is polled by the device until the user approves or denies the request.
+// FailedPrecondition is returned while the request is pending and ResourceExhausted when the device polls too often.
+func (s *AuthServiceServer) SignInWithDeviceCode(ctx context.Context, request *pb.SignInWithDeviceCodeRequest) (*pb.AuthInfo, error) {
+	s.Log.Debug().Msgf("Signing in by device code ...")
+
+	deviceCodeHash := tool.HashToken(request.DeviceCode)
+
+	authorization, err := s.DB.PollDeviceAuthorization(
+		ctx,
+		model.PollDeviceAuthorizationParams{
+			DeviceCodeHash:  deviceCodeHash,
+			IntervalSeconds: s.config.DevicePollInterval.Seconds(),
+		})
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid device code", fmt.Sprintf("Device code is invalid or used: %v", err))
+	}
+	if err := s.devicePollError(&authorization); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.ConsumeDeviceAuthorization(ctx, deviceCodeHash)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to consume device %s authorization", authorization.DeviceID),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("Invalid device code", fmt.Sprintf("Device code of %s is already used", authorization.DeviceID))
+	}
+
+	user, err := s.DB.GetActiveUserById(ctx, authorization.UserID.UUID)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(authorization.UserID.UUID.String(), err)
+	}
+
+	// The user approved the request on a signed in device, so MFA is already passed
+	res, err := s.issueAuthInfo(ctx, &user, &authorization.DeviceID, &authorization.InstallationID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed in on device %s by device code successfully", user.Email, authorization.DeviceID)
+
+	return res, nil
+}
+
+// devicePollError returns the error polled by the device, nil once the request is approved.
+func (s *AuthServiceServer) devicePollError(authorization *model.PollDeviceAuthorizationRow) error {
+	if authorization.Expired {
+		return s.Err.InvalidArgument("Device code expired", fmt.Sprintf("Device code of %s expired", authorization.DeviceID))
+	}
+	if authorization.SlowDown {
+		return s.Err.ResourceExhausted("Slow down", fmt.Sprintf("Device %s polls faster than the interval", authorization.DeviceID))
+	}
+
+	switch authorization.Status {
+	case model.DeviceAuthorizationStatusPending:
+		return s.Err.FailedPrecondition("Authorization pending", fmt.Sprintf("Device %s sign in is not approved yet", authorization.DeviceID))
+	case model.DeviceAuthorizationStatusDenied:
+		return s.Err.PermissionDenied(fmt.Sprintf("device %s sign in denied", authorization.DeviceID))
+	}
+	return nil
+}
+
+func deviceName(deviceInfo *pb.DeviceInfo) string {
+	name := strings.TrimSpace(deviceInfo.Name)
+	if name == "" {
+		name = strings.TrimSpace(deviceInfo.Model)
+	}
+	if name == "" {
+		name = "Unknown device"
+	}
+	if len(name) > 256 {
+		name = name[:256]
+	}
+	return name
+}
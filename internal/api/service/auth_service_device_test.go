@@ -0,0 +1,68 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+)
+
+func TestDevicePollError(t *testing.T) {
+	log := zerolog.Nop()
+	s := &AuthServiceServer{Log: &log, Err: tool.NewGrpcStatusTool(&log)}
+
+	tests := []struct {
+		name          string
+		authorization model.PollDeviceAuthorizationRow
+		code          codes.Code
+	}{
+		{"pending", model.PollDeviceAuthorizationRow{Status: model.DeviceAuthorizationStatusPending}, codes.FailedPrecondition},
+		{"denied", model.PollDeviceAuthorizationRow{Status: model.DeviceAuthorizationStatusDenied}, codes.PermissionDenied},
+		{"approved", model.PollDeviceAuthorizationRow{Status: model.DeviceAuthorizationStatusApproved}, codes.OK},
+		{"pending polled too fast", model.PollDeviceAuthorizationRow{Status: model.DeviceAuthorizationStatusPending, SlowDown: true}, codes.ResourceExhausted},
+		// Slow down wins, otherwise devices polling in a loop get the tokens earlier than the interval allows
+		{"approved polled too fast", model.PollDeviceAuthorizationRow{Status: model.DeviceAuthorizationStatusApproved, SlowDown: true}, codes.ResourceExhausted},
+		{"expired", model.PollDeviceAuthorizationRow{Status: model.DeviceAuthorizationStatusApproved, Expired: true}, codes.InvalidArgument},
+		{"expired polled too fast", model.PollDeviceAuthorizationRow{Status: model.DeviceAuthorizationStatusPending, Expired: true, SlowDown: true}, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.authorization.DeviceID = uuid.New()
+
+			err := s.devicePollError(&test.authorization)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+func TestDeviceName(t *testing.T) {
+	tests := []struct {
+		name       string
+		deviceInfo *pb.DeviceInfo
+		want       string
+	}{
+		{"name", &pb.DeviceInfo{Name: " Living room TV ", Model: "Bravia"}, "Living room TV"},
+		{"model", &pb.DeviceInfo{Name: " ", Model: "Bravia"}, "Bravia"},
+		{"unknown", &pb.DeviceInfo{}, "Unknown device"},
+		{"long name", &pb.DeviceInfo{Name: strings.Repeat("a", 300)}, strings.Repeat("a", 256)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if name := deviceName(test.deviceInfo); name != test.want {
+				t.Fatalf("got %q, want %q", name, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	mailer "github.com/zs-dima/auth-service/internal/mailer"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+func (s *AuthServiceServer) VerifyEmail(ctx context.Context, request *pb.VerifyEmailRequest) (*pb.ResultReply, error) {
+	s.Log.Info().Msgf("Verifying email ...")
+
+	if strings.TrimSpace(request.Token) == "" {
+		return nil, s.Err.InvalidArgument("Invalid verification link", "Empty email verification token")
+	}
+
+	token, err := s.DB.ConsumeUserToken(
+		ctx,
+		model.ConsumeUserTokenParams{
+			TokenHash: tool.HashToken(request.Token),
+			Purpose:   model.UserTokenPurposeEmailVerification,
+		})
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid verification link", fmt.Sprintf("Email verification token is invalid or expired: %v", err))
+	}
+
+	rows, err := s.DB.VerifyUserEmail(
+		ctx,
+		model.VerifyUserEmailParams{
+			ID:    token.UserID,
+			Email: token.Email,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to verify email",
+			fmt.Sprintf("Failed to verify %s email", token.Email),
+			err,
+		)
+	}
+	if rows == 0 {
+		// User email has been changed since the link was sent
+		return nil, s.Err.InvalidArgument("Invalid verification link", fmt.Sprintf("Email %s is no longer used by the user", token.Email))
+	}
+
+	s.Log.Info().Msgf("%s email verified successfully", token.Email)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) SendEmailVerification(ctx context.Context, request *pb.SendEmailVerificationRequest) (*pb.ResultReply, error) {
+	userEmail := request.Email
+
+	s.Log.Info().Msgf("Sending %s email verification ...", userEmail)
+
+	if err := s.requireAppUrl("Email verification"); err != nil {
+		return nil, err
+	}
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	// Reply the same way for unknown and verified emails to not disclose registered users
+	user, err := s.DB.GetActiveUser(ctx, userEmail)
+	if err != nil {
+		s.Log.Warn().Msgf("Email verification requested for unknown user %s", userEmail)
+		return res, nil
+	}
+	if user.EmailVerifiedAt.Valid {
+		s.Log.Warn().Msgf("Email verification requested for verified user %s", userEmail)
+		return res, nil
+	}
+
+	err = s.sendEmailVerification(ctx, &user)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send email verification",
+			fmt.Sprintf("Failed to send %s email verification", userEmail),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Email verification sent to %s successfully", userEmail)
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) ConfirmEmailChange(ctx context.Context, request *pb.ConfirmEmailChangeRequest) (*pb.ResultReply, error) {
+	s.Log.Info().Msgf("Confirming email change ...")
+
+	if strings.TrimSpace(request.Token) == "" {
+		return nil, s.Err.InvalidArgument("Invalid confirmation link", "Empty email change token")
+	}
+
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to change email",
+			"Failed to begin email change transaction",
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	// Token stays valid when the change fails
+	token, err := qtx.ConsumeUserToken(
+		ctx,
+		model.ConsumeUserTokenParams{
+			TokenHash: tool.HashToken(request.Token),
+			Purpose:   model.UserTokenPurposeEmailChange,
+		})
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid confirmation link", fmt.Sprintf("Email change token is invalid or expired: %v", err))
+	}
+
+	rows, err := qtx.UpdateUserEmail(
+		ctx,
+		model.UpdateUserEmailParams{
+			ID:    token.UserID,
+			Email: token.Email,
+		})
+	if err != nil {
+		// Unique constraint fails when the email has been taken after the change was requested
+		return nil, s.Err.Internal(
+			"Failed to change email",
+			fmt.Sprintf("Failed to change email to %s", token.Email),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("Invalid confirmation link", fmt.Sprintf("User of %s email change not found", token.Email))
+	}
+
+	if s.config.EmailChangeRevokesSessions {
+		err = s.endUserSession(ctx, qtx, token.UserID, nil, SignOutReasonEmailChange)
+		if err != nil {
+			return nil, s.Err.Internal(
+				"Failed to change email",
+				fmt.Sprintf("Failed to end %s sessions", token.Email),
+				err,
+			)
+		}
+	}
+
+	err = s.publishUserEvent(ctx, qtx, UserEventUpdated, token.UserID)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to change email",
+			fmt.Sprintf("Failed to publish %s updated event", token.Email),
+			err,
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to change email",
+			fmt.Sprintf("Failed to change email to %s", token.Email),
+			err,
+		)
+	}
+	s.notifyEvents()
+
+	s.Log.Info().Msgf("Email changed to %s successfully", token.Email)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+// requestEmailChange keeps the new email pending until it is confirmed from the new address.
+// The current address is notified to let the owner react on an unexpected change.
+func (s *AuthServiceServer) requestEmailChange(ctx context.Context, user *model.User, email string) error {
+	generator := jwt.TokenGenerator{}
+	token, expiresAt, err := generator.GenerateToken(s.config.EmailChangeTtl)
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.RevokeUserTokens(
+		ctx,
+		model.RevokeUserTokensParams{
+			UserID:  user.ID,
+			Purpose: model.UserTokenPurposeEmailChange,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to revoke email change tokens: %w", err)
+	}
+
+	err = s.DB.CreateUserToken(
+		ctx,
+		model.CreateUserTokenParams{
+			TokenHash: tool.HashToken(token),
+			UserID:    user.ID,
+			Purpose:   model.UserTokenPurposeEmailChange,
+			Email:     email,
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to save email change token: %w", err)
+	}
+
+	link := s.appLink("confirm-email-change", token)
+
+	err = s.sendMail(ctx, email, mailer.TemplateEmailChangeConfirm, map[string]any{
+		"Name":      user.Name,
+		"Link":      link,
+		"ExpiresAt": formatExpiresAt(expiresAt),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.sendMail(ctx, user.Email, mailer.TemplateEmailChangeNotice, map[string]any{
+		"Name":  user.Name,
+		"Email": email,
+	})
+}
+
+// sendEmailVerification replaces previously sent verification links with a new one.
+func (s *AuthServiceServer) sendEmailVerification(ctx context.Context, user *model.User) error {
+	// Without links users stay unverified, REQUIRE_VERIFIED_EMAIL requires APP_URL
+	if s.config.AppUrl == "" {
+		return nil
+	}
+
+	generator := jwt.TokenGenerator{}
+	token, expiresAt, err := generator.GenerateToken(s.config.EmailVerificationTtl)
+	if err != nil {
+		return err
+	}
+
+	err = s.DB.RevokeUserTokens(
+		ctx,
+		model.RevokeUserTokensParams{
+			UserID:  user.ID,
+			Purpose: model.UserTokenPurposeEmailVerification,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to revoke verification tokens: %w", err)
+	}
+
+	err = s.DB.CreateUserToken(
+		ctx,
+		model.CreateUserTokenParams{
+			TokenHash: tool.HashToken(token),
+			UserID:    user.ID,
+			Purpose:   model.UserTokenPurposeEmailVerification,
+			Email:     user.Email,
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to save verification token: %w", err)
+	}
+
+	link := s.appLink("verify-email", token)
+
+	return s.sendMail(ctx, user.Email, mailer.TemplateEmailVerification, map[string]any{
+		"Name":      user.Name,
+		"Link":      link,
+		"ExpiresAt": formatExpiresAt(expiresAt),
+	})
+}
+
+// sendMail renders the template in the caller locale and hands it to the mailer.
+func (s *AuthServiceServer) sendMail(ctx context.Context, to string, template string, data map[string]any) error {
+	message, err := s.config.MailTemplates.Render(template, mailer.LocaleFromContext(ctx), to, data)
+	if err != nil {
+		return err
+	}
+	return s.config.Mailer.Send(ctx, message)
+}
+
+func formatExpiresAt(expiresAt time.Time) string {
+	return expiresAt.UTC().Format("2006-01-02 15:04 MST")
+}
+
+// requireAppUrl rejects requests sending links to the client application when APP_URL is not configured.
+func (s *AuthServiceServer) requireAppUrl(operation string) error {
+	if s.config.AppUrl != "" {
+		return nil
+	}
+	return s.Err.FailedPrecondition(operation+" is not available", operation+" rejected, APP_URL is not configured")
+}
+
+// appLink builds a client application link carrying a one-time token.
+func (s *AuthServiceServer) appLink(path string, token string) string {
+	return fmt.Sprintf("%s/%s?token=%s", strings.TrimRight(s.config.AppUrl, "/"), path, url.QueryEscape(token))
+}
@@ -0,0 +1,89 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+)
+
+// testServer has no database, tests cover the checks made before the first query.
+func testServer(config *AuthServiceServerConfig) *AuthServiceServer {
+	log := zerolog.Nop()
+	return &AuthServiceServer{config: config, Log: &log, Err: tool.NewGrpcStatusTool(&log)}
+}
+
+func TestEmailVerificationRequests(t *testing.T) {
+	withoutAppUrl := testServer(&AuthServiceServerConfig{})
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context) error
+		code codes.Code
+	}{
+		{
+			"verification without APP_URL",
+			func(ctx context.Context) error {
+				_, err := withoutAppUrl.SendEmailVerification(ctx, &pb.SendEmailVerificationRequest{Email: "user@example.com"})
+				return err
+			},
+			codes.FailedPrecondition,
+		},
+		{
+			"empty verification token",
+			func(ctx context.Context) error {
+				_, err := withoutAppUrl.VerifyEmail(ctx, &pb.VerifyEmailRequest{Token: " "})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			// Users created without APP_URL stay unverified instead of failing the sign up
+			"verification link skipped without APP_URL",
+			func(ctx context.Context) error {
+				return withoutAppUrl.sendEmailVerification(ctx, &model.User{Email: "user@example.com"})
+			},
+			codes.OK,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call(context.Background())
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+func TestAppLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		appUrl string
+		token  string
+		want   string
+	}{
+		{"app URL", "https://app.example.com", "abc", "https://app.example.com/verify-email?token=abc"},
+		{"trailing slash", "https://app.example.com/", "abc", "https://app.example.com/verify-email?token=abc"},
+		{"base path", "https://example.com/app", "abc", "https://example.com/app/verify-email?token=abc"},
+		{"escaped token", "https://app.example.com", "a+b/c=", "https://app.example.com/verify-email?token=a%2Bb%2Fc%3D"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testServer(&AuthServiceServerConfig{AppUrl: test.appUrl})
+
+			if link := s.appLink("verify-email", test.token); link != test.want {
+				t.Fatalf("got %q, want %q", link, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+// UserEvent is the user lifecycle event published to the user events channel, admin UIs reload the user on events.
+type UserEvent string
+
+const (
+	UserEventCreated        UserEvent = "user.created"
+	UserEventUpdated        UserEvent = "user.updated"
+	UserEventDeleted        UserEvent = "user.deleted"
+	UserEventPhotoChanged   UserEvent = "user.photo_changed"
+	UserEventSessionRevoked UserEvent = "user.session_revoked"
+)
+
+type userEventData struct {
+	Type   UserEvent `json:"type"`
+	UserId uuid.UUID `json:"user_id"`
+	Time   time.Time `json:"time"`
+}
+
+// publishUserEvent queues the event by the queries of the RPC transaction, call notifyEvents once it is committed.
+func (s *AuthServiceServer) publishUserEvent(ctx context.Context, q *model.Queries, event UserEvent, userId uuid.UUID) error {
+	if s.config.EventOutbox == nil || s.config.UserEventsChannel == "" {
+		return nil
+	}
+	return s.config.EventOutbox.Enqueue(ctx, q, s.config.UserEventsChannel, &userEventData{
+		Type:   event,
+		UserId: userId,
+		Time:   time.Now().UTC(),
+	})
+}
+
+// notifyEvents publishes queued events without waiting for the next outbox poll.
+func (s *AuthServiceServer) notifyEvents() {
+	if s.config.EventOutbox != nil {
+		s.config.EventOutbox.Notify()
+	}
+}
+
+// SignOutReason tells connected clients why their session is revoked.
+type SignOutReason string
+
+const (
+	SignOutReasonSignOut       SignOutReason = "sign_out"
+	SignOutReasonPasswordReset SignOutReason = "password_reset"
+	SignOutReasonEmailChange   SignOutReason = "email_change"
+	SignOutReasonDeleted       SignOutReason = "deleted"
+)
+
+// sessionRevokedData is pushed to the personal channel of the user before Centrifugo disconnects the user.
+type sessionRevokedData struct {
+	Type   string    `json:"type"`
+	UserId uuid.UUID `json:"user_id"`
+	// DeviceId is the device signed out, other devices of the user are signed out as well
+	DeviceId *uuid.UUID    `json:"device_id,omitempty"`
+	Reason   SignOutReason `json:"reason"`
+	Time     time.Time     `json:"time"`
+}
+
+// endUserSession ends the session of the user by the queries of the RPC transaction and queues the forced sign out,
+// connected clients get the message on the personal channel and are disconnected by Centrifugo once it is committed.
+// deviceId is the device signing out, nil when the session is revoked otherwise.
+func (s *AuthServiceServer) endUserSession(ctx context.Context, q *model.Queries, userId uuid.UUID, deviceId *uuid.UUID, reason SignOutReason) error {
+	if err := q.EndUserSession(ctx, userId); err != nil {
+		return err
+	}
+	if err := s.publishUserEvent(ctx, q, UserEventSessionRevoked, userId); err != nil {
+		return err
+	}
+	if s.config.EventOutbox == nil {
+		return nil
+	}
+	return s.config.EventOutbox.EnqueueSignOut(ctx, q, userId, &sessionRevokedData{
+		Type:     "session_revoked",
+		UserId:   userId,
+		DeviceId: deviceId,
+		Reason:   reason,
+		Time:     time.Now().UTC(),
+	})
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+
+	centrifugo "github.com/zs-dima/auth-service/internal/centrifugo"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	"github.com/zs-dima/auth-service/internal/outbox"
+)
+
+// testDb records statements executed by the queries, endUserSession runs :exec queries only.
+type testDb struct {
+	statements []testStatement
+}
+
+type testStatement struct {
+	sql  string
+	args []interface{}
+}
+
+func (db *testDb) Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+	db.statements = append(db.statements, testStatement{sql: sql, args: args})
+	return pgconn.CommandTag{}, nil
+}
+
+func (db *testDb) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	panic("unexpected query " + sql)
+}
+
+func (db *testDb) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	panic("unexpected query " + sql)
+}
+
+// queued returns events queued by EnqueueEvent.
+func (db *testDb) queued() []model.EnqueueEventParams {
+	var events []model.EnqueueEventParams
+	for _, statement := range db.statements {
+		if strings.Contains(statement.sql, "name: EnqueueEvent ") {
+			events = append(events, model.EnqueueEventParams{
+				Channel:        statement.args[0].(string),
+				Data:           statement.args[1].([]byte),
+				DisconnectUser: statement.args[2].(pgtype.Text),
+			})
+		}
+	}
+	return events
+}
+
+func TestEndUserSession(t *testing.T) {
+	log := zerolog.Nop()
+	eventOutbox := centrifugo.NewOutbox(nil, nil, &outbox.Options{}, &log)
+	userId := uuid.New()
+	deviceId := uuid.New()
+
+	tests := []struct {
+		name     string
+		config   *AuthServiceServerConfig
+		deviceId *uuid.UUID
+		reason   SignOutReason
+		// channels of the queued events, the sign out is queued last
+		channels []string
+	}{
+		{"without event bus", &AuthServiceServerConfig{}, &deviceId, SignOutReasonSignOut, nil},
+		{"sign out", &AuthServiceServerConfig{EventOutbox: eventOutbox}, &deviceId, SignOutReasonSignOut, []string{centrifugo.UserChannel(userId)}},
+		{
+			"password reset with user events",
+			&AuthServiceServerConfig{EventOutbox: eventOutbox, UserEventsChannel: "admin:users"},
+			nil,
+			SignOutReasonPasswordReset,
+			[]string{"admin:users", centrifugo.UserChannel(userId)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testServer(test.config)
+			db := &testDb{}
+
+			if err := s.endUserSession(context.Background(), model.New(db), userId, test.deviceId, test.reason); err != nil {
+				t.Fatalf("failed to end session: %v", err)
+			}
+
+			if len(db.statements) == 0 || !strings.Contains(db.statements[0].sql, "name: EndUserSession ") {
+				t.Fatalf("session is not ended first: %v", db.statements)
+			}
+			events := db.queued()
+			if len(events) != len(test.channels) {
+				t.Fatalf("got %d events, want %d", len(events), len(test.channels))
+			}
+			for i, event := range events {
+				if event.Channel != test.channels[i] {
+					t.Errorf("got channel %s, want %s", event.Channel, test.channels[i])
+				}
+			}
+			if len(events) == 0 {
+				return
+			}
+
+			// Only the sign out disconnects the user
+			for _, event := range events[:len(events)-1] {
+				if event.DisconnectUser.Valid {
+					t.Errorf("event of %s disconnects the user", event.Channel)
+				}
+			}
+			signOut := events[len(events)-1]
+			if !signOut.DisconnectUser.Valid || signOut.DisconnectUser.String != userId.String() {
+				t.Fatalf("got disconnect user %v, want %s", signOut.DisconnectUser, userId)
+			}
+			var data sessionRevokedData
+			if err := json.Unmarshal(signOut.Data, &data); err != nil {
+				t.Fatalf("failed to decode sign out: %v", err)
+			}
+			if data.Type != "session_revoked" || data.UserId != userId || data.Reason != test.reason {
+				t.Errorf("unexpected sign out %+v", data)
+			}
+			if (data.DeviceId == nil) != (test.deviceId == nil) || (data.DeviceId != nil && *data.DeviceId != *test.deviceId) {
+				t.Errorf("got device %v, want %v", data.DeviceId, test.deviceId)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	oidc "github.com/zs-dima/auth-service/internal/oidc"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// ExchangeToken issues a short-lived token of the user for the audience of another service, RFC 8693.
+// The calling OAuth client acts on behalf of the user and is recorded in the `act` claim,
+// the audience must be one of the exchange audiences of the client.
+func (s *AuthServiceServer) ExchangeToken(ctx context.Context, request *pb.ExchangeTokenRequest) (*pb.ExchangeTokenReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Exchanging token for %s by %s ...", request.Audience, principal)
+
+	if authInfo.ClientInfo == nil {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("token exchange is allowed to OAuth clients only"))
+	}
+	if s.config.OidcProvider == nil {
+		return nil, s.Err.FailedPrecondition("Token exchange is disabled", "OpenID Connect provider is not configured")
+	}
+	if request.SubjectTokenType != nil && *request.SubjectTokenType != oidc.TokenTypeAccessToken {
+		return nil, s.Err.InvalidArgument("Unsupported subject token type", fmt.Sprintf("Subject token type %s is not supported", *request.SubjectTokenType))
+	}
+
+	audience := strings.TrimSpace(request.Audience)
+	if audience == "" {
+		return nil, s.Err.InvalidArgument("Audience is required", fmt.Sprintf("Token exchange by %s without audience", principal))
+	}
+
+	client, err := s.DB.GetOAuthClient(ctx, authInfo.ClientInfo.Id)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(principal, err)
+	}
+	if !slices.Contains(client.ExchangeAudiences, audience) {
+		return nil, s.Err.InvalidArgument("Invalid audience", fmt.Sprintf("Audience %s is not allowed to %s", audience, principal))
+	}
+
+	// Delegated tokens never carry the exchange scope, so they could not be exchanged for broader ones
+	scopes := request.Scopes
+	if len(scopes) == 0 {
+		scopes = slices.DeleteFunc(slices.Clone(client.Scopes), func(scope string) bool { return scope == oidc.ScopeTokenExchange })
+	}
+	for _, scope := range scopes {
+		if scope == oidc.ScopeTokenExchange || !slices.Contains(client.Scopes, scope) {
+			return nil, s.Err.InvalidArgument("Invalid scope", fmt.Sprintf("Scope %s is not allowed to %s", scope, principal))
+		}
+	}
+
+	subject, err := s.parseSubjectToken(request.SubjectToken, client.ID)
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid subject token", fmt.Sprintf("Subject token exchanged by %s is invalid: %v", principal, err))
+	}
+
+	user, err := s.DB.GetActiveUserById(ctx, subject.UserId)
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid subject token", fmt.Sprintf("Subject user %s is not active: %v", subject.UserId, err))
+	}
+
+	token, expiresAt, err := s.config.OidcProvider.IssueExchangedToken(&user, &client, audience, scopes, subject)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to exchange token",
+			fmt.Sprintf("Failed to issue %s token for %s to %s", audience, user.Email, principal),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("%s token of %s issued to %s successfully", audience, user.Email, principal)
+
+	return &pb.ExchangeTokenReply{
+		AccessToken:     token,
+		IssuedTokenType: oidc.TokenTypeAccessToken,
+		ExpiresIn:       int32(time.Until(expiresAt).Seconds()),
+		Scopes:          scopes,
+	}, nil
+}
+
+// parseSubjectToken accepts user access tokens and tokens issued by the exchange with the client id as the audience.
+// The impersonator of impersonation tokens stays in the `act` claim, so the exchanged token is never a clean user token.
+func (s *AuthServiceServer) parseSubjectToken(subjectToken string, clientId string) (*oidc.ExchangeSubject, error) {
+	userId, expiresAt, actor, err := jwt.ParseAccessToken(subjectToken, s.config.JwtSecretKey)
+	if err == nil {
+		return &oidc.ExchangeSubject{UserId: userId, ExpiresAt: expiresAt, Actor: actor}, nil
+	}
+
+	subject, exchangedErr := s.config.OidcProvider.ParseExchangedToken(subjectToken, clientId)
+	if exchangedErr != nil {
+		return nil, fmt.Errorf("%w, %w", err, exchangedErr)
+	}
+	return subject, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	oidc "github.com/zs-dima/auth-service/internal/oidc"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+func TestExchangeTokenRequests(t *testing.T) {
+	clientContext := context.WithValue(context.Background(), jwt.UserClaimsKey, &jwt.JwtAuthInfo{
+		ClientInfo: &jwt.JwtClientInfo{Id: "billing", Scopes: []string{oidc.ScopeTokenExchange}},
+	})
+	idTokenType := "urn:ietf:params:oauth:token-type:id_token"
+	accessTokenType := oidc.TokenTypeAccessToken
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		provider *oidc.Provider
+		request  *pb.ExchangeTokenRequest
+		code     codes.Code
+	}{
+		{"by user", userContext(model.UserRoleAdministrator), &oidc.Provider{}, &pb.ExchangeTokenRequest{Audience: "orders"}, codes.PermissionDenied},
+		{"without provider", clientContext, nil, &pb.ExchangeTokenRequest{Audience: "orders"}, codes.FailedPrecondition},
+		{"ID token", clientContext, &oidc.Provider{}, &pb.ExchangeTokenRequest{Audience: "orders", SubjectTokenType: &idTokenType}, codes.InvalidArgument},
+		{"without audience", clientContext, &oidc.Provider{}, &pb.ExchangeTokenRequest{Audience: " ", SubjectTokenType: &accessTokenType}, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testServer(&AuthServiceServerConfig{OidcProvider: test.provider})
+
+			_, err := s.ExchangeToken(test.ctx, test.request)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
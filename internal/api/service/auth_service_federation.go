@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+func (s *AuthServiceServer) LoadFederationProviders(request *emptypb.Empty, stream pb.AuthService_LoadFederationProvidersServer) error {
+	s.Log.Info().Msgf("Loading federation providers")
+
+	if s.config.Federation == nil {
+		return nil
+	}
+
+	for _, provider := range s.config.Federation.Providers() {
+		err := stream.Send(&pb.FederationProvider{
+			Name:        provider.Name,
+			DisplayName: provider.DisplayName,
+			LoginUrl:    s.config.Federation.LoginUrl(provider.Name),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SignInWithFederation exchanges the ticket issued after the identity provider callback for the session.
+func (s *AuthServiceServer) SignInWithFederation(ctx context.Context, request *pb.SignInWithFederationRequest) (*pb.AuthInfo, error) {
+	s.Log.Info().Msgf("Signing in by identity provider ...")
+
+	if strings.TrimSpace(request.Ticket) == "" {
+		return nil, s.Err.InvalidArgument("Invalid sign in ticket", "Empty federated sign in ticket")
+	}
+	if request.DeviceInfo.GetId() == nil || request.InstallationId == nil {
+		return nil, s.Err.InvalidArgument("Device is required", "Federated sign in without device info")
+	}
+
+	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
+	installationId := tool.RpcIdToId(request.InstallationId)
+
+	ticket, err := s.DB.ConsumeUserToken(
+		ctx,
+		model.ConsumeUserTokenParams{
+			TokenHash: tool.HashToken(request.Ticket),
+			Purpose:   model.UserTokenPurposeFederatedSignIn,
+		})
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid sign in ticket", fmt.Sprintf("Federated sign in ticket is invalid or expired: %v", err))
+	}
+
+	user, err := s.DB.GetActiveUserById(ctx, ticket.UserID)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(ticket.Email, err)
+	}
+
+	res, err := s.signInUser(ctx, &user, deviceId, installationId, []string{jwt.AmrFederation})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed in by identity provider successfully", user.Email)
+
+	return res, nil
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Impersonate issues a short-lived access token of the user to the support staff viewing the service as the user.
+// The token names the impersonator in the `act` claim and comes without a refresh token, the impersonation is recorded in the audit log.
+func (s *AuthServiceServer) Impersonate(ctx context.Context, request *pb.ImpersonateRequest) (*pb.ImpersonateReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Impersonating user by %s ...", principal)
+
+	if err := s.requirePermission(authInfo, PermissionImpersonate); err != nil {
+		return nil, err
+	}
+
+	reason := strings.TrimSpace(request.Reason)
+	if reason == "" {
+		return nil, s.Err.InvalidArgument("Reason is required", fmt.Sprintf("Impersonation by %s without reason", principal))
+	}
+	if request.UserId == nil {
+		return nil, s.Err.InvalidArgument("User is required", fmt.Sprintf("Impersonation by %s without user", principal))
+	}
+
+	userId := tool.RpcIdToId(request.UserId)
+	if *userId == *authInfo.UserInfo.Id {
+		return nil, s.Err.InvalidArgument("Invalid user", fmt.Sprintf("%s can not impersonate themselves", principal))
+	}
+
+	user, err := s.DB.GetActiveUserById(ctx, *userId)
+	if err != nil {
+		return nil, s.Err.InvalidArgument("User not found", fmt.Sprintf("User %s to impersonate not found: %v", userId, err))
+	}
+	// Administrators are never impersonated, so impersonation does not escalate privileges
+	if user.Role == model.UserRoleAdministrator {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("administrator %s can not be impersonated", user.Email))
+	}
+
+	err = s.audit(
+		ctx,
+		AuditActionImpersonate,
+		&auditUser{id: authInfo.UserInfo.Id, email: authInfo.UserInfo.Email},
+		&auditUser{id: &user.ID, email: user.Email},
+		map[string]any{
+			"reason":       reason,
+			"ttl":          s.config.ImpersonationTtl.String(),
+			"device":       authInfo.DeviceId,
+			"installation": authInfo.InstallationId,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to impersonate user",
+			fmt.Sprintf("Failed to audit impersonation of %s by %s", user.Email, principal),
+			err,
+		)
+	}
+
+	generator := jwt.TokenGenerator{}
+	accessToken, expiresAt, err := generator.GenerateImpersonationToken(
+		&user,
+		authInfo.UserInfo,
+		authInfo.DeviceId,
+		authInfo.InstallationId,
+		s.config.ImpersonationTtl,
+		s.config.JwtSecretKey,
+	)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to impersonate user",
+			fmt.Sprintf("Failed to generate %s impersonation token", user.Email),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("%s impersonated by %s successfully", user.Email, principal)
+
+	return &pb.ImpersonateReply{
+		UserId:      tool.IdToRpcId(&user.ID),
+		UserName:    user.Name,
+		UserRole:    pb.UserRole(pb.UserRole_value[string(user.Role)]),
+		AccessToken: accessToken,
+		ExpiresAt:   timestamppb.New(expiresAt),
+	}, nil
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+func TestImpersonateRequests(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{})
+	userId := uuid.New()
+
+	admin := userContext(model.UserRoleAdministrator)
+	adminId := *jwt.ExtractAuthInfo(admin).UserInfo.Id
+	impersonatingAdmin := context.WithValue(context.Background(), jwt.UserClaimsKey, &jwt.JwtAuthInfo{
+		UserInfo:     &jwt.JwtUserInfo{Id: &userId, Role: jwt.JwtUserRole(model.UserRoleAdministrator), Email: "user@example.com"},
+		Impersonator: &jwt.JwtUserInfo{Id: &adminId, Email: "admin@example.com"},
+	})
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		request *pb.ImpersonateRequest
+		code    codes.Code
+	}{
+		{"by user", userContext(model.UserRoleUser), &pb.ImpersonateRequest{UserId: tool.IdToRpcId(&userId), Reason: "Ticket 42"}, codes.PermissionDenied},
+		{"while impersonating", impersonatingAdmin, &pb.ImpersonateRequest{UserId: tool.IdToRpcId(&userId), Reason: "Ticket 42"}, codes.PermissionDenied},
+		{"without reason", admin, &pb.ImpersonateRequest{UserId: tool.IdToRpcId(&userId), Reason: " "}, codes.InvalidArgument},
+		{"without user", admin, &pb.ImpersonateRequest{Reason: "Ticket 42"}, codes.InvalidArgument},
+		{"themselves", admin, &pb.ImpersonateRequest{UserId: tool.IdToRpcId(&adminId), Reason: "Ticket 42"}, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.Impersonate(test.ctx, test.request)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
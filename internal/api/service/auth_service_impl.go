@@ -6,13 +6,16 @@ import (
 	"fmt"
 	_ "image/jpeg"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
 
 	"github.com/jackc/pgx/v5/pgtype"
+	authn "github.com/zs-dima/auth-service/internal/authn"
 	model "github.com/zs-dima/auth-service/internal/gen/db"
 	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	mailer "github.com/zs-dima/auth-service/internal/mailer"
 	tool "github.com/zs-dima/auth-service/pkg/tool"
 	image_tool "github.com/zs-dima/auth-service/pkg/tool/image_tool"
 	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
@@ -26,7 +29,8 @@ func (s *AuthServiceServer) Auth(ctx context.Context, request *emptypb.Empty) (*
 
 	s.Log.Info().Msgf("Authenticating %s...", userEmail)
 
-	_, err := s.DB.GetActiveUser(ctx, userEmail)
+	// Look up by id, the email claim is outdated once the user changed the email
+	_, err := s.DB.GetActiveUserById(ctx, *authInfo.UserInfo.Id)
 	if err != nil {
 		return nil, s.Err.Unauthenticated(userEmail, err)
 	}
@@ -54,13 +58,14 @@ func (s *AuthServiceServer) RefreshToken(ctx context.Context, request *pb.Refres
 	deviceId := authInfo.DeviceId
 	installationId := authInfo.InstallationId
 
-	user, err := s.DB.GetActiveUser(ctx, userEmail)
+	user, err := s.DB.GetActiveUserById(ctx, *userId)
 	if err != nil {
 		return nil, s.Err.Unauthenticated(userEmail, err)
 	}
 
+	// Refreshed tokens keep the sign in time, so refreshing does not satisfy step-up authentication
 	generator := jwt.TokenGenerator{}
-	accessToken, err := generator.GenerateAccessToken(&user, deviceId, installationId, s.config.JwtSecretKey)
+	accessToken, err := generator.GenerateAccessToken(&user, deviceId, installationId, authInfo.AuthTime, authInfo.Amr, s.config.JwtSecretKey)
 	if err != nil {
 		return nil, s.Err.PermissionDenied(userEmail, err)
 	}
@@ -116,20 +121,48 @@ func (s *AuthServiceServer) SignIn(ctx context.Context, request *pb.SignInReques
 	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
 	installationId := tool.RpcIdToId(request.InstallationId)
 
-	user, err := s.DB.GetActiveUser(ctx, userEmail)
-	if err != nil {
+	user, err := s.config.Authenticator.Authenticate(ctx, userEmail, request.Password)
+	if errors.Is(err, authn.ErrInvalidCredentials) {
 		return nil, s.Err.Unauthenticated(userEmail, err)
 	}
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to authenticate %s", userEmail),
+			err,
+		)
+	}
 
-	encryptor := tool.Encryptor{}
-	// pwd, _ := encryptor.Hash("admin")
-	// s.Log.Warn().Msgf(pwd)
-	if !encryptor.Validate(request.Password, user.Password) {
-		return nil, s.Err.Unauthenticated(userEmail)
+	if s.config.RequireVerifiedEmail && !user.EmailVerifiedAt.Valid {
+		return nil, s.Err.FailedPrecondition(
+			"Email is not verified",
+			fmt.Sprintf("Sign in blocked until %s email is verified", userEmail),
+		)
 	}
 
+	res, err := s.signInUser(ctx, user, deviceId, installationId, []string{jwt.AmrPassword})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("Signed in successfully")
+
+	return res, nil
+}
+
+// issueAuthInfo starts a new user session on the device and issues its tokens, amr lists the methods the user signed in with.
+func (s *AuthServiceServer) issueAuthInfo(
+	ctx context.Context,
+	user *model.User,
+	deviceId *uuid.UUID,
+	installationId *uuid.UUID,
+	amr []string,
+) (*pb.AuthInfo, error) {
+	userEmail := user.Email
+	encryptor := tool.Encryptor{}
+
 	generator := jwt.TokenGenerator{}
-	accessToken, err := generator.GenerateAccessToken(&user, deviceId, installationId, s.config.JwtSecretKey)
+	accessToken, err := generator.GenerateAccessToken(user, deviceId, installationId, time.Now(), amr, s.config.JwtSecretKey)
 	if err != nil {
 		return nil, s.Err.Internal(
 			"failed to sign in",
@@ -165,8 +198,6 @@ func (s *AuthServiceServer) SignIn(ctx context.Context, request *pb.SignInReques
 		return nil, s.Err.PermissionDenied(userEmail, err)
 	}
 
-	s.Log.Info().Msgf("Signed in successfully")
-
 	res := &pb.AuthInfo{
 		UserId:       tool.IdToRpcId(&user.ID),
 		UserName:     user.Name,
@@ -188,16 +219,37 @@ func (s *AuthServiceServer) SignOut(ctx context.Context, in *emptypb.Empty) (*pb
 
 	s.Log.Info().Msgf("Signing out %s...", userEmail)
 
-	user, err := s.DB.GetActiveUser(ctx, userEmail)
+	user, err := s.DB.GetActiveUserById(ctx, *authInfo.UserInfo.Id)
 	if err != nil {
 		return nil, s.Err.Unauthenticated(userEmail, err)
 	}
 
-	err = s.DB.EndUserSession(ctx, user.ID)
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign out",
+			fmt.Sprintf("Failed to sign out %s", userEmail),
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	err = s.endUserSession(ctx, qtx, user.ID, authInfo.DeviceId, SignOutReasonSignOut)
 	if err != nil {
 		return nil, s.Err.PermissionDenied(userEmail, err)
 	}
 
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign out",
+			fmt.Sprintf("Failed to sign out %s", userEmail),
+			err,
+		)
+	}
+	s.notifyEvents()
+
 	s.Log.Info().Msgf("Signed out successfully")
 
 	res := &pb.ResultReply{
@@ -212,15 +264,164 @@ func (s *AuthServiceServer) ResetPassword(ctx context.Context, request *pb.Reset
 
 	s.Log.Info().Msgf("Resetting %s password ...", userEmail)
 
-	_, err := s.DB.GetActiveUser(ctx, userEmail)
+	if err := s.requireAppUrl("Password reset"); err != nil {
+		return nil, err
+	}
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	// Directory domains are rejected by the domain alone, before the lookup, so registered users are not disclosed
+	if s.config.Authenticator.IsExternal(userEmail) {
+		return nil, s.Err.FailedPrecondition("Password is managed by the directory", fmt.Sprintf("Password reset of %s rejected, directory domain", userEmail))
+	}
+
+	// Reply the same way for unknown emails to not disclose registered users
+	user, err := s.DB.GetActiveUser(ctx, userEmail)
 	if err != nil {
-		return nil, s.Err.Unauthenticated(userEmail, err)
+		s.Log.Warn().Msgf("Password reset requested for unknown user %s", userEmail)
+		return res, nil
+	}
+
+	generator := jwt.TokenGenerator{}
+	token, expiresAt, err := generator.GenerateToken(s.config.PasswordResetTtl)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			fmt.Sprintf("Failed to generate %s reset token", userEmail),
+			err,
+		)
+	}
+
+	err = s.DB.RevokeUserTokens(
+		ctx,
+		model.RevokeUserTokensParams{
+			UserID:  user.ID,
+			Purpose: model.UserTokenPurposePasswordReset,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			fmt.Sprintf("Failed to revoke %s reset tokens", userEmail),
+			err,
+		)
 	}
 
-	// TODO Email reset password link
+	err = s.DB.CreateUserToken(
+		ctx,
+		model.CreateUserTokenParams{
+			TokenHash: tool.HashToken(token),
+			UserID:    user.ID,
+			Purpose:   model.UserTokenPurposePasswordReset,
+			Email:     user.Email,
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			fmt.Sprintf("Failed to save %s reset token", userEmail),
+			err,
+		)
+	}
+
+	err = s.sendMail(ctx, user.Email, mailer.TemplatePasswordReset, map[string]any{
+		"Name":      user.Name,
+		"Link":      s.appLink("reset-password", token),
+		"ExpiresAt": formatExpiresAt(expiresAt),
+	})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			fmt.Sprintf("Failed to send %s reset password link", userEmail),
+			err,
+		)
+	}
 
 	s.Log.Info().Msgf("Reset password link sent to %s successfully", userEmail)
 
+	return res, nil
+}
+
+func (s *AuthServiceServer) ConfirmPasswordReset(ctx context.Context, request *pb.ConfirmPasswordResetRequest) (*pb.ResultReply, error) {
+	s.Log.Info().Msgf("Confirming password reset ...")
+
+	if strings.TrimSpace(request.Token) == "" || request.Password == "" {
+		return nil, s.Err.InvalidArgument("Token and password are required", "Password reset without token or password")
+	}
+
+	encryptor := tool.Encryptor{}
+	passwordHash, err := encryptor.Hash(request.Password)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			"Failed to hash reset password",
+			err,
+		)
+	}
+
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			"Failed to begin password reset transaction",
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	token, err := qtx.ConsumeUserToken(
+		ctx,
+		model.ConsumeUserTokenParams{
+			TokenHash: tool.HashToken(request.Token),
+			Purpose:   model.UserTokenPurposePasswordReset,
+		})
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid reset password link", fmt.Sprintf("Password reset token is invalid or expired: %v", err))
+	}
+
+	err = qtx.UpdateUserPasswordById(
+		ctx,
+		model.UpdateUserPasswordByIdParams{
+			ID:       token.UserID,
+			Password: passwordHash,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			fmt.Sprintf("Failed to update %s password", token.Email),
+			err,
+		)
+	}
+
+	// Sessions opened with the forgotten password are not trusted anymore
+	err = s.endUserSession(ctx, qtx, token.UserID, nil, SignOutReasonPasswordReset)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			fmt.Sprintf("Failed to end %s sessions", token.Email),
+			err,
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to reset password",
+			fmt.Sprintf("Failed to reset %s password", token.Email),
+			err,
+		)
+	}
+	s.notifyEvents()
+
+	user, err := s.DB.GetUser(ctx, token.UserID)
+	if err == nil {
+		s.notifyPasswordChanged(ctx, &user)
+	}
+
+	s.Log.Info().Msgf("%s password reset successfully", token.Email)
+
 	res := &pb.ResultReply{
 		Result: true,
 	}
@@ -233,6 +434,10 @@ func (s *AuthServiceServer) SetPassword(ctx context.Context, request *pb.SetPass
 
 	s.Log.Info().Msgf("Updating %s password ...", userEmail)
 
+	if s.config.Authenticator.IsExternal(userEmail) {
+		return nil, s.Err.FailedPrecondition("Password is managed by the directory", fmt.Sprintf("Password update of %s rejected, directory user", userEmail))
+	}
+
 	encryptor := tool.Encryptor{}
 	passwordHash, err := encryptor.Hash(request.Password)
 	if err != nil {
@@ -253,7 +458,10 @@ func (s *AuthServiceServer) SetPassword(ctx context.Context, request *pb.SetPass
 		return nil, s.Err.Unauthenticated(userEmail, err)
 	}
 
-	// TODO Email notification
+	user, err := s.DB.GetActiveUser(ctx, userEmail)
+	if err == nil {
+		s.notifyPasswordChanged(ctx, &user)
+	}
 
 	s.Log.Info().Msgf("%s password updated successfully", userEmail)
 
@@ -264,11 +472,21 @@ func (s *AuthServiceServer) SetPassword(ctx context.Context, request *pb.SetPass
 	return res, nil
 }
 
+// notifyPasswordChanged lets the user react on an unexpected password change.
+func (s *AuthServiceServer) notifyPasswordChanged(ctx context.Context, user *model.User) {
+	err := s.sendMail(ctx, user.Email, mailer.TemplatePasswordChanged, map[string]any{
+		"Name": user.Name,
+	})
+	if err != nil {
+		s.Log.Error().Msgf("Failed to notify %s about password change: %v", user.Email, err)
+	}
+}
+
 func (s *AuthServiceServer) LoadUsersInfo(request *emptypb.Empty, stream pb.AuthService_LoadUsersInfoServer) error {
 	ctx := stream.Context()
 
 	authInfo := jwt.ExtractAuthInfo(ctx)
-	userEmail := authInfo.UserInfo.Email
+	userEmail := authInfo.Principal()
 
 	s.Log.Info().Msgf("Loading users info %s", userEmail)
 
@@ -304,7 +522,7 @@ func (s *AuthServiceServer) LoadUserAvatar(request *pb.LoadUserAvatarRequest, st
 	ctx := stream.Context()
 
 	authInfo := jwt.ExtractAuthInfo(ctx)
-	userEmail := authInfo.UserInfo.Email
+	userEmail := authInfo.Principal()
 
 	var userIds []uuid.UUID
 	for _, id := range request.UserId {
@@ -343,7 +561,7 @@ func (s *AuthServiceServer) LoadUsers(request *pb.UserId, stream pb.AuthService_
 	ctx := stream.Context()
 
 	authInfo := jwt.ExtractAuthInfo(ctx)
-	userEmail := authInfo.UserInfo.Email
+	userEmail := authInfo.Principal()
 
 	s.Log.Info().Msgf("Loading users %s", userEmail)
 
@@ -354,16 +572,22 @@ func (s *AuthServiceServer) LoadUsers(request *pb.UserId, stream pb.AuthService_
 
 	for _, user := range users {
 		userInfo := &pb.User{
-			Id:      tool.IdToRpcId(&user.ID),
-			Name:    user.Name,
-			Email:   user.Email,
-			Role:    pb.UserRole(pb.UserRole_value[string(user.Role)]),
-			Deleted: user.Deleted.Bool,
+			Id:             tool.IdToRpcId(&user.ID),
+			Name:           user.Name,
+			Email:          user.Email,
+			Role:           pb.UserRole(pb.UserRole_value[string(user.Role)]),
+			Deleted:        user.Deleted.Bool,
+			EmailVerified:  user.EmailVerified,
+			SmsMfaEnabled:  user.SmsMfaEnabled,
+			ServiceAccount: user.ServiceAccount,
 		}
 
 		if user.Blurhash.Valid {
 			userInfo.Blurhash = &user.Blurhash.String
 		}
+		if user.Phone.Valid {
+			userInfo.Phone = &user.Phone.String
+		}
 
 		if err := stream.Send(userInfo); err != nil {
 			return err
@@ -392,7 +616,18 @@ func (s *AuthServiceServer) CreateUser(ctx context.Context, request *pb.CreateUs
 		)
 	}
 
-	_, err = s.DB.CreateUser(
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			fmt.Sprintf("Failed to save %s", userEmail),
+			fmt.Sprintf("Failed to save user: %s", userEmail),
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	_, err = qtx.CreateUser(
 		ctx,
 		model.CreateUserParams{
 			ID:       *userId,
@@ -410,6 +645,34 @@ func (s *AuthServiceServer) CreateUser(ctx context.Context, request *pb.CreateUs
 		)
 	}
 
+	err = s.publishUserEvent(ctx, qtx, UserEventCreated, *userId)
+	if err != nil {
+		return nil, s.Err.Internal(
+			fmt.Sprintf("Failed to save %s", userEmail),
+			fmt.Sprintf("Failed to publish user %s created event", userId),
+			err,
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			fmt.Sprintf("Failed to save %s", userEmail),
+			fmt.Sprintf("Failed to save user: %s", userEmail),
+			err,
+		)
+	}
+	s.notifyEvents()
+
+	user, err := s.DB.GetUser(ctx, *userId)
+	if err == nil {
+		err = s.sendEmailVerification(ctx, &user)
+	}
+	if err != nil {
+		// The user is created anyway, verification could be requested again
+		s.Log.Error().Msgf("Failed to send %s email verification: %v", request.Email, err)
+	}
+
 	s.Log.Info().Msgf("%s user saved successfully", userEmail)
 
 	res := &pb.ResultReply{
@@ -426,12 +689,56 @@ func (s *AuthServiceServer) UpdateUser(ctx context.Context, request *pb.UpdateUs
 
 	s.Log.Info().Msgf("Saving %s user ...", userEmail)
 
-	err := s.DB.UpdateUser(
+	user, err := s.DB.GetUser(ctx, *userId)
+	if err != nil {
+		return nil, s.Err.InvalidArgument(
+			"User not found",
+			fmt.Sprintf("Failed to load user %s: %v", userId, err),
+		)
+	}
+
+	// Email is swapped only once the new address is confirmed, empty email keeps the current one
+	email, emailValid := tool.NormalizeEmail(request.Email)
+	if email != "" && !emailValid {
+		return nil, s.Err.InvalidArgument("Invalid email", fmt.Sprintf("Invalid %s email %s", user.Email, email))
+	}
+	emailChanged := email != "" && !strings.EqualFold(email, user.Email)
+	if emailChanged {
+		if err := s.requireAppUrl("Email change"); err != nil {
+			return nil, err
+		}
+		taken, err := s.DB.IsEmailTaken(ctx, email)
+		if err != nil {
+			return nil, s.Err.Internal(
+				fmt.Sprintf("Failed to save %s", userEmail),
+				fmt.Sprintf("Failed to check %s availability", email),
+				err,
+			)
+		}
+		if taken {
+			return nil, s.Err.InvalidArgument(
+				"Email is already in use",
+				fmt.Sprintf("Email %s is already in use", email),
+			)
+		}
+	}
+
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			fmt.Sprintf("Failed to save %s", userEmail),
+			fmt.Sprintf("Failed to save user: %s", userEmail),
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	err = qtx.UpdateUser(
 		ctx,
 		model.UpdateUserParams{
 			ID:      *userId,
 			Name:    request.Name,
-			Email:   request.Email,
 			Role:    model.UserRole(pb.UserRole_name[int32(request.Role)]),
 			Deleted: request.Deleted,
 		})
@@ -443,6 +750,46 @@ func (s *AuthServiceServer) UpdateUser(ctx context.Context, request *pb.UpdateUs
 		)
 	}
 
+	event := UserEventUpdated
+	if request.Deleted && !user.DeletedAt.Valid {
+		event = UserEventDeleted
+
+		// Deactivated user is signed out of all devices right away
+		err = s.endUserSession(ctx, qtx, user.ID, nil, SignOutReasonDeleted)
+		if err != nil {
+			return nil, s.Err.Internal(
+				fmt.Sprintf("Failed to save %s", userEmail),
+				fmt.Sprintf("Failed to end %s sessions", user.Email),
+				err,
+			)
+		}
+	}
+	err = s.publishUserEvent(ctx, qtx, event, user.ID)
+	if err != nil {
+		return nil, s.Err.Internal(
+			fmt.Sprintf("Failed to save %s", userEmail),
+			fmt.Sprintf("Failed to publish user %s event %s", user.ID, event),
+			err,
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			fmt.Sprintf("Failed to save %s", userEmail),
+			fmt.Sprintf("Failed to save user: %s", userEmail),
+			err,
+		)
+	}
+	s.notifyEvents()
+
+	// The user is saved already, the email change could be requested again
+	if emailChanged {
+		if err := s.requestEmailChange(ctx, &user, email); err != nil {
+			s.Log.Error().Msgf("Failed to request %s email change to %s: %v", user.Email, email, err)
+		}
+	}
+
 	s.Log.Info().Msgf("%s user saved successfully", userEmail)
 
 	res := &pb.ResultReply{
@@ -508,6 +855,15 @@ func (s *AuthServiceServer) SaveUserPhoto(ctx context.Context, request *pb.UserP
 		)
 	}
 
+	err = s.publishUserEvent(ctx, qtx, UserEventPhotoChanged, *userId)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to save photo",
+			fmt.Sprintf("Failed to publish user %s photo changed event", userId),
+			err,
+		)
+	}
+
 	err = tx.Commit(ctx)
 	if err != nil {
 		return nil, s.Err.Internal(
@@ -516,6 +872,7 @@ func (s *AuthServiceServer) SaveUserPhoto(ctx context.Context, request *pb.UserP
 			err,
 		)
 	}
+	s.notifyEvents()
 
 	s.Log.Info().Msgf("%s avatar saved successfully", userEmail)
 
@@ -0,0 +1,423 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	mailer "github.com/zs-dima/auth-service/internal/mailer"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+	timestamppb "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *AuthServiceServer) InviteUser(ctx context.Context, request *pb.InviteUserRequest) (*pb.Invitation, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+	inviteeEmail := strings.TrimSpace(request.Email)
+
+	s.Log.Info().Msgf("Inviting %s by %s ...", inviteeEmail, userEmail)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+	if err := s.requireAppUrl("Invitation"); err != nil {
+		return nil, err
+	}
+
+	if inviteeEmail == "" {
+		return nil, s.Err.InvalidArgument("Email is required", "Invitation email is empty")
+	}
+
+	taken, err := s.DB.IsEmailTaken(ctx, inviteeEmail)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to invite user",
+			fmt.Sprintf("Failed to check %s availability", inviteeEmail),
+			err,
+		)
+	}
+	if taken {
+		return nil, s.Err.InvalidArgument(
+			"Email is already in use",
+			fmt.Sprintf("Email %s is already in use", inviteeEmail),
+		)
+	}
+
+	generator := jwt.TokenGenerator{}
+	token, expiresAt, err := generator.GenerateToken(s.config.InvitationTtl)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to invite user",
+			fmt.Sprintf("Failed to generate %s invitation token", inviteeEmail),
+			err,
+		)
+	}
+
+	invitation := model.UserInvitation{
+		ID:        uuid.New(),
+		UserID:    uuid.NullUUID{UUID: uuid.New(), Valid: true},
+		Email:     inviteeEmail,
+		Role:      model.UserRole(pb.UserRole_name[int32(request.Role)]),
+		TokenHash: tool.HashToken(token),
+		InvitedBy: uuid.NullUUID{UUID: *authInfo.UserInfo.Id, Valid: true},
+		ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	}
+
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to invite user",
+			fmt.Sprintf("Failed to invite %s", inviteeEmail),
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	// Pending user could not sign in, empty password never matches a bcrypt hash
+	_, err = qtx.CreateUser(
+		ctx,
+		model.CreateUserParams{
+			ID:       invitation.UserID.UUID,
+			Name:     inviteeEmail,
+			Email:    inviteeEmail,
+			Password: "",
+			Role:     invitation.Role,
+			Deleted:  false,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to invite user",
+			fmt.Sprintf("Failed to create pending user %s", inviteeEmail),
+			err,
+		)
+	}
+
+	err = qtx.CreateInvitation(
+		ctx,
+		model.CreateInvitationParams{
+			ID:        invitation.ID,
+			UserID:    invitation.UserID,
+			Email:     invitation.Email,
+			Role:      invitation.Role,
+			TokenHash: invitation.TokenHash,
+			InvitedBy: invitation.InvitedBy,
+			ExpiresAt: invitation.ExpiresAt,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to invite user",
+			fmt.Sprintf("Failed to save %s invitation", inviteeEmail),
+			err,
+		)
+	}
+
+	err = s.publishUserEvent(ctx, qtx, UserEventCreated, invitation.UserID.UUID)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to invite user",
+			fmt.Sprintf("Failed to publish pending user %s created event", inviteeEmail),
+			err,
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to invite user",
+			fmt.Sprintf("Failed to invite %s", inviteeEmail),
+			err,
+		)
+	}
+	s.notifyEvents()
+
+	err = s.sendInvitation(ctx, inviteeEmail, token, expiresAt)
+	if err != nil {
+		// Invitation is saved anyway, it could be resent
+		s.Log.Error().Msgf("Failed to send %s invitation: %v", inviteeEmail, err)
+	}
+
+	s.Log.Info().Msgf("%s invited successfully", inviteeEmail)
+
+	return invitationToRpc(&invitation), nil
+}
+
+func (s *AuthServiceServer) AcceptInvitation(ctx context.Context, request *pb.AcceptInvitationRequest) (*pb.ResultReply, error) {
+	s.Log.Info().Msgf("Accepting invitation ...")
+
+	if strings.TrimSpace(request.Token) == "" {
+		return nil, s.Err.InvalidArgument("Invalid invitation link", "Empty invitation token")
+	}
+	if strings.TrimSpace(request.Name) == "" || request.Password == "" {
+		return nil, s.Err.InvalidArgument("Name and password are required", "Invitation accepted without name or password")
+	}
+
+	invitation, err := s.acceptInvitation(ctx, request.Token, request.Name, request.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s invitation accepted successfully", invitation.Email)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) LoadInvitations(request *emptypb.Empty, stream pb.AuthService_LoadInvitationsServer) error {
+	ctx := stream.Context()
+
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Loading invitations %s", userEmail)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return err
+	}
+
+	invitations, err := s.DB.LoadInvitations(ctx)
+	if err != nil {
+		return s.Err.Internal(
+			"Failed to load invitations",
+			fmt.Sprintf("Failed to load invitations %s", userEmail),
+			err,
+		)
+	}
+
+	for _, invitation := range invitations {
+		if err := stream.Send(invitationToRpc(&invitation)); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Info().Msgf("Loaded invitations %s successfully", userEmail)
+
+	return nil
+}
+
+func (s *AuthServiceServer) ResendInvitation(ctx context.Context, request *pb.InvitationId) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+	invitationId := tool.RpcIdToId(request.Id)
+
+	s.Log.Info().Msgf("Resending %s invitation by %s ...", invitationId, userEmail)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+	if err := s.requireAppUrl("Invitation"); err != nil {
+		return nil, err
+	}
+
+	invitation, err := s.DB.GetInvitation(ctx, *invitationId)
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invitation not found", fmt.Sprintf("Failed to load %s invitation: %v", invitationId, err))
+	}
+
+	generator := jwt.TokenGenerator{}
+	token, expiresAt, err := generator.GenerateToken(s.config.InvitationTtl)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to resend invitation",
+			fmt.Sprintf("Failed to generate %s invitation token", invitation.Email),
+			err,
+		)
+	}
+
+	// Previous link stops working as its token hash is replaced
+	rows, err := s.DB.RenewInvitation(
+		ctx,
+		model.RenewInvitationParams{
+			ID:        invitation.ID,
+			TokenHash: tool.HashToken(token),
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to resend invitation",
+			fmt.Sprintf("Failed to renew %s invitation", invitation.Email),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.FailedPrecondition("Invitation is closed", fmt.Sprintf("%s invitation is accepted or cancelled", invitation.Email))
+	}
+
+	err = s.sendInvitation(ctx, invitation.Email, token, expiresAt)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to resend invitation",
+			fmt.Sprintf("Failed to send %s invitation", invitation.Email),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("%s invitation resent successfully", invitation.Email)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) CancelInvitation(ctx context.Context, request *pb.InvitationId) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+	invitationId := tool.RpcIdToId(request.Id)
+
+	s.Log.Info().Msgf("Cancelling %s invitation by %s ...", invitationId, userEmail)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to cancel invitation",
+			fmt.Sprintf("Failed to cancel %s invitation", invitationId),
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	pendingUserId, err := qtx.CancelInvitation(ctx, *invitationId)
+	if err != nil {
+		return nil, s.Err.FailedPrecondition("Invitation is closed", fmt.Sprintf("%s invitation is not pending: %v", invitationId, err))
+	}
+
+	// Remove the pending user to let the email be invited again
+	if pendingUserId.Valid {
+		err = qtx.DeletePendingUser(ctx, pendingUserId.UUID)
+		if err != nil {
+			return nil, s.Err.Internal(
+				"Failed to cancel invitation",
+				fmt.Sprintf("Failed to delete %s pending user", pendingUserId.UUID),
+				err,
+			)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to cancel invitation",
+			fmt.Sprintf("Failed to cancel %s invitation", invitationId),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("%s invitation cancelled successfully", invitationId)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+// acceptInvitation completes the pending user with the name and password chosen by the invitee.
+func (s *AuthServiceServer) acceptInvitation(ctx context.Context, token string, name string, password string) (*model.AcceptInvitationRow, error) {
+	encryptor := tool.Encryptor{}
+	passwordHash, err := encryptor.Hash(password)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to accept invitation",
+			"Failed to hash invited user password",
+			err,
+		)
+	}
+
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to accept invitation",
+			"Failed to begin invitation transaction",
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	invitation, err := qtx.AcceptInvitation(ctx, tool.HashToken(token))
+	if err != nil || !invitation.UserID.Valid {
+		return nil, s.Err.InvalidArgument("Invalid invitation link", fmt.Sprintf("Invitation token is invalid or expired: %v", err))
+	}
+
+	// Invitation link proves the email ownership
+	err = qtx.CompleteInvitedUser(
+		ctx,
+		model.CompleteInvitedUserParams{
+			ID:       invitation.UserID.UUID,
+			Name:     strings.TrimSpace(name),
+			Password: passwordHash,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to accept invitation",
+			fmt.Sprintf("Failed to complete %s user", invitation.Email),
+			err,
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to accept invitation",
+			fmt.Sprintf("Failed to accept %s invitation", invitation.Email),
+			err,
+		)
+	}
+
+	return &invitation, nil
+}
+
+func (s *AuthServiceServer) sendInvitation(ctx context.Context, email string, token string, expiresAt time.Time) error {
+	link := s.appLink("accept-invitation", token)
+
+	return s.sendMail(ctx, email, mailer.TemplateInvitation, map[string]any{
+		"Link":      link,
+		"ExpiresAt": formatExpiresAt(expiresAt),
+	})
+}
+
+func invitationToRpc(invitation *model.UserInvitation) *pb.Invitation {
+	status := pb.InvitationStatus_invitation_pending
+	switch {
+	case invitation.AcceptedAt.Valid:
+		status = pb.InvitationStatus_invitation_accepted
+	case invitation.CancelledAt.Valid:
+		status = pb.InvitationStatus_invitation_cancelled
+	case invitation.ExpiresAt.Time.Before(time.Now()):
+		status = pb.InvitationStatus_invitation_expired
+	}
+
+	res := &pb.Invitation{
+		Id:        tool.IdToRpcId(&invitation.ID),
+		Email:     invitation.Email,
+		Role:      pb.UserRole(pb.UserRole_value[string(invitation.Role)]),
+		Status:    status,
+		ExpiresAt: timestamppb.New(invitation.ExpiresAt.Time),
+		CreatedAt: timestamppb.New(invitation.CreatedAt.Time),
+	}
+
+	if invitation.InvitedBy.Valid {
+		res.InvitedBy = tool.IdToRpcId(&invitation.InvitedBy.UUID)
+	}
+
+	return res
+}
@@ -0,0 +1,154 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// userContext is the context of a request authenticated by the interceptor as a user of the role.
+func userContext(role model.UserRole) context.Context {
+	userId := uuid.New()
+	return context.WithValue(context.Background(), jwt.UserClaimsKey, &jwt.JwtAuthInfo{
+		UserInfo: &jwt.JwtUserInfo{Id: &userId, Role: jwt.JwtUserRole(role), Email: string(role) + "@example.com"},
+	})
+}
+
+func TestInvitationRequests(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{AppUrl: "https://app.example.com"})
+	withoutAppUrl := testServer(&AuthServiceServerConfig{})
+	invitationId := uuid.New()
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{
+			"invite by user",
+			func() error {
+				_, err := s.InviteUser(userContext(model.UserRoleUser), &pb.InviteUserRequest{Email: "new@example.com"})
+				return err
+			},
+			codes.PermissionDenied,
+		},
+		{
+			"invite without APP_URL",
+			func() error {
+				_, err := withoutAppUrl.InviteUser(userContext(model.UserRoleAdministrator), &pb.InviteUserRequest{Email: "new@example.com"})
+				return err
+			},
+			codes.FailedPrecondition,
+		},
+		{
+			"invite without email",
+			func() error {
+				_, err := s.InviteUser(userContext(model.UserRoleAdministrator), &pb.InviteUserRequest{Email: " "})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"resend by user",
+			func() error {
+				_, err := s.ResendInvitation(userContext(model.UserRoleUser), &pb.InvitationId{Id: tool.IdToRpcId(&invitationId)})
+				return err
+			},
+			codes.PermissionDenied,
+		},
+		{
+			"resend without APP_URL",
+			func() error {
+				_, err := withoutAppUrl.ResendInvitation(userContext(model.UserRoleAdministrator), &pb.InvitationId{Id: tool.IdToRpcId(&invitationId)})
+				return err
+			},
+			codes.FailedPrecondition,
+		},
+		{
+			"cancel by user",
+			func() error {
+				_, err := s.CancelInvitation(userContext(model.UserRoleUser), &pb.InvitationId{Id: tool.IdToRpcId(&invitationId)})
+				return err
+			},
+			codes.PermissionDenied,
+		},
+		{
+			"accept without token",
+			func() error {
+				_, err := s.AcceptInvitation(context.Background(), &pb.AcceptInvitationRequest{Token: " ", Name: "User", Password: "secret"})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"accept without password",
+			func() error {
+				_, err := s.AcceptInvitation(context.Background(), &pb.AcceptInvitationRequest{Token: "token", Name: "User"})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"accept without name",
+			func() error {
+				_, err := s.AcceptInvitation(context.Background(), &pb.AcceptInvitationRequest{Token: "token", Name: " ", Password: "secret"})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+func TestInvitationStatus(t *testing.T) {
+	now := pgtype.Timestamp{Time: time.Now(), Valid: true}
+	valid := pgtype.Timestamp{Time: time.Now().Add(time.Hour), Valid: true}
+	expired := pgtype.Timestamp{Time: time.Now().Add(-time.Hour), Valid: true}
+
+	tests := []struct {
+		name       string
+		invitation model.UserInvitation
+		want       pb.InvitationStatus
+	}{
+		{"pending", model.UserInvitation{ExpiresAt: valid}, pb.InvitationStatus_invitation_pending},
+		{"expired", model.UserInvitation{ExpiresAt: expired}, pb.InvitationStatus_invitation_expired},
+		{"accepted", model.UserInvitation{ExpiresAt: valid, AcceptedAt: now}, pb.InvitationStatus_invitation_accepted},
+		{"accepted and expired", model.UserInvitation{ExpiresAt: expired, AcceptedAt: now}, pb.InvitationStatus_invitation_accepted},
+		{"cancelled", model.UserInvitation{ExpiresAt: valid, CancelledAt: now}, pb.InvitationStatus_invitation_cancelled},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.invitation.ID = uuid.New()
+			test.invitation.Role = model.UserRoleUser
+
+			invitation := invitationToRpc(&test.invitation)
+
+			if invitation.Status != test.want {
+				t.Fatalf("got %s, want %s", invitation.Status, test.want)
+			}
+			if invitation.Role != pb.UserRole_user || invitation.InvitedBy != nil {
+				t.Fatalf("unexpected invitation %v", invitation)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	oidc "github.com/zs-dima/auth-service/internal/oidc"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// AuthorizeOAuthClient completes the OpenID Connect authorization request for the signed in user.
+// The client application login page receives the request query from the authorization endpoint.
+func (s *AuthServiceServer) AuthorizeOAuthClient(ctx context.Context, request *pb.AuthorizeOAuthClientRequest) (*pb.AuthorizeOAuthClientReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Authorizing OAuth client for %s ...", principal)
+
+	if s.config.OidcProvider == nil {
+		return nil, s.Err.FailedPrecondition("OpenID Connect is disabled", "OpenID Connect provider is not configured")
+	}
+	if authInfo.UserInfo == nil {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("user is required"))
+	}
+
+	redirectUri, err := s.config.OidcProvider.Authorize(ctx, *authInfo.UserInfo.Id, request.Query, request.Deny)
+	if err != nil {
+		var oauthErr *oidc.Error
+		if errors.As(err, &oauthErr) {
+			return nil, s.Err.InvalidArgument("Invalid authorization request", fmt.Sprintf("Authorization request of %s is invalid: %v", principal, oauthErr))
+		}
+		return nil, s.Err.Internal(
+			"Failed to authorize client",
+			fmt.Sprintf("Failed to authorize OAuth client for %s", principal),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("OAuth client authorized for %s successfully", principal)
+
+	return &pb.AuthorizeOAuthClientReply{RedirectUri: redirectUri}, nil
+}
+
+func (s *AuthServiceServer) CreateOAuthClient(ctx context.Context, request *pb.SaveOAuthClientRequest) (*pb.OAuthClientSecretReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+	clientId := strings.TrimSpace(request.Id)
+
+	s.Log.Info().Msgf("Creating OAuth client %s by %s ...", clientId, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+	if err := s.validateOAuthClient(request, request.Confidential); err != nil {
+		return nil, err
+	}
+
+	var secret *string
+	secretHash := pgtype.Text{}
+	if request.Confidential {
+		plain, hash, err := s.generateClientSecret()
+		if err != nil {
+			return nil, s.Err.Internal(
+				"Failed to create OAuth client",
+				fmt.Sprintf("Failed to generate OAuth client %s secret", clientId),
+				err,
+			)
+		}
+		secret = &plain
+		secretHash = pgtype.Text{String: hash, Valid: true}
+	}
+
+	err := s.DB.CreateOAuthClient(
+		ctx,
+		model.CreateOAuthClientParams{
+			ID:                clientId,
+			Name:              strings.TrimSpace(request.Name),
+			SecretHash:        secretHash,
+			RedirectUris:      request.RedirectUris,
+			Scopes:            request.Scopes,
+			GrantTypes:        request.GrantTypes,
+			Audience:          oauthClientAudience(request),
+			ExchangeAudiences: oauthClientExchangeAudiences(request),
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to create OAuth client",
+			fmt.Sprintf("Failed to create OAuth client %s", clientId),
+			err,
+		)
+	}
+
+	client, err := s.DB.GetOAuthClient(ctx, clientId)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to create OAuth client",
+			fmt.Sprintf("Failed to load OAuth client %s", clientId),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("OAuth client %s created successfully", clientId)
+
+	return &pb.OAuthClientSecretReply{
+		Client: oauthClientToRpc(&client),
+		Secret: secret,
+	}, nil
+}
+
+func (s *AuthServiceServer) LoadOAuthClients(request *emptypb.Empty, stream pb.AuthService_LoadOAuthClientsServer) error {
+	ctx := stream.Context()
+
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Loading OAuth clients %s", principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return err
+	}
+
+	clients, err := s.DB.LoadOAuthClients(ctx)
+	if err != nil {
+		return s.Err.Internal(
+			"Failed to load OAuth clients",
+			fmt.Sprintf("Failed to load OAuth clients %s", principal),
+			err,
+		)
+	}
+
+	for _, client := range clients {
+		if err := stream.Send(oauthClientToRpc(&client)); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Info().Msgf("Loaded OAuth clients %s successfully", principal)
+
+	return nil
+}
+
+func (s *AuthServiceServer) UpdateOAuthClient(ctx context.Context, request *pb.SaveOAuthClientRequest) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+	clientId := strings.TrimSpace(request.Id)
+
+	s.Log.Info().Msgf("Updating OAuth client %s by %s ...", clientId, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	client, err := s.DB.GetOAuthClient(ctx, clientId)
+	if err != nil {
+		return nil, s.Err.InvalidArgument("OAuth client not found", fmt.Sprintf("OAuth client %s not found: %v", clientId, err))
+	}
+	if err := s.validateOAuthClient(request, client.SecretHash.Valid); err != nil {
+		return nil, err
+	}
+
+	_, err = s.DB.UpdateOAuthClient(
+		ctx,
+		model.UpdateOAuthClientParams{
+			ID:                clientId,
+			Name:              strings.TrimSpace(request.Name),
+			RedirectUris:      request.RedirectUris,
+			Scopes:            request.Scopes,
+			GrantTypes:        request.GrantTypes,
+			Audience:          oauthClientAudience(request),
+			ExchangeAudiences: oauthClientExchangeAudiences(request),
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to update OAuth client",
+			fmt.Sprintf("Failed to update OAuth client %s", clientId),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("OAuth client %s updated successfully", clientId)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+// RotateOAuthClientSecret replaces the secret of a confidential client, the previous secret stops working at once.
+func (s *AuthServiceServer) RotateOAuthClientSecret(ctx context.Context, request *pb.OAuthClientId) (*pb.OAuthClientSecretReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Rotating OAuth client %s secret by %s ...", request.Id, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	secret, secretHash, err := s.generateClientSecret()
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to rotate OAuth client secret",
+			fmt.Sprintf("Failed to generate OAuth client %s secret", request.Id),
+			err,
+		)
+	}
+
+	rows, err := s.DB.UpdateOAuthClientSecret(
+		ctx,
+		model.UpdateOAuthClientSecretParams{
+			ID:         request.Id,
+			SecretHash: pgtype.Text{String: secretHash, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to rotate OAuth client secret",
+			fmt.Sprintf("Failed to save OAuth client %s secret", request.Id),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.FailedPrecondition("OAuth client is not confidential", fmt.Sprintf("OAuth client %s not found or public", request.Id))
+	}
+
+	client, err := s.DB.GetOAuthClient(ctx, request.Id)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to rotate OAuth client secret",
+			fmt.Sprintf("Failed to load OAuth client %s", request.Id),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("OAuth client %s secret rotated successfully", request.Id)
+
+	return &pb.OAuthClientSecretReply{
+		Client: oauthClientToRpc(&client),
+		Secret: &secret,
+	}, nil
+}
+
+func (s *AuthServiceServer) DisableOAuthClient(ctx context.Context, request *pb.OAuthClientId) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Disabling OAuth client %s by %s ...", request.Id, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.DisableOAuthClient(ctx, request.Id)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to disable OAuth client",
+			fmt.Sprintf("Failed to disable OAuth client %s", request.Id),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("OAuth client not found", fmt.Sprintf("OAuth client %s not found or disabled", request.Id))
+	}
+
+	s.Log.Info().Msgf("OAuth client %s disabled successfully", request.Id)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) validateOAuthClient(request *pb.SaveOAuthClientRequest, confidential bool) error {
+	if strings.TrimSpace(request.Id) == "" || strings.TrimSpace(request.Name) == "" {
+		return s.Err.InvalidArgument("Id and name are required", "OAuth client without id or name")
+	}
+	if len(request.GrantTypes) == 0 {
+		return s.Err.InvalidArgument("Grant type is required", fmt.Sprintf("OAuth client %s without grant types", request.Id))
+	}
+	for _, grantType := range request.GrantTypes {
+		if !slices.Contains(oidc.GrantTypes, grantType) {
+			return s.Err.InvalidArgument("Unsupported grant type", fmt.Sprintf("OAuth client %s grant type %s is not supported", request.Id, grantType))
+		}
+	}
+	if slices.Contains(request.GrantTypes, oidc.GrantAuthorizationCode) && len(request.RedirectUris) == 0 {
+		return s.Err.InvalidArgument("Redirect URI is required", fmt.Sprintf("OAuth client %s without redirect URIs", request.Id))
+	}
+	if slices.Contains(request.GrantTypes, oidc.GrantClientCredentials) && !confidential {
+		return s.Err.InvalidArgument("Client credentials require a secret", fmt.Sprintf("Public OAuth client %s can not use client credentials", request.Id))
+	}
+	return nil
+}
+
+// generateClientSecret returns the plain secret shown once and its bcrypt hash.
+func (s *AuthServiceServer) generateClientSecret() (string, string, error) {
+	generator := jwt.TokenGenerator{}
+	secret, _, err := generator.GenerateToken(0)
+	if err != nil {
+		return "", "", err
+	}
+
+	encryptor := tool.Encryptor{}
+	secretHash, err := encryptor.Hash(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	return secret, secretHash, nil
+}
+
+func oauthClientAudience(request *pb.SaveOAuthClientRequest) string {
+	if request.Audience == nil || strings.TrimSpace(*request.Audience) == "" {
+		return jwt.Audience
+	}
+	return strings.TrimSpace(*request.Audience)
+}
+
+func oauthClientExchangeAudiences(request *pb.SaveOAuthClientRequest) []string {
+	audiences := []string{}
+	for _, audience := range request.ExchangeAudiences {
+		if audience = strings.TrimSpace(audience); audience != "" && !slices.Contains(audiences, audience) {
+			audiences = append(audiences, audience)
+		}
+	}
+	return audiences
+}
+
+func oauthClientToRpc(client *model.OauthClient) *pb.OAuthClient {
+	return &pb.OAuthClient{
+		Id:                client.ID,
+		Name:              client.Name,
+		RedirectUris:      client.RedirectUris,
+		Scopes:            client.Scopes,
+		GrantTypes:        client.GrantTypes,
+		Audience:          client.Audience,
+		Confidential:      client.SecretHash.Valid,
+		Disabled:          client.DisabledAt.Valid,
+		CreatedAt:         timestamppb.New(client.CreatedAt.Time),
+		ExchangeAudiences: client.ExchangeAudiences,
+	}
+}
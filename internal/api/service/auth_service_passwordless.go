@@ -0,0 +1,339 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	mailer "github.com/zs-dima/auth-service/internal/mailer"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// OtpLength is the number of digits of one-time sign in codes.
+const OtpLength = 6
+
+func (s *AuthServiceServer) RequestMagicLink(ctx context.Context, request *pb.RequestMagicLinkRequest) (*pb.ResultReply, error) {
+	userEmail := strings.TrimSpace(request.Email)
+
+	s.Log.Info().Msgf("Sending %s magic link ...", userEmail)
+
+	if err := s.requireAppUrl("Magic link"); err != nil {
+		return nil, err
+	}
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	// Reply the same way for unknown emails to not disclose registered users
+	user, err := s.DB.GetActiveUser(ctx, userEmail)
+	if err != nil {
+		s.Log.Warn().Msgf("Magic link requested for unknown user %s", userEmail)
+		return res, nil
+	}
+
+	generator := jwt.TokenGenerator{}
+	token, expiresAt, err := generator.GenerateToken(s.config.MagicLinkTtl)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send magic link",
+			fmt.Sprintf("Failed to generate %s magic link token", userEmail),
+			err,
+		)
+	}
+
+	err = s.DB.RevokeUserTokens(
+		ctx,
+		model.RevokeUserTokensParams{
+			UserID:  user.ID,
+			Purpose: model.UserTokenPurposeMagicLink,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send magic link",
+			fmt.Sprintf("Failed to revoke %s magic link tokens", userEmail),
+			err,
+		)
+	}
+
+	err = s.DB.CreateUserToken(
+		ctx,
+		model.CreateUserTokenParams{
+			TokenHash: tool.HashToken(token),
+			UserID:    user.ID,
+			Purpose:   model.UserTokenPurposeMagicLink,
+			Email:     user.Email,
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send magic link",
+			fmt.Sprintf("Failed to save %s magic link token", userEmail),
+			err,
+		)
+	}
+
+	err = s.sendMail(ctx, user.Email, mailer.TemplateMagicLink, map[string]any{
+		"Name":      user.Name,
+		"Link":      s.appLink("magic-link", token),
+		"ExpiresAt": formatExpiresAt(expiresAt),
+	})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send magic link",
+			fmt.Sprintf("Failed to send %s magic link", userEmail),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Magic link sent to %s successfully", userEmail)
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) ConsumeMagicLink(ctx context.Context, request *pb.ConsumeMagicLinkRequest) (*pb.AuthInfo, error) {
+	s.Log.Info().Msgf("Signing in by magic link ...")
+
+	if strings.TrimSpace(request.Token) == "" {
+		return nil, s.Err.InvalidArgument("Invalid sign in link", "Empty magic link token")
+	}
+	if request.DeviceInfo.GetId() == nil || request.InstallationId == nil {
+		return nil, s.Err.InvalidArgument("Device is required", "Magic link sign in without device info")
+	}
+
+	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
+	installationId := tool.RpcIdToId(request.InstallationId)
+
+	token, err := s.DB.ConsumeUserToken(
+		ctx,
+		model.ConsumeUserTokenParams{
+			TokenHash: tool.HashToken(request.Token),
+			Purpose:   model.UserTokenPurposeMagicLink,
+		})
+	if err != nil {
+		return nil, s.Err.InvalidArgument("Invalid sign in link", fmt.Sprintf("Magic link token is invalid or expired: %v", err))
+	}
+
+	user, err := s.DB.GetActiveUserById(ctx, token.UserID)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(token.Email, err)
+	}
+	if user.Email != token.Email {
+		// User email has been changed since the link was sent
+		return nil, s.Err.Unauthenticated(token.Email, fmt.Errorf("email is no longer used by the user"))
+	}
+
+	err = s.markEmailVerified(ctx, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.signInUser(ctx, &user, deviceId, installationId, []string{jwt.AmrOtp})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed in by magic link successfully", user.Email)
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) RequestEmailOtp(ctx context.Context, request *pb.RequestEmailOtpRequest) (*pb.ResultReply, error) {
+	userEmail := strings.TrimSpace(request.Email)
+
+	s.Log.Info().Msgf("Sending %s sign in code ...", userEmail)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	// Reply the same way for unknown emails to not disclose registered users
+	user, err := s.DB.GetActiveUser(ctx, userEmail)
+	if err != nil {
+		s.Log.Warn().Msgf("Sign in code requested for unknown user %s", userEmail)
+		return res, nil
+	}
+
+	code, expiresAt, err := s.createOtp(ctx, &user, model.UserOtpPurposeEmailSignIn, user.Email)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send sign in code",
+			fmt.Sprintf("Failed to create %s sign in code", userEmail),
+			err,
+		)
+	}
+
+	err = s.sendMail(ctx, user.Email, mailer.TemplateSignInCode, map[string]any{
+		"Name":      user.Name,
+		"Code":      code,
+		"ExpiresAt": formatExpiresAt(expiresAt),
+	})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send sign in code",
+			fmt.Sprintf("Failed to send %s sign in code", userEmail),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Sign in code sent to %s successfully", userEmail)
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) SignInWithEmailOtp(ctx context.Context, request *pb.SignInWithEmailOtpRequest) (*pb.AuthInfo, error) {
+	userEmail := strings.TrimSpace(request.Email)
+
+	s.Log.Info().Msgf("Signing in %s by code ...", userEmail)
+
+	if userEmail == "" || strings.TrimSpace(request.Code) == "" {
+		return nil, s.Err.Unauthenticated(userEmail)
+	}
+	if request.DeviceInfo.GetId() == nil || request.InstallationId == nil {
+		return nil, s.Err.InvalidArgument("Device is required", fmt.Sprintf("Code sign in of %s without device info", userEmail))
+	}
+
+	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
+	installationId := tool.RpcIdToId(request.InstallationId)
+
+	user, err := s.DB.GetActiveUser(ctx, userEmail)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(userEmail, err)
+	}
+
+	recipient, err := s.useOtp(ctx, &user, model.UserOtpPurposeEmailSignIn, request.Code)
+	if err != nil {
+		return nil, err
+	}
+	if recipient != user.Email {
+		// User email has been changed since the code was sent
+		return nil, s.Err.Unauthenticated(userEmail, fmt.Errorf("sign in code was sent to %s", recipient))
+	}
+
+	err = s.markEmailVerified(ctx, &user)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.signInUser(ctx, &user, deviceId, installationId, []string{jwt.AmrOtp})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed in by code successfully", userEmail)
+
+	return res, nil
+}
+
+// createOtp replaces previously sent codes of the purpose with a new one, only its hash is stored.
+func (s *AuthServiceServer) createOtp(
+	ctx context.Context,
+	user *model.User,
+	purpose model.UserOtpPurpose,
+	recipient string,
+) (string, time.Time, error) {
+	generator := jwt.TokenGenerator{}
+	code, expiresAt, err := generator.GenerateCode(OtpLength, s.config.OtpTtl)
+	if err != nil {
+		return "", expiresAt, err
+	}
+
+	encryptor := tool.Encryptor{}
+	codeHash, err := encryptor.Hash(code)
+	if err != nil {
+		return "", expiresAt, fmt.Errorf("failed to hash code: %w", err)
+	}
+
+	err = s.DB.RevokeUserOtps(
+		ctx,
+		model.RevokeUserOtpsParams{
+			UserID:  user.ID,
+			Purpose: purpose,
+		})
+	if err != nil {
+		return "", expiresAt, fmt.Errorf("failed to revoke codes: %w", err)
+	}
+
+	err = s.DB.CreateUserOtp(
+		ctx,
+		model.CreateUserOtpParams{
+			UserID:    user.ID,
+			Purpose:   purpose,
+			Recipient: recipient,
+			CodeHash:  codeHash,
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return "", expiresAt, fmt.Errorf("failed to save code: %w", err)
+	}
+
+	return code, expiresAt, nil
+}
+
+// useOtp checks the latest code of the purpose and returns the recipient it was sent to.
+// Each check counts as an attempt.
+func (s *AuthServiceServer) useOtp(
+	ctx context.Context,
+	user *model.User,
+	purpose model.UserOtpPurpose,
+	code string,
+) (string, error) {
+	otp, err := s.DB.UseUserOtpAttempt(
+		ctx,
+		model.UseUserOtpAttemptParams{
+			UserID:      user.ID,
+			Purpose:     purpose,
+			MaxAttempts: int32(s.config.OtpMaxAttempts),
+		})
+	if err != nil {
+		return "", s.Err.Unauthenticated(user.Email, fmt.Errorf("no valid %s code: %w", purpose, err))
+	}
+
+	encryptor := tool.Encryptor{}
+	if !encryptor.Validate(strings.TrimSpace(code), otp.CodeHash) {
+		return "", s.Err.Unauthenticated(user.Email, fmt.Errorf("wrong %s code", purpose))
+	}
+
+	rows, err := s.DB.ConsumeUserOtp(ctx, otp.ID)
+	if err != nil {
+		return "", s.Err.Internal(
+			"Failed to check code",
+			fmt.Sprintf("Failed to consume %s %s code", user.Email, purpose),
+			err,
+		)
+	}
+	if rows == 0 {
+		return "", s.Err.Unauthenticated(user.Email, fmt.Errorf("%s code has already been used", purpose))
+	}
+
+	return otp.Recipient, nil
+}
+
+// markEmailVerified verifies the email of a user who proved the mailbox ownership by a passwordless sign in.
+func (s *AuthServiceServer) markEmailVerified(ctx context.Context, user *model.User) error {
+	if user.EmailVerifiedAt.Valid {
+		return nil
+	}
+
+	_, err := s.DB.VerifyUserEmail(
+		ctx,
+		model.VerifyUserEmailParams{
+			ID:    user.ID,
+			Email: user.Email,
+		})
+	if err != nil {
+		return s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to verify %s email", user.Email),
+			err,
+		)
+	}
+
+	user.EmailVerifiedAt = pgtype.Timestamp{Time: time.Now(), Valid: true}
+	return nil
+}
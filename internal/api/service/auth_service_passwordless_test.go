@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+)
+
+// Links are single use by the ConsumeUserToken query, tests cover the checks made before the token is consumed.
+func TestMagicLinkRequests(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{AppUrl: "https://app.example.com"})
+	withoutAppUrl := testServer(&AuthServiceServerConfig{})
+	deviceId := uuid.New()
+	installationId := uuid.New()
+
+	tests := []struct {
+		name string
+		call func(ctx context.Context) error
+		code codes.Code
+	}{
+		{
+			"request without APP_URL",
+			func(ctx context.Context) error {
+				_, err := withoutAppUrl.RequestMagicLink(ctx, &pb.RequestMagicLinkRequest{Email: "user@example.com"})
+				return err
+			},
+			codes.FailedPrecondition,
+		},
+		{
+			"sign in without token",
+			func(ctx context.Context) error {
+				_, err := s.ConsumeMagicLink(ctx, &pb.ConsumeMagicLinkRequest{
+					Token:          " ",
+					InstallationId: tool.IdToRpcId(&installationId),
+					DeviceInfo:     &pb.DeviceInfo{Id: tool.IdToRpcId(&deviceId)},
+				})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"sign in without device",
+			func(ctx context.Context) error {
+				_, err := s.ConsumeMagicLink(ctx, &pb.ConsumeMagicLinkRequest{Token: "token", InstallationId: tool.IdToRpcId(&installationId)})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"sign in without installation",
+			func(ctx context.Context) error {
+				_, err := s.ConsumeMagicLink(ctx, &pb.ConsumeMagicLinkRequest{Token: "token", DeviceInfo: &pb.DeviceInfo{Id: tool.IdToRpcId(&deviceId)}})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call(context.Background())
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+// Codes are single use and limited to OTP_MAX_ATTEMPTS by the UseUserOtpAttempt and ConsumeUserOtp queries,
+// tests cover the checks made before an attempt is counted.
+func TestEmailOtpSignIn(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{OtpMaxAttempts: 5})
+	deviceId := uuid.New()
+	installationId := uuid.New()
+
+	tests := []struct {
+		name    string
+		request *pb.SignInWithEmailOtpRequest
+		code    codes.Code
+	}{
+		{"without email", &pb.SignInWithEmailOtpRequest{Email: " ", Code: "123456"}, codes.Unauthenticated},
+		{"without code", &pb.SignInWithEmailOtpRequest{Email: "user@example.com", Code: " "}, codes.Unauthenticated},
+		{"without device", &pb.SignInWithEmailOtpRequest{Email: "user@example.com", Code: "123456", InstallationId: tool.IdToRpcId(&installationId)}, codes.InvalidArgument},
+		{"without installation", &pb.SignInWithEmailOtpRequest{Email: "user@example.com", Code: "123456", DeviceInfo: &pb.DeviceInfo{Id: tool.IdToRpcId(&deviceId)}}, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.SignInWithEmailOtp(context.Background(), test.request)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	authn "github.com/zs-dima/auth-service/internal/authn"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// CreatePersonalAccessToken issues a scoped token of the calling user for scripts, it is not tied to a device session.
+func (s *AuthServiceServer) CreatePersonalAccessToken(ctx context.Context, request *pb.CreatePersonalAccessTokenRequest) (*pb.PersonalAccessTokenReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+	name := strings.TrimSpace(request.Name)
+
+	s.Log.Info().Msgf("Creating personal access token %s by %s ...", name, principal)
+
+	if authInfo.UserInfo == nil {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("user is required"))
+	}
+	if name == "" {
+		return nil, s.Err.InvalidArgument("Name is required", fmt.Sprintf("Personal access token of %s without name", principal))
+	}
+	if len(request.Scopes) == 0 {
+		return nil, s.Err.InvalidArgument("Scope is required", fmt.Sprintf("Personal access token %s without scopes", name))
+	}
+	for _, scope := range request.Scopes {
+		if !slices.Contains(authn.PersonalAccessTokenScopes, scope) {
+			return nil, s.Err.InvalidArgument("Unsupported scope", fmt.Sprintf("Personal access token scope %s is not supported", scope))
+		}
+	}
+
+	expiresAt := pgtype.Timestamp{}
+	if request.ExpiresAt != nil {
+		if !request.ExpiresAt.AsTime().After(time.Now()) {
+			return nil, s.Err.InvalidArgument("Invalid expiration", fmt.Sprintf("Personal access token %s expires in the past", name))
+		}
+		expiresAt = pgtype.Timestamp{Time: request.ExpiresAt.AsTime(), Valid: true}
+	}
+
+	token, tokenHash, err := authn.GeneratePersonalAccessToken()
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to create personal access token",
+			fmt.Sprintf("Failed to generate personal access token %s of %s", name, principal),
+			err,
+		)
+	}
+
+	pat := model.PersonalAccessToken{
+		ID:        uuid.New(),
+		UserID:    *authInfo.UserInfo.Id,
+		Name:      name,
+		TokenHash: tokenHash,
+		Scopes:    request.Scopes,
+		ExpiresAt: expiresAt,
+		CreatedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+	}
+
+	err = s.DB.CreatePersonalAccessToken(
+		ctx,
+		model.CreatePersonalAccessTokenParams{
+			ID:        pat.ID,
+			UserID:    pat.UserID,
+			Name:      pat.Name,
+			TokenHash: pat.TokenHash,
+			Scopes:    pat.Scopes,
+			ExpiresAt: pat.ExpiresAt,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to create personal access token",
+			fmt.Sprintf("Failed to save personal access token %s of %s", name, principal),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Personal access token %s of %s created successfully", pat.ID, principal)
+
+	return &pb.PersonalAccessTokenReply{
+		Token:  personalAccessTokenToRpc(&pat),
+		Secret: token,
+	}, nil
+}
+
+func (s *AuthServiceServer) LoadPersonalAccessTokens(request *emptypb.Empty, stream pb.AuthService_LoadPersonalAccessTokensServer) error {
+	ctx := stream.Context()
+
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Loading personal access tokens %s", principal)
+
+	if authInfo.UserInfo == nil {
+		return s.Err.PermissionDenied(principal, fmt.Errorf("user is required"))
+	}
+
+	pats, err := s.DB.LoadPersonalAccessTokens(ctx, *authInfo.UserInfo.Id)
+	if err != nil {
+		return s.Err.Internal(
+			"Failed to load personal access tokens",
+			fmt.Sprintf("Failed to load personal access tokens %s", principal),
+			err,
+		)
+	}
+
+	for _, pat := range pats {
+		if err := stream.Send(personalAccessTokenToRpc(&pat)); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Info().Msgf("Loaded personal access tokens %s successfully", principal)
+
+	return nil
+}
+
+func (s *AuthServiceServer) RevokePersonalAccessToken(ctx context.Context, request *pb.PersonalAccessTokenId) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	if request.Id == nil {
+		return nil, s.Err.InvalidArgument("Token is required", fmt.Sprintf("Personal access token revocation by %s without id", principal))
+	}
+	patId := tool.RpcIdToId(request.Id)
+
+	s.Log.Info().Msgf("Revoking personal access token %s by %s ...", patId, principal)
+
+	if authInfo.UserInfo == nil {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("user is required"))
+	}
+
+	rows, err := s.DB.RevokePersonalAccessToken(
+		ctx,
+		model.RevokePersonalAccessTokenParams{
+			ID:     *patId,
+			UserID: *authInfo.UserInfo.Id,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to revoke personal access token",
+			fmt.Sprintf("Failed to revoke personal access token %s", patId),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("Personal access token not found", fmt.Sprintf("Personal access token %s of %s not found or revoked", patId, principal))
+	}
+
+	s.Log.Info().Msgf("Personal access token %s revoked successfully", patId)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func personalAccessTokenToRpc(pat *model.PersonalAccessToken) *pb.PersonalAccessToken {
+	rpcPat := &pb.PersonalAccessToken{
+		Id:        tool.IdToRpcId(&pat.ID),
+		Name:      pat.Name,
+		Scopes:    pat.Scopes,
+		Revoked:   pat.RevokedAt.Valid,
+		CreatedAt: timestamppb.New(pat.CreatedAt.Time),
+	}
+	if pat.ExpiresAt.Valid {
+		rpcPat.ExpiresAt = timestamppb.New(pat.ExpiresAt.Time)
+	}
+	if pat.LastUsedAt.Valid {
+		rpcPat.LastUsedAt = timestamppb.New(pat.LastUsedAt.Time)
+	}
+	return rpcPat
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+func TestCreatePersonalAccessTokenRequests(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{})
+	user := userContext(model.UserRoleUser)
+	client := context.WithValue(context.Background(), jwt.UserClaimsKey, &jwt.JwtAuthInfo{
+		ClientInfo: &jwt.JwtClientInfo{Id: "billing"},
+	})
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		request *pb.CreatePersonalAccessTokenRequest
+		code    codes.Code
+	}{
+		{"by client", client, &pb.CreatePersonalAccessTokenRequest{Name: "CI", Scopes: []string{"users:read"}}, codes.PermissionDenied},
+		{"without name", user, &pb.CreatePersonalAccessTokenRequest{Name: " ", Scopes: []string{"users:read"}}, codes.InvalidArgument},
+		{"without scopes", user, &pb.CreatePersonalAccessTokenRequest{Name: "CI"}, codes.InvalidArgument},
+		{"unsupported scope", user, &pb.CreatePersonalAccessTokenRequest{Name: "CI", Scopes: []string{"users:read", "token:exchange"}}, codes.InvalidArgument},
+		{
+			"expired",
+			user,
+			&pb.CreatePersonalAccessTokenRequest{Name: "CI", Scopes: []string{"users:read"}, ExpiresAt: timestamppb.New(time.Now().Add(-time.Minute))},
+			codes.InvalidArgument,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.CreatePersonalAccessToken(test.ctx, test.request)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
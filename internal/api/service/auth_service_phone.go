@@ -0,0 +1,371 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+var smsOtpTexts = map[model.UserOtpPurpose]string{
+	model.UserOtpPurposePhoneVerification: "%s is your phone verification code",
+	model.UserOtpPurposeSmsSignIn:         "%s is your sign in code",
+	model.UserOtpPurposeSmsMfa:            "%s is your sign in confirmation code",
+}
+
+// SetPhone sends a verification code to the new phone, the phone is saved once the code is verified.
+func (s *AuthServiceServer) SetPhone(ctx context.Context, request *pb.SetPhoneRequest) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Setting %s phone ...", userEmail)
+
+	if s.config.SmsSender == nil {
+		return nil, s.Err.FailedPrecondition("SMS is disabled", "SMS sender is not configured")
+	}
+
+	phone, ok := tool.NormalizePhone(request.Phone)
+	if !ok {
+		return nil, s.Err.InvalidArgument("Invalid phone number", fmt.Sprintf("Invalid %s phone %s", userEmail, request.Phone))
+	}
+
+	user, err := s.DB.GetActiveUserById(ctx, *authInfo.UserInfo.Id)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(userEmail, err)
+	}
+
+	taken, err := s.DB.IsPhoneTaken(
+		ctx,
+		model.IsPhoneTakenParams{
+			Phone: pgtype.Text{String: phone, Valid: true},
+			ID:    user.ID,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to set phone",
+			fmt.Sprintf("Failed to check %s phone availability", userEmail),
+			err,
+		)
+	}
+	if taken {
+		return nil, s.Err.InvalidArgument("Phone is already in use", fmt.Sprintf("Phone %s is already in use", phone))
+	}
+
+	err = s.sendSmsOtp(ctx, &user, model.UserOtpPurposePhoneVerification, phone)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to set phone",
+			fmt.Sprintf("Failed to send %s phone verification code", userEmail),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("%s phone verification code sent successfully", userEmail)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) VerifyPhone(ctx context.Context, request *pb.VerifyPhoneRequest) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Verifying %s phone ...", userEmail)
+
+	user, err := s.DB.GetActiveUserById(ctx, *authInfo.UserInfo.Id)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(userEmail, err)
+	}
+
+	phone, err := s.useOtp(ctx, &user, model.UserOtpPurposePhoneVerification, request.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unique constraint fails when the phone has been taken after the code was sent
+	rows, err := s.DB.UpdateUserPhone(
+		ctx,
+		model.UpdateUserPhoneParams{
+			ID:    user.ID,
+			Phone: pgtype.Text{String: phone, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to verify phone",
+			fmt.Sprintf("Failed to set %s phone %s", userEmail, phone),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.Unauthenticated(userEmail)
+	}
+
+	s.Log.Info().Msgf("%s phone verified successfully", userEmail)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) RequestSmsOtp(ctx context.Context, request *pb.RequestSmsOtpRequest) (*pb.ResultReply, error) {
+	phone, _ := tool.NormalizePhone(request.Phone)
+
+	s.Log.Info().Msgf("Sending %s sign in code ...", phone)
+
+	if s.config.SmsSender == nil {
+		return nil, s.Err.FailedPrecondition("SMS is disabled", "SMS sender is not configured")
+	}
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	// Reply the same way for unknown phones to not disclose registered users
+	user, err := s.DB.GetActiveUserByPhone(ctx, pgtype.Text{String: phone, Valid: true})
+	if err != nil {
+		s.Log.Warn().Msgf("Sign in code requested for unknown phone %s", phone)
+		return res, nil
+	}
+	if user.SmsMfaEnabled {
+		// SMS is the second factor of these users, it is not enough to sign in alone
+		s.Log.Warn().Msgf("Sign in code requested for %s with SMS MFA enabled", user.Email)
+		return res, nil
+	}
+
+	err = s.sendSmsOtp(ctx, &user, model.UserOtpPurposeSmsSignIn, phone)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to send sign in code",
+			fmt.Sprintf("Failed to send %s sign in code", phone),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Sign in code sent to %s successfully", phone)
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) SignInWithSmsOtp(ctx context.Context, request *pb.SignInWithSmsOtpRequest) (*pb.AuthInfo, error) {
+	phone, _ := tool.NormalizePhone(request.Phone)
+
+	s.Log.Info().Msgf("Signing in %s by code ...", phone)
+
+	if phone == "" || strings.TrimSpace(request.Code) == "" {
+		return nil, s.Err.Unauthenticated(phone)
+	}
+	if request.DeviceInfo.GetId() == nil || request.InstallationId == nil {
+		return nil, s.Err.InvalidArgument("Device is required", fmt.Sprintf("Code sign in of %s without device info", phone))
+	}
+
+	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
+	installationId := tool.RpcIdToId(request.InstallationId)
+
+	user, err := s.DB.GetActiveUserByPhone(ctx, pgtype.Text{String: phone, Valid: true})
+	if err != nil {
+		return nil, s.Err.Unauthenticated(phone, err)
+	}
+	if user.SmsMfaEnabled {
+		return nil, s.Err.Unauthenticated(user.Email, fmt.Errorf("SMS sign in is not allowed with SMS MFA enabled"))
+	}
+
+	recipient, err := s.useOtp(ctx, &user, model.UserOtpPurposeSmsSignIn, request.Code)
+	if err != nil {
+		return nil, err
+	}
+	if recipient != phone {
+		// User phone has been changed since the code was sent
+		return nil, s.Err.Unauthenticated(user.Email, fmt.Errorf("sign in code was sent to %s", recipient))
+	}
+
+	res, err := s.issueAuthInfo(ctx, &user, deviceId, installationId, []string{jwt.AmrOtp, jwt.AmrSms})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed in by SMS code successfully", user.Email)
+
+	return res, nil
+}
+
+// SetSmsMfa requires an SMS code on every sign in of the user, the phone has to be verified first.
+func (s *AuthServiceServer) SetSmsMfa(ctx context.Context, request *pb.SetSmsMfaRequest) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Setting %s SMS MFA to %t ...", userEmail, request.Enabled)
+
+	if request.Enabled && s.config.SmsSender == nil {
+		return nil, s.Err.FailedPrecondition("SMS is disabled", "SMS sender is not configured")
+	}
+
+	rows, err := s.DB.SetUserSmsMfa(
+		ctx,
+		model.SetUserSmsMfaParams{
+			ID:            *authInfo.UserInfo.Id,
+			SmsMfaEnabled: request.Enabled,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to set SMS MFA",
+			fmt.Sprintf("Failed to set %s SMS MFA", userEmail),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.FailedPrecondition("Phone is not verified", fmt.Sprintf("SMS MFA of %s requires verified phone", userEmail))
+	}
+
+	s.Log.Info().Msgf("%s SMS MFA set successfully", userEmail)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) VerifySmsMfa(ctx context.Context, request *pb.VerifySmsMfaRequest) (*pb.AuthInfo, error) {
+	s.Log.Info().Msgf("Verifying SMS MFA ...")
+
+	if request.DeviceInfo.GetId() == nil || request.InstallationId == nil {
+		return nil, s.Err.InvalidArgument("Device is required", "SMS MFA without device info")
+	}
+
+	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
+	installationId := tool.RpcIdToId(request.InstallationId)
+
+	// MFA token stays valid for another attempt when the code is wrong
+	mfaTokenHash := tool.HashToken(request.MfaToken)
+	token, err := s.DB.GetUserToken(
+		ctx,
+		model.GetUserTokenParams{
+			TokenHash: mfaTokenHash,
+			Purpose:   model.UserTokenPurposeMfa,
+		})
+	if err != nil {
+		return nil, s.Err.Unauthenticated("", fmt.Errorf("MFA token is invalid or expired: %w", err))
+	}
+
+	user, err := s.DB.GetActiveUserById(ctx, token.UserID)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(token.Email, err)
+	}
+
+	recipient, err := s.useOtp(ctx, &user, model.UserOtpPurposeSmsMfa, request.Code)
+	if err != nil {
+		return nil, err
+	}
+	if recipient != user.Phone.String {
+		return nil, s.Err.Unauthenticated(user.Email, fmt.Errorf("MFA code was sent to %s", recipient))
+	}
+
+	_, err = s.DB.ConsumeUserToken(
+		ctx,
+		model.ConsumeUserTokenParams{
+			TokenHash: mfaTokenHash,
+			Purpose:   model.UserTokenPurposeMfa,
+		})
+	if err != nil {
+		return nil, s.Err.Unauthenticated(user.Email, fmt.Errorf("MFA token has already been used: %w", err))
+	}
+
+	res, err := s.issueAuthInfo(ctx, &user, deviceId, installationId, []string{jwt.AmrMfa, jwt.AmrSms})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed in with SMS MFA successfully", user.Email)
+
+	return res, nil
+}
+
+// signInUser issues tokens of the authenticated user, or challenges the second factor when SMS MFA is enabled.
+func (s *AuthServiceServer) signInUser(
+	ctx context.Context,
+	user *model.User,
+	deviceId *uuid.UUID,
+	installationId *uuid.UUID,
+	amr []string,
+) (*pb.AuthInfo, error) {
+	if !user.SmsMfaEnabled || !user.PhoneVerifiedAt.Valid {
+		return s.issueAuthInfo(ctx, user, deviceId, installationId, amr)
+	}
+	// The second factor could not be skipped, users with SMS MFA could not sign in while SMS is disabled
+	if s.config.SmsSender == nil {
+		return nil, s.Err.FailedPrecondition("SMS is disabled", fmt.Sprintf("SMS MFA code of %s could not be sent, SMS sender is not configured", user.Email))
+	}
+
+	generator := jwt.TokenGenerator{}
+	mfaToken, expiresAt, err := generator.GenerateToken(s.config.OtpTtl)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to generate %s MFA token", user.Email),
+			err,
+		)
+	}
+
+	err = s.DB.RevokeUserTokens(
+		ctx,
+		model.RevokeUserTokensParams{
+			UserID:  user.ID,
+			Purpose: model.UserTokenPurposeMfa,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to revoke %s MFA tokens", user.Email),
+			err,
+		)
+	}
+
+	err = s.DB.CreateUserToken(
+		ctx,
+		model.CreateUserTokenParams{
+			TokenHash: tool.HashToken(mfaToken),
+			UserID:    user.ID,
+			Purpose:   model.UserTokenPurposeMfa,
+			Email:     user.Email,
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to save %s MFA token", user.Email),
+			err,
+		)
+	}
+
+	err = s.sendSmsOtp(ctx, user, model.UserOtpPurposeSmsMfa, user.Phone.String)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to send %s MFA code", user.Email),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("%s SMS MFA code sent", user.Email)
+
+	return &pb.AuthInfo{MfaToken: &mfaToken}, nil
+}
+
+func (s *AuthServiceServer) sendSmsOtp(ctx context.Context, user *model.User, purpose model.UserOtpPurpose, phone string) error {
+	code, _, err := s.createOtp(ctx, user, purpose, phone)
+	if err != nil {
+		return err
+	}
+	return s.config.SmsSender.Send(ctx, phone, fmt.Sprintf(smsOtpTexts[purpose], code))
+}
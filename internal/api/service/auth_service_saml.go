@@ -0,0 +1,235 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/zs-dima/auth-service/internal/federation"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// samlConnectionIdPattern keeps connection ids usable in the SAML endpoint URLs.
+var samlConnectionIdPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+
+// FindSamlConnection returns the login URL of the organization identity provider of the email domain.
+func (s *AuthServiceServer) FindSamlConnection(ctx context.Context, request *pb.FindSamlConnectionRequest) (*pb.FederationProvider, error) {
+	s.Log.Info().Msgf("Finding SAML connection of %s ...", request.Email)
+
+	if s.config.Federation == nil || !s.config.Federation.SamlEnabled() {
+		return nil, s.Err.FailedPrecondition("SAML sign in is disabled", "SAML service provider is not configured")
+	}
+
+	_, domain, ok := strings.Cut(strings.TrimSpace(request.Email), "@")
+	if !ok || domain == "" {
+		return nil, s.Err.InvalidArgument("Invalid email", fmt.Sprintf("Email %s has no domain", request.Email))
+	}
+
+	connection, err := s.DB.FindSamlConnectionByDomain(ctx, domain)
+	if err != nil {
+		return nil, s.Err.FailedPrecondition("Organization sign in is not available", fmt.Sprintf("No SAML connection of %s domain: %v", domain, err))
+	}
+
+	s.Log.Info().Msgf("SAML connection %s of %s found successfully", connection.ID, request.Email)
+
+	return &pb.FederationProvider{
+		Name:        federation.SamlProviderPrefix + connection.ID,
+		DisplayName: connection.Name,
+		LoginUrl:    s.config.Federation.SamlLoginUrl(connection.ID),
+	}, nil
+}
+
+// SaveSamlConnection creates or updates the connection of the organization identity provider, disabled connections are enabled again.
+func (s *AuthServiceServer) SaveSamlConnection(ctx context.Context, request *pb.SamlConnection) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+	connectionId := strings.TrimSpace(request.Id)
+
+	s.Log.Info().Msgf("Saving SAML connection %s by %s ...", connectionId, userEmail)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	if !samlConnectionIdPattern.MatchString(connectionId) || strings.TrimSpace(request.Name) == "" {
+		return nil, s.Err.InvalidArgument("Id and name are required", "SAML connection id must consist of lowercase letters, digits and dashes")
+	}
+	if err := federation.ValidateSamlMetadata(request.IdpMetadata); err != nil {
+		return nil, s.Err.InvalidArgument("Invalid identity provider metadata", fmt.Sprintf("SAML connection %s metadata is invalid: %v", connectionId, err))
+	}
+
+	domains := make([]string, 0, len(request.Domains))
+	for _, domain := range request.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 {
+		return nil, s.Err.InvalidArgument("Domain is required", fmt.Sprintf("SAML connection %s without domains", connectionId))
+	}
+
+	roleMapping := map[string]model.UserRole{}
+	for _, mapping := range request.RoleMapping {
+		roleMapping[mapping.Value] = model.UserRole(pb.UserRole_name[int32(mapping.Role)])
+	}
+	roleMappingJson, err := json.Marshal(roleMapping)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to save SAML connection",
+			fmt.Sprintf("Failed to encode SAML connection %s role mapping", connectionId),
+			err,
+		)
+	}
+
+	err = s.DB.SaveSamlConnection(
+		ctx,
+		model.SaveSamlConnectionParams{
+			ID:             connectionId,
+			Name:           strings.TrimSpace(request.Name),
+			IdpMetadata:    request.IdpMetadata,
+			Domains:        domains,
+			EmailAttribute: optionalText(request.EmailAttribute),
+			NameAttribute:  optionalText(request.NameAttribute),
+			RoleAttribute:  optionalText(request.RoleAttribute),
+			RoleMapping:    roleMappingJson,
+			Provisioning:   request.Provisioning,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to save SAML connection",
+			fmt.Sprintf("Failed to save SAML connection %s", connectionId),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("SAML connection %s saved successfully", connectionId)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func (s *AuthServiceServer) LoadSamlConnections(request *emptypb.Empty, stream pb.AuthService_LoadSamlConnectionsServer) error {
+	ctx := stream.Context()
+
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Loading SAML connections %s", userEmail)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return err
+	}
+
+	connections, err := s.DB.LoadSamlConnections(ctx)
+	if err != nil {
+		return s.Err.Internal(
+			"Failed to load SAML connections",
+			fmt.Sprintf("Failed to load SAML connections %s", userEmail),
+			err,
+		)
+	}
+
+	for _, connection := range connections {
+		rpcConnection, err := samlConnectionToRpc(&connection)
+		if err != nil {
+			return s.Err.Internal(
+				"Failed to load SAML connections",
+				fmt.Sprintf("Failed to decode SAML connection %s role mapping", connection.ID),
+				err,
+			)
+		}
+		if err := stream.Send(rpcConnection); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Info().Msgf("Loaded SAML connections %s successfully", userEmail)
+
+	return nil
+}
+
+func (s *AuthServiceServer) DisableSamlConnection(ctx context.Context, request *pb.SamlConnectionId) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	userEmail := authInfo.UserInfo.Email
+
+	s.Log.Info().Msgf("Disabling SAML connection %s by %s ...", request.Id, userEmail)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.DisableSamlConnection(ctx, request.Id)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to disable SAML connection",
+			fmt.Sprintf("Failed to disable SAML connection %s", request.Id),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("SAML connection not found", fmt.Sprintf("SAML connection %s not found or disabled", request.Id))
+	}
+
+	s.Log.Info().Msgf("SAML connection %s disabled successfully", request.Id)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func optionalText(value *string) pgtype.Text {
+	if value == nil || strings.TrimSpace(*value) == "" {
+		return pgtype.Text{}
+	}
+	return pgtype.Text{String: strings.TrimSpace(*value), Valid: true}
+}
+
+func samlConnectionToRpc(connection *model.SamlConnection) (*pb.SamlConnection, error) {
+	roleMapping := map[string]model.UserRole{}
+	if err := json.Unmarshal(connection.RoleMapping, &roleMapping); err != nil {
+		return nil, err
+	}
+
+	rpcRoleMapping := make([]*pb.SamlRoleMapping, 0, len(roleMapping))
+	for value, role := range roleMapping {
+		rpcRoleMapping = append(rpcRoleMapping, &pb.SamlRoleMapping{
+			Value: value,
+			Role:  pb.UserRole(pb.UserRole_value[string(role)]),
+		})
+	}
+
+	rpcConnection := &pb.SamlConnection{
+		Id:           connection.ID,
+		Name:         connection.Name,
+		IdpMetadata:  connection.IdpMetadata,
+		Domains:      connection.Domains,
+		RoleMapping:  rpcRoleMapping,
+		Provisioning: connection.Provisioning,
+		Disabled:     connection.DisabledAt.Valid,
+		CreatedAt:    timestamppb.New(connection.CreatedAt.Time),
+	}
+	if connection.EmailAttribute.Valid {
+		rpcConnection.EmailAttribute = &connection.EmailAttribute.String
+	}
+	if connection.NameAttribute.Valid {
+		rpcConnection.NameAttribute = &connection.NameAttribute.String
+	}
+	if connection.RoleAttribute.Valid {
+		rpcConnection.RoleAttribute = &connection.RoleAttribute.String
+	}
+
+	return rpcConnection, nil
+}
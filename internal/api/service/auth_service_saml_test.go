@@ -0,0 +1,153 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+)
+
+const testSamlMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`
+
+func TestSamlConnectionRequests(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{})
+	admin := userContext(model.UserRoleAdministrator)
+	connection := func(id string, name string, metadata string, domains ...string) *pb.SamlConnection {
+		return &pb.SamlConnection{Id: id, Name: name, IdpMetadata: metadata, Domains: domains}
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{
+			"find without SAML service provider",
+			func() error {
+				_, err := s.FindSamlConnection(context.Background(), &pb.FindSamlConnectionRequest{Email: "user@acme.com"})
+				return err
+			},
+			codes.FailedPrecondition,
+		},
+		{
+			"save by user",
+			func() error {
+				_, err := s.SaveSamlConnection(userContext(model.UserRoleUser), connection("acme", "Acme", testSamlMetadata, "acme.com"))
+				return err
+			},
+			codes.PermissionDenied,
+		},
+		{
+			"save without name",
+			func() error {
+				_, err := s.SaveSamlConnection(admin, connection("acme", " ", testSamlMetadata, "acme.com"))
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"save id not usable in URLs",
+			func() error {
+				_, err := s.SaveSamlConnection(admin, connection("acme/../admin", "Acme", testSamlMetadata, "acme.com"))
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"save upper case id",
+			func() error {
+				_, err := s.SaveSamlConnection(admin, connection("Acme", "Acme", testSamlMetadata, "acme.com"))
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"save malformed metadata",
+			func() error {
+				_, err := s.SaveSamlConnection(admin, connection("acme", "Acme", "<EntityDescriptor", "acme.com"))
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"save without domains",
+			func() error {
+				_, err := s.SaveSamlConnection(admin, connection("acme", "Acme", testSamlMetadata, " ", ""))
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"disable by user",
+			func() error {
+				_, err := s.DisableSamlConnection(userContext(model.UserRoleUser), &pb.SamlConnectionId{Id: "acme"})
+				return err
+			},
+			codes.PermissionDenied,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+func TestSamlConnectionToRpc(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection model.SamlConnection
+		role       pb.UserRole
+		disabled   bool
+		ok         bool
+	}{
+		{
+			"role mapping",
+			model.SamlConnection{ID: "acme", RoleMapping: []byte(`{"admins":"administrator"}`), EmailAttribute: pgtype.Text{String: "mail", Valid: true}},
+			pb.UserRole_administrator,
+			false,
+			true,
+		},
+		{
+			"disabled",
+			model.SamlConnection{ID: "acme", RoleMapping: []byte(`{"staff":"user"}`), DisabledAt: pgtype.Timestamp{Valid: true}},
+			pb.UserRole_user,
+			true,
+			true,
+		},
+		{"malformed role mapping", model.SamlConnection{ID: "acme", RoleMapping: []byte(`[`)}, 0, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			connection, err := samlConnectionToRpc(&test.connection)
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if !test.ok {
+				return
+			}
+			if len(connection.RoleMapping) != 1 || connection.RoleMapping[0].Role != test.role || connection.Disabled != test.disabled {
+				t.Fatalf("unexpected connection %v", connection)
+			}
+			if test.connection.EmailAttribute.Valid != (connection.EmailAttribute != nil) || connection.NameAttribute != nil {
+				t.Fatalf("unexpected attributes of connection %v", connection)
+			}
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	authn "github.com/zs-dima/auth-service/internal/authn"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SignInServiceAccount issues an access token to the service account authenticated by a signed assertion or a client secret.
+// The token has no refresh token and no device, the service account signs in again once it expires.
+func (s *AuthServiceServer) SignInServiceAccount(ctx context.Context, request *pb.SignInServiceAccountRequest) (*pb.ServiceAccountToken, error) {
+	var account *model.ServiceAccount
+	var err error
+
+	switch {
+	case request.Assertion != nil:
+		s.Log.Info().Msg("Signing in service account by assertion ...")
+
+		account, err = s.config.ServiceAccounts.AuthenticateAssertion(ctx, *request.Assertion)
+		if err != nil {
+			return nil, s.Err.Unauthenticated("service account", err)
+		}
+	case request.ServiceAccountId != nil && request.Secret != nil:
+		accountId := tool.RpcIdToId(request.ServiceAccountId)
+
+		s.Log.Info().Msgf("Signing in service account %s by secret ...", accountId)
+
+		account, err = s.config.ServiceAccounts.AuthenticateSecret(ctx, *accountId, *request.Secret)
+		if err != nil {
+			return nil, s.Err.Unauthenticated("service account "+accountId.String(), err)
+		}
+	default:
+		return nil, s.Err.InvalidArgument("Credentials are required", "Service account sign in without assertion or secret")
+	}
+
+	generator := jwt.TokenGenerator{}
+	accessToken, expiresAt, err := generator.GenerateServiceAccountToken(account, s.config.ServiceAccountTokenTtl, s.config.JwtSecretKey)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign in",
+			fmt.Sprintf("Failed to generate service account %s access token", account.ID),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Service account %s signed in successfully", account.ID)
+
+	return &pb.ServiceAccountToken{
+		AccessToken: accessToken,
+		ExpiresAt:   timestamppb.New(expiresAt),
+	}, nil
+}
+
+func (s *AuthServiceServer) CreateServiceAccount(ctx context.Context, request *pb.CreateServiceAccountRequest) (*pb.ServiceAccount, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+	name := strings.TrimSpace(request.Name)
+
+	s.Log.Info().Msgf("Creating service account %s by %s ...", name, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, s.Err.InvalidArgument("Name is required", fmt.Sprintf("Service account by %s without name", principal))
+	}
+
+	account := model.ServiceAccount{
+		ID:          uuid.New(),
+		Role:        model.UserRole(pb.UserRole_name[int32(request.Role)]),
+		Name:        name,
+		Description: optionalText(request.Description),
+		CreatedAt:   pgtype.Timestamp{Time: time.Now(), Valid: true},
+	}
+
+	err := s.DB.CreateServiceAccount(
+		ctx,
+		model.CreateServiceAccountParams{
+			ID:          account.ID,
+			Role:        account.Role,
+			Name:        account.Name,
+			Description: account.Description,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to create service account",
+			fmt.Sprintf("Failed to save service account %s", name),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Service account %s %s created successfully", account.ID, name)
+
+	return serviceAccountToRpc(&account), nil
+}
+
+func (s *AuthServiceServer) LoadServiceAccounts(request *emptypb.Empty, stream pb.AuthService_LoadServiceAccountsServer) error {
+	ctx := stream.Context()
+
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Loading service accounts %s", principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return err
+	}
+
+	accounts, err := s.DB.LoadServiceAccounts(ctx)
+	if err != nil {
+		return s.Err.Internal(
+			"Failed to load service accounts",
+			fmt.Sprintf("Failed to load service accounts %s", principal),
+			err,
+		)
+	}
+
+	for _, account := range accounts {
+		if err := stream.Send(serviceAccountToRpc(&account)); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Info().Msgf("Loaded service accounts %s successfully", principal)
+
+	return nil
+}
+
+// DeleteServiceAccount stops the service account from signing in, access tokens already issued expire on their own.
+func (s *AuthServiceServer) DeleteServiceAccount(ctx context.Context, request *pb.ServiceAccountId) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	if request.Id == nil {
+		return nil, s.Err.InvalidArgument("Service account is required", fmt.Sprintf("Service account deletion by %s without id", principal))
+	}
+	accountId := tool.RpcIdToId(request.Id)
+
+	s.Log.Info().Msgf("Deleting service account %s by %s ...", accountId, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.DeleteServiceAccount(ctx, *accountId)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to delete service account",
+			fmt.Sprintf("Failed to delete service account %s", accountId),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("Service account not found", fmt.Sprintf("Service account %s not found or deleted", accountId))
+	}
+
+	s.Log.Info().Msgf("Service account %s deleted successfully", accountId)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+// AddServiceAccountKey registers the public key of the service account, or generates a client secret when no key is given.
+func (s *AuthServiceServer) AddServiceAccountKey(ctx context.Context, request *pb.AddServiceAccountKeyRequest) (*pb.ServiceAccountKeyReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	if request.ServiceAccountId == nil {
+		return nil, s.Err.InvalidArgument("Service account is required", fmt.Sprintf("Service account key by %s without service account", principal))
+	}
+	accountId := tool.RpcIdToId(request.ServiceAccountId)
+
+	s.Log.Info().Msgf("Adding service account %s key by %s ...", accountId, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.DB.GetActiveServiceAccount(ctx, *accountId); err != nil {
+		return nil, s.Err.InvalidArgument("Service account not found", fmt.Sprintf("Service account %s not found or deleted: %v", accountId, err))
+	}
+
+	key := model.ServiceAccountKey{
+		ID:               uuid.New(),
+		ServiceAccountID: *accountId,
+		CreatedAt:        pgtype.Timestamp{Time: time.Now(), Valid: true},
+	}
+
+	var secret *string
+	if request.PublicKey != nil {
+		publicKey := strings.TrimSpace(*request.PublicKey)
+		if _, err := authn.ParseServiceAccountPublicKey(publicKey); err != nil {
+			return nil, s.Err.InvalidArgument("Invalid public key", fmt.Sprintf("Service account %s public key is invalid: %v", accountId, err))
+		}
+		key.Type = model.ServiceAccountKeyTypePublicKey
+		key.PublicKey = pgtype.Text{String: publicKey, Valid: true}
+	} else {
+		plain, hash, err := s.generateClientSecret()
+		if err != nil {
+			return nil, s.Err.Internal(
+				"Failed to add service account key",
+				fmt.Sprintf("Failed to generate service account %s secret", accountId),
+				err,
+			)
+		}
+		secret = &plain
+		key.Type = model.ServiceAccountKeyTypeSecret
+		key.SecretHash = pgtype.Text{String: hash, Valid: true}
+	}
+
+	err := s.DB.CreateServiceAccountKey(
+		ctx,
+		model.CreateServiceAccountKeyParams{
+			ID:               key.ID,
+			ServiceAccountID: key.ServiceAccountID,
+			Type:             key.Type,
+			PublicKey:        key.PublicKey,
+			SecretHash:       key.SecretHash,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to add service account key",
+			fmt.Sprintf("Failed to save service account %s key", accountId),
+			err,
+		)
+	}
+
+	s.Log.Info().Msgf("Service account %s key %s added successfully", accountId, key.ID)
+
+	return &pb.ServiceAccountKeyReply{
+		Key:    serviceAccountKeyToRpc(&key),
+		Secret: secret,
+	}, nil
+}
+
+func (s *AuthServiceServer) LoadServiceAccountKeys(request *pb.ServiceAccountId, stream pb.AuthService_LoadServiceAccountKeysServer) error {
+	ctx := stream.Context()
+
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	if request.Id == nil {
+		return s.Err.InvalidArgument("Service account is required", fmt.Sprintf("Service account keys loaded by %s without id", principal))
+	}
+	accountId := tool.RpcIdToId(request.Id)
+
+	s.Log.Info().Msgf("Loading service account %s keys %s", accountId, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return err
+	}
+
+	keys, err := s.DB.LoadServiceAccountKeys(ctx, *accountId)
+	if err != nil {
+		return s.Err.Internal(
+			"Failed to load service account keys",
+			fmt.Sprintf("Failed to load service account %s keys", accountId),
+			err,
+		)
+	}
+
+	for _, key := range keys {
+		if err := stream.Send(serviceAccountKeyToRpc(&key)); err != nil {
+			return err
+		}
+	}
+
+	s.Log.Info().Msgf("Loaded service account %s keys %s successfully", accountId, principal)
+
+	return nil
+}
+
+func (s *AuthServiceServer) RevokeServiceAccountKey(ctx context.Context, request *pb.RevokeServiceAccountKeyRequest) (*pb.ResultReply, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	if request.ServiceAccountId == nil || request.KeyId == nil {
+		return nil, s.Err.InvalidArgument("Key is required", fmt.Sprintf("Service account key revocation by %s without id", principal))
+	}
+	accountId := tool.RpcIdToId(request.ServiceAccountId)
+	keyId := tool.RpcIdToId(request.KeyId)
+
+	s.Log.Info().Msgf("Revoking service account %s key %s by %s ...", accountId, keyId, principal)
+
+	if err := s.requireRole(authInfo, model.UserRoleAdministrator); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.RevokeServiceAccountKey(
+		ctx,
+		model.RevokeServiceAccountKeyParams{
+			ID:               *keyId,
+			ServiceAccountID: *accountId,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to revoke service account key",
+			fmt.Sprintf("Failed to revoke service account %s key %s", accountId, keyId),
+			err,
+		)
+	}
+	if rows == 0 {
+		return nil, s.Err.InvalidArgument("Service account key not found", fmt.Sprintf("Service account %s key %s not found or revoked", accountId, keyId))
+	}
+
+	s.Log.Info().Msgf("Service account %s key %s revoked successfully", accountId, keyId)
+
+	res := &pb.ResultReply{
+		Result: true,
+	}
+
+	return res, nil
+}
+
+func serviceAccountToRpc(account *model.ServiceAccount) *pb.ServiceAccount {
+	rpcAccount := &pb.ServiceAccount{
+		Id:        tool.IdToRpcId(&account.ID),
+		Name:      account.Name,
+		Role:      pb.UserRole(pb.UserRole_value[string(account.Role)]),
+		Deleted:   account.DeletedAt.Valid,
+		CreatedAt: timestamppb.New(account.CreatedAt.Time),
+	}
+	if account.Description.Valid {
+		rpcAccount.Description = &account.Description.String
+	}
+	return rpcAccount
+}
+
+func serviceAccountKeyToRpc(key *model.ServiceAccountKey) *pb.ServiceAccountKey {
+	rpcKey := &pb.ServiceAccountKey{
+		Id:               tool.IdToRpcId(&key.ID),
+		ServiceAccountId: tool.IdToRpcId(&key.ServiceAccountID),
+		Type:             string(key.Type),
+		Revoked:          key.RevokedAt.Valid,
+		CreatedAt:        timestamppb.New(key.CreatedAt.Time),
+	}
+	if key.PublicKey.Valid {
+		rpcKey.PublicKey = &key.PublicKey.String
+	}
+	if key.LastUsedAt.Valid {
+		rpcKey.LastUsedAt = timestamppb.New(key.LastUsedAt.Time)
+	}
+	return rpcKey
+}
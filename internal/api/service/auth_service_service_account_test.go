@@ -0,0 +1,94 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+)
+
+func TestServiceAccountRequests(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{})
+	admin := userContext(model.UserRoleAdministrator)
+	accountId := uuid.New()
+	publicKey := "key"
+
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{
+			"sign in without credentials",
+			func() error {
+				_, err := s.SignInServiceAccount(context.Background(), &pb.SignInServiceAccountRequest{})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"sign in with id only",
+			func() error {
+				_, err := s.SignInServiceAccount(context.Background(), &pb.SignInServiceAccountRequest{ServiceAccountId: tool.IdToRpcId(&accountId)})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"create by user",
+			func() error {
+				_, err := s.CreateServiceAccount(userContext(model.UserRoleUser), &pb.CreateServiceAccountRequest{Name: "Billing"})
+				return err
+			},
+			codes.PermissionDenied,
+		},
+		{
+			"create without name",
+			func() error {
+				_, err := s.CreateServiceAccount(admin, &pb.CreateServiceAccountRequest{Name: " "})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"add key without service account",
+			func() error {
+				_, err := s.AddServiceAccountKey(admin, &pb.AddServiceAccountKeyRequest{PublicKey: &publicKey})
+				return err
+			},
+			codes.InvalidArgument,
+		},
+		{
+			"add key by user",
+			func() error {
+				_, err := s.AddServiceAccountKey(userContext(model.UserRoleUser), &pb.AddServiceAccountKeyRequest{ServiceAccountId: tool.IdToRpcId(&accountId)})
+				return err
+			},
+			codes.PermissionDenied,
+		},
+		{
+			"delete by user",
+			func() error {
+				_, err := s.DeleteServiceAccount(userContext(model.UserRoleUser), &pb.ServiceAccountId{Id: tool.IdToRpcId(&accountId)})
+				return err
+			},
+			codes.PermissionDenied,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.call()
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	mailer "github.com/zs-dima/auth-service/internal/mailer"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// SignUpPolicy defines who is allowed to register without an administrator.
+type SignUpPolicy string
+
+const (
+	SignUpDisabled   SignUpPolicy = "disabled"
+	SignUpOpen       SignUpPolicy = "open"
+	SignUpDomains    SignUpPolicy = "domains"
+	SignUpInvitation SignUpPolicy = "invitation"
+)
+
+func (s *AuthServiceServer) SignUp(ctx context.Context, request *pb.SignUpRequest) (*pb.SignUpReply, error) {
+	userEmail := strings.TrimSpace(request.Email)
+
+	s.Log.Info().Msgf("Signing up %s ...", userEmail)
+
+	if s.config.SignUpPolicy == SignUpDisabled || s.config.SignUpPolicy == "" {
+		return nil, s.Err.FailedPrecondition("Sign up is disabled", fmt.Sprintf("Sign up of %s rejected, sign up is disabled", userEmail))
+	}
+
+	if request.DeviceInfo.GetId() == nil || request.InstallationId == nil {
+		return nil, s.Err.InvalidArgument("Device is required", fmt.Sprintf("Sign up of %s without device info", userEmail))
+	}
+	if strings.TrimSpace(request.Name) == "" || request.Password == "" {
+		return nil, s.Err.InvalidArgument("Name and password are required", fmt.Sprintf("Sign up of %s without name or password", userEmail))
+	}
+
+	deviceId := tool.RpcIdToId(request.DeviceInfo.Id)
+	installationId := tool.RpcIdToId(request.InstallationId)
+
+	if s.config.SignUpPolicy == SignUpInvitation {
+		return s.signUpByInvitation(ctx, request, deviceId, installationId)
+	}
+
+	userEmail, emailValid := tool.NormalizeEmail(userEmail)
+	if userEmail == "" {
+		return nil, s.Err.InvalidArgument("Email is required", "Sign up without email")
+	}
+	if !emailValid {
+		return nil, s.Err.InvalidArgument("Invalid email", fmt.Sprintf("Sign up of invalid email %s", userEmail))
+	}
+	if s.config.Authenticator.IsExternal(userEmail) {
+		return nil, s.Err.FailedPrecondition("Email is managed by the directory", fmt.Sprintf("Sign up of %s rejected, directory domain", userEmail))
+	}
+	if s.config.SignUpPolicy == SignUpDomains && !s.isSignUpDomainAllowed(userEmail) {
+		return nil, s.Err.FailedPrecondition("Email domain is not allowed", fmt.Sprintf("Sign up of %s rejected, domain is not allowed", userEmail))
+	}
+
+	taken, err := s.DB.IsEmailTaken(ctx, userEmail)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to check %s availability", userEmail),
+			err,
+		)
+	}
+	if taken {
+		if !s.config.RequireVerifiedEmail {
+			return nil, s.Err.InvalidArgument("Email is already in use", fmt.Sprintf("Email %s is already in use", userEmail))
+		}
+
+		// Reply as for a new user to not disclose registered emails, the owner is notified instead
+		err = s.sendMail(ctx, userEmail, mailer.TemplateSignUpAttempt, nil)
+		if err != nil {
+			s.Log.Error().Msgf("Failed to notify %s about sign up attempt: %v", userEmail, err)
+		}
+
+		return &pb.SignUpReply{VerificationRequired: true}, nil
+	}
+
+	encryptor := tool.Encryptor{}
+	passwordHash, err := encryptor.Hash(request.Password)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to hash %s password", userEmail),
+			err,
+		)
+	}
+
+	tx, err := s.DbPool.Begin(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to create user %s", userEmail),
+			err,
+		)
+	}
+	defer tx.Rollback(ctx)
+	qtx := s.DB.WithTx(tx)
+
+	userId, err := qtx.CreateUser(
+		ctx,
+		model.CreateUserParams{
+			ID:       uuid.New(),
+			Name:     strings.TrimSpace(request.Name),
+			Email:    userEmail,
+			Password: passwordHash,
+			Role:     model.UserRoleUser,
+			Deleted:  false,
+		})
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to create user %s", userEmail),
+			err,
+		)
+	}
+
+	err = s.publishUserEvent(ctx, qtx, UserEventCreated, userId)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to publish user %s created event", userEmail),
+			err,
+		)
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to create user %s", userEmail),
+			err,
+		)
+	}
+	s.notifyEvents()
+
+	user, err := s.DB.GetUser(ctx, userId)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to load user %s", userEmail),
+			err,
+		)
+	}
+
+	err = s.sendEmailVerification(ctx, &user)
+	if err != nil {
+		// The user is created anyway, verification could be requested again
+		s.Log.Error().Msgf("Failed to send %s email verification: %v", userEmail, err)
+	}
+
+	if s.config.RequireVerifiedEmail {
+		s.Log.Info().Msgf("%s signed up successfully, email verification required", userEmail)
+		return &pb.SignUpReply{VerificationRequired: true}, nil
+	}
+
+	authInfo, err := s.issueAuthInfo(ctx, &user, deviceId, installationId, []string{jwt.AmrPassword})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed up successfully", userEmail)
+
+	return &pb.SignUpReply{AuthInfo: authInfo}, nil
+}
+
+func (s *AuthServiceServer) signUpByInvitation(
+	ctx context.Context,
+	request *pb.SignUpRequest,
+	deviceId *uuid.UUID,
+	installationId *uuid.UUID,
+) (*pb.SignUpReply, error) {
+	if strings.TrimSpace(request.GetInvitationToken()) == "" {
+		return nil, s.Err.FailedPrecondition("Sign up requires invitation", fmt.Sprintf("Sign up of %s without invitation", request.Email))
+	}
+
+	invitation, err := s.acceptInvitation(ctx, request.GetInvitationToken(), request.Name, request.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.DB.GetUser(ctx, invitation.UserID.UUID)
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to sign up",
+			fmt.Sprintf("Failed to load user %s", invitation.Email),
+			err,
+		)
+	}
+
+	// Invitation link verifies the email, so the user could sign in immediately
+	authInfo, err := s.issueAuthInfo(ctx, &user, deviceId, installationId, []string{jwt.AmrPassword})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s signed up by invitation successfully", invitation.Email)
+
+	return &pb.SignUpReply{AuthInfo: authInfo}, nil
+}
+
+func (s *AuthServiceServer) isSignUpDomainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := strings.ToLower(email[at+1:])
+
+	for _, allowed := range s.config.SignUpAllowedDomains {
+		if domain == strings.ToLower(allowed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	authn "github.com/zs-dima/auth-service/internal/authn"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+)
+
+func signUpRequest(email string) *pb.SignUpRequest {
+	deviceId := uuid.New()
+	installationId := uuid.New()
+	return &pb.SignUpRequest{
+		Email:          email,
+		Name:           "User",
+		Password:       "secret",
+		InstallationId: tool.IdToRpcId(&installationId),
+		DeviceInfo:     &pb.DeviceInfo{Id: tool.IdToRpcId(&deviceId)},
+	}
+}
+
+func TestSignUpPolicy(t *testing.T) {
+	// Passwords of the directory domain are managed by LDAP
+	authenticator := authn.NewDomainAuthenticator(nil)
+	authenticator.Add(nil, "corp.example.com")
+
+	withoutDevice := signUpRequest("user@example.com")
+	withoutDevice.DeviceInfo = nil
+	withoutPassword := signUpRequest("user@example.com")
+	withoutPassword.Password = ""
+	withoutName := signUpRequest("user@example.com")
+	withoutName.Name = " "
+
+	tests := []struct {
+		name    string
+		policy  SignUpPolicy
+		request *pb.SignUpRequest
+		code    codes.Code
+	}{
+		{"unset policy", "", signUpRequest("user@example.com"), codes.FailedPrecondition},
+		{"disabled", SignUpDisabled, signUpRequest("user@example.com"), codes.FailedPrecondition},
+		{"without device", SignUpOpen, withoutDevice, codes.InvalidArgument},
+		{"without password", SignUpOpen, withoutPassword, codes.InvalidArgument},
+		{"without name", SignUpOpen, withoutName, codes.InvalidArgument},
+		{"invitation without token", SignUpInvitation, signUpRequest("user@example.com"), codes.FailedPrecondition},
+		{"without email", SignUpOpen, signUpRequest(" "), codes.InvalidArgument},
+		{"invalid email", SignUpOpen, signUpRequest("user@"), codes.InvalidArgument},
+		{"directory domain", SignUpOpen, signUpRequest("user@corp.example.com"), codes.FailedPrecondition},
+		{"directory domain not normalized", SignUpOpen, signUpRequest(" User@CORP.example.com "), codes.FailedPrecondition},
+		{"directory domain of allowed domains", SignUpDomains, signUpRequest("user@corp.example.com"), codes.FailedPrecondition},
+		{"domain not allowed", SignUpDomains, signUpRequest("user@other.com"), codes.FailedPrecondition},
+		{"subdomain not allowed", SignUpDomains, signUpRequest("user@sub.example.com"), codes.FailedPrecondition},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := testServer(&AuthServiceServerConfig{
+				Authenticator:        authenticator,
+				SignUpPolicy:         test.policy,
+				SignUpAllowedDomains: []string{"example.com", "corp.example.com"},
+				RequireVerifiedEmail: true,
+			})
+
+			_, err := s.SignUp(context.Background(), test.request)
+
+			if code := status.Code(err); code != test.code {
+				t.Fatalf("got %s, want %s: %v", code, test.code, err)
+			}
+		})
+	}
+}
+
+func TestIsSignUpDomainAllowed(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{SignUpAllowedDomains: []string{"example.com", "Partner.ORG"}})
+
+	tests := []struct {
+		email   string
+		allowed bool
+	}{
+		{"user@example.com", true},
+		{"user@EXAMPLE.com", true},
+		{"user@partner.org", true},
+		{"user@sub.example.com", false},
+		{"user@example.com.evil.com", false},
+		{"user@other.com", false},
+		{"example.com", false},
+	}
+
+	for _, test := range tests {
+		if allowed := s.isSignUpDomainAllowed(test.email); allowed != test.allowed {
+			t.Errorf("isSignUpDomainAllowed(%q) = %v, want %v", test.email, allowed, test.allowed)
+		}
+	}
+}
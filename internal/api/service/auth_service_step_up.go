@@ -0,0 +1,54 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	authn "github.com/zs-dima/auth-service/internal/authn"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// Reauthenticate checks the password of the signed in user again and issues tokens with a fresh `auth_time`,
+// so methods requiring a recent sign in are allowed. Users with SMS MFA get the MFA token to complete by VerifySmsMfa.
+func (s *AuthServiceServer) Reauthenticate(ctx context.Context, request *pb.ReauthenticateRequest) (*pb.AuthInfo, error) {
+	authInfo := jwt.ExtractAuthInfo(ctx)
+	principal := authInfo.Principal()
+
+	s.Log.Info().Msgf("Re-authenticating %s ...", principal)
+
+	if authInfo.UserInfo == nil || authInfo.DeviceId == nil {
+		return nil, s.Err.PermissionDenied(principal, fmt.Errorf("user session is required"))
+	}
+
+	// Look up by id, the email claim is outdated once the user changed the email
+	user, err := s.DB.GetActiveUserById(ctx, *authInfo.UserInfo.Id)
+	if err != nil {
+		return nil, s.Err.Unauthenticated(principal, err)
+	}
+
+	authenticated, err := s.config.Authenticator.Authenticate(ctx, user.Email, request.Password)
+	if errors.Is(err, authn.ErrInvalidCredentials) {
+		return nil, s.Err.Unauthenticated(user.Email, err)
+	}
+	if err != nil {
+		return nil, s.Err.Internal(
+			"Failed to re-authenticate",
+			fmt.Sprintf("Failed to authenticate %s", user.Email),
+			err,
+		)
+	}
+	if authenticated.ID != user.ID {
+		return nil, s.Err.Unauthenticated(user.Email, fmt.Errorf("%s authenticated as another user %s", user.Email, authenticated.ID))
+	}
+
+	res, err := s.signInUser(ctx, authenticated, authInfo.DeviceId, authInfo.InstallationId, []string{jwt.AmrPassword})
+	if err != nil {
+		return nil, err
+	}
+
+	s.Log.Info().Msgf("%s re-authenticated successfully", user.Email)
+
+	return res, nil
+}
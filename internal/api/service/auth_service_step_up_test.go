@@ -0,0 +1,45 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	pb "github.com/zs-dima/auth-service/internal/gen/proto"
+	jwt "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// Callers without a device session can not get a fresh sign in, the interceptor denies them step-up methods instead.
+func TestReauthenticateWithoutSession(t *testing.T) {
+	s := testServer(&AuthServiceServerConfig{})
+	userId := uuid.New()
+	accountId := uuid.New()
+
+	tests := []struct {
+		name     string
+		authInfo *jwt.JwtAuthInfo
+	}{
+		{"client", &jwt.JwtAuthInfo{ClientInfo: &jwt.JwtClientInfo{Id: "billing"}}},
+		{"personal access token", &jwt.JwtAuthInfo{
+			UserInfo: &jwt.JwtUserInfo{Id: &userId, Role: jwt.JwtUserRole(model.UserRoleUser), Email: "user@example.com"},
+			PatInfo:  &jwt.JwtPatInfo{Id: uuid.New(), Scopes: []string{"users:write"}},
+		}},
+		{"service account", &jwt.JwtAuthInfo{UserInfo: &jwt.JwtUserInfo{Id: &accountId, ServiceAccount: true}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.WithValue(context.Background(), jwt.UserClaimsKey, test.authInfo)
+
+			_, err := s.Reauthenticate(ctx, &pb.ReauthenticateRequest{Password: "secret"})
+
+			if code := status.Code(err); code != codes.PermissionDenied {
+				t.Fatalf("got %s, want %s: %v", code, codes.PermissionDenied, err)
+			}
+		})
+	}
+}
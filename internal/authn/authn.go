@@ -0,0 +1,83 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+)
+
+// ErrInvalidCredentials is returned for unknown users and wrong passwords alike.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks the user password and returns the active local user.
+type Authenticator interface {
+	Authenticate(ctx context.Context, email string, password string) (*model.User, error)
+}
+
+// PostgresAuthenticator checks passwords against bcrypt hashes of the user table.
+type PostgresAuthenticator struct {
+	db *model.Queries
+}
+
+func NewPostgresAuthenticator(db *model.Queries) *PostgresAuthenticator {
+	return &PostgresAuthenticator{db: db}
+}
+
+func (a *PostgresAuthenticator) Authenticate(ctx context.Context, email string, password string) (*model.User, error) {
+	user, err := a.db.GetActiveUser(ctx, email)
+	if err != nil {
+		return nil, errors.Join(ErrInvalidCredentials, err)
+	}
+
+	encryptor := tool.Encryptor{}
+	if !encryptor.Validate(password, user.Password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &user, nil
+}
+
+// DomainAuthenticator selects the authenticator by the email domain, the default one is used for other domains.
+type DomainAuthenticator struct {
+	fallback Authenticator
+	domains  map[string]Authenticator
+}
+
+func NewDomainAuthenticator(fallback Authenticator) *DomainAuthenticator {
+	return &DomainAuthenticator{
+		fallback: fallback,
+		domains:  map[string]Authenticator{},
+	}
+}
+
+// Add routes the email domains to the authenticator.
+func (a *DomainAuthenticator) Add(authenticator Authenticator, domains ...string) {
+	for _, domain := range domains {
+		a.domains[strings.ToLower(domain)] = authenticator
+	}
+}
+
+func (a *DomainAuthenticator) Authenticate(ctx context.Context, email string, password string) (*model.User, error) {
+	return a.authenticator(email).Authenticate(ctx, email, password)
+}
+
+// IsExternal reports whether the password of the email is managed outside of the service.
+func (a *DomainAuthenticator) IsExternal(email string) bool {
+	_, ok := a.domains[emailDomain(email)]
+	return ok
+}
+
+func (a *DomainAuthenticator) authenticator(email string) Authenticator {
+	if authenticator, ok := a.domains[emailDomain(email)]; ok {
+		return authenticator
+	}
+	return a.fallback
+}
+
+func emailDomain(email string) string {
+	_, domain, _ := strings.Cut(email, "@")
+	return strings.ToLower(strings.TrimSpace(domain))
+}
@@ -0,0 +1,479 @@
+package authn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+type LdapOptions struct {
+	// Name of the directory used in logs, e.g. `corp`.
+	Name string
+	// Url of the server, `ldap://host:389` or `ldaps://host:636`.
+	Url      string
+	StartTls bool
+	// BindDn and BindPassword of the service account searching users, anonymous search when empty.
+	BindDn       string
+	BindPassword string
+	BaseDn       string
+	// UserFilter restricts users allowed to sign in, e.g. `(&(objectClass=user)(memberOf=cn=app,ou=groups,dc=example,dc=com))`.
+	UserFilter     string
+	EmailAttribute string
+	NameAttribute  string
+	GroupAttribute string
+	// RoleMapping maps group DNs to user roles, users without mapped groups get the user role.
+	RoleMapping map[string]model.UserRole
+	// Domains of emails authenticated by the directory.
+	Domains []string
+	// SyncInterval of names, roles and removed users, sync is disabled when zero.
+	SyncInterval time.Duration
+	// SyncMaxDeletes is the maximum number of users deleted by one sync, no user is deleted when more are missing.
+	SyncMaxDeletes int
+	// SyncDryRun logs changes of the sync without applying them.
+	SyncDryRun bool
+	Timeout    time.Duration
+}
+
+// LdapAuthenticator checks passwords by binding as the directory user found by the email.
+// Users are created on the first sign in without a local password, their names and roles follow the directory.
+type LdapAuthenticator struct {
+	options *LdapOptions
+	db      *model.Queries
+	log     *zerolog.Logger
+}
+
+// LdapProvider is the provider of user identities linked by directories.
+const LdapProvider = "ldap"
+
+type directoryUser struct {
+	dn    string
+	email string
+	name  string
+	role  model.UserRole
+}
+
+func NewLdapAuthenticator(options *LdapOptions, db *model.Queries, log *zerolog.Logger) *LdapAuthenticator {
+	if options.UserFilter == "" {
+		options.UserFilter = "(objectClass=person)"
+	}
+	if options.EmailAttribute == "" {
+		options.EmailAttribute = "mail"
+	}
+	if options.NameAttribute == "" {
+		options.NameAttribute = "cn"
+	}
+	if options.GroupAttribute == "" {
+		options.GroupAttribute = "memberOf"
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 10 * time.Second
+	}
+	if options.SyncMaxDeletes <= 0 {
+		options.SyncMaxDeletes = 10
+	}
+
+	roleMapping := map[string]model.UserRole{}
+	for group, role := range options.RoleMapping {
+		roleMapping[normalizeDn(group)] = role
+	}
+	options.RoleMapping = roleMapping
+
+	return &LdapAuthenticator{
+		options: options,
+		db:      db,
+		log:     log,
+	}
+}
+
+// Domains authenticated by the directory.
+func (a *LdapAuthenticator) Domains() []string {
+	return a.options.Domains
+}
+
+func (a *LdapAuthenticator) Authenticate(ctx context.Context, email string, password string) (*model.User, error) {
+	// Empty password is an unauthenticated bind, which succeeds on most servers
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := fmt.Sprintf("(&%s(%s=%s))", a.options.UserFilter, a.options.EmailAttribute, ldap.EscapeFilter(email))
+	entries, err := a.search(conn, filter, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, errors.Join(ErrInvalidCredentials, fmt.Errorf("%d %s directory entries found", len(entries), a.options.Name))
+	}
+
+	err = conn.Bind(entries[0].dn, password)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind %s to %s directory: %w", entries[0].dn, a.options.Name, err)
+	}
+
+	return a.syncUser(ctx, entries[0])
+}
+
+// Run syncs directory users periodically until the context is cancelled.
+func (a *LdapAuthenticator) Run(ctx context.Context) {
+	if a.options.SyncInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(a.options.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.Sync(ctx); err != nil && ctx.Err() == nil {
+			a.log.Error().Msgf("Failed to sync %s directory: %v", a.options.Name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sync updates names and roles of users provisioned from the directory and deletes users removed from the directory.
+// Local users of the directory domains who never signed in by the directory are left untouched.
+func (a *LdapAuthenticator) Sync(ctx context.Context) error {
+	conn, err := a.connect()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	entries, err := a.search(conn, a.options.UserFilter, true)
+	if err != nil {
+		return err
+	}
+	// Empty result is rather a broken filter or base DN than removal of all users
+	if len(entries) == 0 {
+		return fmt.Errorf("no users found in %s directory, sync skipped", a.options.Name)
+	}
+
+	users, err := a.db.LoadActiveIdentityUsers(ctx, a.issuer())
+	if err != nil {
+		return fmt.Errorf("failed to load %s directory users: %w", a.options.Name, err)
+	}
+
+	updates, deletes := planSync(users, entries)
+	// Mass removal is rather a changed filter or base DN than users leaving
+	if len(deletes) > a.options.SyncMaxDeletes {
+		return fmt.Errorf("%d users missing in %s directory exceed the limit of %d deletes, sync skipped", len(deletes), a.options.Name, a.options.SyncMaxDeletes)
+	}
+
+	if a.options.SyncDryRun {
+		for _, update := range updates {
+			a.log.Info().Msgf("%s would be updated by %s directory: name %s, role %s", update.user.Email, a.options.Name, update.entry.name, update.entry.role)
+		}
+		for _, user := range deletes {
+			a.log.Info().Msgf("%s would be deleted, the user is removed from %s directory", user.Email, a.options.Name)
+		}
+		a.log.Info().Msgf("%s directory sync dry run: %d users to update, %d to delete", a.options.Name, len(updates), len(deletes))
+		return nil
+	}
+
+	for _, update := range updates {
+		if err := a.updateUser(ctx, update.user, update.entry); err != nil {
+			return err
+		}
+	}
+	for _, user := range deletes {
+		if err := a.deleteUser(ctx, user); err != nil {
+			return err
+		}
+	}
+
+	a.log.Info().Msgf("%s directory synced: %d users updated, %d deleted", a.options.Name, len(updates), len(deletes))
+
+	return nil
+}
+
+type syncUpdate struct {
+	user  *model.User
+	entry *directoryUser
+}
+
+// planSync returns users whose name or role differ from the directory and users missing in the directory.
+func planSync(users []model.User, entries []*directoryUser) ([]syncUpdate, []*model.User) {
+	directory := map[string]*directoryUser{}
+	for _, entry := range entries {
+		directory[strings.ToLower(entry.email)] = entry
+	}
+
+	var updates []syncUpdate
+	var deletes []*model.User
+	for i := range users {
+		user := &users[i]
+		entry, ok := directory[strings.ToLower(user.Email)]
+		if !ok {
+			deletes = append(deletes, user)
+			continue
+		}
+		if entry.name != user.Name || entry.role != user.Role {
+			updates = append(updates, syncUpdate{user: user, entry: entry})
+		}
+	}
+	return updates, deletes
+}
+
+// deleteUser ends the session of the user removed from the directory before the user is deleted.
+func (a *LdapAuthenticator) deleteUser(ctx context.Context, user *model.User) error {
+	if err := a.db.EndUserSession(ctx, user.ID); err != nil {
+		return fmt.Errorf("failed to end %s session: %w", user.Email, err)
+	}
+	if err := a.db.DeleteUser(ctx, user.ID); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", user.Email, err)
+	}
+
+	a.log.Info().Msgf("%s deleted, the user is removed from %s directory", user.Email, a.options.Name)
+
+	return nil
+}
+
+// syncUser returns the local user of the directory entry, the user is created on the first sign in.
+func (a *LdapAuthenticator) syncUser(ctx context.Context, entry *directoryUser) (*model.User, error) {
+	user, err := a.db.GetActiveUser(ctx, entry.email)
+	if err == nil {
+		if err := a.linkUser(ctx, &user, entry); err != nil {
+			return nil, err
+		}
+		if entry.name != user.Name || entry.role != user.Role {
+			if err := a.updateUser(ctx, &user, entry); err != nil {
+				return nil, err
+			}
+		}
+		return &user, nil
+	}
+
+	// Deleted users are not restored by the directory
+	taken, err := a.db.IsEmailTaken(ctx, entry.email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check %s: %w", entry.email, err)
+	}
+	if taken {
+		return nil, errors.Join(ErrInvalidCredentials, fmt.Errorf("user %s is deleted", entry.email))
+	}
+
+	userId, err := a.db.CreateUser(
+		ctx,
+		model.CreateUserParams{
+			ID:       uuid.New(),
+			Name:     entry.name,
+			Email:    entry.email,
+			Password: "",
+			Role:     entry.role,
+			Deleted:  false,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user %s: %w", entry.email, err)
+	}
+
+	// Directory emails are trusted
+	_, err = a.db.VerifyUserEmail(ctx, model.VerifyUserEmailParams{ID: userId, Email: entry.email})
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify %s email: %w", entry.email, err)
+	}
+
+	user, err = a.db.GetUser(ctx, userId)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user %s: %w", entry.email, err)
+	}
+
+	if err := a.linkUser(ctx, &user, entry); err != nil {
+		return nil, err
+	}
+
+	a.log.Info().Msgf("User %s created from %s directory with %s role", entry.email, a.options.Name, entry.role)
+
+	return &user, nil
+}
+
+// linkUser records the directory entry as the identity of the user, only linked users are synced with the directory.
+func (a *LdapAuthenticator) linkUser(ctx context.Context, user *model.User, entry *directoryUser) error {
+	subject := normalizeDn(entry.dn)
+	email := pgtype.Text{String: entry.email, Valid: true}
+
+	identity, err := a.db.GetUserIdentity(ctx, model.GetUserIdentityParams{Issuer: a.issuer(), Subject: subject})
+	if err == nil {
+		err = a.db.UpdateUserIdentitySignIn(ctx, model.UpdateUserIdentitySignInParams{ID: identity.ID, Email: email})
+		if err != nil {
+			return fmt.Errorf("failed to update %s directory identity of %s: %w", a.options.Name, user.Email, err)
+		}
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("failed to load %s directory identity %s: %w", a.options.Name, entry.dn, err)
+	}
+
+	err = a.db.CreateUserIdentity(
+		ctx,
+		model.CreateUserIdentityParams{
+			UserID:   user.ID,
+			Provider: LdapProvider,
+			Issuer:   a.issuer(),
+			Subject:  subject,
+			Email:    email,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to link %s directory identity to %s: %w", a.options.Name, user.Email, err)
+	}
+	return nil
+}
+
+// issuer of identities of the directory users.
+func (a *LdapAuthenticator) issuer() string {
+	return LdapProvider + ":" + a.options.Name
+}
+
+func (a *LdapAuthenticator) updateUser(ctx context.Context, user *model.User, entry *directoryUser) error {
+	err := a.db.SyncDirectoryUser(
+		ctx,
+		model.SyncDirectoryUserParams{
+			ID:   user.ID,
+			Name: entry.name,
+			Role: entry.role,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to update %s from %s directory: %w", user.Email, a.options.Name, err)
+	}
+
+	if entry.role != user.Role {
+		a.log.Info().Msgf("%s role changed from %s to %s by %s directory", user.Email, user.Role, entry.role, a.options.Name)
+	}
+
+	user.Name = entry.name
+	user.Role = entry.role
+	return nil
+}
+
+func (a *LdapAuthenticator) connect() (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.options.Url, ldap.DialWithTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect %s directory: %w", a.options.Name, err)
+	}
+	conn.SetTimeout(a.options.Timeout)
+
+	if a.options.StartTls {
+		if err := conn.StartTLS(&tls.Config{MinVersion: tls.VersionTLS12, ServerName: serverName(a.options.Url)}); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS with %s directory: %w", a.options.Name, err)
+		}
+	}
+
+	if a.options.BindDn != "" {
+		if err := conn.Bind(a.options.BindDn, a.options.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to bind %s directory service account: %w", a.options.Name, err)
+		}
+	}
+
+	return conn, nil
+}
+
+func (a *LdapAuthenticator) search(conn *ldap.Conn, filter string, paged bool) ([]*directoryUser, error) {
+	request := ldap.NewSearchRequest(
+		a.options.BaseDn,
+		ldap.ScopeWholeSubtree,
+		ldap.NeverDerefAliases,
+		0,
+		int(a.options.Timeout.Seconds()),
+		false,
+		filter,
+		[]string{a.options.EmailAttribute, a.options.NameAttribute, a.options.GroupAttribute},
+		nil,
+	)
+
+	var result *ldap.SearchResult
+	var err error
+	if paged {
+		result, err = conn.SearchWithPaging(request, 500)
+	} else {
+		result, err = conn.Search(request)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s directory: %w", a.options.Name, err)
+	}
+
+	users := make([]*directoryUser, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		email := strings.TrimSpace(entry.GetAttributeValue(a.options.EmailAttribute))
+		if email == "" {
+			continue
+		}
+		name := strings.TrimSpace(entry.GetAttributeValue(a.options.NameAttribute))
+		if name == "" {
+			name = email
+		}
+
+		users = append(users, &directoryUser{
+			dn:    entry.DN,
+			email: email,
+			name:  name,
+			role:  a.mapRole(entry.GetAttributeValues(a.options.GroupAttribute)),
+		})
+	}
+	return users, nil
+}
+
+// mapRole returns the highest role of the mapped groups.
+func (a *LdapAuthenticator) mapRole(groups []string) model.UserRole {
+	role := model.UserRoleUser
+	for _, group := range groups {
+		if mapped, ok := a.options.RoleMapping[normalizeDn(group)]; ok && mapped == model.UserRoleAdministrator {
+			role = mapped
+		}
+	}
+	return role
+}
+
+func normalizeDn(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(dn))
+	}
+
+	rdns := make([]string, 0, len(parsed.RDNs))
+	for _, rdn := range parsed.RDNs {
+		attributes := make([]string, 0, len(rdn.Attributes))
+		for _, attribute := range rdn.Attributes {
+			attributes = append(attributes, strings.ToLower(attribute.Type)+"="+strings.ToLower(attribute.Value))
+		}
+		rdns = append(rdns, strings.Join(attributes, "+"))
+	}
+	return strings.Join(rdns, ",")
+}
+
+func serverName(url string) string {
+	host := url
+	if _, rest, ok := strings.Cut(url, "://"); ok {
+		host = rest
+	}
+	host, _, _ = strings.Cut(host, "/")
+	if i := strings.LastIndex(host, ":"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
@@ -0,0 +1,200 @@
+package authn
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+func testLdapAuthenticator() *LdapAuthenticator {
+	log := zerolog.Nop()
+	return NewLdapAuthenticator(
+		&LdapOptions{
+			Name: "corp",
+			Url:  "ldaps://ldap.example.com:636",
+			RoleMapping: map[string]model.UserRole{
+				"CN=Admins, OU=Groups, DC=Example, DC=com": model.UserRoleAdministrator,
+				"cn=staff,ou=groups,dc=example,dc=com":     model.UserRoleUser,
+			},
+		},
+		nil,
+		&log,
+	)
+}
+
+func TestNewLdapAuthenticatorDefaults(t *testing.T) {
+	a := testLdapAuthenticator()
+
+	tests := []struct {
+		name  string
+		value any
+		want  any
+	}{
+		{"user filter", a.options.UserFilter, "(objectClass=person)"},
+		{"email attribute", a.options.EmailAttribute, "mail"},
+		{"name attribute", a.options.NameAttribute, "cn"},
+		{"group attribute", a.options.GroupAttribute, "memberOf"},
+		{"sync max deletes", a.options.SyncMaxDeletes, 10},
+		{"issuer", a.issuer(), "ldap:corp"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.value != test.want {
+				t.Fatalf("got %v, want %v", test.value, test.want)
+			}
+		})
+	}
+}
+
+func TestLdapMapRole(t *testing.T) {
+	a := testLdapAuthenticator()
+
+	tests := []struct {
+		name   string
+		groups []string
+		role   model.UserRole
+	}{
+		{"no groups", nil, model.UserRoleUser},
+		{"unmapped group", []string{"cn=guests,ou=groups,dc=example,dc=com"}, model.UserRoleUser},
+		{"user group", []string{"cn=staff,ou=groups,dc=example,dc=com"}, model.UserRoleUser},
+		{"administrator group", []string{"cn=admins,ou=groups,dc=example,dc=com"}, model.UserRoleAdministrator},
+		{"administrator group in other case and spacing", []string{"CN=ADMINS,ou=Groups, dc=example,DC=COM"}, model.UserRoleAdministrator},
+		{"highest role wins", []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"}, model.UserRoleAdministrator},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if role := a.mapRole(test.groups); role != test.role {
+				t.Fatalf("got %s, want %s", role, test.role)
+			}
+		})
+	}
+}
+
+func TestNormalizeDn(t *testing.T) {
+	tests := []struct {
+		dn   string
+		want string
+	}{
+		{"cn=John Doe,ou=People,dc=example,dc=com", "cn=john doe,ou=people,dc=example,dc=com"},
+		{"CN=John Doe, OU=People, DC=Example, DC=com", "cn=john doe,ou=people,dc=example,dc=com"},
+		{"cn=John+uid=jdoe,dc=example,dc=com", "cn=john+uid=jdoe,dc=example,dc=com"},
+		{`cn=Doe\, John,dc=example,dc=com`, "cn=doe, john,dc=example,dc=com"},
+		{" Not A DN ", "not a dn"},
+	}
+
+	for _, test := range tests {
+		if dn := normalizeDn(test.dn); dn != test.want {
+			t.Errorf("normalizeDn(%q) = %q, want %q", test.dn, dn, test.want)
+		}
+	}
+}
+
+func TestServerName(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"ldaps://ldap.example.com:636", "ldap.example.com"},
+		{"ldap://ldap.example.com", "ldap.example.com"},
+		{"ldap://ldap.example.com:389/dc=example,dc=com", "ldap.example.com"},
+		{"ldap.example.com:389", "ldap.example.com"},
+	}
+
+	for _, test := range tests {
+		if name := serverName(test.url); name != test.want {
+			t.Errorf("serverName(%q) = %q, want %q", test.url, name, test.want)
+		}
+	}
+}
+
+func TestPlanSync(t *testing.T) {
+	user := func(email string, name string, role model.UserRole) model.User {
+		return model.User{ID: uuid.New(), Email: email, Name: name, Role: role}
+	}
+	entry := func(email string, name string, role model.UserRole) *directoryUser {
+		return &directoryUser{dn: "cn=" + name + ",dc=example,dc=com", email: email, name: name, role: role}
+	}
+
+	tests := []struct {
+		name    string
+		users   []model.User
+		entries []*directoryUser
+		updates []string
+		deletes []string
+	}{
+		{
+			name:    "unchanged",
+			users:   []model.User{user("john@example.com", "John", model.UserRoleUser)},
+			entries: []*directoryUser{entry("john@example.com", "John", model.UserRoleUser)},
+		},
+		{
+			name:    "email case differs",
+			users:   []model.User{user("john@example.com", "John", model.UserRoleUser)},
+			entries: []*directoryUser{entry("John@Example.com", "John", model.UserRoleUser)},
+		},
+		{
+			name:    "renamed",
+			users:   []model.User{user("john@example.com", "John", model.UserRoleUser)},
+			entries: []*directoryUser{entry("john@example.com", "John Doe", model.UserRoleUser)},
+			updates: []string{"john@example.com"},
+		},
+		{
+			name:    "promoted",
+			users:   []model.User{user("john@example.com", "John", model.UserRoleUser)},
+			entries: []*directoryUser{entry("john@example.com", "John", model.UserRoleAdministrator)},
+			updates: []string{"john@example.com"},
+		},
+		{
+			name: "removed from directory",
+			users: []model.User{
+				user("john@example.com", "John", model.UserRoleUser),
+				user("jane@example.com", "Jane", model.UserRoleUser),
+			},
+			entries: []*directoryUser{entry("jane@example.com", "Jane", model.UserRoleUser)},
+			deletes: []string{"john@example.com"},
+		},
+		{
+			name:    "directory users who never signed in are not created",
+			entries: []*directoryUser{entry("jane@example.com", "Jane", model.UserRoleUser)},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updates, deletes := planSync(test.users, test.entries)
+
+			if len(updates) != len(test.updates) {
+				t.Fatalf("got %d updates, want %v", len(updates), test.updates)
+			}
+			for i, update := range updates {
+				if update.user.Email != test.updates[i] {
+					t.Errorf("got update of %s, want %s", update.user.Email, test.updates[i])
+				}
+			}
+			if len(deletes) != len(test.deletes) {
+				t.Fatalf("got %d deletes, want %v", len(deletes), test.deletes)
+			}
+			for i, user := range deletes {
+				if user.Email != test.deletes[i] {
+					t.Errorf("got delete of %s, want %s", user.Email, test.deletes[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLdapAuthenticateEmptyPassword(t *testing.T) {
+	// Empty password is rejected before the directory is contacted, the server would accept an unauthenticated bind
+	_, err := testLdapAuthenticator().Authenticate(context.Background(), "john@example.com", "")
+
+	if !errors.Is(err, ErrInvalidCredentials) {
+		t.Fatalf("got %v, want %v", err, ErrInvalidCredentials)
+	}
+}
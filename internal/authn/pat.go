@@ -0,0 +1,73 @@
+package authn
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// PersonalAccessTokenPrefix tells apart personal access tokens from JWTs in the authorization header.
+const PersonalAccessTokenPrefix = "pat_"
+
+const (
+	ScopeUsersRead  = "users:read"
+	ScopeUsersWrite = "users:write"
+)
+
+// PersonalAccessTokenScopes users grant to their personal access tokens.
+var PersonalAccessTokenScopes = []string{ScopeUsersRead, ScopeUsersWrite}
+
+// PersonalAccessTokens resolves personal access tokens to their active users.
+type PersonalAccessTokens struct {
+	db *model.Queries
+}
+
+func NewPersonalAccessTokens(db *model.Queries) *PersonalAccessTokens {
+	return &PersonalAccessTokens{db: db}
+}
+
+// GeneratePersonalAccessToken returns the plain token shown once and its hash.
+func GeneratePersonalAccessToken() (string, string, error) {
+	generator := jwt_tool.TokenGenerator{}
+	token, _, err := generator.GenerateToken(0)
+	if err != nil {
+		return "", "", err
+	}
+	token = PersonalAccessTokenPrefix + token
+	return token, tool.HashToken(token), nil
+}
+
+// IsPersonalAccessToken checks the token prefix only.
+func (p *PersonalAccessTokens) IsPersonalAccessToken(token string) bool {
+	return strings.HasPrefix(token, PersonalAccessTokenPrefix)
+}
+
+// Authenticate returns the user of the token and the token scopes, the last use time of the token is updated once a minute.
+func (p *PersonalAccessTokens) Authenticate(ctx context.Context, token string) (*jwt_tool.JwtUserInfo, *jwt_tool.JwtPatInfo, error) {
+	pat, err := p.db.UsePersonalAccessToken(ctx, tool.HashToken(token))
+	if err != nil {
+		return nil, nil, fmt.Errorf("personal access token is invalid, revoked or expired: %w", err)
+	}
+
+	user, err := p.db.GetActiveUserById(ctx, pat.UserID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("personal access token user %s is not active: %w", pat.UserID, err)
+	}
+
+	userId := user.ID
+	return &jwt_tool.JwtUserInfo{
+			Id:            &userId,
+			Role:          jwt_tool.JwtUserRole(user.Role),
+			Email:         user.Email,
+			EmailVerified: user.EmailVerifiedAt.Valid,
+		},
+		&jwt_tool.JwtPatInfo{
+			Id:     pat.ID,
+			Scopes: pat.Scopes,
+		},
+		nil
+}
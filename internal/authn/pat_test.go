@@ -0,0 +1,47 @@
+package authn
+
+import (
+	"strings"
+	"testing"
+
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+)
+
+func TestGeneratePersonalAccessToken(t *testing.T) {
+	token, tokenHash, err := GeneratePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+	other, _, err := GeneratePersonalAccessToken()
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+
+	if !strings.HasPrefix(token, PersonalAccessTokenPrefix) || token == other {
+		t.Fatalf("unexpected tokens %q and %q", token, other)
+	}
+	// Only the hash is stored, the plain token is shown once
+	if tokenHash != tool.HashToken(token) || strings.Contains(tokenHash, token) {
+		t.Fatalf("got hash %q of token %q", tokenHash, token)
+	}
+}
+
+func TestIsPersonalAccessToken(t *testing.T) {
+	tokens := NewPersonalAccessTokens(nil)
+
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{"pat_abc", true},
+		{"eyJhbGciOiJIUzI1NiJ9.e30.abc", false},
+		{"PAT_abc", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if got := tokens.IsPersonalAccessToken(test.token); got != test.want {
+			t.Errorf("IsPersonalAccessToken(%q) = %v, want %v", test.token, got, test.want)
+		}
+	}
+}
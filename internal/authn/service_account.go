@@ -0,0 +1,185 @@
+package authn
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// ServiceAccountAssertionMaxAge limits the lifetime of assertions, so their ids are kept for a short time only.
+const ServiceAccountAssertionMaxAge = 5 * time.Minute
+
+// ServiceAccounts authenticates service accounts by assertions signed with their keys or by client secrets.
+type ServiceAccounts struct {
+	db *model.Queries
+}
+
+func NewServiceAccounts(db *model.Queries) *ServiceAccounts {
+	return &ServiceAccounts{db: db}
+}
+
+// ParseServiceAccountPublicKey parses a PEM encoded RSA or EC public key.
+func ParseServiceAccountPublicKey(pem string) (crypto.PublicKey, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM([]byte(pem)); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("public key is not a PEM encoded RSA or EC public key")
+}
+
+// AuthenticateAssertion verifies the JWT signed by a public key of the service account, RFC 7523.
+// `iss` and `sub` are the service account id, `aud` is the service, `exp` is at most 5 minutes ahead and `jti` is used once.
+// The `kid` header selects the key, otherwise every active key of the account is tried.
+func (a *ServiceAccounts) AuthenticateAssertion(ctx context.Context, assertion string) (*model.ServiceAccount, error) {
+	parser := jwt.Parser{}
+	unverified, _, err := parser.ParseUnverified(assertion, jwt.MapClaims{})
+	if err != nil {
+		return nil, fmt.Errorf("malformed assertion: %w", err)
+	}
+	unverifiedClaims := unverified.Claims.(jwt.MapClaims)
+	iss, _ := unverifiedClaims["iss"].(string)
+	sub, _ := unverifiedClaims["sub"].(string)
+	if iss == "" || iss != sub {
+		return nil, fmt.Errorf("assertion iss and sub must be the service account id")
+	}
+	accountId, err := uuid.Parse(iss)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse assertion iss: %w", err)
+	}
+	kid, _ := unverified.Header["kid"].(string)
+
+	account, err := a.db.GetActiveServiceAccount(ctx, accountId)
+	if err != nil {
+		return nil, fmt.Errorf("service account %s is not active: %w", accountId, err)
+	}
+
+	keys, err := a.db.LoadActiveServiceAccountKeys(
+		ctx,
+		model.LoadActiveServiceAccountKeysParams{
+			ServiceAccountID: account.ID,
+			Type:             model.ServiceAccountKeyTypePublicKey,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service account %s keys: %w", accountId, err)
+	}
+
+	for _, key := range keys {
+		if kid != "" && kid != key.ID.String() {
+			continue
+		}
+		claims, err := verifyAssertion(assertion, key.PublicKey.String)
+		if err != nil {
+			continue
+		}
+
+		if err := a.useAssertion(ctx, &account, claims); err != nil {
+			return nil, err
+		}
+		if err := a.db.UseServiceAccountKey(ctx, key.ID); err != nil {
+			return nil, fmt.Errorf("failed to update service account key %s: %w", key.ID, err)
+		}
+		return &account, nil
+	}
+
+	return nil, fmt.Errorf("assertion of service account %s is not signed by an active key or is invalid", accountId)
+}
+
+// AuthenticateSecret checks the client secret against active secrets of the service account.
+func (a *ServiceAccounts) AuthenticateSecret(ctx context.Context, accountId uuid.UUID, secret string) (*model.ServiceAccount, error) {
+	account, err := a.db.GetActiveServiceAccount(ctx, accountId)
+	if err != nil {
+		return nil, fmt.Errorf("service account %s is not active: %w", accountId, err)
+	}
+
+	keys, err := a.db.LoadActiveServiceAccountKeys(
+		ctx,
+		model.LoadActiveServiceAccountKeysParams{
+			ServiceAccountID: account.ID,
+			Type:             model.ServiceAccountKeyTypeSecret,
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service account %s secrets: %w", accountId, err)
+	}
+
+	encryptor := tool.Encryptor{}
+	for _, key := range keys {
+		if !encryptor.Validate(secret, key.SecretHash.String) {
+			continue
+		}
+		if err := a.db.UseServiceAccountKey(ctx, key.ID); err != nil {
+			return nil, fmt.Errorf("failed to update service account key %s: %w", key.ID, err)
+		}
+		return &account, nil
+	}
+
+	return nil, fmt.Errorf("secret of service account %s is invalid", accountId)
+}
+
+// useAssertion records the assertion id, so the same assertion is rejected until it expires.
+func (a *ServiceAccounts) useAssertion(ctx context.Context, account *model.ServiceAccount, claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return fmt.Errorf("assertion of service account %s has no jti", account.ID)
+	}
+	exp, _ := claims["exp"].(float64)
+
+	if err := a.db.DeleteExpiredServiceAccountAssertions(ctx, account.ID); err != nil {
+		return fmt.Errorf("failed to delete expired assertions of service account %s: %w", account.ID, err)
+	}
+	rows, err := a.db.CreateServiceAccountAssertion(
+		ctx,
+		model.CreateServiceAccountAssertionParams{
+			ServiceAccountID: account.ID,
+			Jti:              jti,
+			ExpiresAt:        pgtype.Timestamp{Time: time.Unix(int64(exp), 0), Valid: true},
+		})
+	if err != nil {
+		return fmt.Errorf("failed to save assertion of service account %s: %w", account.ID, err)
+	}
+	if rows == 0 {
+		return fmt.Errorf("assertion %s of service account %s is already used", jti, account.ID)
+	}
+	return nil
+}
+
+// verifyAssertion validates the signature by the PEM public key and the audience and lifetime of the assertion.
+func verifyAssertion(assertion string, publicKeyPem string) (jwt.MapClaims, error) {
+	publicKey, err := ParseServiceAccountPublicKey(publicKeyPem)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(assertion, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+			return publicKey, nil
+		}
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	})
+	if err != nil || token == nil || !token.Valid {
+		return nil, fmt.Errorf("invalid assertion: %w", err)
+	}
+	if !claims.VerifyAudience(jwt_tool.Audience, true) {
+		return nil, fmt.Errorf("assertion audience is not %s", jwt_tool.Audience)
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("assertion has no exp")
+	}
+	if time.Until(time.Unix(int64(exp), 0)) > ServiceAccountAssertionMaxAge {
+		return nil, fmt.Errorf("assertion expires later than %s", ServiceAccountAssertionMaxAge)
+	}
+	return claims, nil
+}
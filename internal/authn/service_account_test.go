@@ -0,0 +1,114 @@
+package authn
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+func publicKeyPem(t *testing.T, publicKey any) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	claims := func(audience string, expiresIn time.Duration) jwt.MapClaims {
+		accountId := uuid.New().String()
+		claims := jwt.MapClaims{"iss": accountId, "sub": accountId, "aud": audience, "jti": uuid.New().String()}
+		if expiresIn != 0 {
+			claims["exp"] = time.Now().Add(expiresIn).Unix()
+		}
+		return claims
+	}
+	sign := func(method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+		assertion, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatalf("failed to sign assertion: %v", err)
+		}
+		return assertion
+	}
+
+	tests := []struct {
+		name      string
+		assertion string
+		publicKey string
+		ok        bool
+	}{
+		{"RSA key", sign(jwt.SigningMethodRS256, rsaKey, claims(jwt_tool.Audience, time.Minute)), publicKeyPem(t, &rsaKey.PublicKey), true},
+		{"EC key", sign(jwt.SigningMethodES256, ecKey, claims(jwt_tool.Audience, time.Minute)), publicKeyPem(t, &ecKey.PublicKey), true},
+		{"other key", sign(jwt.SigningMethodRS256, otherKey, claims(jwt_tool.Audience, time.Minute)), publicKeyPem(t, &rsaKey.PublicKey), false},
+		{"HMAC by the public key", sign(jwt.SigningMethodHS256, []byte(publicKeyPem(t, &rsaKey.PublicKey)), claims(jwt_tool.Audience, time.Minute)), publicKeyPem(t, &rsaKey.PublicKey), false},
+		{"other audience", sign(jwt.SigningMethodRS256, rsaKey, claims("orders", time.Minute)), publicKeyPem(t, &rsaKey.PublicKey), false},
+		{"expired", sign(jwt.SigningMethodRS256, rsaKey, claims(jwt_tool.Audience, -time.Minute)), publicKeyPem(t, &rsaKey.PublicKey), false},
+		{"without expiration", sign(jwt.SigningMethodRS256, rsaKey, claims(jwt_tool.Audience, 0)), publicKeyPem(t, &rsaKey.PublicKey), false},
+		{"long-lived", sign(jwt.SigningMethodRS256, rsaKey, claims(jwt_tool.Audience, time.Hour)), publicKeyPem(t, &rsaKey.PublicKey), false},
+		{"malformed key", sign(jwt.SigningMethodRS256, rsaKey, claims(jwt_tool.Audience, time.Minute)), "key", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := verifyAssertion(test.assertion, test.publicKey); (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+// Assertions naming no service account are rejected before the account is loaded.
+func TestAuthenticateMalformedAssertion(t *testing.T) {
+	accounts := NewServiceAccounts(nil)
+	sign := func(claims jwt.MapClaims) string {
+		assertion, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("key"))
+		if err != nil {
+			t.Fatalf("failed to sign assertion: %v", err)
+		}
+		return assertion
+	}
+	accountId := uuid.New().String()
+
+	tests := []struct {
+		name      string
+		assertion string
+	}{
+		{"not a JWT", "assertion"},
+		{"without iss", sign(jwt.MapClaims{"sub": accountId})},
+		{"other sub", sign(jwt.MapClaims{"iss": accountId, "sub": uuid.New().String()})},
+		{"iss not an id", sign(jwt.MapClaims{"iss": "billing", "sub": "billing"})},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := accounts.AuthenticateAssertion(context.Background(), test.assertion); err == nil {
+				t.Fatal("malformed assertion is accepted")
+			}
+		})
+	}
+}
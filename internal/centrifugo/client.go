@@ -0,0 +1,102 @@
+package centrifugo
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client calls the Centrifugo server HTTP API, e.g. `http://centrifugo:8000/api` with the `api_key` of Centrifugo.
+type Client struct {
+	apiUrl string
+	apiKey string
+	http   *http.Client
+}
+
+func NewClient(apiUrl string, apiKey string) *Client {
+	return &Client{
+		apiUrl: strings.TrimRight(apiUrl, "/"),
+		apiKey: apiKey,
+		http:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// DisconnectSessionRevoked is the terminal disconnect code of connections of signed out users, clients do not reconnect with the same token.
+const DisconnectSessionRevoked = 4501
+
+type publishRequest struct {
+	Channel string          `json:"channel"`
+	Data    json.RawMessage `json:"data"`
+}
+
+type disconnectRequest struct {
+	User       string     `json:"user"`
+	Disconnect disconnect `json:"disconnect"`
+}
+
+type disconnect struct {
+	Code   uint32 `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type apiReply struct {
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Publish sends the JSON data to subscribers of the channel.
+func (c *Client) Publish(ctx context.Context, channel string, data []byte) error {
+	return c.call(ctx, "publish", publishRequest{Channel: channel, Data: data})
+}
+
+// Disconnect closes all connections of the user.
+func (c *Client) Disconnect(ctx context.Context, user string, reason string) error {
+	return c.call(ctx, "disconnect", disconnectRequest{
+		User:       user,
+		Disconnect: disconnect{Code: DisconnectSessionRevoked, Reason: reason},
+	})
+}
+
+func (c *Client) call(ctx context.Context, method string, params any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s request: %w", method, err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiUrl+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-API-Key", c.apiKey)
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return fmt.Errorf("failed to call Centrifugo %s: %w", method, err)
+	}
+	defer response.Body.Close()
+
+	replyBody, err := io.ReadAll(io.LimitReader(response.Body, 1<<16))
+	if err != nil {
+		return fmt.Errorf("failed to read Centrifugo %s reply: %w", method, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("centrifugo %s replied %s: %s", method, response.Status, replyBody)
+	}
+
+	reply := apiReply{}
+	if err := json.Unmarshal(replyBody, &reply); err != nil {
+		return fmt.Errorf("failed to decode Centrifugo %s reply: %w", method, err)
+	}
+	if reply.Error != nil {
+		return fmt.Errorf("centrifugo %s error %d: %s", method, reply.Error.Code, reply.Error.Message)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package centrifugo
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCall(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		reply  string
+		ok     bool
+	}{
+		{"published", http.StatusOK, `{}`, true},
+		{"API error", http.StatusOK, `{"error":{"code":102,"message":"unknown channel"}}`, false},
+		{"unauthorized", http.StatusUnauthorized, `{}`, false},
+		{"malformed reply", http.StatusOK, `{`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var path, apiKey string
+			var request publishRequest
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				apiKey = r.Header.Get("X-API-Key")
+				body, _ := io.ReadAll(r.Body)
+				_ = json.Unmarshal(body, &request)
+
+				w.WriteHeader(test.status)
+				_, _ = w.Write([]byte(test.reply))
+			}))
+			defer server.Close()
+
+			err := NewClient(server.URL+"/api/", "key").Publish(context.Background(), "user:1", []byte(`{"type":"user.updated"}`))
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if path != "/api/publish" || apiKey != "key" || request.Channel != "user:1" || string(request.Data) != `{"type":"user.updated"}` {
+				t.Fatalf("unexpected request to %s with key %q: %+v", path, apiKey, request)
+			}
+		})
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	var request disconnectRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &request)
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	if err := NewClient(server.URL, "key").Disconnect(context.Background(), "user-id", "session revoked"); err != nil {
+		t.Fatalf("failed to disconnect: %v", err)
+	}
+	if request.User != "user-id" || request.Disconnect.Code != DisconnectSessionRevoked || request.Disconnect.Reason != "session revoked" {
+		t.Fatalf("unexpected disconnect request %+v", request)
+	}
+}
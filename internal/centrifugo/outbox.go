@@ -0,0 +1,162 @@
+package centrifugo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	"github.com/zs-dima/auth-service/internal/outbox"
+)
+
+var defaultOutboxOptions = outbox.Options{
+	PollInterval:  5 * time.Second,
+	Lease:         time.Minute,
+	BatchSize:     100,
+	MaxAttempts:   20,
+	MinBackoff:    5 * time.Second,
+	MaxBackoff:    10 * time.Minute,
+	Retention:     7 * 24 * time.Hour,
+	PurgeInterval: time.Hour,
+}
+
+// Outbox queues events in Postgres within the transaction of the change, so events are never lost while Centrifugo is down
+// and never published for rolled back changes. Run publishes the queued events, retrying with exponential backoff.
+type Outbox struct {
+	db      *model.Queries
+	client  *Client
+	options *outbox.Options
+	log     *zerolog.Logger
+	worker  *outbox.Worker[model.EventOutbox]
+}
+
+func NewOutbox(db *model.Queries, client *Client, options *outbox.Options, log *zerolog.Logger) *Outbox {
+	options.SetDefaults(&defaultOutboxOptions)
+
+	o := &Outbox{
+		db:      db,
+		client:  client,
+		options: options,
+		log:     log,
+	}
+	o.worker = outbox.NewWorker(
+		"event",
+		&outbox.Store[model.EventOutbox]{
+			Claim:         o.claim,
+			MarkDelivered: db.MarkEventPublished,
+			MarkFailed:    o.markFailed,
+			Purge:         db.PurgeEventOutbox,
+		},
+		o.publish,
+		options,
+		log,
+	)
+	return o
+}
+
+// Enqueue queues the event by the queries of the transaction, Notify once the transaction is committed.
+func (o *Outbox) Enqueue(ctx context.Context, q *model.Queries, channel string, event any) error {
+	return o.enqueue(ctx, q, channel, event, pgtype.Text{})
+}
+
+// EnqueueSignOut queues the event to the personal channel of the user, connections of the user are disconnected once it is published.
+func (o *Outbox) EnqueueSignOut(ctx context.Context, q *model.Queries, userId uuid.UUID, event any) error {
+	return o.enqueue(ctx, q, UserChannel(userId), event, pgtype.Text{String: userId.String(), Valid: true})
+}
+
+func (o *Outbox) enqueue(ctx context.Context, q *model.Queries, channel string, event any, disconnectUser pgtype.Text) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s event: %w", channel, err)
+	}
+
+	err = q.EnqueueEvent(
+		ctx,
+		model.EnqueueEventParams{
+			Channel:        channel,
+			Data:           data,
+			DisconnectUser: disconnectUser,
+		})
+	if err != nil {
+		return fmt.Errorf("failed to queue %s event: %w", channel, err)
+	}
+	return nil
+}
+
+// Notify wakes up the worker without waiting for the next poll.
+func (o *Outbox) Notify() {
+	o.worker.Notify()
+}
+
+// Run publishes queued events until the context is cancelled.
+func (o *Outbox) Run(ctx context.Context) {
+	o.worker.Run(ctx)
+}
+
+func (o *Outbox) claim(ctx context.Context, lease time.Duration, batchSize int32) ([]outbox.Message[model.EventOutbox], error) {
+	events, err := o.db.ClaimEventOutbox(
+		ctx,
+		model.ClaimEventOutboxParams{
+			Lease:     lease,
+			BatchSize: batchSize,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]outbox.Message[model.EventOutbox], len(events))
+	for i, event := range events {
+		messages[i] = outbox.Message[model.EventOutbox]{Id: event.ID, Attempts: event.Attempts, Value: event}
+	}
+	return messages, nil
+}
+
+// publish pushes the event to the channel, then disconnects the user of a sign out event.
+// Once pushed, retries of a failed disconnect do not push the event again.
+func (o *Outbox) publish(ctx context.Context, message *outbox.Message[model.EventOutbox]) error {
+	event := &message.Value
+	if !event.ChannelPublishedAt.Valid {
+		err := o.client.Publish(ctx, event.Channel, event.Data)
+		if err != nil {
+			if event.DisconnectUser.Valid && message.Attempts+1 >= o.options.MaxAttempts {
+				// The event is given up, connections of the signed out user are still closed
+				return errors.Join(err, o.disconnect(ctx, event))
+			}
+			return err
+		}
+		if !event.DisconnectUser.Valid {
+			return nil
+		}
+
+		if err = o.db.MarkEventChannelPublished(ctx, message.Id); err != nil {
+			o.log.Warn().Msgf("Failed to mark event %s as pushed to %s: %v", message.Id, event.Channel, err)
+		}
+	}
+
+	// Clients get the event before the connection is closed
+	return o.disconnect(ctx, event)
+}
+
+func (o *Outbox) disconnect(ctx context.Context, event *model.EventOutbox) error {
+	if !event.DisconnectUser.Valid {
+		return nil
+	}
+	return o.client.Disconnect(ctx, event.DisconnectUser.String, "session revoked")
+}
+
+func (o *Outbox) markFailed(ctx context.Context, id uuid.UUID, lastError string, nextAttemptAt time.Time, failed bool) error {
+	return o.db.MarkEventAttemptFailed(
+		ctx,
+		model.MarkEventAttemptFailedParams{
+			ID:            id,
+			LastError:     pgtype.Text{String: lastError, Valid: true},
+			NextAttemptAt: pgtype.Timestamp{Time: nextAttemptAt, Valid: true},
+			Failed:        failed,
+		})
+}
@@ -0,0 +1,81 @@
+package centrifugo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	"github.com/zs-dima/auth-service/internal/outbox"
+)
+
+func TestOutboxPublish(t *testing.T) {
+	signOut := pgtype.Text{String: "user-id", Valid: true}
+	pushed := pgtype.Timestamp{Time: time.Now(), Valid: true}
+
+	tests := []struct {
+		name string
+		// attempts made before
+		attempts       int32
+		disconnectUser pgtype.Text
+		pushedAt       pgtype.Timestamp
+		// failing Centrifugo API methods
+		failing []string
+		calls   []string
+		ok      bool
+	}{
+		{name: "event", calls: []string{"publish"}, ok: true},
+		{name: "event failed", failing: []string{"publish"}, calls: []string{"publish"}},
+		{name: "event given up", attempts: 2, failing: []string{"publish"}, calls: []string{"publish"}},
+		{name: "sign out", disconnectUser: signOut, calls: []string{"publish", "disconnect"}, ok: true},
+		{name: "sign out push failed", disconnectUser: signOut, failing: []string{"publish"}, calls: []string{"publish"}},
+		{name: "sign out disconnect failed", disconnectUser: signOut, failing: []string{"disconnect"}, calls: []string{"publish", "disconnect"}},
+		{name: "sign out retried after push", disconnectUser: signOut, pushedAt: pushed, calls: []string{"disconnect"}, ok: true},
+		{name: "sign out given up", attempts: 2, disconnectUser: signOut, failing: []string{"publish"}, calls: []string{"publish", "disconnect"}},
+	}
+
+	log := zerolog.Nop()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var calls []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method := strings.TrimPrefix(r.URL.Path, "/")
+				calls = append(calls, method)
+				for _, failing := range test.failing {
+					if failing == method {
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+				}
+				_, _ = w.Write([]byte(`{}`))
+			}))
+			defer server.Close()
+
+			o := NewOutbox(nil, NewClient(server.URL, "key"), &outbox.Options{MaxAttempts: 3}, &log)
+			err := o.publish(context.Background(), &outbox.Message[model.EventOutbox]{
+				Id:       uuid.New(),
+				Attempts: test.attempts,
+				Value: model.EventOutbox{
+					Channel:            "user:user-id",
+					Data:               []byte(`{"type":"session_revoked"}`),
+					DisconnectUser:     test.disconnectUser,
+					ChannelPublishedAt: test.pushedAt,
+				},
+			})
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if strings.Join(calls, ",") != strings.Join(test.calls, ",") {
+				t.Fatalf("got calls %v, want %v", calls, test.calls)
+			}
+		})
+	}
+}
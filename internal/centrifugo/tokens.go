@@ -0,0 +1,112 @@
+package centrifugo
+
+import (
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// Channel namespaces of deployments/centrifugo/config.json, the namespace is the channel prefix before `:`.
+const (
+	// NamespaceEventBus channels are open to all users.
+	NamespaceEventBus = "eventbus"
+	// NamespaceUser channels `user:<user id>` carry events of the user, connections are subscribed to their own channel.
+	NamespaceUser = "user"
+	// NamespaceRole channels `role:<role>` carry events of all users of the role.
+	NamespaceRole = "role"
+	// NamespaceAdmin channels are open to administrators only.
+	NamespaceAdmin = "admin"
+)
+
+// channelRules allow the user to subscribe to the channel name within the namespace, administrators subscribe to any channel.
+var channelRules = map[string]func(user *jwt_tool.JwtUserInfo, name string) bool{
+	NamespaceEventBus: func(user *jwt_tool.JwtUserInfo, name string) bool {
+		return true
+	},
+	NamespaceUser: func(user *jwt_tool.JwtUserInfo, name string) bool {
+		return name == user.Id.String()
+	},
+	NamespaceRole: func(user *jwt_tool.JwtUserInfo, name string) bool {
+		return name == string(user.Role)
+	},
+	NamespaceAdmin: func(user *jwt_tool.JwtUserInfo, name string) bool {
+		return false
+	},
+}
+
+// UserChannel is the personal channel of the user.
+func UserChannel(userId uuid.UUID) string {
+	return NamespaceUser + ":" + userId.String()
+}
+
+// CanSubscribe tells whether the user may subscribe to the channel, channels of unknown namespaces are denied.
+func CanSubscribe(user *jwt_tool.JwtUserInfo, channel string) bool {
+	namespace, name, ok := strings.Cut(channel, ":")
+	if !ok || name == "" {
+		return false
+	}
+	rule, ok := channelRules[namespace]
+	if !ok {
+		return false
+	}
+	return string(user.Role) == string(model.UserRoleAdministrator) || rule(user, name)
+}
+
+// Tokens issues connection and subscription JWTs verified by Centrifugo with the shared `token_hmac_secret_key`.
+type Tokens struct {
+	secretKey string
+	ttl       time.Duration
+}
+
+func NewTokens(secretKey string, ttl time.Duration) *Tokens {
+	return &Tokens{
+		secretKey: secretKey,
+		ttl:       ttl,
+	}
+}
+
+// ConnectionToken issues the connection token of the user, `info` is shared with other clients by presence and join events.
+// The connection is subscribed to the personal channel of the user by the server.
+func (t *Tokens) ConnectionToken(user *jwt_tool.JwtUserInfo) (string, time.Time, error) {
+	expiresAt := time.Now().Add(t.ttl)
+
+	info := map[string]any{
+		"role": user.Role,
+	}
+	if user.Email != "" {
+		info["email"] = user.Email
+	}
+
+	claims := jwt.MapClaims{
+		"sub":      user.Id.String(),
+		"exp":      expiresAt.Unix(),
+		"iat":      time.Now().Unix(),
+		"info":     info,
+		"channels": []string{UserChannel(*user.Id)},
+	}
+	return t.sign(claims, expiresAt)
+}
+
+// SubscriptionToken issues the token of the channel, the caller checks CanSubscribe first.
+func (t *Tokens) SubscriptionToken(user *jwt_tool.JwtUserInfo, channel string) (string, time.Time, error) {
+	expiresAt := time.Now().Add(t.ttl)
+
+	claims := jwt.MapClaims{
+		"sub":     user.Id.String(),
+		"channel": channel,
+		"exp":     expiresAt.Unix(),
+		"iat":     time.Now().Unix(),
+	}
+	return t.sign(claims, expiresAt)
+}
+
+func (t *Tokens) sign(claims jwt.MapClaims, expiresAt time.Time) (string, time.Time, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	signed, err := token.SignedString([]byte(t.secretKey))
+	return signed, expiresAt, err
+}
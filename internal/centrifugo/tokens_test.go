@@ -0,0 +1,96 @@
+package centrifugo
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+func TestCanSubscribe(t *testing.T) {
+	userId := uuid.New()
+	user := &jwt_tool.JwtUserInfo{Id: &userId, Role: "user"}
+	administrator := &jwt_tool.JwtUserInfo{Id: &userId, Role: "administrator"}
+
+	tests := []struct {
+		name    string
+		user    *jwt_tool.JwtUserInfo
+		channel string
+		ok      bool
+	}{
+		{"event bus", user, "eventbus:news", true},
+		{"own channel", user, UserChannel(userId), true},
+		{"channel of other user", user, UserChannel(uuid.New()), false},
+		{"own role", user, "role:user", true},
+		{"other role", user, "role:administrator", false},
+		{"admin channel", user, "admin:audit", false},
+		{"unknown namespace", user, "orders:1", false},
+		{"without namespace", user, "news", false},
+		{"without name", user, "eventbus:", false},
+		{"admin channel by administrator", administrator, "admin:audit", true},
+		{"channel of other user by administrator", administrator, UserChannel(uuid.New()), true},
+		{"unknown namespace by administrator", administrator, "orders:1", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := CanSubscribe(test.user, test.channel); ok != test.ok {
+				t.Fatalf("got %v, want %v", ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestTokens(t *testing.T) {
+	tokens := NewTokens("secret", time.Hour)
+	userId := uuid.New()
+	user := &jwt_tool.JwtUserInfo{Id: &userId, Role: "user", Email: "user@example.com"}
+
+	tests := []struct {
+		name  string
+		issue func() (string, time.Time, error)
+		check func(claims jwt.MapClaims) bool
+	}{
+		{
+			"connection",
+			func() (string, time.Time, error) { return tokens.ConnectionToken(user) },
+			func(claims jwt.MapClaims) bool {
+				channels, _ := claims["channels"].([]any)
+				info, _ := claims["info"].(map[string]any)
+				return len(channels) == 1 && channels[0] == UserChannel(userId) && info["role"] == "user" && info["email"] == "user@example.com"
+			},
+		},
+		{
+			"subscription",
+			func() (string, time.Time, error) { return tokens.SubscriptionToken(user, "role:user") },
+			func(claims jwt.MapClaims) bool {
+				return claims["channel"] == "role:user"
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signed, expiresAt, err := test.issue()
+			if err != nil {
+				t.Fatalf("failed to issue token: %v", err)
+			}
+			if until := time.Until(expiresAt); until > time.Hour || until < time.Hour-time.Minute {
+				t.Errorf("token expires in %s, want %s", until, time.Hour)
+			}
+
+			claims := jwt.MapClaims{}
+			_, err = jwt.ParseWithClaims(signed, claims, func(token *jwt.Token) (any, error) {
+				return []byte("secret"), nil
+			})
+			if err != nil {
+				t.Fatalf("failed to parse token: %v", err)
+			}
+			if claims["sub"] != userId.String() || !test.check(claims) {
+				t.Fatalf("unexpected claims %v", claims)
+			}
+		})
+	}
+}
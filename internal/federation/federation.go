@@ -0,0 +1,143 @@
+package federation
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/rs/zerolog"
+	"golang.org/x/oauth2"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+const (
+	LoginPath    = "/federation/login/"
+	CallbackPath = "/federation/callback"
+)
+
+const (
+	// LoginTtl is the time the user has to sign in at the identity provider.
+	LoginTtl = 10 * time.Minute
+	// TicketTtl is the lifetime of the ticket the client application exchanges for the session.
+	TicketTtl = time.Minute
+)
+
+type ProviderOptions struct {
+	// Name is the provider identifier used in URLs, e.g. `google`.
+	Name         string
+	DisplayName  string
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	Scopes       []string
+	// RoleClaim is the ID token claim with the user groups or roles, roles are not synced when it is empty.
+	RoleClaim string
+	// RoleMapping maps role claim values to user roles.
+	RoleMapping map[string]model.UserRole
+	// Provisioning creates users signed in for the first time.
+	Provisioning bool
+	// TrustEmail treats provider emails as verified, for providers without the `email_verified` claim.
+	TrustEmail bool
+}
+
+type FederationOptions struct {
+	// BaseUrl is the public base URL of the HTTP gateway, e.g. `https://auth.example.com`.
+	BaseUrl string
+	// AppUrl of the client application, it receives the sign in ticket.
+	AppUrl    string
+	Providers []*ProviderOptions
+	// Saml is nil unless organizations sign in by SAML identity providers.
+	Saml *SamlOptions
+}
+
+// Federation signs users in by external OpenID Connect identity providers with the authorization code flow
+// and by SAML identity providers of organizations.
+// The client application exchanges the ticket it receives after the callback for the session.
+type Federation struct {
+	options   *FederationOptions
+	providers map[string]*provider
+	db        *model.Queries
+	log       *zerolog.Logger
+}
+
+// provider discovers the identity provider configuration on first use,
+// so the service starts even when the identity provider is not available yet.
+type provider struct {
+	options  *ProviderOptions
+	mu       sync.Mutex
+	oidc     *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+}
+
+func NewFederation(options *FederationOptions, db *model.Queries, log *zerolog.Logger) *Federation {
+	options.BaseUrl = strings.TrimRight(options.BaseUrl, "/")
+	options.AppUrl = strings.TrimRight(options.AppUrl, "/")
+
+	providers := map[string]*provider{}
+	for _, providerOptions := range options.Providers {
+		providers[providerOptions.Name] = &provider{options: providerOptions}
+	}
+
+	return &Federation{
+		options:   options,
+		providers: providers,
+		db:        db,
+		log:       log,
+	}
+}
+
+// Register adds the login, callback and SAML endpoints to the HTTP server.
+func (f *Federation) Register(mux *http.ServeMux) {
+	mux.HandleFunc(LoginPath, f.handleLogin)
+	mux.HandleFunc(CallbackPath, f.handleCallback)
+	if f.options.Saml != nil {
+		mux.HandleFunc(SamlPath, f.handleSaml)
+	}
+}
+
+// Providers returns the configured identity providers in the configuration order.
+func (f *Federation) Providers() []*ProviderOptions {
+	return f.options.Providers
+}
+
+// LoginUrl of the endpoint which starts the sign in by the provider.
+func (f *Federation) LoginUrl(name string) string {
+	return f.options.BaseUrl + LoginPath + name
+}
+
+func (f *Federation) redirectUrl() string {
+	return f.options.BaseUrl + CallbackPath
+}
+
+func (f *Federation) oauth2Config(p *provider) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     p.options.ClientId,
+		ClientSecret: p.options.ClientSecret,
+		Endpoint:     p.oidc.Endpoint(),
+		RedirectURL:  f.redirectUrl(),
+		Scopes:       p.options.Scopes,
+	}
+}
+
+func (p *provider) discover(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.oidc != nil {
+		return nil
+	}
+
+	discovered, err := oidc.NewProvider(ctx, p.options.Issuer)
+	if err != nil {
+		return fmt.Errorf("failed to discover %s identity provider: %w", p.options.Name, err)
+	}
+
+	p.oidc = discovered
+	p.verifier = discovered.Verifier(&oidc.Config{ClientID: p.options.ClientId})
+	return nil
+}
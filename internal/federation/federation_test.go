@@ -0,0 +1,119 @@
+package federation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+func testFederation() *Federation {
+	log := zerolog.Nop()
+	return NewFederation(
+		&FederationOptions{
+			BaseUrl:   "https://auth.example.com/",
+			AppUrl:    "https://app.example.com/",
+			Providers: []*ProviderOptions{{Name: "google", Issuer: "https://accounts.google.com"}},
+		},
+		nil,
+		&log,
+	)
+}
+
+func TestMapRole(t *testing.T) {
+	options := &ProviderOptions{
+		RoleClaim: "groups",
+		RoleMapping: map[string]model.UserRole{
+			"staff":  model.UserRoleUser,
+			"admins": model.UserRoleAdministrator,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		options *ProviderOptions
+		claims  map[string]any
+		role    model.UserRole
+	}{
+		{"string claim", options, map[string]any{"groups": "staff"}, model.UserRoleUser},
+		{"list claim", options, map[string]any{"groups": []any{"staff", "admins"}}, model.UserRoleAdministrator},
+		{"administrator wins in any order", options, map[string]any{"groups": []any{"admins", "staff"}}, model.UserRoleAdministrator},
+		{"unmapped values", options, map[string]any{"groups": []any{"guests", 42}}, ""},
+		{"missing claim", options, map[string]any{"roles": "admins"}, ""},
+		{"claim of other type", options, map[string]any{"groups": map[string]any{"admins": true}}, ""},
+		{"roles are not synced", &ProviderOptions{RoleMapping: options.RoleMapping}, map[string]any{"groups": "admins"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			role := mapRole(test.options, test.claims)
+
+			if test.role == "" {
+				if role != nil {
+					t.Fatalf("got role %s, want none", *role)
+				}
+				return
+			}
+			if role == nil || *role != test.role {
+				t.Fatalf("got role %v, want %s", role, test.role)
+			}
+		})
+	}
+}
+
+func TestHandleLogin(t *testing.T) {
+	f := testFederation()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"unknown provider", http.MethodGet, LoginPath + "github", http.StatusNotFound},
+		{"missing provider", http.MethodGet, LoginPath, http.StatusNotFound},
+		{"post", http.MethodPost, LoginPath + "google", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			f.handleLogin(w, httptest.NewRequest(test.method, test.path, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
+
+func TestUrls(t *testing.T) {
+	f := testFederation()
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"login", f.LoginUrl("google"), "https://auth.example.com/federation/login/google"},
+		{"callback", f.redirectUrl(), "https://auth.example.com/federation/callback"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.url != test.want {
+				t.Fatalf("got %s, want %s", test.url, test.want)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	f.redirectError(w, httptest.NewRequest(http.MethodGet, CallbackPath, nil), "access_denied")
+	if location := w.Header().Get("Location"); location != "https://app.example.com/federated-sign-in?error=access_denied" {
+		t.Fatalf("got error redirect %s", location)
+	}
+}
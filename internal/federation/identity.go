@@ -0,0 +1,169 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+// externalIdentity is the user identity asserted by an OpenID Connect or SAML identity provider.
+type externalIdentity struct {
+	provider string
+	issuer   string
+	subject  string
+	email    string
+	// emailVerified allows to link the identity to the existing user with the email
+	emailVerified bool
+	name          string
+	// role mapped from the provider claims, the user role is kept when it is nil
+	role         *model.UserRole
+	provisioning bool
+}
+
+// resolveUser returns the user linked to the external identity.
+// Unknown identities are linked to the user with the same verified email or provisioned when allowed.
+func (f *Federation) resolveUser(ctx context.Context, external *externalIdentity) (*model.User, error) {
+	email := external.email
+	role := external.role
+
+	identity, err := f.db.GetUserIdentity(ctx, model.GetUserIdentityParams{Issuer: external.issuer, Subject: external.subject})
+	if err == nil {
+		user, err := f.db.GetActiveUserById(ctx, identity.UserID)
+		if err != nil {
+			return nil, newLoginError("access_denied", fmt.Errorf("user %s of %s identity is not active: %w", identity.UserID, external.provider, err))
+		}
+
+		err = f.db.UpdateUserIdentitySignIn(
+			ctx,
+			model.UpdateUserIdentitySignInParams{
+				ID:    identity.ID,
+				Email: pgtype.Text{String: email, Valid: email != ""},
+			})
+		if err != nil {
+			return nil, fmt.Errorf("failed to update %s identity of %s: %w", external.provider, user.Email, err)
+		}
+
+		return f.syncRole(ctx, &user, role)
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("failed to load %s identity %s: %w", external.provider, external.subject, err)
+	}
+
+	// Linking by an unverified email would let the provider users take over local accounts
+	if !external.emailVerified {
+		return nil, newLoginError("access_denied", fmt.Errorf("%s identity %s has no verified email", external.provider, external.subject))
+	}
+
+	user, err := f.db.GetActiveUser(ctx, email)
+	if err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return nil, fmt.Errorf("failed to load user %s: %w", email, err)
+		}
+		if !external.provisioning {
+			return nil, newLoginError("access_denied", fmt.Errorf("user %s is not registered, %s provisioning is disabled", email, external.provider))
+		}
+
+		user, err = f.provisionUser(ctx, email, external.name, role)
+		if err != nil {
+			return nil, err
+		}
+		role = nil
+	}
+
+	err = f.db.CreateUserIdentity(
+		ctx,
+		model.CreateUserIdentityParams{
+			UserID:   user.ID,
+			Provider: external.provider,
+			Issuer:   external.issuer,
+			Subject:  external.subject,
+			Email:    pgtype.Text{String: email, Valid: true},
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to link %s identity to %s: %w", external.provider, email, err)
+	}
+
+	f.log.Info().Msgf("%s identity %s linked to %s", external.provider, external.subject, email)
+
+	if !user.EmailVerifiedAt.Valid {
+		_, err = f.db.VerifyUserEmail(ctx, model.VerifyUserEmailParams{ID: user.ID, Email: user.Email})
+		if err != nil {
+			return nil, fmt.Errorf("failed to verify %s email: %w", email, err)
+		}
+	}
+
+	return f.syncRole(ctx, &user, role)
+}
+
+// provisionUser creates the user without password, it signs in by the provider only.
+func (f *Federation) provisionUser(ctx context.Context, email string, name string, role *model.UserRole) (model.User, error) {
+	if strings.TrimSpace(name) == "" {
+		name = email
+	}
+	userRole := model.UserRoleUser
+	if role != nil {
+		userRole = *role
+	}
+
+	userId, err := f.db.CreateUser(
+		ctx,
+		model.CreateUserParams{
+			ID:       uuid.New(),
+			Name:     strings.TrimSpace(name),
+			Email:    email,
+			Password: "",
+			Role:     userRole,
+			Deleted:  false,
+		})
+	if err != nil {
+		return model.User{}, fmt.Errorf("failed to provision user %s: %w", email, err)
+	}
+
+	user, err := f.db.GetUser(ctx, userId)
+	if err != nil {
+		return model.User{}, fmt.Errorf("failed to load provisioned user %s: %w", email, err)
+	}
+
+	f.log.Info().Msgf("User %s provisioned with %s role", email, userRole)
+
+	return user, nil
+}
+
+// syncRole updates the user role when the provider claims map to another role.
+func (f *Federation) syncRole(ctx context.Context, user *model.User, role *model.UserRole) (*model.User, error) {
+	if role == nil || *role == user.Role {
+		return user, nil
+	}
+
+	err := f.db.UpdateUserRole(ctx, model.UpdateUserRoleParams{ID: user.ID, Role: *role})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update %s role: %w", user.Email, err)
+	}
+
+	f.log.Info().Msgf("%s role changed from %s to %s by identity provider", user.Email, user.Role, *role)
+
+	user.Role = *role
+	return user, nil
+}
+
+// mapRoleValues returns the highest role mapped from the values, nil when no value is mapped.
+func mapRoleValues(mapping map[string]model.UserRole, values []string) *model.UserRole {
+	var role *model.UserRole
+	for _, value := range values {
+		mapped, ok := mapping[value]
+		if !ok {
+			continue
+		}
+		if role == nil || mapped == model.UserRoleAdministrator {
+			role = &mapped
+		}
+	}
+	return role
+}
@@ -0,0 +1,228 @@
+package federation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/jackc/pgx/v5/pgtype"
+	"golang.org/x/oauth2"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// SignInPath of the client application page which receives the ticket or the error.
+const SignInPath = "/federated-sign-in"
+
+// identityClaims are the ID token claims used to link and provision users.
+type identityClaims struct {
+	Email         string `json:"email"`
+	EmailVerified *bool  `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// loginError is reported to the client application by the `error` query parameter.
+type loginError struct {
+	code string
+	err  error
+}
+
+func (e *loginError) Error() string {
+	return e.code + ": " + e.err.Error()
+}
+
+func newLoginError(code string, err error) *loginError {
+	return &loginError{code: code, err: err}
+}
+
+func (f *Federation) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	name := strings.TrimPrefix(r.URL.Path, LoginPath)
+
+	p, ok := f.providers[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if err := p.discover(ctx); err != nil {
+		f.log.Error().Msgf("Federated sign in by %s failed: %v", name, err)
+		f.redirectError(w, r, "temporarily_unavailable")
+		return
+	}
+
+	generator := jwt_tool.TokenGenerator{}
+	state, expiresAt, err := generator.GenerateToken(LoginTtl)
+	if err != nil {
+		f.log.Error().Msgf("Failed to generate %s sign in state: %v", name, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+	nonce, _, err := generator.GenerateToken(LoginTtl)
+	if err != nil {
+		f.log.Error().Msgf("Failed to generate %s sign in nonce: %v", name, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = f.db.CreateFederatedLogin(
+		ctx,
+		model.CreateFederatedLoginParams{
+			StateHash:    tool.HashToken(state),
+			Provider:     name,
+			Nonce:        nonce,
+			CodeVerifier: verifier,
+			ExpiresAt:    pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		f.log.Error().Msgf("Failed to save %s sign in state: %v", name, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+
+	authUrl := f.oauth2Config(p).AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+	http.Redirect(w, r, authUrl, http.StatusFound)
+}
+
+func (f *Federation) handleCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ticket, err := f.completeLogin(r.Context(), r.URL.Query())
+	if err != nil {
+		f.log.Warn().Msgf("Federated sign in failed: %v", err)
+
+		code := "server_error"
+		var loginErr *loginError
+		if errors.As(err, &loginErr) {
+			code = loginErr.code
+		}
+		f.redirectError(w, r, code)
+		return
+	}
+
+	http.Redirect(w, r, f.options.AppUrl+SignInPath+"?"+url.Values{"ticket": {ticket}}.Encode(), http.StatusFound)
+}
+
+// completeLogin verifies the identity provider response and returns the ticket of the signed in user.
+func (f *Federation) completeLogin(ctx context.Context, query url.Values) (string, error) {
+	// State is single use, it is consumed even when the response turns out to be an error
+	login, err := f.db.ConsumeFederatedLogin(ctx, tool.HashToken(query.Get("state")))
+	if err != nil {
+		return "", newLoginError("invalid_request", fmt.Errorf("state is invalid or expired: %w", err))
+	}
+	if idpErr := query.Get("error"); idpErr != "" {
+		return "", newLoginError("access_denied", fmt.Errorf("%s returned %s: %s", login.Provider, idpErr, query.Get("error_description")))
+	}
+
+	p, ok := f.providers[login.Provider]
+	if !ok {
+		return "", newLoginError("invalid_request", fmt.Errorf("provider %s is no longer configured", login.Provider))
+	}
+	if err := p.discover(ctx); err != nil {
+		return "", newLoginError("temporarily_unavailable", err)
+	}
+
+	token, err := f.oauth2Config(p).Exchange(ctx, query.Get("code"), oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		return "", newLoginError("access_denied", fmt.Errorf("%s code exchange failed: %w", login.Provider, err))
+	}
+	rawIdToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return "", newLoginError("access_denied", fmt.Errorf("%s returned no ID token", login.Provider))
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIdToken)
+	if err != nil {
+		return "", newLoginError("access_denied", fmt.Errorf("%s ID token is invalid: %w", login.Provider, err))
+	}
+	if idToken.Nonce != login.Nonce {
+		return "", newLoginError("access_denied", fmt.Errorf("%s ID token nonce does not match", login.Provider))
+	}
+
+	var claims identityClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return "", newLoginError("access_denied", fmt.Errorf("%s ID token claims are invalid: %w", login.Provider, err))
+	}
+	var rawClaims map[string]any
+	if err := idToken.Claims(&rawClaims); err != nil {
+		return "", newLoginError("access_denied", fmt.Errorf("%s ID token claims are invalid: %w", login.Provider, err))
+	}
+
+	email := strings.TrimSpace(claims.Email)
+	user, err := f.resolveUser(ctx, &externalIdentity{
+		provider:      p.options.Name,
+		issuer:        idToken.Issuer,
+		subject:       idToken.Subject,
+		email:         email,
+		emailVerified: email != "" && (p.options.TrustEmail || (claims.EmailVerified != nil && *claims.EmailVerified)),
+		name:          claims.Name,
+		role:          mapRole(p.options, rawClaims),
+		provisioning:  p.options.Provisioning,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return f.createTicket(ctx, user)
+}
+
+func (f *Federation) createTicket(ctx context.Context, user *model.User) (string, error) {
+	generator := jwt_tool.TokenGenerator{}
+	ticket, expiresAt, err := generator.GenerateToken(TicketTtl)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate %s sign in ticket: %w", user.Email, err)
+	}
+
+	err = f.db.CreateUserToken(
+		ctx,
+		model.CreateUserTokenParams{
+			TokenHash: tool.HashToken(ticket),
+			UserID:    user.ID,
+			Purpose:   model.UserTokenPurposeFederatedSignIn,
+			Email:     user.Email,
+			ExpiresAt: pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s sign in ticket: %w", user.Email, err)
+	}
+
+	return ticket, nil
+}
+
+func (f *Federation) redirectError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, f.options.AppUrl+SignInPath+"?"+url.Values{"error": {code}}.Encode(), http.StatusFound)
+}
+
+// mapRole returns the highest role mapped from the role claim, nil when no value is mapped.
+func mapRole(options *ProviderOptions, claims map[string]any) *model.UserRole {
+	if options.RoleClaim == "" {
+		return nil
+	}
+
+	var values []string
+	switch claim := claims[options.RoleClaim].(type) {
+	case string:
+		values = []string{claim}
+	case []any:
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+	}
+	return mapRoleValues(options.RoleMapping, values)
+}
@@ -0,0 +1,318 @@
+package federation
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	"github.com/jackc/pgx/v5/pgtype"
+	dsig "github.com/russellhaering/goxmldsig"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// SamlPath is the prefix of `/saml/<connection>/metadata`, `/saml/<connection>/login` and `/saml/<connection>/acs`.
+const SamlPath = "/saml/"
+
+// SamlProviderPrefix prefixes connection ids in the provider of user identities.
+const SamlProviderPrefix = "saml:"
+
+type SamlOptions struct {
+	// Key signs authentication requests and decrypts assertions, Certificate is published in the SP metadata.
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// NewSamlOptions parses the PEM encoded RSA key and certificate of the service provider.
+func NewSamlOptions(keyPem []byte, certificatePem []byte) (*SamlOptions, error) {
+	keyPair, err := tls.X509KeyPair(certificatePem, keyPem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SAML key pair: %w", err)
+	}
+	key, ok := keyPair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("SAML key is not an RSA key")
+	}
+	certificate, err := x509.ParseCertificate(keyPair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SAML certificate: %w", err)
+	}
+
+	return &SamlOptions{Key: key, Certificate: certificate}, nil
+}
+
+// ValidateSamlMetadata checks the identity provider metadata supports the redirect binding.
+func ValidateSamlMetadata(metadata string) error {
+	entity, err := samlsp.ParseMetadata([]byte(metadata))
+	if err != nil {
+		return err
+	}
+	sp := &saml.ServiceProvider{IDPMetadata: entity}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return fmt.Errorf("identity provider has no HTTP-Redirect single sign on service")
+	}
+	return nil
+}
+
+// SamlEnabled reports whether SAML connections are served.
+func (f *Federation) SamlEnabled() bool {
+	return f.options.Saml != nil
+}
+
+// SamlLoginUrl of the endpoint which starts the sign in by the organization identity provider.
+func (f *Federation) SamlLoginUrl(connectionId string) string {
+	return f.options.BaseUrl + SamlPath + connectionId + "/login"
+}
+
+func (f *Federation) handleSaml(w http.ResponseWriter, r *http.Request) {
+	connectionId, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, SamlPath), "/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	connection, err := f.db.GetSamlConnection(r.Context(), connectionId)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	sp, err := f.serviceProvider(&connection)
+	if err != nil {
+		f.log.Error().Msgf("SAML connection %s is invalid: %v", connectionId, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+
+	switch {
+	case action == "metadata" && r.Method == http.MethodGet:
+		f.handleSamlMetadata(w, sp)
+	case action == "login" && r.Method == http.MethodGet:
+		f.handleSamlLogin(w, r, &connection, sp)
+	case action == "acs" && r.Method == http.MethodPost:
+		f.handleSamlAcs(w, r, &connection, sp)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *Federation) handleSamlMetadata(w http.ResponseWriter, sp *saml.ServiceProvider) {
+	metadata, err := xml.MarshalIndent(sp.Metadata(), "", "  ")
+	if err != nil {
+		f.log.Error().Msgf("Failed to write SAML metadata: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(metadata)
+}
+
+func (f *Federation) handleSamlLogin(w http.ResponseWriter, r *http.Request, connection *model.SamlConnection, sp *saml.ServiceProvider) {
+	ctx := r.Context()
+
+	request, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		f.log.Error().Msgf("Failed to make %s SAML request: %v", connection.ID, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+
+	generator := jwt_tool.TokenGenerator{}
+	relayState, expiresAt, err := generator.GenerateToken(LoginTtl)
+	if err != nil {
+		f.log.Error().Msgf("Failed to generate %s SAML relay state: %v", connection.ID, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+
+	err = f.db.CreateSamlRequest(
+		ctx,
+		model.CreateSamlRequestParams{
+			RelayStateHash: tool.HashToken(relayState),
+			ConnectionID:   connection.ID,
+			RequestID:      request.ID,
+			ExpiresAt:      pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		f.log.Error().Msgf("Failed to save %s SAML request: %v", connection.ID, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+
+	// Redirect does not escape the relay state
+	redirectUrl, err := request.Redirect(url.QueryEscape(relayState), sp)
+	if err != nil {
+		f.log.Error().Msgf("Failed to sign %s SAML request: %v", connection.ID, err)
+		f.redirectError(w, r, "server_error")
+		return
+	}
+
+	http.Redirect(w, r, redirectUrl.String(), http.StatusFound)
+}
+
+func (f *Federation) handleSamlAcs(w http.ResponseWriter, r *http.Request, connection *model.SamlConnection, sp *saml.ServiceProvider) {
+	ticket, err := f.completeSamlLogin(r.Context(), r, connection, sp)
+	if err != nil {
+		f.log.Warn().Msgf("SAML sign in by %s failed: %v", connection.ID, err)
+
+		code := "server_error"
+		var loginErr *loginError
+		if errors.As(err, &loginErr) {
+			code = loginErr.code
+		}
+		f.redirectError(w, r, code)
+		return
+	}
+
+	http.Redirect(w, r, f.options.AppUrl+SignInPath+"?"+url.Values{"ticket": {ticket}}.Encode(), http.StatusFound)
+}
+
+// completeSamlLogin validates the assertion and returns the ticket of the signed in user.
+// Only responses to requests of the service are accepted, identity provider initiated sign in is not supported.
+func (f *Federation) completeSamlLogin(ctx context.Context, r *http.Request, connection *model.SamlConnection, sp *saml.ServiceProvider) (string, error) {
+	if err := r.ParseForm(); err != nil {
+		return "", newLoginError("invalid_request", err)
+	}
+
+	requestId, err := f.db.ConsumeSamlRequest(
+		ctx,
+		model.ConsumeSamlRequestParams{
+			RelayStateHash: tool.HashToken(r.PostForm.Get("RelayState")),
+			ConnectionID:   connection.ID,
+		})
+	if err != nil {
+		return "", newLoginError("invalid_request", fmt.Errorf("relay state is invalid or expired: %w", err))
+	}
+
+	assertion, err := sp.ParseResponse(r, []string{requestId})
+	if err != nil {
+		var responseErr *saml.InvalidResponseError
+		if errors.As(err, &responseErr) {
+			err = responseErr.PrivateErr
+		}
+		return "", newLoginError("access_denied", fmt.Errorf("SAML response is invalid: %w", err))
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return "", newLoginError("access_denied", fmt.Errorf("SAML assertion has no NameID"))
+	}
+	// Transient NameID changes on every sign in, so the identity could not be linked
+	if assertion.Subject.NameID.Format == string(saml.TransientNameIDFormat) {
+		return "", newLoginError("access_denied", fmt.Errorf("transient NameID is not supported, use persistent or email format"))
+	}
+
+	attributes := samlAttributes(assertion)
+
+	email := assertion.Subject.NameID.Value
+	if connection.EmailAttribute.Valid {
+		email = firstValue(attributes[connection.EmailAttribute.String])
+	}
+	email = strings.TrimSpace(email)
+
+	// Organization identity providers assert emails of their own domains only
+	_, domain, _ := strings.Cut(strings.ToLower(email), "@")
+	if !slices.Contains(connection.Domains, domain) {
+		return "", newLoginError("access_denied", fmt.Errorf("email %s is not of %s domains", email, connection.ID))
+	}
+
+	var name string
+	if connection.NameAttribute.Valid {
+		name = firstValue(attributes[connection.NameAttribute.String])
+	}
+
+	var role *model.UserRole
+	if connection.RoleAttribute.Valid {
+		roleMapping := map[string]model.UserRole{}
+		if err := json.Unmarshal(connection.RoleMapping, &roleMapping); err != nil {
+			return "", fmt.Errorf("invalid %s role mapping: %w", connection.ID, err)
+		}
+		role = mapRoleValues(roleMapping, attributes[connection.RoleAttribute.String])
+	}
+
+	user, err := f.resolveUser(ctx, &externalIdentity{
+		provider:      SamlProviderPrefix + connection.ID,
+		issuer:        assertion.Issuer.Value,
+		subject:       assertion.Subject.NameID.Value,
+		email:         email,
+		emailVerified: true,
+		name:          name,
+		role:          role,
+		provisioning:  connection.Provisioning,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return f.createTicket(ctx, user)
+}
+
+func (f *Federation) serviceProvider(connection *model.SamlConnection) (*saml.ServiceProvider, error) {
+	if f.options.Saml == nil {
+		return nil, fmt.Errorf("SAML is not configured")
+	}
+
+	idpMetadata, err := samlsp.ParseMetadata([]byte(connection.IdpMetadata))
+	if err != nil {
+		return nil, err
+	}
+
+	base := f.options.BaseUrl + SamlPath + connection.ID
+	metadataUrl, err := url.Parse(base + "/metadata")
+	if err != nil {
+		return nil, err
+	}
+	acsUrl, err := url.Parse(base + "/acs")
+	if err != nil {
+		return nil, err
+	}
+
+	return &saml.ServiceProvider{
+		EntityID:              metadataUrl.String(),
+		Key:                   f.options.Saml.Key,
+		Certificate:           f.options.Saml.Certificate,
+		MetadataURL:           *metadataUrl,
+		AcsURL:                *acsUrl,
+		IDPMetadata:           idpMetadata,
+		AuthnNameIDFormat:     saml.UnspecifiedNameIDFormat,
+		SignatureMethod:       dsig.RSASHA256SignatureMethod,
+		MetadataValidDuration: 7 * 24 * time.Hour,
+	}, nil
+}
+
+// samlAttributes maps attribute names and friendly names to the values.
+func samlAttributes(assertion *saml.Assertion) map[string][]string {
+	attributes := map[string][]string{}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			values := make([]string, 0, len(attribute.Values))
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+			attributes[attribute.Name] = values
+			if attribute.FriendlyName != "" {
+				attributes[attribute.FriendlyName] = values
+			}
+		}
+	}
+	return attributes
+}
+
+func firstValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,108 @@
+package federation
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/crewjam/saml"
+)
+
+const testIdpMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://idp.example.com">
+  <IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleSignOnService Binding="%s" Location="https://idp.example.com/sso"/>
+  </IDPSSODescriptor>
+</EntityDescriptor>`
+
+func TestSamlAttributes(t *testing.T) {
+	assertion := &saml.Assertion{
+		AttributeStatements: []saml.AttributeStatement{{
+			Attributes: []saml.Attribute{
+				{
+					Name:         "urn:oid:0.9.2342.19200300.100.1.3",
+					FriendlyName: "mail",
+					Values:       []saml.AttributeValue{{Value: "user@example.com"}},
+				},
+				{
+					Name:   "groups",
+					Values: []saml.AttributeValue{{Value: "staff"}, {Value: "admins"}},
+				},
+				{Name: "empty"},
+			},
+		}},
+	}
+	attributes := samlAttributes(assertion)
+
+	tests := []struct {
+		name  string
+		first string
+		count int
+	}{
+		{"urn:oid:0.9.2342.19200300.100.1.3", "user@example.com", 1},
+		{"mail", "user@example.com", 1},
+		{"groups", "staff", 2},
+		{"empty", "", 0},
+		{"missing", "", 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values := attributes[test.name]
+
+			if len(values) != test.count || firstValue(values) != test.first {
+				t.Fatalf("got %q, want %d values starting with %q", values, test.count, test.first)
+			}
+		})
+	}
+}
+
+func TestValidateSamlMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata string
+		ok       bool
+	}{
+		{"redirect binding", fmt.Sprintf(testIdpMetadata, saml.HTTPRedirectBinding), true},
+		{"post binding only", fmt.Sprintf(testIdpMetadata, saml.HTTPPostBinding), false},
+		{"malformed metadata", "<EntityDescriptor", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := ValidateSamlMetadata(test.metadata); (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+		})
+	}
+}
+
+func TestHandleSaml(t *testing.T) {
+	f := testFederation()
+	f.options.Saml = &SamlOptions{}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"missing action", SamlPath + "acme", http.StatusNotFound},
+		{"missing connection", SamlPath, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+
+			f.handleSaml(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+
+	if url := f.SamlLoginUrl("acme"); url != "https://auth.example.com/saml/acme/login" {
+		t.Fatalf("got SAML login URL %s", url)
+	}
+}
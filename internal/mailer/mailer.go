@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	Html    string
+}
+
+// Mailer sends transactional emails such as verification links.
+type Mailer interface {
+	Send(ctx context.Context, message *Message) error
+}
+
+// LogMailer writes emails to the log instead of sending them, for development environments only as links in emails are secrets.
+type LogMailer struct {
+	Log *zerolog.Logger
+}
+
+func NewLogMailer(log *zerolog.Logger) *LogMailer {
+	return &LogMailer{
+		Log: log,
+	}
+}
+
+func (m *LogMailer) Send(ctx context.Context, message *Message) error {
+	m.Log.Info().
+		Str("to", message.To).
+		Str("subject", message.Subject).
+		Msg(message.Text)
+	return nil
+}
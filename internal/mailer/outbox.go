@@ -0,0 +1,116 @@
+package mailer
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	"github.com/zs-dima/auth-service/internal/outbox"
+)
+
+var defaultOutboxOptions = outbox.Options{
+	PollInterval:  10 * time.Second,
+	Lease:         5 * time.Minute,
+	BatchSize:     10,
+	MaxAttempts:   8,
+	MinBackoff:    30 * time.Second,
+	MaxBackoff:    time.Hour,
+	Retention:     7 * 24 * time.Hour,
+	PurgeInterval: time.Hour,
+}
+
+// OutboxMailer queues emails in Postgres, so sending never blocks or fails the RPC because of the SMTP server.
+// Run delivers the queued emails with the sender, retrying with exponential backoff.
+// Bodies carry sign in links and codes, they are cleared once the email is sent or given up.
+type OutboxMailer struct {
+	db     *model.Queries
+	sender Mailer
+	worker *outbox.Worker[model.MailOutbox]
+}
+
+func NewOutboxMailer(db *model.Queries, sender Mailer, options *outbox.Options, log *zerolog.Logger) *OutboxMailer {
+	options.SetDefaults(&defaultOutboxOptions)
+
+	m := &OutboxMailer{
+		db:     db,
+		sender: sender,
+	}
+	m.worker = outbox.NewWorker(
+		"mail",
+		&outbox.Store[model.MailOutbox]{
+			Claim:         m.claim,
+			MarkDelivered: db.MarkMailSent,
+			MarkFailed:    m.markFailed,
+			Purge:         db.PurgeMailOutbox,
+		},
+		m.send,
+		options,
+		log,
+	)
+	return m
+}
+
+func (m *OutboxMailer) Send(ctx context.Context, message *Message) error {
+	err := m.db.EnqueueMail(
+		ctx,
+		model.EnqueueMailParams{
+			Recipient: message.To,
+			Subject:   message.Subject,
+			TextBody:  message.Text,
+			HtmlBody:  message.Html,
+		})
+	if err != nil {
+		return err
+	}
+
+	m.worker.Notify()
+	return nil
+}
+
+// Run delivers queued emails until the context is cancelled.
+func (m *OutboxMailer) Run(ctx context.Context) {
+	m.worker.Run(ctx)
+}
+
+func (m *OutboxMailer) claim(ctx context.Context, lease time.Duration, batchSize int32) ([]outbox.Message[model.MailOutbox], error) {
+	mails, err := m.db.ClaimMailOutbox(
+		ctx,
+		model.ClaimMailOutboxParams{
+			Lease:     lease,
+			BatchSize: batchSize,
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]outbox.Message[model.MailOutbox], len(mails))
+	for i, mail := range mails {
+		messages[i] = outbox.Message[model.MailOutbox]{Id: mail.ID, Attempts: mail.Attempts, Value: mail}
+	}
+	return messages, nil
+}
+
+func (m *OutboxMailer) send(ctx context.Context, message *outbox.Message[model.MailOutbox]) error {
+	mail := &message.Value
+	return m.sender.Send(ctx, &Message{
+		To:      mail.Recipient,
+		Subject: mail.Subject,
+		Text:    mail.TextBody,
+		Html:    mail.HtmlBody,
+	})
+}
+
+func (m *OutboxMailer) markFailed(ctx context.Context, id uuid.UUID, lastError string, nextAttemptAt time.Time, failed bool) error {
+	return m.db.MarkMailAttemptFailed(
+		ctx,
+		model.MarkMailAttemptFailedParams{
+			ID:            id,
+			LastError:     pgtype.Text{String: lastError, Valid: true},
+			NextAttemptAt: pgtype.Timestamp{Time: nextAttemptAt, Valid: true},
+			Failed:        failed,
+		})
+}
@@ -0,0 +1,178 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type SmtpTls string
+
+const (
+	// SmtpStartTls upgrades the connection when the server supports STARTTLS, usually port 587.
+	SmtpStartTls SmtpTls = "starttls"
+	// SmtpImplicitTls connects over TLS, usually port 465.
+	SmtpImplicitTls SmtpTls = "tls"
+	// SmtpNoTls is suitable for local SMTP sinks only.
+	SmtpNoTls SmtpTls = "none"
+)
+
+type SmtpOptions struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	Tls      SmtpTls
+	Timeout  time.Duration
+}
+
+// SmtpMailer delivers emails to an SMTP server, e.g. a local sink like Mailpit for development.
+type SmtpMailer struct {
+	options *SmtpOptions
+}
+
+func NewSmtpMailer(options *SmtpOptions) *SmtpMailer {
+	if options.Timeout <= 0 {
+		options.Timeout = 30 * time.Second
+	}
+	return &SmtpMailer{
+		options: options,
+	}
+}
+
+func (m *SmtpMailer) Send(ctx context.Context, message *Message) error {
+	body, err := m.compose(message)
+	if err != nil {
+		return fmt.Errorf("failed to compose email: %w", err)
+	}
+
+	client, err := m.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.options.Username != "" {
+		auth := smtp.PlainAuth("", m.options.Username, m.options.Password, m.options.Host)
+		if err = client.Auth(auth); err != nil {
+			return fmt.Errorf("smtp auth failed: %w", err)
+		}
+	}
+	if err = client.Mail(m.options.From); err != nil {
+		return fmt.Errorf("smtp MAIL FROM failed: %w", err)
+	}
+	if err = client.Rcpt(message.To); err != nil {
+		return fmt.Errorf("smtp RCPT TO failed: %w", err)
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return fmt.Errorf("smtp DATA failed: %w", err)
+	}
+	if _, err = writer.Write(body); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+	if err = writer.Close(); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+
+	return client.Quit()
+}
+
+func (m *SmtpMailer) dial(ctx context.Context) (*smtp.Client, error) {
+	address := net.JoinHostPort(m.options.Host, strconv.Itoa(m.options.Port))
+	dialer := &net.Dialer{Timeout: m.options.Timeout}
+	tlsConfig := &tls.Config{ServerName: m.options.Host}
+
+	var conn net.Conn
+	var err error
+	if m.options.Tls == SmtpImplicitTls {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(m.options.Timeout))
+
+	client, err := smtp.NewClient(conn, m.options.Host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to start smtp session: %w", err)
+	}
+
+	if m.options.Tls == SmtpStartTls {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			_ = client.Close()
+			return nil, fmt.Errorf("smtp server %s does not support STARTTLS", address)
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("smtp STARTTLS failed: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+// compose builds a multipart/alternative message with text and HTML bodies.
+func (m *SmtpMailer) compose(message *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	parts := multipart.NewWriter(&buf)
+
+	headers := []struct{ key, value string }{
+		{"From", m.options.From},
+		{"To", message.To},
+		{"Subject", mime.QEncoding.Encode("utf-8", message.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", uuid.New(), m.options.Host)},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", parts.Boundary())},
+	}
+	for _, header := range headers {
+		fmt.Fprintf(&buf, "%s: %s\r\n", header.key, header.value)
+	}
+	buf.WriteString("\r\n")
+
+	bodies := []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", message.Text},
+		{"text/html; charset=utf-8", message.Html},
+	}
+	for _, body := range bodies {
+		if body.content == "" {
+			continue
+		}
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoder := quotedprintable.NewWriter(part)
+		if _, err = encoder.Write([]byte(body.content)); err != nil {
+			return nil, err
+		}
+		if err = encoder.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
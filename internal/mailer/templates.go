@@ -0,0 +1,147 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	html "html/template"
+	"io/fs"
+	"strings"
+	text "text/template"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Templates are stored as `templates/<locale>/<name>.txt` and `templates/<locale>/<name>.html`.
+// Text template defines the subject in a `subject` block.
+//
+//go:embed templates
+var templateFiles embed.FS
+
+const (
+	TemplateEmailVerification  = "email_verification"
+	TemplateEmailChangeConfirm = "email_change_confirm"
+	TemplateEmailChangeNotice  = "email_change_notice"
+	TemplateInvitation         = "invitation"
+	TemplateSignUpAttempt      = "sign_up_attempt"
+	TemplatePasswordReset      = "password_reset"
+	TemplatePasswordChanged    = "password_changed"
+	TemplateMagicLink          = "magic_link"
+	TemplateSignInCode         = "sign_in_code"
+)
+
+type localizedTemplate struct {
+	text *text.Template
+	html *html.Template
+}
+
+// Templates renders emails in the recipient locale falling back to the default locale.
+type Templates struct {
+	defaultLocale string
+	templates     map[string]map[string]*localizedTemplate
+}
+
+func NewTemplates(defaultLocale string) (*Templates, error) {
+	templates := make(map[string]map[string]*localizedTemplate)
+
+	locales, err := fs.ReadDir(templateFiles, "templates")
+	if err != nil {
+		return nil, err
+	}
+	for _, locale := range locales {
+		if !locale.IsDir() {
+			continue
+		}
+
+		names, err := fs.Glob(templateFiles, fmt.Sprintf("templates/%s/*.txt", locale.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range names {
+			name := strings.TrimSuffix(path[strings.LastIndex(path, "/")+1:], ".txt")
+
+			textTemplate, err := text.ParseFS(templateFiles, path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+			}
+			if textTemplate.Lookup("subject") == nil {
+				return nil, fmt.Errorf("template %s has no subject", path)
+			}
+
+			htmlPath := strings.TrimSuffix(path, ".txt") + ".html"
+			htmlTemplate, err := html.ParseFS(templateFiles, htmlPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", htmlPath, err)
+			}
+
+			if templates[name] == nil {
+				templates[name] = make(map[string]*localizedTemplate)
+			}
+			templates[name][locale.Name()] = &localizedTemplate{text: textTemplate, html: htmlTemplate}
+		}
+	}
+
+	for name, localized := range templates {
+		if localized[defaultLocale] == nil {
+			return nil, fmt.Errorf("template %s has no %s default locale", name, defaultLocale)
+		}
+	}
+
+	return &Templates{
+		defaultLocale: defaultLocale,
+		templates:     templates,
+	}, nil
+}
+
+// Render builds the message from the named template and data.
+func (t *Templates) Render(name string, locale string, to string, data any) (*Message, error) {
+	localized, ok := t.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown email template %s", name)
+	}
+	template, ok := localized[locale]
+	if !ok {
+		template = localized[t.defaultLocale]
+	}
+
+	var subject, textBody, htmlBody bytes.Buffer
+	if err := template.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, fmt.Errorf("failed to render %s subject: %w", name, err)
+	}
+	if err := template.text.Execute(&textBody, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s text: %w", name, err)
+	}
+	if err := template.html.Execute(&htmlBody, data); err != nil {
+		return nil, fmt.Errorf("failed to render %s html: %w", name, err)
+	}
+
+	return &Message{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    strings.TrimSpace(textBody.String()) + "\n",
+		Html:    htmlBody.String(),
+	}, nil
+}
+
+// LocaleFromContext returns the primary language of the `accept-language` request header, e.g. `en`.
+func LocaleFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	// HTTP gateway forwards the header with a prefix
+	values := md.Get("accept-language")
+	if len(values) == 0 {
+		values = md.Get("grpcgateway-accept-language")
+	}
+	if len(values) == 0 {
+		return ""
+	}
+
+	tag, _, _ := strings.Cut(values[0], ",")
+	tag, _, _ = strings.Cut(tag, ";")
+	tag, _, _ = strings.Cut(tag, "-")
+	return strings.ToLower(strings.TrimSpace(tag))
+}
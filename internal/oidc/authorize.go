@@ -0,0 +1,177 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+// AuthorizationRequest is the validated authorization request of a client.
+type AuthorizationRequest struct {
+	Client              *model.OauthClient
+	RedirectUri         string
+	Scopes              []string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Prompt              string
+}
+
+// parseAuthorizationRequest validates the client and the redirect URI first,
+// errors are returned to the user then, other errors are redirected back to the client.
+func (p *Provider) parseAuthorizationRequest(
+	ctx context.Context,
+	query url.Values,
+) (*AuthorizationRequest, *Error, *Error) {
+	clientId := query.Get("client_id")
+	if clientId == "" {
+		return nil, newError("invalid_request", "client_id is required"), nil
+	}
+	client, err := p.db.GetOAuthClient(ctx, clientId)
+	if err != nil {
+		return nil, newError("invalid_client", "unknown client"), nil
+	}
+
+	if !slices.Contains(client.GrantTypes, GrantAuthorizationCode) {
+		return nil, newError("unauthorized_client", "authorization code grant is not allowed"), nil
+	}
+
+	redirectUri := query.Get("redirect_uri")
+	if !slices.Contains(client.RedirectUris, redirectUri) {
+		return nil, newError("invalid_request", "redirect_uri is not registered"), nil
+	}
+
+	request := &AuthorizationRequest{
+		Client:              &client,
+		RedirectUri:         redirectUri,
+		Scopes:              strings.Fields(query.Get("scope")),
+		State:               query.Get("state"),
+		Nonce:               query.Get("nonce"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+		Prompt:              query.Get("prompt"),
+	}
+
+	if query.Get("response_type") != "code" {
+		return request, nil, newError("unsupported_response_type", "only code response type is supported")
+	}
+	if !slices.Contains(request.Scopes, ScopeOpenId) {
+		return request, nil, newError("invalid_scope", "openid scope is required")
+	}
+	for _, scope := range request.Scopes {
+		if !slices.Contains(supportedScopes, scope) || !slices.Contains(client.Scopes, scope) {
+			return request, nil, newError("invalid_scope", "scope "+scope+" is not allowed")
+		}
+	}
+	// PKCE is required for all clients, plain method is not allowed
+	if request.CodeChallenge == "" || request.CodeChallengeMethod != "S256" {
+		return request, nil, newError("invalid_request", "code_challenge with S256 method is required")
+	}
+
+	return request, nil, nil
+}
+
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		p.writeError(w, http.StatusBadRequest, newError("invalid_request", err.Error()))
+		return
+	}
+
+	request, userErr, clientErr := p.parseAuthorizationRequest(r.Context(), r.Form)
+	if userErr != nil {
+		p.writeError(w, http.StatusBadRequest, userErr)
+		return
+	}
+	if clientErr != nil {
+		p.log.Warn().Msgf("OIDC authorization of %s failed: %v", request.Client.ID, clientErr)
+		http.Redirect(w, r, request.errorRedirect(clientErr), http.StatusFound)
+		return
+	}
+	if request.Prompt == "none" {
+		// There is no provider session, the user is always signed in by the client application
+		http.Redirect(w, r, request.errorRedirect(newError("login_required", "")), http.StatusFound)
+		return
+	}
+
+	http.Redirect(w, r, p.options.LoginUrl+"?"+r.Form.Encode(), http.StatusFound)
+}
+
+// Authorize completes the authorization request forwarded by the client application for the signed in user.
+// It returns the redirect URL with the authorization code, or with the error when the client has to be notified.
+func (p *Provider) Authorize(ctx context.Context, userId uuid.UUID, rawQuery string, deny bool) (string, error) {
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", newError("invalid_request", err.Error())
+	}
+
+	request, userErr, clientErr := p.parseAuthorizationRequest(ctx, query)
+	if userErr != nil {
+		return "", userErr
+	}
+	if clientErr != nil {
+		return request.errorRedirect(clientErr), nil
+	}
+	if deny {
+		return request.errorRedirect(newError("access_denied", "")), nil
+	}
+
+	generator := jwt_tool.TokenGenerator{}
+	code, expiresAt, err := generator.GenerateToken(p.options.CodeTtl)
+	if err != nil {
+		return "", err
+	}
+
+	err = p.db.CreateOAuthAuthorizationCode(
+		ctx,
+		model.CreateOAuthAuthorizationCodeParams{
+			CodeHash:      tool.HashToken(code),
+			ClientID:      request.Client.ID,
+			UserID:        userId,
+			RedirectUri:   request.RedirectUri,
+			Scope:         strings.Join(request.Scopes, " "),
+			Nonce:         pgtype.Text{String: request.Nonce, Valid: request.Nonce != ""},
+			CodeChallenge: request.CodeChallenge,
+			ExpiresAt:     pgtype.Timestamp{Time: expiresAt, Valid: true},
+		})
+	if err != nil {
+		return "", err
+	}
+
+	p.log.Info().Msgf("OIDC authorization code issued to %s for %s", request.Client.ID, userId)
+
+	return request.redirect(url.Values{"code": {code}}), nil
+}
+
+func (r *AuthorizationRequest) errorRedirect(err *Error) string {
+	params := url.Values{"error": {err.Code}}
+	if err.Description != "" {
+		params.Set("error_description", err.Description)
+	}
+	return r.redirect(params)
+}
+
+func (r *AuthorizationRequest) redirect(params url.Values) string {
+	if r.State != "" {
+		params.Set("state", r.State)
+	}
+
+	separator := "?"
+	if strings.Contains(r.RedirectUri, "?") {
+		separator = "&"
+	}
+	return r.RedirectUri + separator + params.Encode()
+}
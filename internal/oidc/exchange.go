@@ -0,0 +1,97 @@
+package oidc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+// ScopeTokenExchange allows OAuth clients to exchange user tokens for delegated tokens.
+const ScopeTokenExchange = "token:exchange"
+
+// TokenTypeAccessToken is the RFC 8693 type of subject and issued tokens.
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// ExchangeSubject is the user the delegated token is issued for.
+type ExchangeSubject struct {
+	UserId uuid.UUID
+	// ExpiresAt of the subject token, delegated tokens do not outlive it.
+	ExpiresAt time.Time
+	// Actor is the `act` claim of the subject token, nil for user tokens.
+	Actor map[string]any
+}
+
+// IssueExchangedToken signs a short-lived token of the user for the audience on behalf of the acting client.
+// The `act` claim names the client and nests the actors of the subject token along the call chain.
+func (p *Provider) IssueExchangedToken(
+	user *model.User,
+	client *model.OauthClient,
+	audience string,
+	scopes []string,
+	subject *ExchangeSubject,
+) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(p.options.ExchangedTokenTtl)
+	if subject.ExpiresAt.Before(expiresAt) {
+		expiresAt = subject.ExpiresAt
+	}
+
+	actor := map[string]any{"sub": client.ID}
+	if subject.Actor != nil {
+		actor["act"] = subject.Actor
+	}
+
+	token, err := p.options.SigningKey.Sign(AccessTokenType, jwt.MapClaims{
+		"iss":       p.options.Issuer,
+		"sub":       user.ID.String(),
+		"aud":       audience,
+		"userId":    user.ID.String(),
+		"userEmail": user.Email,
+		"role":      user.Role,
+		"client_id": client.ID,
+		"scope":     strings.Join(scopes, " "),
+		"act":       actor,
+		"jti":       uuid.New().String(),
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", expiresAt, err
+	}
+
+	return token, expiresAt, nil
+}
+
+// ParseExchangedToken validates a delegated token of the audience, so the receiving service exchanges it again.
+func (p *Provider) ParseExchangedToken(tokenStr string, audience string) (*ExchangeSubject, error) {
+	claims := jwt.MapClaims{}
+	token, err := p.options.SigningKey.Parse(tokenStr, claims)
+	if err != nil || token == nil || !token.Valid {
+		return nil, fmt.Errorf("invalid exchanged token: %w", err)
+	}
+	if !claims.VerifyIssuer(p.options.Issuer, true) || !claims.VerifyAudience(audience, true) {
+		return nil, fmt.Errorf("exchanged token is not issued for %s", audience)
+	}
+
+	actor, ok := claims["act"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("token has no act claim")
+	}
+	userIdStr, _ := claims["userId"].(string)
+	userId, err := uuid.Parse(userIdStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse userId claim")
+	}
+	exp, _ := claims["exp"].(float64)
+
+	return &ExchangeSubject{
+		UserId:    userId,
+		ExpiresAt: time.Unix(int64(exp), 0),
+		Actor:     actor,
+	}, nil
+}
@@ -0,0 +1,116 @@
+package oidc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+)
+
+func TestExchangedToken(t *testing.T) {
+	p := testProvider(t)
+	client := &model.OauthClient{ID: "billing"}
+	user := testUser()
+
+	tests := []struct {
+		name      string
+		subject   ExchangeSubject
+		audience  string
+		parsedBy  string
+		expiresIn time.Duration
+		// actors along the call chain, the acting client first
+		actors []string
+		ok     bool
+	}{
+		{
+			name:      "user token",
+			subject:   ExchangeSubject{UserId: user.ID, ExpiresAt: time.Now().Add(time.Hour)},
+			audience:  "orders",
+			parsedBy:  "orders",
+			expiresIn: 5 * time.Minute,
+			actors:    []string{"billing"},
+			ok:        true,
+		},
+		{
+			name:      "subject expiring sooner",
+			subject:   ExchangeSubject{UserId: user.ID, ExpiresAt: time.Now().Add(time.Minute)},
+			audience:  "orders",
+			parsedBy:  "orders",
+			expiresIn: time.Minute,
+			actors:    []string{"billing"},
+			ok:        true,
+		},
+		{
+			name:      "exchanged token",
+			subject:   ExchangeSubject{UserId: user.ID, ExpiresAt: time.Now().Add(time.Hour), Actor: map[string]any{"sub": "gateway"}},
+			audience:  "orders",
+			parsedBy:  "orders",
+			expiresIn: 5 * time.Minute,
+			actors:    []string{"billing", "gateway"},
+			ok:        true,
+		},
+		{
+			name:      "other audience",
+			subject:   ExchangeSubject{UserId: user.ID, ExpiresAt: time.Now().Add(time.Hour)},
+			audience:  "orders",
+			parsedBy:  "billing",
+			expiresIn: 5 * time.Minute,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			token, expiresAt, err := p.IssueExchangedToken(user, client, test.audience, []string{"users:read"}, &test.subject)
+			if err != nil {
+				t.Fatalf("failed to issue token: %v", err)
+			}
+			if until := time.Until(expiresAt); until > test.expiresIn || until < test.expiresIn-time.Minute {
+				t.Errorf("token expires in %s, want %s", until, test.expiresIn)
+			}
+
+			subject, err := p.ParseExchangedToken(token, test.parsedBy)
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if !test.ok {
+				return
+			}
+			if subject.UserId != user.ID || subject.ExpiresAt.Unix() != expiresAt.Unix() {
+				t.Errorf("got subject %+v, want user %s expiring at %s", subject, user.ID, expiresAt)
+			}
+			actor := subject.Actor
+			for _, want := range test.actors {
+				if actor == nil || actor["sub"] != want {
+					t.Fatalf("got actor %v, want %s", actor, want)
+				}
+				actor, _ = actor["act"].(map[string]any)
+			}
+			if actor != nil {
+				t.Fatalf("got unexpected actor %v", actor)
+			}
+		})
+	}
+}
+
+func TestParseExchangedTokenWithoutActor(t *testing.T) {
+	p := testProvider(t)
+	user := testUser()
+
+	// Tokens of the provider without `act` are user tokens, they are not exchanged as delegated ones
+	token, err := p.options.SigningKey.Sign(AccessTokenType, jwt.MapClaims{
+		"iss":    p.options.Issuer,
+		"aud":    "orders",
+		"userId": user.ID.String(),
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	if _, err := p.ParseExchangedToken(token, "orders"); err == nil {
+		t.Fatal("token without act claim is accepted")
+	}
+}
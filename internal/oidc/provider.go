@@ -0,0 +1,149 @@
+package oidc
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+const (
+	DiscoveryPath = "/.well-known/openid-configuration"
+	AuthorizePath = "/oauth2/authorize"
+	TokenPath     = "/oauth2/token"
+	UserInfoPath  = "/oauth2/userinfo"
+	JwksPath      = "/oauth2/jwks"
+)
+
+const (
+	ScopeOpenId  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopePhone   = "phone"
+)
+
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+)
+
+var supportedScopes = []string{ScopeOpenId, ScopeProfile, ScopeEmail, ScopePhone}
+
+// GrantTypes supported by the token endpoint.
+var GrantTypes = []string{GrantAuthorizationCode, GrantClientCredentials}
+
+type ProviderOptions struct {
+	// Issuer is the public base URL of the service, e.g. `https://auth.example.com`.
+	Issuer     string
+	SigningKey *jwt_tool.SigningKey
+	// LoginUrl of the client application page which signs the user in and completes the authorization request.
+	LoginUrl string
+	// CodeTtl is the lifetime of authorization codes.
+	CodeTtl time.Duration
+	// AccessTokenTtl is the lifetime of access and ID tokens.
+	AccessTokenTtl time.Duration
+	// ServiceTokenTtl is the lifetime of client credentials tokens.
+	ServiceTokenTtl time.Duration
+	// ExchangedTokenTtl is the lifetime of tokens issued by the token exchange.
+	ExchangedTokenTtl time.Duration
+}
+
+// Provider implements the OpenID Connect authorization code flow with PKCE over the existing users.
+// The user is signed in by the client application, which completes the request with the Authorize method.
+// Backend services get service tokens by the client credentials grant.
+type Provider struct {
+	options *ProviderOptions
+	db      *model.Queries
+	log     *zerolog.Logger
+}
+
+func NewProvider(options *ProviderOptions, db *model.Queries, log *zerolog.Logger) *Provider {
+	options.Issuer = strings.TrimRight(options.Issuer, "/")
+	if options.CodeTtl <= 0 {
+		options.CodeTtl = 5 * time.Minute
+	}
+	if options.AccessTokenTtl <= 0 {
+		options.AccessTokenTtl = time.Hour
+	}
+	if options.ServiceTokenTtl <= 0 {
+		options.ServiceTokenTtl = time.Hour
+	}
+	if options.ExchangedTokenTtl <= 0 {
+		options.ExchangedTokenTtl = 5 * time.Minute
+	}
+
+	return &Provider{
+		options: options,
+		db:      db,
+		log:     log,
+	}
+}
+
+// Register adds the provider endpoints to the HTTP server.
+func (p *Provider) Register(mux *http.ServeMux) {
+	mux.HandleFunc(DiscoveryPath, p.handleDiscovery)
+	mux.HandleFunc(JwksPath, p.handleJwks)
+	mux.HandleFunc(AuthorizePath, p.handleAuthorize)
+	mux.HandleFunc(TokenPath, p.handleToken)
+	mux.HandleFunc(UserInfoPath, p.handleUserInfo)
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, map[string]any{
+		"issuer":                                p.options.Issuer,
+		"authorization_endpoint":                p.options.Issuer + AuthorizePath,
+		"token_endpoint":                        p.options.Issuer + TokenPath,
+		"userinfo_endpoint":                     p.options.Issuer + UserInfoPath,
+		"jwks_uri":                              p.options.Issuer + JwksPath,
+		"scopes_supported":                      supportedScopes,
+		"response_types_supported":              []string{"code"},
+		"response_modes_supported":              []string{"query"},
+		"grant_types_supported":                 GrantTypes,
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce",
+			"name", "email", "email_verified", "phone_number", "phone_number_verified",
+		},
+	})
+}
+
+func (p *Provider) handleJwks(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, p.options.SigningKey.Jwks())
+}
+
+// Error is an OAuth 2.0 error response, see RFC 6749 section 5.2.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+func newError(code string, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func (p *Provider) writeError(w http.ResponseWriter, status int, err *Error) {
+	p.log.Warn().Msgf("OIDC request failed: %v", err)
+	writeJson(w, status, err)
+}
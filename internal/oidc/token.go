@@ -0,0 +1,262 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	tool "github.com/zs-dima/auth-service/pkg/tool"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+const AccessTokenType = "at+jwt"
+
+type tokenReply struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+	IdToken     string `json:"id_token,omitempty"`
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		p.writeError(w, http.StatusBadRequest, newError("invalid_request", err.Error()))
+		return
+	}
+
+	client, oauthErr := p.authenticateClient(r)
+	if oauthErr != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="oauth2"`)
+		p.writeError(w, http.StatusUnauthorized, oauthErr)
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if !slices.Contains(GrantTypes, grantType) {
+		p.writeError(w, http.StatusBadRequest, newError("unsupported_grant_type", ""))
+		return
+	}
+	if !slices.Contains(client.GrantTypes, grantType) {
+		p.writeError(w, http.StatusBadRequest, newError("unauthorized_client", grantType+" grant is not allowed"))
+		return
+	}
+
+	switch grantType {
+	case GrantAuthorizationCode:
+		p.exchangeAuthorizationCode(w, r, client)
+	case GrantClientCredentials:
+		p.issueServiceToken(w, r, client)
+	}
+}
+
+// authenticateClient accepts client_secret_basic, client_secret_post or a public client id without secret.
+func (p *Provider) authenticateClient(r *http.Request) (*model.OauthClient, *Error) {
+	clientId, clientSecret, basic := r.BasicAuth()
+	if !basic {
+		clientId = r.PostForm.Get("client_id")
+		clientSecret = r.PostForm.Get("client_secret")
+	}
+	if clientId == "" {
+		return nil, newError("invalid_client", "client authentication is required")
+	}
+
+	client, err := p.db.GetOAuthClient(r.Context(), clientId)
+	if err != nil {
+		return nil, newError("invalid_client", "unknown client")
+	}
+
+	if client.SecretHash.Valid {
+		encryptor := tool.Encryptor{}
+		if clientSecret == "" || !encryptor.Validate(clientSecret, client.SecretHash.String) {
+			return nil, newError("invalid_client", "invalid client secret")
+		}
+	}
+
+	return &client, nil
+}
+
+func (p *Provider) exchangeAuthorizationCode(w http.ResponseWriter, r *http.Request, client *model.OauthClient) {
+	ctx := r.Context()
+
+	// Code is single use, it is consumed even when the request turns out to be invalid
+	code, err := p.db.ConsumeOAuthAuthorizationCode(ctx, tool.HashToken(r.PostForm.Get("code")))
+	if err != nil {
+		p.writeError(w, http.StatusBadRequest, newError("invalid_grant", "code is invalid or expired"))
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectUri != r.PostForm.Get("redirect_uri") {
+		p.writeError(w, http.StatusBadRequest, newError("invalid_grant", "code was issued to another client or redirect_uri"))
+		return
+	}
+	if !verifyCodeChallenge(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		p.writeError(w, http.StatusBadRequest, newError("invalid_grant", "code_verifier does not match"))
+		return
+	}
+
+	user, err := p.db.GetActiveUserById(ctx, code.UserID)
+	if err != nil {
+		p.writeError(w, http.StatusBadRequest, newError("invalid_grant", "user is not active"))
+		return
+	}
+
+	reply, err := p.issueTokens(ctx, client, &user, strings.Fields(code.Scope), code.Nonce.String)
+	if err != nil {
+		p.log.Error().Msgf("Failed to issue OIDC tokens to %s for %s: %v", client.ID, user.Email, err)
+		p.writeError(w, http.StatusInternalServerError, newError("server_error", ""))
+		return
+	}
+
+	p.log.Info().Msgf("OIDC tokens issued to %s for %s", client.ID, user.Email)
+
+	w.Header().Set("Pragma", "no-cache")
+	writeJson(w, http.StatusOK, reply)
+}
+
+// issueServiceToken issues a token of the client itself, it is accepted by the audience of the client.
+func (p *Provider) issueServiceToken(w http.ResponseWriter, r *http.Request, client *model.OauthClient) {
+	if !client.SecretHash.Valid {
+		p.writeError(w, http.StatusUnauthorized, newError("invalid_client", "public clients can not use client credentials"))
+		return
+	}
+
+	scopes := client.Scopes
+	if requested := strings.Fields(r.PostForm.Get("scope")); len(requested) > 0 {
+		for _, scope := range requested {
+			if !slices.Contains(client.Scopes, scope) {
+				p.writeError(w, http.StatusBadRequest, newError("invalid_scope", "scope "+scope+" is not allowed"))
+				return
+			}
+		}
+		scopes = requested
+	}
+
+	now := time.Now()
+	scope := strings.Join(scopes, " ")
+
+	accessToken, err := p.options.SigningKey.Sign(AccessTokenType, jwt.MapClaims{
+		"iss":       p.options.Issuer,
+		"sub":       client.ID,
+		"aud":       client.Audience,
+		"client_id": client.ID,
+		"principal": jwt_tool.PrincipalClient,
+		"scope":     scope,
+		"jti":       uuid.New().String(),
+		"iat":       now.Unix(),
+		"exp":       now.Add(p.options.ServiceTokenTtl).Unix(),
+	})
+	if err != nil {
+		p.log.Error().Msgf("Failed to issue service token to %s: %v", client.ID, err)
+		p.writeError(w, http.StatusInternalServerError, newError("server_error", ""))
+		return
+	}
+
+	p.log.Info().Msgf("Service token issued to %s", client.ID)
+
+	w.Header().Set("Pragma", "no-cache")
+	writeJson(w, http.StatusOK, &tokenReply{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(p.options.ServiceTokenTtl.Seconds()),
+		Scope:       scope,
+	})
+}
+
+func (p *Provider) issueTokens(
+	ctx context.Context,
+	client *model.OauthClient,
+	user *model.User,
+	scopes []string,
+	nonce string,
+) (*tokenReply, error) {
+	now := time.Now()
+	expiresAt := now.Add(p.options.AccessTokenTtl)
+	scope := strings.Join(scopes, " ")
+
+	accessToken, err := p.options.SigningKey.Sign(AccessTokenType, jwt.MapClaims{
+		"iss":       p.options.Issuer,
+		"sub":       user.ID.String(),
+		"aud":       client.ID,
+		"client_id": client.ID,
+		"scope":     scope,
+		"jti":       uuid.New().String(),
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	idClaims := jwt.MapClaims{
+		"iss":     p.options.Issuer,
+		"sub":     user.ID.String(),
+		"aud":     client.ID,
+		"iat":     now.Unix(),
+		"exp":     expiresAt.Unix(),
+		"at_hash": accessTokenHash(accessToken),
+	}
+	if nonce != "" {
+		idClaims["nonce"] = nonce
+	}
+	for name, value := range userClaims(user, scopes) {
+		idClaims[name] = value
+	}
+
+	idToken, err := p.options.SigningKey.Sign("JWT", idClaims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenReply{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(p.options.AccessTokenTtl.Seconds()),
+		Scope:       scope,
+		IdToken:     idToken,
+	}, nil
+}
+
+// userClaims returns the standard claims of the user allowed by the scopes.
+func userClaims(user *model.User, scopes []string) map[string]any {
+	claims := map[string]any{}
+	if slices.Contains(scopes, ScopeProfile) {
+		claims["name"] = user.Name
+	}
+	if slices.Contains(scopes, ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerifiedAt.Valid
+	}
+	if slices.Contains(scopes, ScopePhone) && user.Phone.Valid {
+		claims["phone_number"] = user.Phone.String
+		claims["phone_number_verified"] = user.PhoneVerifiedAt.Valid
+	}
+	return claims
+}
+
+func verifyCodeChallenge(verifier string, challenge string) bool {
+	if verifier == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// accessTokenHash is the at_hash claim: left half of the SHA-256 hash of the access token.
+func accessTokenHash(accessToken string) string {
+	hash := sha256.Sum256([]byte(accessToken))
+	return base64.RawURLEncoding.EncodeToString(hash[:len(hash)/2])
+}
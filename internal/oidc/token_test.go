@@ -0,0 +1,331 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/rs/zerolog"
+
+	model "github.com/zs-dima/auth-service/internal/gen/db"
+	jwt_tool "github.com/zs-dima/auth-service/pkg/tool/jwt"
+)
+
+const (
+	testIssuer = "https://auth.example.com"
+	// testCodeVerifier and its S256 challenge, BASE64URL(SHA256(verifier))
+	testCodeVerifier  = "dBjftJeZ4CVP-mJ92IXmUyFgY3pUlsaL1fGOHBA9-TpA"
+	testCodeChallenge = "1Cfx2dhMspVNB3Nik230_iuRLQF3NTQEYB8MwV-Uch4"
+)
+
+func testProvider(t *testing.T) *Provider {
+	t.Helper()
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	log := zerolog.Nop()
+	return NewProvider(
+		&ProviderOptions{
+			Issuer:     testIssuer + "/",
+			SigningKey: &jwt_tool.SigningKey{Id: "test", PrivateKey: privateKey},
+		},
+		nil,
+		&log,
+	)
+}
+
+func testUser() *model.User {
+	return &model.User{
+		ID:              uuid.New(),
+		Role:            model.UserRoleUser,
+		Name:            "Test User",
+		Email:           "user@example.com",
+		EmailVerifiedAt: pgtype.Timestamp{Time: time.Now(), Valid: true},
+		Phone:           pgtype.Text{String: "+14155552671", Valid: true},
+	}
+}
+
+func parseClaims(t *testing.T, p *Provider, tokenStr string) (jwt.MapClaims, *jwt.Token) {
+	t.Helper()
+	claims := jwt.MapClaims{}
+	token, err := p.options.SigningKey.Parse(tokenStr, claims)
+	if err != nil || !token.Valid {
+		t.Fatalf("failed to parse token: %v", err)
+	}
+	return claims, token
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	hash := sha256.Sum256([]byte(testCodeVerifier))
+	if challenge := base64.RawURLEncoding.EncodeToString(hash[:]); challenge != testCodeChallenge {
+		t.Fatalf("test challenge %s does not match the verifier, want %s", testCodeChallenge, challenge)
+	}
+
+	tests := []struct {
+		name      string
+		verifier  string
+		challenge string
+		ok        bool
+	}{
+		{"matching verifier", testCodeVerifier, testCodeChallenge, true},
+		{"other verifier", testCodeVerifier + "x", testCodeChallenge, false},
+		{"plain challenge", testCodeVerifier, testCodeVerifier, false},
+		{"padded challenge", testCodeVerifier, testCodeChallenge + "=", false},
+		{"empty verifier", "", testCodeChallenge, false},
+		{"empty verifier and challenge", "", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := verifyCodeChallenge(test.verifier, test.challenge); ok != test.ok {
+				t.Fatalf("got %v, want %v", ok, test.ok)
+			}
+		})
+	}
+}
+
+func TestAccessTokenHash(t *testing.T) {
+	hash := accessTokenHash("access-token")
+
+	decoded, err := base64.RawURLEncoding.DecodeString(hash)
+	if err != nil {
+		t.Fatalf("at_hash %s is not base64url: %v", hash, err)
+	}
+	full := sha256.Sum256([]byte("access-token"))
+	if string(decoded) != string(full[:16]) {
+		t.Fatalf("at_hash is not the left half of the SHA-256 hash")
+	}
+	if accessTokenHash("other-token") == hash {
+		t.Fatalf("at_hash of other token is the same")
+	}
+}
+
+func TestUserClaims(t *testing.T) {
+	user := testUser()
+
+	tests := []struct {
+		name   string
+		scopes []string
+		claims []string
+	}{
+		{"openid only", []string{ScopeOpenId}, nil},
+		{"profile", []string{ScopeOpenId, ScopeProfile}, []string{"name"}},
+		{"email", []string{ScopeOpenId, ScopeEmail}, []string{"email", "email_verified"}},
+		{"phone", []string{ScopeOpenId, ScopePhone}, []string{"phone_number", "phone_number_verified"}},
+		{
+			"all scopes",
+			[]string{ScopeOpenId, ScopeProfile, ScopeEmail, ScopePhone},
+			[]string{"name", "email", "email_verified", "phone_number", "phone_number_verified"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			claims := userClaims(user, test.scopes)
+
+			if len(claims) != len(test.claims) {
+				t.Fatalf("got claims %v, want %v", claims, test.claims)
+			}
+			for _, name := range test.claims {
+				if _, ok := claims[name]; !ok {
+					t.Errorf("claim %s is missing in %v", name, claims)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthorizationRequestRedirect(t *testing.T) {
+	tests := []struct {
+		name        string
+		redirectUri string
+		state       string
+		err         *Error
+		want        string
+	}{
+		{"code", "https://app.example.com/callback", "xyz", nil, "https://app.example.com/callback?code=abc&state=xyz"},
+		{"code without state", "https://app.example.com/callback", "", nil, "https://app.example.com/callback?code=abc"},
+		{"redirect URI with query", "https://app.example.com/callback?tenant=1", "xyz", nil, "https://app.example.com/callback?tenant=1&code=abc&state=xyz"},
+		{"error", "https://app.example.com/callback", "xyz", newError("access_denied", ""), "https://app.example.com/callback?error=access_denied&state=xyz"},
+		{
+			"error with description",
+			"https://app.example.com/callback",
+			"",
+			newError("invalid_scope", "scope admin is not allowed"),
+			"https://app.example.com/callback?error=invalid_scope&error_description=scope+admin+is+not+allowed",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := &AuthorizationRequest{RedirectUri: test.redirectUri, State: test.state}
+
+			var redirect string
+			if test.err != nil {
+				redirect = request.errorRedirect(test.err)
+			} else {
+				redirect = request.redirect(url.Values{"code": {"abc"}})
+			}
+
+			if redirect != test.want {
+				t.Fatalf("got %s, want %s", redirect, test.want)
+			}
+		})
+	}
+}
+
+func TestIssueTokens(t *testing.T) {
+	p := testProvider(t)
+	user := testUser()
+	client := &model.OauthClient{ID: "web"}
+
+	tests := []struct {
+		name   string
+		scopes []string
+		nonce  string
+	}{
+		{"with nonce", []string{ScopeOpenId, ScopeEmail}, "n-0S6_WzA2Mj"},
+		{"without nonce", []string{ScopeOpenId}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply, err := p.issueTokens(nil, client, user, test.scopes, test.nonce)
+			if err != nil {
+				t.Fatalf("failed to issue tokens: %v", err)
+			}
+
+			accessClaims, accessToken := parseClaims(t, p, reply.AccessToken)
+			if accessToken.Header["typ"] != AccessTokenType {
+				t.Errorf("got access token typ %v, want %s", accessToken.Header["typ"], AccessTokenType)
+			}
+			if accessClaims["iss"] != testIssuer || accessClaims["aud"] != client.ID || accessClaims["sub"] != user.ID.String() {
+				t.Errorf("unexpected access token claims %v", accessClaims)
+			}
+			if accessClaims["scope"] != strings.Join(test.scopes, " ") {
+				t.Errorf("got scope %v, want %s", accessClaims["scope"], strings.Join(test.scopes, " "))
+			}
+
+			idClaims, idToken := parseClaims(t, p, reply.IdToken)
+			if idToken.Header["typ"] == AccessTokenType {
+				t.Errorf("ID token must not be accepted as an access token")
+			}
+			if idClaims["at_hash"] != accessTokenHash(reply.AccessToken) {
+				t.Errorf("got at_hash %v, want %s", idClaims["at_hash"], accessTokenHash(reply.AccessToken))
+			}
+			if nonce, _ := idClaims["nonce"].(string); nonce != test.nonce {
+				t.Errorf("got nonce %q, want %q", nonce, test.nonce)
+			}
+		})
+	}
+}
+
+func TestIssueServiceToken(t *testing.T) {
+	p := testProvider(t)
+	client := &model.OauthClient{
+		ID:         "billing",
+		SecretHash: pgtype.Text{String: "hash", Valid: true},
+		Scopes:     []string{"users:read", "token:exchange"},
+		Audience:   "auth-service",
+	}
+	publicClient := &model.OauthClient{ID: "spa", Scopes: []string{"users:read"}, Audience: "auth-service"}
+
+	tests := []struct {
+		name   string
+		client *model.OauthClient
+		scope  string
+		status int
+		want   string
+	}{
+		{"client scopes by default", client, "", http.StatusOK, "users:read token:exchange"},
+		{"requested scope", client, "users:read", http.StatusOK, "users:read"},
+		{"scope of other client", client, "users:write", http.StatusBadRequest, ""},
+		{"public client", publicClient, "", http.StatusUnauthorized, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			form := url.Values{"grant_type": {GrantClientCredentials}}
+			if test.scope != "" {
+				form.Set("scope", test.scope)
+			}
+			r := httptest.NewRequest(http.MethodPost, TokenPath, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if err := r.ParseForm(); err != nil {
+				t.Fatalf("failed to parse form: %v", err)
+			}
+			w := httptest.NewRecorder()
+
+			p.issueServiceToken(w, r, test.client)
+
+			if w.Code != test.status {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.status, w.Body)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+
+			reply := tokenReply{}
+			if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+				t.Fatalf("failed to decode reply: %v", err)
+			}
+			claims, _ := parseClaims(t, p, reply.AccessToken)
+			if claims["scope"] != test.want || reply.Scope != test.want {
+				t.Errorf("got scope %v, want %s", claims["scope"], test.want)
+			}
+			if claims["sub"] != client.ID || claims["aud"] != client.Audience || claims["principal"] != jwt_tool.PrincipalClient {
+				t.Errorf("unexpected service token claims %v", claims)
+			}
+		})
+	}
+}
+
+func TestValidateAccessToken(t *testing.T) {
+	p := testProvider(t)
+
+	sign := func(typ string, claims jwt.MapClaims) string {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := p.options.SigningKey.Sign(typ, claims)
+		if err != nil {
+			t.Fatalf("failed to sign token: %v", err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		ok            bool
+	}{
+		{"provider audience", "Bearer " + sign(AccessTokenType, jwt.MapClaims{"iss": testIssuer, "aud": testIssuer}), true},
+		{"ID token", "Bearer " + sign("JWT", jwt.MapClaims{"iss": testIssuer, "aud": testIssuer}), false},
+		{"other issuer", "Bearer " + sign(AccessTokenType, jwt.MapClaims{"iss": "https://evil.example.com", "aud": testIssuer}), false},
+		{"missing audience", "Bearer " + sign(AccessTokenType, jwt.MapClaims{"iss": testIssuer}), false},
+		{"audience list", "Bearer " + sign(AccessTokenType, jwt.MapClaims{"iss": testIssuer, "aud": []string{"billing", "orders"}}), false},
+		{"missing bearer", sign(AccessTokenType, jwt.MapClaims{"iss": testIssuer, "aud": testIssuer}), false},
+		{"malformed token", "Bearer abc", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, UserInfoPath, nil)
+			r.Header.Set("Authorization", test.authorization)
+
+			if _, ok := p.validateAccessToken(r); ok != test.ok {
+				t.Fatalf("got %v, want %v", ok, test.ok)
+			}
+		})
+	}
+}
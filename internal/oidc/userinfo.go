@@ -0,0 +1,75 @@
+package oidc
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+func (p *Provider) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	claims, ok := p.validateAccessToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		p.writeError(w, http.StatusUnauthorized, newError("invalid_token", ""))
+		return
+	}
+
+	sub, _ := claims["sub"].(string)
+	userId, err := uuid.Parse(sub)
+	if err != nil {
+		p.writeError(w, http.StatusUnauthorized, newError("invalid_token", "invalid subject"))
+		return
+	}
+
+	user, err := p.db.GetActiveUserById(r.Context(), userId)
+	if err != nil {
+		p.writeError(w, http.StatusUnauthorized, newError("invalid_token", "user is not active"))
+		return
+	}
+
+	scope, _ := claims["scope"].(string)
+	reply := userClaims(&user, strings.Fields(scope))
+	reply["sub"] = sub
+
+	writeJson(w, http.StatusOK, reply)
+}
+
+// validateAccessToken checks the Bearer access token issued by the token endpoint.
+// The audience is this provider or a registered client, tokens issued for other services are rejected.
+func (p *Provider) validateAccessToken(r *http.Request) (jwt.MapClaims, bool) {
+	tokenStr, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := p.options.SigningKey.Parse(tokenStr, claims)
+	if err != nil || !token.Valid || token.Header["typ"] != AccessTokenType {
+		return nil, false
+	}
+
+	// Parse validates exp, the issuer and the audience are checked explicitly
+	if !claims.VerifyIssuer(p.options.Issuer, true) {
+		return nil, false
+	}
+	if claims.VerifyAudience(p.options.Issuer, true) {
+		return claims, true
+	}
+
+	audience, _ := claims["aud"].(string)
+	if audience == "" {
+		return nil, false
+	}
+	if _, err := p.db.GetOAuthClient(r.Context(), audience); err != nil {
+		return nil, false
+	}
+
+	return claims, true
+}
@@ -0,0 +1,199 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+type Options struct {
+	// PollInterval between outbox checks when no new messages are queued.
+	PollInterval time.Duration
+	// Lease is how long a claimed message is hidden from other workers while being delivered.
+	Lease time.Duration
+	// BatchSize is the number of messages claimed at once.
+	BatchSize int32
+	// MaxAttempts before the message is marked as failed.
+	MaxAttempts int32
+	// MinBackoff is the delay after the first failure, doubled with each attempt up to MaxBackoff.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retention of delivered and failed messages.
+	Retention time.Duration
+	// PurgeInterval between deletions of messages older than Retention.
+	PurgeInterval time.Duration
+}
+
+// SetDefaults replaces the unset options by the defaults.
+func (o *Options) SetDefaults(defaults *Options) {
+	if o.PollInterval <= 0 {
+		o.PollInterval = defaults.PollInterval
+	}
+	if o.Lease <= 0 {
+		o.Lease = defaults.Lease
+	}
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaults.BatchSize
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = defaults.MaxAttempts
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = defaults.MinBackoff
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = defaults.MaxBackoff
+	}
+	if o.Retention <= 0 {
+		o.Retention = defaults.Retention
+	}
+	if o.PurgeInterval <= 0 {
+		o.PurgeInterval = defaults.PurgeInterval
+	}
+}
+
+// Message is a claimed row of the outbox table.
+type Message[T any] struct {
+	Id uuid.UUID
+	// Attempts made before the current one.
+	Attempts int32
+	Value    T
+}
+
+// Store is the Postgres table of the outbox.
+type Store[T any] struct {
+	// Claim hides due messages from other workers for the lease.
+	Claim func(ctx context.Context, lease time.Duration, batchSize int32) ([]Message[T], error)
+	// MarkDelivered records the delivery, the message is not claimed again.
+	MarkDelivered func(ctx context.Context, id uuid.UUID) error
+	// MarkFailed records the failed attempt, the message is retried at nextAttemptAt unless failed is set.
+	MarkFailed func(ctx context.Context, id uuid.UUID, lastError string, nextAttemptAt time.Time, failed bool) error
+	// Purge deletes delivered and failed messages older than the retention.
+	Purge func(ctx context.Context, retention time.Duration) (int64, error)
+}
+
+// DeliverFunc delivers the message, errors are retried with exponential backoff.
+type DeliverFunc[T any] func(ctx context.Context, message *Message[T]) error
+
+// Worker delivers messages queued in Postgres, so sending never blocks or fails the change because of the receiver.
+// Messages are claimed with a lease, so several instances of the service share the outbox.
+type Worker[T any] struct {
+	// name of the outbox in logs, e.g. `mail`
+	name    string
+	store   *Store[T]
+	deliver DeliverFunc[T]
+	options *Options
+	log     *zerolog.Logger
+	notify  chan struct{}
+}
+
+func NewWorker[T any](name string, store *Store[T], deliver DeliverFunc[T], options *Options, log *zerolog.Logger) *Worker[T] {
+	return &Worker[T]{
+		name:    name,
+		store:   store,
+		deliver: deliver,
+		options: options,
+		log:     log,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Notify wakes up the worker without waiting for the next poll.
+func (w *Worker[T]) Notify() {
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers queued messages and purges old ones until the context is cancelled.
+func (w *Worker[T]) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.options.PollInterval)
+	defer ticker.Stop()
+	purgeTicker := time.NewTicker(w.options.PurgeInterval)
+	defer purgeTicker.Stop()
+
+	w.purge(ctx)
+	for {
+		w.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.notify:
+		case <-purgeTicker.C:
+			w.purge(ctx)
+		}
+	}
+}
+
+func (w *Worker[T]) deliverDue(ctx context.Context) {
+	for {
+		messages, err := w.store.Claim(ctx, w.options.Lease, w.options.BatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				w.log.Error().Msgf("Failed to claim %s outbox: %v", w.name, err)
+			}
+			return
+		}
+
+		for i := range messages {
+			w.deliverMessage(ctx, &messages[i])
+		}
+
+		if int32(len(messages)) < w.options.BatchSize {
+			return
+		}
+	}
+}
+
+func (w *Worker[T]) deliverMessage(ctx context.Context, message *Message[T]) {
+	err := w.deliver(ctx, message)
+	if err == nil {
+		if err = w.store.MarkDelivered(ctx, message.Id); err != nil {
+			w.log.Error().Msgf("Failed to mark %s %s as delivered: %v", w.name, message.Id, err)
+		}
+		return
+	}
+
+	attempts := message.Attempts + 1
+	failed := attempts >= w.options.MaxAttempts
+	if failed {
+		w.log.Error().Msgf("Failed to deliver %s %s, giving up after %d attempts: %v", w.name, message.Id, attempts, err)
+	} else {
+		w.log.Warn().Msgf("Failed to deliver %s %s, attempt %d: %v", w.name, message.Id, attempts, err)
+	}
+
+	err = w.store.MarkFailed(ctx, message.Id, err.Error(), time.Now().Add(w.backoff(attempts)), failed)
+	if err != nil {
+		w.log.Error().Msgf("Failed to mark %s %s attempt: %v", w.name, message.Id, err)
+	}
+}
+
+// purge deletes delivered and failed messages older than the retention.
+func (w *Worker[T]) purge(ctx context.Context) {
+	purged, err := w.store.Purge(ctx, w.options.Retention)
+	if err != nil {
+		if ctx.Err() == nil {
+			w.log.Error().Msgf("Failed to purge %s outbox: %v", w.name, err)
+		}
+		return
+	}
+	if purged > 0 {
+		w.log.Info().Msgf("Purged %d messages from %s outbox", purged, w.name)
+	}
+}
+
+func (w *Worker[T]) backoff(attempts int32) time.Duration {
+	backoff := w.options.MinBackoff
+	for i := int32(1); i < attempts && backoff < w.options.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > w.options.MaxBackoff {
+		backoff = w.options.MaxBackoff
+	}
+	return backoff
+}
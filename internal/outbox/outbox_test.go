@@ -0,0 +1,262 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+// testStore keeps the outbox in memory and records the calls of the worker.
+type testStore struct {
+	queued    []Message[string]
+	claims    int
+	delivered []uuid.UUID
+	failed    map[uuid.UUID]bool
+	// nextAttempts of the failed messages
+	nextAttempts map[uuid.UUID]time.Time
+	retention    time.Duration
+}
+
+func newTestStore(messages ...Message[string]) *testStore {
+	return &testStore{
+		queued:       messages,
+		failed:       make(map[uuid.UUID]bool),
+		nextAttempts: make(map[uuid.UUID]time.Time),
+	}
+}
+
+func (s *testStore) store() *Store[string] {
+	return &Store[string]{
+		Claim: func(ctx context.Context, lease time.Duration, batchSize int32) ([]Message[string], error) {
+			s.claims++
+			n := int(batchSize)
+			if n > len(s.queued) {
+				n = len(s.queued)
+			}
+			claimed := s.queued[:n]
+			s.queued = s.queued[n:]
+			return claimed, nil
+		},
+		MarkDelivered: func(ctx context.Context, id uuid.UUID) error {
+			s.delivered = append(s.delivered, id)
+			return nil
+		},
+		MarkFailed: func(ctx context.Context, id uuid.UUID, lastError string, nextAttemptAt time.Time, failed bool) error {
+			s.failed[id] = failed
+			s.nextAttempts[id] = nextAttemptAt
+			return nil
+		},
+		Purge: func(ctx context.Context, retention time.Duration) (int64, error) {
+			s.retention = retention
+			return 0, nil
+		},
+	}
+}
+
+func testOptions() *Options {
+	options := &Options{BatchSize: 2, MaxAttempts: 3}
+	options.SetDefaults(&Options{
+		PollInterval:  time.Second,
+		Lease:         time.Minute,
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Minute,
+		Retention:     time.Hour,
+		PurgeInterval: time.Hour,
+	})
+	return options
+}
+
+func TestSetDefaults(t *testing.T) {
+	defaults := Options{
+		PollInterval:  time.Second,
+		Lease:         time.Minute,
+		BatchSize:     10,
+		MaxAttempts:   8,
+		MinBackoff:    30 * time.Second,
+		MaxBackoff:    time.Hour,
+		Retention:     24 * time.Hour,
+		PurgeInterval: time.Hour,
+	}
+	configured := Options{
+		PollInterval:  5 * time.Second,
+		Lease:         10 * time.Second,
+		BatchSize:     50,
+		MaxAttempts:   3,
+		MinBackoff:    time.Second,
+		MaxBackoff:    time.Minute,
+		Retention:     time.Hour,
+		PurgeInterval: time.Minute,
+	}
+
+	tests := []struct {
+		name    string
+		options Options
+		want    Options
+	}{
+		{"unset", Options{}, defaults},
+		{"negative", Options{PollInterval: -1, BatchSize: -1, Retention: -1}, defaults},
+		{"configured", configured, configured},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := test.options
+			options.SetDefaults(&defaults)
+
+			if options != test.want {
+				t.Fatalf("got %+v, want %+v", options, test.want)
+			}
+		})
+	}
+}
+
+func TestWorkerBackoff(t *testing.T) {
+	worker := NewWorker[string]("test", nil, nil, &Options{MinBackoff: 30 * time.Second, MaxBackoff: 5 * time.Minute}, nil)
+
+	tests := []struct {
+		attempts int32
+		backoff  time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if backoff := worker.backoff(test.attempts); backoff != test.backoff {
+			t.Errorf("backoff(%d) = %s, want %s", test.attempts, backoff, test.backoff)
+		}
+	}
+}
+
+func TestWorkerDeliver(t *testing.T) {
+	ok := Message[string]{Id: uuid.New(), Value: "ok"}
+	retried := Message[string]{Id: uuid.New(), Attempts: 1, Value: "error"}
+	givenUp := Message[string]{Id: uuid.New(), Attempts: 2, Value: "error"}
+
+	tests := []struct {
+		name     string
+		messages []Message[string]
+		// claims include the last claim of a partial batch
+		claims    int
+		delivered []uuid.UUID
+		failed    map[uuid.UUID]bool
+	}{
+		{
+			name:   "empty outbox",
+			claims: 1,
+			failed: map[uuid.UUID]bool{},
+		},
+		{
+			name:      "delivered",
+			messages:  []Message[string]{ok},
+			claims:    1,
+			delivered: []uuid.UUID{ok.Id},
+			failed:    map[uuid.UUID]bool{},
+		},
+		{
+			name:     "retried before max attempts",
+			messages: []Message[string]{retried},
+			claims:   1,
+			failed:   map[uuid.UUID]bool{retried.Id: false},
+		},
+		{
+			name:     "given up at max attempts",
+			messages: []Message[string]{givenUp},
+			claims:   1,
+			failed:   map[uuid.UUID]bool{givenUp.Id: true},
+		},
+		{
+			name:      "full batches claimed again",
+			messages:  []Message[string]{ok, retried, givenUp},
+			claims:    2,
+			delivered: []uuid.UUID{ok.Id},
+			failed:    map[uuid.UUID]bool{retried.Id: false, givenUp.Id: true},
+		},
+	}
+
+	log := zerolog.Nop()
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := newTestStore(test.messages...)
+			deliver := func(ctx context.Context, message *Message[string]) error {
+				if message.Value == "error" {
+					return errors.New("receiver is down")
+				}
+				return nil
+			}
+			worker := NewWorker("test", store.store(), deliver, testOptions(), &log)
+
+			start := time.Now()
+			worker.deliverDue(context.Background())
+
+			if store.claims != test.claims {
+				t.Errorf("got %d claims, want %d", store.claims, test.claims)
+			}
+			if len(store.delivered) != len(test.delivered) || (len(test.delivered) > 0 && store.delivered[0] != test.delivered[0]) {
+				t.Errorf("got delivered %v, want %v", store.delivered, test.delivered)
+			}
+			if len(store.failed) != len(test.failed) {
+				t.Fatalf("got failed %v, want %v", store.failed, test.failed)
+			}
+			for id, failed := range test.failed {
+				if store.failed[id] != failed {
+					t.Errorf("got %s failed %v, want %v", id, store.failed[id], failed)
+				}
+			}
+			if next, ok := store.nextAttempts[retried.Id]; ok && next.Sub(start) < worker.backoff(retried.Attempts+1) {
+				t.Errorf("got next attempt in %s, want backoff of %s", next.Sub(start), worker.backoff(retried.Attempts+1))
+			}
+		})
+	}
+}
+
+func TestWorkerRun(t *testing.T) {
+	store := newTestStore(Message[string]{Id: uuid.New()})
+	ctx, cancel := context.WithCancel(context.Background())
+	deliver := func(ctx context.Context, message *Message[string]) error {
+		// Stops the worker once the first message is delivered
+		cancel()
+		return nil
+	}
+	log := zerolog.Nop()
+	worker := NewWorker("test", store.store(), deliver, testOptions(), &log)
+
+	done := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker did not stop once the context was cancelled")
+	}
+	if store.retention != time.Hour {
+		t.Errorf("got purge retention %s, want %s", store.retention, time.Hour)
+	}
+	if len(store.delivered) != 1 {
+		t.Errorf("got %d delivered, want 1", len(store.delivered))
+	}
+}
+
+func TestWorkerNotify(t *testing.T) {
+	worker := NewWorker[string]("test", nil, nil, testOptions(), nil)
+
+	// Notifications queued while the worker is busy are coalesced and never block the caller
+	worker.Notify()
+	worker.Notify()
+
+	if pending := len(worker.notify); pending != 1 {
+		t.Fatalf("got %d pending notifications, want 1", pending)
+	}
+}
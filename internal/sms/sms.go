@@ -0,0 +1,76 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// SmsSender sends text messages such as one-time codes to phone numbers.
+type SmsSender interface {
+	Send(ctx context.Context, phone string, text string) error
+}
+
+// LogSender writes messages to the log instead of sending them, for development environments only as codes are secrets.
+type LogSender struct {
+	Log *zerolog.Logger
+}
+
+func NewLogSender(log *zerolog.Logger) *LogSender {
+	return &LogSender{
+		Log: log,
+	}
+}
+
+func (s *LogSender) Send(ctx context.Context, phone string, text string) error {
+	s.Log.Info().
+		Str("phone", phone).
+		Msg(text)
+	return nil
+}
+
+type fileMessage struct {
+	Phone  string    `json:"phone"`
+	Text   string    `json:"text"`
+	SentAt time.Time `json:"sent_at"`
+}
+
+// FileSender appends messages as JSON lines to a file, so tests could read the sent codes.
+type FileSender struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileSender(path string) *FileSender {
+	return &FileSender{
+		path: path,
+	}
+}
+
+func (s *FileSender) Send(ctx context.Context, phone string, text string) error {
+	line, err := json.Marshal(fileMessage{
+		Phone:  phone,
+		Text:   text,
+		SentAt: time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open sms file: %w", err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
@@ -0,0 +1,109 @@
+package sms
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func readMessages(t *testing.T, path string) []fileMessage {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	var messages []fileMessage
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		message := fileMessage{}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			t.Fatalf("failed to decode %q: %v", scanner.Text(), err)
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+func TestFileSender(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []fileMessage
+	}{
+		{"single message", []fileMessage{{Phone: "+14155552671", Text: "Your code is 123456"}}},
+		{
+			"messages are appended",
+			[]fileMessage{
+				{Phone: "+14155552671", Text: "Your code is 123456"},
+				{Phone: "+442071838750", Text: "Your code is 654321"},
+			},
+		},
+		{"text with new lines", []fileMessage{{Phone: "+14155552671", Text: "Code:\n123456"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sms.jsonl")
+			sender := NewFileSender(path)
+
+			for _, message := range test.messages {
+				if err := sender.Send(context.Background(), message.Phone, message.Text); err != nil {
+					t.Fatalf("failed to send: %v", err)
+				}
+			}
+
+			messages := readMessages(t, path)
+			if len(messages) != len(test.messages) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(test.messages))
+			}
+			for i, message := range messages {
+				if message.Phone != test.messages[i].Phone || message.Text != test.messages[i].Text || message.SentAt.IsZero() {
+					t.Errorf("message %d = %+v, want %+v", i, message, test.messages[i])
+				}
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("failed to stat %s: %v", path, err)
+			}
+			if mode := info.Mode().Perm(); mode&0o077 != 0 {
+				t.Errorf("got file mode %o, codes must not be readable by others", mode)
+			}
+		})
+	}
+}
+
+func TestFileSenderConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms.jsonl")
+	sender := NewFileSender(path)
+
+	const count = 50
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sender.Send(context.Background(), "+14155552671", "Your code is 123456"); err != nil {
+				t.Errorf("failed to send: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if messages := readMessages(t, path); len(messages) != count {
+		t.Fatalf("got %d messages, want %d", len(messages), count)
+	}
+}
+
+func TestFileSenderInvalidPath(t *testing.T) {
+	sender := NewFileSender(filepath.Join(t.TempDir(), "missing", "sms.jsonl"))
+
+	if err := sender.Send(context.Background(), "+14155552671", "Your code is 123456"); err == nil {
+		t.Fatal("got no error for a missing directory")
+	}
+}
@@ -62,6 +62,13 @@ func (s *GrpcStatusTool) Internal(
 	return s.status(codes.Internal, title, details)
 }
 
+func (s *GrpcStatusTool) FailedPrecondition(
+	title string,
+	details string,
+) error {
+	return s.status(codes.FailedPrecondition, title, details)
+}
+
 func (s *GrpcStatusTool) InvalidArgument(
 	title string,
 	details string,
@@ -69,6 +76,13 @@ func (s *GrpcStatusTool) InvalidArgument(
 	return s.status(codes.InvalidArgument, title, details)
 }
 
+func (s *GrpcStatusTool) ResourceExhausted(
+	title string,
+	details string,
+) error {
+	return s.status(codes.ResourceExhausted, title, details)
+}
+
 func (s *GrpcStatusTool) status(
 	code codes.Code,
 	title string,
@@ -0,0 +1,18 @@
+package tool
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// NormalizeEmail trims and lower-cases the email and checks it is a plain address, e.g. user@example.com.
+func NormalizeEmail(email string) (string, bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || address.Name != "" {
+		return email, false
+	}
+	_, domain, ok := strings.Cut(email, "@")
+	return email, ok && domain != ""
+}
@@ -0,0 +1,28 @@
+package tool
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		want  string
+		ok    bool
+	}{
+		{"user@example.com", "user@example.com", true},
+		{"  User@Example.COM ", "user@example.com", true},
+		{"", "", false},
+		{"   ", "", false},
+		{"user", "user", false},
+		{"user@", "user@", false},
+		{"@example.com", "@example.com", false},
+		{"User <user@example.com>", "user <user@example.com>", false},
+		{"user@example.com, other@example.com", "user@example.com, other@example.com", false},
+	}
+
+	for _, test := range tests {
+		email, ok := NormalizeEmail(test.email)
+		if email != test.want || ok != test.ok {
+			t.Errorf("NormalizeEmail(%q) = %q, %v, want %q, %v", test.email, email, ok, test.want, test.ok)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package tool
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 
 	"golang.org/x/crypto/bcrypt"
@@ -25,3 +27,10 @@ func (gen *Encryptor) Validate(token, hashedToken string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hashedToken), []byte(token))
 	return err == nil
 }
+
+// HashToken returns SHA-256 digest of a random high-entropy token.
+// Unlike bcrypt it is deterministic, so the hash could be used to look the token up.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
@@ -1,8 +1,11 @@
 package tool
 
 import (
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func GetFileValue(key string) string {
@@ -22,3 +25,42 @@ func GetFileValue(key string) string {
 	}
 	return value
 }
+
+// GetIntValue returns the integer value of the environment variable or the fallback when it is not set.
+func GetIntValue(key string, fallback int) (int, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid environment variable %s: %w", key, err)
+	}
+	return result, nil
+}
+
+// GetFloatValue returns the float value of the environment variable or the fallback when it is not set.
+func GetFloatValue(key string, fallback float64) (float64, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+	result, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid environment variable %s: %w", key, err)
+	}
+	return result, nil
+}
+
+// GetDurationValue returns the duration value (e.g. `15m`) of the environment variable or the fallback when it is not set.
+func GetDurationValue(key string, fallback time.Duration) (time.Duration, error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback, nil
+	}
+	result, err := time.ParseDuration(value)
+	if err != nil {
+		return fallback, fmt.Errorf("invalid environment variable %s: %w", key, err)
+	}
+	return result, nil
+}
@@ -1,6 +1,8 @@
 package jwt_tool
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 )
 
@@ -11,18 +13,73 @@ const (
 	Audience          = "auth-service"
 	UserClaimsKey key = iota
 	TokenLength   int = 54 // To ensure the base64-encoded string is ≤ 72 bytes supported by bcrypt
+	// PrincipalClient is the `principal` claim of service tokens issued to OAuth clients
+	PrincipalClient = "client"
+	// PrincipalServiceAccount is the `principal` claim of access tokens issued to service accounts
+	PrincipalServiceAccount = "service_account"
+)
+
+// Authentication methods of the `amr` claim, RFC 8176
+const (
+	AmrPassword   = "pwd"
+	AmrOtp        = "otp"
+	AmrSms        = "sms"
+	AmrMfa        = "mfa"
+	AmrFederation = "fed"
 )
 
 type JwtUserRole string
 
 type JwtUserInfo struct {
-	Id    *uuid.UUID
-	Role  JwtUserRole
-	Email string
+	Id            *uuid.UUID
+	Role          JwtUserRole
+	Email         string
+	EmailVerified bool
+	// ServiceAccount is set for non-human principals, they have no email and no device.
+	ServiceAccount bool
+}
+
+// JwtClientInfo is the OAuth client authenticated by the client credentials grant.
+type JwtClientInfo struct {
+	Id     string
+	Scopes []string
+}
+
+// JwtPatInfo is the personal access token the user authenticated with.
+type JwtPatInfo struct {
+	Id     uuid.UUID
+	Scopes []string
 }
 
+// JwtAuthInfo holds either the user or the client principal, ClientInfo is nil for users.
 type JwtAuthInfo struct {
-	UserInfo       *JwtUserInfo
+	UserInfo   *JwtUserInfo
+	ClientInfo *JwtClientInfo
+	// PatInfo is set for users authenticated by personal access tokens, they have no device.
+	PatInfo *JwtPatInfo
+	// Impersonator is the administrator viewing the service as the user, nil unless the token is issued by Impersonate.
+	Impersonator   *JwtUserInfo
 	DeviceId       *uuid.UUID
 	InstallationId *uuid.UUID
+	// AuthTime is the time the user signed in, zero for tokens without the `auth_time` claim.
+	AuthTime time.Time
+	// Amr lists the methods the user signed in with.
+	Amr []string
+}
+
+// Principal names the caller for logs, the user email, the service account id or the client id.
+func (a *JwtAuthInfo) Principal() string {
+	if a.ClientInfo != nil {
+		return "client " + a.ClientInfo.Id
+	}
+	if a.UserInfo == nil {
+		return "anonymous"
+	}
+	if a.UserInfo.ServiceAccount {
+		return "service account " + a.UserInfo.Id.String()
+	}
+	if a.Impersonator != nil {
+		return a.UserInfo.Email + " impersonated by " + a.Impersonator.Email
+	}
+	return a.UserInfo.Email
 }
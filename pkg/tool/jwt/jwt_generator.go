@@ -5,6 +5,8 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"math/big"
+	"strings"
 	"time"
 
 	model "github.com/zs-dima/auth-service/internal/gen/db"
@@ -19,30 +21,31 @@ type ITokenGenerator interface {
 		user *model.User,
 		deviceId *uuid.UUID,
 		installationId *uuid.UUID,
+		authTime time.Time,
+		amr []string,
 		jwtSecretKey string,
 	) (string, error)
 	GenerateRefreshToken() (string, time.Time, error)
+	GenerateToken(ttl time.Duration) (string, time.Time, error)
+	GenerateCode(digits int, ttl time.Duration) (string, time.Time, error)
 }
 
 type TokenGenerator struct{}
 
+// GenerateAccessToken generates an access token of the user session on the device,
+// authTime and amr tell when and how the user signed in, they are kept when the token is refreshed
 func (gen *TokenGenerator) GenerateAccessToken(
 	user *model.User,
 	deviceId *uuid.UUID,
 	installationId *uuid.UUID,
+	authTime time.Time,
+	amr []string,
 	jwtSecretKey string,
 ) (string, error) {
-	claims := &jwt.MapClaims{
-		"sub":          user.Name,
-		"aud":          Audience,
-		"iss":          Issuer,
-		"jti":          uuid.New().String(),
-		"role":         user.Role,
-		"userEmail":    user.Email,
-		"userId":       user.ID,
-		"device":       deviceId,
-		"installation": installationId,
-		"exp":          time.Now().Add(time.Hour * 24).Unix(), // Token expires after 24 hours
+	claims := accessTokenClaims(user, deviceId, installationId, time.Now().Add(time.Hour*24)) // Token expires after 24 hours
+	claims["auth_time"] = authTime.Unix()
+	if len(amr) > 0 {
+		claims["amr"] = amr
 	}
 	// Audience aud; IssuedAt int64 iat; Issuer iss; NotBefore int64 nbf
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -50,9 +53,112 @@ func (gen *TokenGenerator) GenerateAccessToken(
 	return token.SignedString([]byte(jwtSecretKey))
 }
 
-// GenerateToken generates a base64 encoded securely random string
+// GenerateImpersonationToken generates an access token of the user for the impersonator valid for the ttl,
+// the `act` claim names the impersonator
+func (gen *TokenGenerator) GenerateImpersonationToken(
+	user *model.User,
+	impersonator *JwtUserInfo,
+	deviceId *uuid.UUID,
+	installationId *uuid.UUID,
+	ttl time.Duration,
+	jwtSecretKey string,
+) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+
+	claims := accessTokenClaims(user, deviceId, installationId, expiresAt)
+	claims["act"] = map[string]any{
+		"sub":       impersonator.Id,
+		"userEmail": impersonator.Email,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	signed, err := token.SignedString([]byte(jwtSecretKey))
+	return signed, expiresAt, err
+}
+
+// GenerateServiceAccountToken generates an access token of the service account valid for the ttl,
+// it has no email and no device claims
+func (gen *TokenGenerator) GenerateServiceAccountToken(
+	account *model.ServiceAccount,
+	ttl time.Duration,
+	jwtSecretKey string,
+) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+
+	claims := jwt.MapClaims{
+		"sub":       account.Name,
+		"aud":       Audience,
+		"iss":       Issuer,
+		"jti":       uuid.New().String(),
+		"role":      account.Role,
+		"userId":    account.ID,
+		"principal": PrincipalServiceAccount,
+		"exp":       expiresAt.Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	signed, err := token.SignedString([]byte(jwtSecretKey))
+	return signed, expiresAt, err
+}
+
+func accessTokenClaims(user *model.User, deviceId *uuid.UUID, installationId *uuid.UUID, expiresAt time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"sub":            user.Name,
+		"aud":            Audience,
+		"iss":            Issuer,
+		"jti":            uuid.New().String(),
+		"role":           user.Role,
+		"userEmail":      user.Email,
+		"userId":         user.ID,
+		"email_verified": user.EmailVerifiedAt.Valid,
+		"device":         deviceId,
+		"installation":   installationId,
+		"exp":            expiresAt.Unix(),
+	}
+}
+
+// ParseAccessToken validates the user access token and returns the user id, the token expiration time
+// and the `act` claim of impersonation tokens, nil for tokens of the user
+func ParseAccessToken(tokenStr string, jwtSecretKey string) (uuid.UUID, time.Time, map[string]any, error) {
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(jwtSecretKey), nil
+	})
+	if err != nil || token == nil || !token.Valid {
+		return uuid.Nil, time.Time{}, nil, fmt.Errorf("invalid access token: %w", err)
+	}
+	if !claims.VerifyIssuer(Issuer, true) || !claims.VerifyAudience(Audience, true) {
+		return uuid.Nil, time.Time{}, nil, fmt.Errorf("access token is not issued by %s", Issuer)
+	}
+
+	userIdStr, _ := claims["userId"].(string)
+	userId, err := uuid.Parse(userIdStr)
+	if err != nil {
+		return uuid.Nil, time.Time{}, nil, fmt.Errorf("failed to parse userId claim")
+	}
+	exp, _ := claims["exp"].(float64)
+
+	var actor map[string]any
+	if act, ok := claims["act"]; ok {
+		if actor, ok = act.(map[string]any); !ok {
+			return uuid.Nil, time.Time{}, nil, fmt.Errorf("failed to parse act claim")
+		}
+	}
+
+	return userId, time.Unix(int64(exp), 0), actor, nil
+}
+
+// GenerateRefreshToken generates a base64 encoded securely random string
 func (gen *TokenGenerator) GenerateRefreshToken() (string, time.Time, error) {
-	expiresAt := time.Now().Add(time.Hour * 24 * 7) // Refresh token expires after 7 days
+	return gen.GenerateToken(time.Hour * 24 * 7) // Refresh token expires after 7 days
+}
+
+// GenerateToken generates a base64 encoded securely random string valid for the ttl
+func (gen *TokenGenerator) GenerateToken(ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
 
 	b := make([]byte, TokenLength)
 	_, err := rand.Read(b)
@@ -63,6 +169,52 @@ func (gen *TokenGenerator) GenerateRefreshToken() (string, time.Time, error) {
 	return token, expiresAt, nil
 }
 
+// GenerateCode generates a securely random numeric code of the digits length valid for the ttl
+func (gen *TokenGenerator) GenerateCode(digits int, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", expiresAt, fmt.Errorf("error generating code: %w", err)
+	}
+	code := fmt.Sprintf("%0*d", digits, n)
+	return code, expiresAt, nil
+}
+
+// userCodeAlphabet has no vowels to avoid words and no characters looking alike
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// GenerateUserCode generates a securely random code of 8 consonants formatted as `XXXX-XXXX` valid for the ttl
+func (gen *TokenGenerator) GenerateUserCode(ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+
+	code := make([]byte, 0, 9)
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			code = append(code, '-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", expiresAt, fmt.Errorf("error generating user code: %w", err)
+		}
+		code = append(code, userCodeAlphabet[n.Int64()])
+	}
+	return string(code), expiresAt, nil
+}
+
+// NormalizeUserCode removes separators and spaces of the user code typed by the user
+func NormalizeUserCode(code string) string {
+	normalized := make([]byte, 0, len(code))
+	for _, c := range []byte(strings.ToUpper(code)) {
+		if c >= 'A' && c <= 'Z' {
+			normalized = append(normalized, c)
+		}
+	}
+	return string(normalized)
+}
+
 func ExtractAuthInfo(ctx context.Context) *JwtAuthInfo {
 	return ctx.Value(UserClaimsKey).(*JwtAuthInfo)
 }
@@ -0,0 +1,133 @@
+package jwt_tool
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/uuid"
+)
+
+const testSecretKey = "test-secret"
+
+func signTestToken(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testSecretKey))
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+	return token
+}
+
+func TestParseAccessToken(t *testing.T) {
+	userId := uuid.New()
+	impersonatorId := uuid.New()
+	exp := time.Now().Add(time.Hour).Unix()
+
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		claims := jwt.MapClaims{"iss": Issuer, "aud": Audience, "exp": exp, "userId": userId.String()}
+		for key, value := range extra {
+			claims[key] = value
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		actor string
+		ok    bool
+	}{
+		{"user token", signTestToken(t, claims(nil)), "", true},
+		{"impersonation token", signTestToken(t, claims(jwt.MapClaims{"act": map[string]any{"sub": impersonatorId.String()}})), impersonatorId.String(), true},
+		{"malformed act claim", signTestToken(t, claims(jwt.MapClaims{"act": impersonatorId.String()})), "", false},
+		{"foreign audience", signTestToken(t, claims(jwt.MapClaims{"aud": "billing"})), "", false},
+		{"expired token", signTestToken(t, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()})), "", false},
+		{"missing user", signTestToken(t, claims(jwt.MapClaims{"userId": ""})), "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, expiresAt, actor, err := ParseAccessToken(test.token, testSecretKey)
+
+			if (err == nil) != test.ok {
+				t.Fatalf("got error %v, want ok %v", err, test.ok)
+			}
+			if !test.ok {
+				return
+			}
+			if id != userId || expiresAt.Unix() != exp {
+				t.Errorf("got %s expiring at %s, want %s expiring at %s", id, expiresAt, userId, time.Unix(exp, 0))
+			}
+			if sub, _ := actor["sub"].(string); sub != test.actor {
+				t.Errorf("got actor %q, want %q", sub, test.actor)
+			}
+		})
+	}
+}
+
+func TestUserCode(t *testing.T) {
+	generator := TokenGenerator{}
+	code, _, err := generator.GenerateUserCode(time.Minute)
+	if err != nil {
+		t.Fatalf("failed to generate user code: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		typed string
+		want  string
+	}{
+		{"generated", code, strings.ReplaceAll(code, "-", "")},
+		{"lower case with spaces", " bcdf ghjk ", "BCDFGHJK"},
+		{"separators", "BCDF-GHJK", "BCDFGHJK"},
+		{"digits and symbols", "BCDF_1234.GHJK", "BCDFGHJK"},
+		{"empty", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if normalized := NormalizeUserCode(test.typed); normalized != test.want {
+				t.Fatalf("got %q, want %q", normalized, test.want)
+			}
+		})
+	}
+
+	if len(code) != 9 || code[4] != '-' || strings.Trim(strings.ReplaceAll(code, "-", ""), userCodeAlphabet) != "" {
+		t.Fatalf("user code %q is not formatted as XXXX-XXXX of the alphabet", code)
+	}
+}
+
+func TestGenerateCode(t *testing.T) {
+	generator := TokenGenerator{}
+
+	tests := []struct {
+		digits int
+	}{
+		{4},
+		{6},
+		{8},
+	}
+
+	for _, test := range tests {
+		codes := map[string]bool{}
+		for i := 0; i < 100; i++ {
+			code, expiresAt, err := generator.GenerateCode(test.digits, time.Minute)
+			if err != nil {
+				t.Fatalf("failed to generate code: %v", err)
+			}
+			// Leading zeros are kept, every code has the same length
+			if len(code) != test.digits || strings.Trim(code, "0123456789") != "" {
+				t.Fatalf("code %q is not %d digits", code, test.digits)
+			}
+			if until := time.Until(expiresAt); until <= 0 || until > time.Minute {
+				t.Fatalf("code expires in %s, want a minute", until)
+			}
+			codes[code] = true
+		}
+		if len(codes) < 50 {
+			t.Errorf("got %d distinct codes of %d digits out of 100", len(codes), test.digits)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package jwt_tool
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// SigningKey is the RSA key signing tokens verified by third parties with the published JWKS.
+type SigningKey struct {
+	Id         string
+	PrivateKey *rsa.PrivateKey
+}
+
+// Jwk is the public part of the signing key in JSON Web Key format.
+type Jwk struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type Jwks struct {
+	Keys []Jwk `json:"keys"`
+}
+
+// ParseSigningKey parses a PEM encoded RSA private key, the key id is the public key thumbprint.
+func ParseSigningKey(pem []byte) (*SigningKey, error) {
+	privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pem)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+
+	jwk := publicJwk(&privateKey.PublicKey, "")
+	// RFC 7638 thumbprint of the required members in lexicographic order
+	thumbprint := sha256.Sum256([]byte(fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk.E, jwk.N)))
+
+	return &SigningKey{
+		Id:         base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+		PrivateKey: privateKey,
+	}, nil
+}
+
+// Sign signs the claims with RS256, the typ header tells apart token kinds, e.g. `at+jwt` for access tokens.
+func (k *SigningKey) Sign(typ string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["typ"] = typ
+	token.Header["kid"] = k.Id
+	return token.SignedString(k.PrivateKey)
+}
+
+// Parse validates the RS256 signature of the token signed by the key.
+func (k *SigningKey) Parse(tokenStr string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return &k.PrivateKey.PublicKey, nil
+	})
+}
+
+func (k *SigningKey) Jwks() *Jwks {
+	return &Jwks{
+		Keys: []Jwk{publicJwk(&k.PrivateKey.PublicKey, k.Id)},
+	}
+}
+
+func publicJwk(key *rsa.PublicKey, id string) Jwk {
+	return Jwk{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: "RS256",
+		Kid: id,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
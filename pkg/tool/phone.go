@@ -0,0 +1,21 @@
+package tool
+
+import (
+	"regexp"
+	"strings"
+)
+
+var phoneRegexp = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// NormalizePhone strips formatting from the phone number and checks it is in E.164 format, e.g. +14155552671.
+func NormalizePhone(phone string) (string, bool) {
+	phone = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '(', ')', '.':
+			return -1
+		}
+		return r
+	}, phone)
+
+	return phone, phoneRegexp.MatchString(phone)
+}
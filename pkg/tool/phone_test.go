@@ -0,0 +1,28 @@
+package tool
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	tests := []struct {
+		phone string
+		want  string
+		ok    bool
+	}{
+		{"+14155552671", "+14155552671", true},
+		{"+1 (415) 555-2671", "+14155552671", true},
+		{"+44 20.7183.8750", "+442071838750", true},
+		{"14155552671", "14155552671", false},
+		{"+04155552671", "+04155552671", false},
+		{"+12345", "+12345", false},
+		{"+1234567890123456", "+1234567890123456", false},
+		{"+1415555abcd", "+1415555abcd", false},
+		{"", "", false},
+	}
+
+	for _, test := range tests {
+		phone, ok := NormalizePhone(test.phone)
+		if phone != test.want || ok != test.ok {
+			t.Errorf("NormalizePhone(%q) = %q, %v, want %q, %v", test.phone, phone, ok, test.want, test.ok)
+		}
+	}
+}